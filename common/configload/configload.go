@@ -0,0 +1,138 @@
+// Package configload layers the settings of a server: defaults, then a YAML
+// or JSON file, then environment variables, then command-line flags, each
+// overriding the previous ones. The settings are a struct whose fields are
+// matched by their yaml, env and flag tags; nested structs are walked.
+package configload
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Apply overrides the defaults held by cfg with the file at path, if not
+// empty, the environment and the flags explicitly set on fs. fromFlags is
+// the struct the flags of fs were parsed into; both are pointers to the same
+// struct type.
+func Apply(cfg, fromFlags interface{}, path string, fs *flag.FlagSet) error {
+	if path != "" {
+		if err := loadFile(path, cfg); err != nil {
+			return err
+		}
+	}
+	if err := loadEnv(cfg); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	copyFlags(cfg, fromFlags, set)
+	return nil
+}
+
+// loadFile reads YAML; JSON files work as well since JSON is valid YAML.
+func loadFile(path string, cfg interface{}) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+func loadEnv(cfg interface{}) error {
+	var errs []error
+	walk(reflect.ValueOf(cfg).Elem(), func(f reflect.StructField, v reflect.Value) {
+		name := f.Tag.Get("env")
+		if name == "" {
+			return
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := setString(v, s); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func copyFlags(dst, src interface{}, set map[string]bool) {
+	srcValues := make(map[string]reflect.Value)
+	walk(reflect.ValueOf(src).Elem(), func(f reflect.StructField, v reflect.Value) {
+		srcValues[f.Tag.Get("flag")] = v
+	})
+	walk(reflect.ValueOf(dst).Elem(), func(f reflect.StructField, v reflect.Value) {
+		if name := f.Tag.Get("flag"); set[name] {
+			v.Set(srcValues[name])
+		}
+	})
+}
+
+func walk(v reflect.Value, fn func(reflect.StructField, reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			walk(v.Field(i), fn)
+			continue
+		}
+		fn(t.Field(i), v.Field(i))
+	}
+}
+
+func setString(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
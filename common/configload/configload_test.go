@@ -0,0 +1,67 @@
+package configload
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type settings struct {
+	Addr    string        `yaml:"addr" env:"TEST_ADDR" flag:"addr"`
+	Timeout time.Duration `yaml:"timeout" env:"TEST_TIMEOUT" flag:"timeout"`
+	Rate    float64       `yaml:"rate" env:"TEST_RATE" flag:"rate"`
+	Nested  struct {
+		Size int `yaml:"size" env:"TEST_SIZE" flag:"size"`
+	} `yaml:"nested"`
+}
+
+func (s *settings) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.Addr, "addr", s.Addr, "")
+	fs.DurationVar(&s.Timeout, "timeout", s.Timeout, "")
+	fs.Float64Var(&s.Rate, "rate", s.Rate, "")
+	fs.IntVar(&s.Nested.Size, "size", s.Nested.Size, "")
+}
+
+func TestApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "addr: file\ntimeout: 2s\nrate: 1.5\nnested:\n  size: 3\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_TIMEOUT", "4s")
+	t.Setenv("TEST_SIZE", "5")
+
+	fromFlags := &settings{Addr: "default"}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fromFlags.register(fs)
+	if err := fs.Parse([]string{"-size", "7"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &settings{Addr: "default"}
+	if err := Apply(cfg, fromFlags, path, fs); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != "file" || cfg.Timeout != 4*time.Second || cfg.Rate != 1.5 || cfg.Nested.Size != 7 {
+		t.Errorf("got %+v", cfg)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("unknown: 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := Apply(&settings{}, &settings{}, path, fs); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+
+	t.Setenv("TEST_TIMEOUT", "soon")
+	err := Apply(&settings{}, &settings{}, "", fs)
+	if err == nil || !strings.Contains(err.Error(), "TEST_TIMEOUT") {
+		t.Errorf("expected an error naming TEST_TIMEOUT, got %v", err)
+	}
+}
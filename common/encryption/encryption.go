@@ -0,0 +1,335 @@
+// Package encryption seals files at rest with envelope encryption.
+//
+// Every sealed file carries its own random data key, encrypted ("wrapped")
+// with a master key from a keyring, followed by the contents encrypted with
+// the data key. Both layers use AES-256-GCM. The keyring is read from a key
+// file holding one hex- or base64-encoded 32-byte key per line: the first
+// key seals new files, the others are retired keys that are only used to
+// open files sealed before a rotation.
+//
+// A nil *Keyring means encryption is disabled: files are written as they
+// are, and sealed files are refused instead of being misread.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	keySize   = 32
+	keyIDSize = 8
+	nonceSize = 12
+	tagSize   = 16
+
+	wrappedKeySize = keySize + tagSize
+	headerSize     = len(magic) + keyIDSize + nonceSize + wrappedKeySize + nonceSize
+)
+
+// magic starts every sealed file. Plain files written by this repository
+// are JSON and never start with it.
+const magic = "KVSEAL1\x00"
+
+var (
+	ErrInvalidKey  = errors.New("invalid encryption key")
+	ErrUnknownKey  = errors.New("file is sealed with a key missing from the keyring")
+	ErrNoKey       = errors.New("file is encrypted but no encryption key is configured")
+	ErrCorruptFile = errors.New("encrypted file is corrupt or was sealed with a different key")
+)
+
+type masterKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// Keyring holds the master keys.
+type Keyring struct {
+	active masterKey
+	keys   map[[keyIDSize]byte]masterKey
+}
+
+// LoadKeyring reads the master keys from a key file.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := decodeKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: %w: no key found", path, ErrInvalidKey)
+	}
+	return NewKeyring(keys...)
+}
+
+// NewKeyring builds a keyring from raw 32-byte keys, the first of which
+// seals new files.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no key given", ErrInvalidKey)
+	}
+	kr := &Keyring{keys: make(map[[keyIDSize]byte]masterKey, len(keys))}
+	for i, key := range keys {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("%w: key %d is %d bytes, want %d", ErrInvalidKey, i+1, len(key), keySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		mk := masterKey{aead: aead}
+		sum := sha256.Sum256(key)
+		copy(mk.id[:], sum[:])
+		if i == 0 {
+			kr.active = mk
+		}
+		kr.keys[mk.id] = mk
+	}
+	return kr, nil
+}
+
+func decodeKey(text string) ([]byte, error) {
+	if key, err := hex.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: want %d bytes, hex or base64 encoded", ErrInvalidKey, keySize)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ActiveKeyID identifies the key that seals new files. It is derived from
+// the key and safe to log.
+func (kr *Keyring) ActiveKeyID() string {
+	if kr == nil {
+		return ""
+	}
+	return hex.EncodeToString(kr.active.id[:])
+}
+
+// IsSealed reports whether data was produced by Seal.
+func IsSealed(data []byte) bool {
+	return len(data) >= len(magic) && string(data[:len(magic)]) == magic
+}
+
+// Seal encrypts plaintext under a fresh data key wrapped with the active
+// master key. A nil keyring returns plaintext unchanged.
+func (kr *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	if kr == nil {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, headerSize+len(plaintext)+tagSize)
+	out = append(out, magic...)
+	out = append(out, kr.active.id[:]...)
+
+	wrapNonce, err := nonce()
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, wrapNonce...)
+	// The key ID is authenticated with the wrapped key, so that the header
+	// cannot be pointed at another key of the ring.
+	out = kr.active.aead.Seal(out, wrapNonce, dataKey, kr.active.id[:])
+
+	dataNonce, err := nonce()
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, dataNonce...)
+	return aead.Seal(out, dataNonce, plaintext, out[:headerSize]), nil
+}
+
+// Open decrypts data sealed by Seal. Data that is not sealed is returned
+// unchanged, so that files written before encryption was enabled can still
+// be read; they are sealed the next time they are written.
+func (kr *Keyring) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	if kr == nil {
+		return nil, ErrNoKey
+	}
+	if len(data) < headerSize+tagSize {
+		return nil, ErrCorruptFile
+	}
+	mk, err := kr.key(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := len(magic) + keyIDSize
+	wrapNonce := data[p : p+nonceSize]
+	p += nonceSize
+	dataKey, err := mk.aead.Open(nil, wrapNonce, data[p:p+wrappedKeySize], mk.id[:])
+	if err != nil {
+		return nil, ErrCorruptFile
+	}
+	p += wrappedKeySize
+	dataNonce := data[p : p+nonceSize]
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, dataNonce, data[headerSize:], data[:headerSize])
+	if err != nil {
+		return nil, ErrCorruptFile
+	}
+	return plaintext, nil
+}
+
+// Check verifies that data can be opened with this keyring without
+// decrypting it: plain data always can, sealed data only with its key.
+func (kr *Keyring) Check(data []byte) error {
+	if !IsSealed(data) {
+		return nil
+	}
+	if kr == nil {
+		return ErrNoKey
+	}
+	if len(data) < headerSize+tagSize {
+		return ErrCorruptFile
+	}
+	mk, err := kr.key(data)
+	if err != nil {
+		return err
+	}
+	p := len(magic) + keyIDSize
+	if _, err := mk.aead.Open(nil, data[p:p+nonceSize], data[p+nonceSize:p+nonceSize+wrappedKeySize], mk.id[:]); err != nil {
+		return ErrCorruptFile
+	}
+	return nil
+}
+
+// NeedsRotation reports whether data is plain or sealed with a retired key,
+// and would be sealed differently if written again.
+func (kr *Keyring) NeedsRotation(data []byte) bool {
+	if kr == nil {
+		return false
+	}
+	if !IsSealed(data) || len(data) < len(magic)+keyIDSize {
+		return true
+	}
+	return !bytes.Equal(data[len(magic):len(magic)+keyIDSize], kr.active.id[:])
+}
+
+func (kr *Keyring) key(data []byte) (masterKey, error) {
+	var id [keyIDSize]byte
+	copy(id[:], data[len(magic):])
+	mk, ok := kr.keys[id]
+	if !ok {
+		return masterKey{}, fmt.Errorf("%w (key ID %s)", ErrUnknownKey, hex.EncodeToString(id[:]))
+	}
+	return mk, nil
+}
+
+func nonce() ([]byte, error) {
+	n := make([]byte, nonceSize)
+	if _, err := rand.Read(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// WriteFile seals data and writes it to name.
+func (kr *Keyring) WriteFile(name string, data []byte, perm os.FileMode) error {
+	sealed, err := kr.Seal(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, sealed, perm)
+}
+
+// ReadFile reads name and opens its contents.
+func (kr *Keyring) ReadFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err = kr.Open(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return data, nil
+}
+
+// ReadHeader reads as much of r as Check and NeedsRotation look at.
+func ReadHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize+tagSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// ReadFileHeader is ReadHeader for a file. A missing file has an empty
+// header, which passes Check since the file will simply be created.
+func ReadFileHeader(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadHeader(f)
+}
+
+// CheckFile verifies that name can be opened with this keyring. Missing
+// files pass.
+func (kr *Keyring) CheckFile(name string) error {
+	header, err := ReadFileHeader(name)
+	if err != nil {
+		return err
+	}
+	if err := kr.Check(header); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func TestSealOpen(t *testing.T) {
+	kr, err := NewKeyring(testKey(1))
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	plaintext := []byte(`{"password":"secret"}`)
+
+	sealed, err := kr.Seal(plaintext)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("sealed data is not encrypted: %q", sealed)
+	}
+	if again, _ := kr.Seal(plaintext); bytes.Equal(again, sealed) {
+		t.Fatalf("sealing twice gave the same bytes")
+	}
+	got, err := kr.Open(sealed)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := kr.Open(tampered); !errors.Is(err, ErrCorruptFile) {
+		t.Fatalf("expected tampering to be detected, got %v", err)
+	}
+	if got, err := kr.Open(plaintext); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("expected plain data to pass through, got %q, %v", got, err)
+	}
+
+	var disabled *Keyring
+	if _, err := disabled.Open(sealed); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("expected ErrNoKey without a keyring, got %v", err)
+	}
+	if got, _ := disabled.Seal(plaintext); !bytes.Equal(got, plaintext) {
+		t.Fatalf("expected a nil keyring not to seal")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, _ := NewKeyring(testKey(1))
+	sealed, err := old.Seal([]byte("data"))
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+
+	rotated, _ := NewKeyring(testKey(2), testKey(1))
+	if got, err := rotated.Open(sealed); err != nil || string(got) != "data" {
+		t.Fatalf("retired key does not open old data: %q, %v", got, err)
+	}
+	if !rotated.NeedsRotation(sealed) {
+		t.Fatalf("expected data sealed with a retired key to need rotation")
+	}
+	resealed, _ := rotated.Seal([]byte("data"))
+	if rotated.NeedsRotation(resealed) {
+		t.Fatalf("expected data sealed with the active key not to need rotation")
+	}
+
+	other, _ := NewKeyring(testKey(3))
+	if err := other.Check(sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected a mismatched key to be refused, got %v", err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "master.key")
+	content := "# active key\n" + hex.EncodeToString(testKey(4)) + "\n"
+	if err := os.WriteFile(keyFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := LoadKeyring(keyFile)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	name := filepath.Join(dir, "data.json")
+	if err := kr.CheckFile(name); err != nil {
+		t.Fatalf("expected a missing file to pass the check, got %v", err)
+	}
+	if err := kr.WriteFile(name, []byte(`{"a":"b"}`), 0600); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := kr.CheckFile(name); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if got, err := kr.ReadFile(name); err != nil || string(got) != `{"a":"b"}` {
+		t.Fatalf("ReadFile = %q, %v", got, err)
+	}
+
+	other, _ := NewKeyring(testKey(5))
+	if err := other.CheckFile(name); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected the check to refuse another key, got %v", err)
+	}
+
+	os.WriteFile(keyFile, []byte("not a key\n"), 0600)
+	if _, err := LoadKeyring(keyFile); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+}
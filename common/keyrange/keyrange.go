@@ -0,0 +1,16 @@
+// Package keyrange holds the etcd key range convention shared by the etcd
+// API of the in-memory-Raft server, its transactions and the kv tests.
+package keyrange
+
+// Contains follows the etcd convention: an empty end selects the key alone,
+// "\x00" every key from key on, anything else the range [key, end).
+func Contains(k, key, end string) bool {
+	switch end {
+	case "":
+		return k == key
+	case "\x00":
+		return k >= key
+	default:
+		return k >= key && k < end
+	}
+}
@@ -0,0 +1,24 @@
+package keyrange
+
+import "testing"
+
+func TestContains(t *testing.T) {
+	for _, tc := range []struct {
+		k, key, end string
+		want        bool
+	}{
+		{"a", "a", "", true},
+		{"ab", "a", "", false},
+		{"a", "a", "\x00", true},
+		{"z", "b", "\x00", true},
+		{"a", "b", "\x00", false},
+		{"b", "b", "d", true},
+		{"c", "b", "d", true},
+		{"d", "b", "d", false},
+		{"a", "b", "d", false},
+	} {
+		if got := Contains(tc.k, tc.key, tc.end); got != tc.want {
+			t.Errorf("Contains(%q, %q, %q) = %v, want %v", tc.k, tc.key, tc.end, got, tc.want)
+		}
+	}
+}
@@ -2,92 +2,306 @@ package main
 
 import (
 	"bytes"
+	"common/encryption"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"inmemoryraft/internal/api"
+	"inmemoryraft/internal/chaos"
+	"inmemoryraft/internal/config"
+	"inmemoryraft/internal/etcdapi"
+	"inmemoryraft/internal/resp"
 	"inmemoryraft/internal/services"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	DefaultHTTPAddr = "localhost:8000"
-	DefaultRaftAddr = "localhost:7000"
+	joinBackoffMin = 500 * time.Millisecond
+	joinBackoffMax = 30 * time.Second
+	joinTimeout    = 10 * time.Second // of one join attempt
 )
 
-var httpAddr string
-var raftAddr string
-var joinAddr string
-var nodeID string
+var errJoinRejected = errors.New("join rejected")
 
-func init() {
-	flag.StringVar(&httpAddr, "haddr", DefaultHTTPAddr, "Set the HTTP bind address")
-	flag.StringVar(&raftAddr, "raddr", DefaultRaftAddr, "Set Raft bind address")
-	flag.StringVar(&joinAddr, "join", "", "Set join address, if any")
-	flag.StringVar(&nodeID, "id", "", "Node ID. If not set, same as Raft bind address")
+var joinClient = &http.Client{Timeout: joinTimeout}
+
+func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <raft-data-path> \n", os.Args[0])
 		flag.PrintDefaults()
 	}
-}
-
-func main() {
-	flag.Parse()
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("invalid configuration: %s", err.Error())
+	}
 	if flag.NArg() == 0 {
 		fmt.Fprintf(os.Stderr, "No Raft storage directory specified\n")
 		os.Exit(1)
 	}
 
+	nodeID := cfg.NodeID
 	if nodeID == "" {
-		nodeID = raftAddr
+		nodeID = cfg.RaftAddr
 	}
 
-	raftDir := "internal/data/snapshots/" + flag.Arg(0)
-	if raftDir == "" {
-		log.Fatalln("No Raft storage directory specified")
+	joinAddrs := splitList(cfg.Join)
+	peers, err := parsePeers(cfg.Peers)
+	if err != nil {
+		log.Fatalf("invalid -peers: %s", err.Error())
+	}
+	if err := checkBootstrap(peers, cfg.BootstrapExpect, nodeID, len(joinAddrs) > 0); err != nil {
+		log.Fatalln(err.Error())
 	}
+
+	raftDir := filepath.Join(cfg.DataDir, flag.Arg(0))
 	if err := os.MkdirAll(raftDir, 0700); err != nil {
 		log.Fatalf("failed to create path for Raft storage: %s", err.Error())
 	}
 
 	store := services.NewStore()
 	store.RaftDir = raftDir
-	store.RaftBind = raftAddr
-	if err := store.InitNode(joinAddr == "", nodeID); err != nil {
+	store.RaftBind = cfg.RaftAddr
+	store.JoinToken = cfg.JoinToken
+	store.RaftConfig = cfg.Raft.RaftConfig(nodeID)
+	store.RetainSnapshots = cfg.Raft.RetainSnapshots
+	store.ApplyTimeout = cfg.Raft.ApplyTimeout
+	store.TransactionLogPath = cfg.TransactionLog
+	store.MaxKeySize = cfg.Limits.MaxKeySize
+	store.MaxValueSize = cfg.Limits.MaxValueSize
+	store.MaxPendingApplies = cfg.Limits.MaxPendingApplies
+	store.AuditLogSize = cfg.AuditLogSize
+	store.HistorySize = cfg.HistorySize
+	if cfg.EncryptionKey != "" {
+		keyring, err := encryption.LoadKeyring(cfg.EncryptionKey)
+		if err != nil {
+			log.Fatalf("failed to load encryption keys: %s", err.Error())
+		}
+		store.Keyring = keyring
+		log.Printf("encryption at rest enabled, active key %s", keyring.ActiveKeyID())
+	}
+	if cfg.DebugFaults {
+		store.Faults = chaos.New()
+		log.Printf("network fault injection enabled, do not use in production")
+	}
+	if err := store.InitNode(len(joinAddrs) == 0 && len(peers) == 0, nodeID); err != nil {
 		log.Fatalf("failed to open store: %s", err.Error())
 	}
+	if len(peers) > 0 {
+		if err := store.BootstrapPeers(peers); err != nil {
+			log.Fatalf("failed to bootstrap cluster: %s", err.Error())
+		}
+	}
 
-	h := api.NewInMemoryStore(httpAddr, store)
+	h := api.NewInMemoryStore(cfg.HTTPAddr, store)
+	h.RateLimits = rateLimits(cfg.RateLimits)
 	if err := h.Starter(); err != nil {
 		log.Fatalf("failed to start HTTP service: %s", err.Error())
 	}
 
-	if joinAddr != "" {
-		if err := join(joinAddr, raftAddr, nodeID); err != nil {
-			log.Fatalf("failed to join node at %s: %s", joinAddr, err.Error())
+	var rs *resp.Server
+	if cfg.RESPAddr != "" {
+		rs = resp.NewServer(cfg.RESPAddr, store)
+		if err := rs.Start(); err != nil {
+			log.Fatalf("failed to start Redis protocol service: %s", err.Error())
+		}
+		log.Printf("serving the Redis protocol on %s", cfg.RESPAddr)
+	}
+
+	var es *etcdapi.Server
+	if cfg.EtcdAddr != "" {
+		es = etcdapi.NewServer(cfg.EtcdAddr, store)
+		if err := es.Start(); err != nil {
+			log.Fatalf("failed to start etcd API service: %s", err.Error())
 		}
+		log.Printf("serving the etcd v3 API on %s", cfg.EtcdAddr)
+	}
+
+	joinCtx, cancelJoin := context.WithCancel(context.Background())
+	defer cancelJoin()
+	if len(joinAddrs) > 0 {
+		go func() {
+			if err := joinCluster(joinCtx, joinAddrs, cfg.RaftAddr, nodeID, cfg.JoinToken, cfg.ClusterID); err != nil {
+				log.Printf("gave up joining cluster: %s", err.Error())
+			}
+		}()
 	}
 
-	log.Printf("raft node started successfully, listening on http://%s", httpAddr)
+	log.Printf("raft node started successfully, listening on http://%s", cfg.HTTPAddr)
 
 	terminate := make(chan os.Signal, 1)
-	signal.Notify(terminate, os.Interrupt)
-	<-terminate
-	log.Println("raft node exiting")
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
+	sig := <-terminate
+	log.Printf("received %s, raft node exiting", sig)
+	cancelJoin()
+
+	shutdown(store, h, rs, es, cfg)
+	log.Println("raft node stopped")
+}
+
+// shutdown drains the node: new writes are refused, in-flight ones are
+// committed before leadership is handed off (otherwise they would fail with
+// ErrLeadershipLost), and only then the HTTP, Redis protocol and etcd API
+// servers and Raft are stopped.
+func shutdown(store *services.InMemoryStore, h *api.StorageController, rs *resp.Server, es *etcdapi.Server, cfg *config.Config) {
+	store.StopWrites()
+
+	if store.IsLeader() {
+		if err := store.TransferLeadership(""); err != nil {
+			log.Printf("failed to transfer leadership: %s", err.Error())
+		} else {
+			log.Println("leadership transferred")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		log.Printf("failed to shut down HTTP service: %s", err.Error())
+	}
+	if rs != nil {
+		if err := rs.Close(); err != nil {
+			log.Printf("failed to shut down Redis protocol service: %s", err.Error())
+		}
+	}
+	if es != nil {
+		if err := es.Close(); err != nil {
+			log.Printf("failed to shut down etcd API service: %s", err.Error())
+		}
+	}
+
+	if err := store.Shutdown(cfg.SnapshotOnExit); err != nil {
+		log.Printf("failed to shut down raft: %s", err.Error())
+	}
 }
 
-func join(joinAddr, raftAddr, nodeID string) error {
-	b, err := json.Marshal(map[string]string{"addr": raftAddr, "id": nodeID})
+// joinCluster asks the nodes in joinAddrs in turn to admit this node, backing
+// off between rounds, until one of them (the leader) accepts or ctx is done.
+// A node with wrong credentials is rejected for good, so it stops retrying.
+func joinCluster(ctx context.Context, joinAddrs []string, raftAddr, nodeID, token, clusterID string) error {
+	backoff := joinBackoffMin
+	for attempt := 1; ; attempt++ {
+		for _, addr := range joinAddrs {
+			id, err := join(ctx, addr, raftAddr, nodeID, token, clusterID)
+			if err == nil {
+				log.Printf("joined cluster %s via %s", id, addr)
+				return nil
+			}
+			if errors.Is(err, errJoinRejected) {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("join attempt %d via %s failed: %s", attempt, addr, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > joinBackoffMax {
+			backoff = joinBackoffMax
+		}
+	}
+}
+
+func join(ctx context.Context, joinAddr, raftAddr, nodeID, token, clusterID string) (string, error) {
+	b, err := json.Marshal(map[string]string{"addr": raftAddr, "id": nodeID, "token": token, "cluster_id": clusterID})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/join", joinAddr), bytes.NewReader(b))
 	if err != nil {
-		return err
+		return "", err
 	}
-	resp, err := http.Post(fmt.Sprintf("http://%s/join", joinAddr), "application-type/json", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := joinClient.Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("%w by %s: %s", errJoinRejected, joinAddr, strings.TrimSpace(string(msg)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	m := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return "", err
+	}
+	return m["cluster_id"], nil
+}
+
+// parsePeers parses "id=addr,id=addr" into a map of node ID to Raft address.
+func parsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, p := range splitList(s) {
+		id, addr, ok := strings.Cut(p, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("peer '%s' is not in id=addr form", p)
+		}
+		if _, dup := peers[id]; dup {
+			return nil, fmt.Errorf("peer '%s' listed twice", id)
+		}
+		peers[id] = addr
+	}
+	return peers, nil
+}
+
+func checkBootstrap(peers map[string]string, expect int, nodeID string, joining bool) error {
+	if len(peers) == 0 {
+		if expect > 0 {
+			return fmt.Errorf("-bootstrap-expect requires -peers")
+		}
+		return nil
+	}
+	if joining {
+		return fmt.Errorf("-join and -peers are mutually exclusive")
+	}
+	if expect > 0 && expect != len(peers) {
+		return fmt.Errorf("-bootstrap-expect is %d but -peers lists %d nodes", expect, len(peers))
+	}
+	if _, ok := peers[nodeID]; !ok {
+		return fmt.Errorf("node '%s' is not listed in -peers", nodeID)
+	}
 	return nil
 }
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func rateLimits(c config.RateLimits) api.RateLimits {
+	limits := api.RateLimits{
+		Read:   api.RateLimit{Rate: c.ReadRate, Burst: c.ReadBurst},
+		Write:  api.RateLimit{Rate: c.WriteRate, Burst: c.WriteBurst},
+		Routes: make(map[string]api.RateLimit, len(c.Routes)),
+	}
+	for route, l := range c.Routes {
+		limits.Routes[route] = api.RateLimit{Rate: l.Rate, Burst: l.Burst}
+	}
+	return limits
+}
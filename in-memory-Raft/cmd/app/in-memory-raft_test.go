@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParsePeers(t *testing.T) {
+	peers, err := parsePeers("node0=localhost:7000, node1=localhost:7001")
+	if err != nil {
+		t.Fatalf("failed to parse peers: %s", err)
+	}
+	if len(peers) != 2 || peers["node0"] != "localhost:7000" || peers["node1"] != "localhost:7001" {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+
+	for _, bad := range []string{"node0", "=localhost:7000", "node0=", "node0=a,node0=b"} {
+		if _, err := parsePeers(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestCheckBootstrap(t *testing.T) {
+	peers := map[string]string{"node0": "localhost:7000", "node1": "localhost:7001", "node2": "localhost:7002"}
+
+	if err := checkBootstrap(peers, 3, "node0", false); err != nil {
+		t.Fatalf("expected valid bootstrap, got %s", err)
+	}
+	if err := checkBootstrap(peers, 0, "node1", false); err != nil {
+		t.Fatalf("expected -bootstrap-expect to be optional, got %s", err)
+	}
+	if err := checkBootstrap(peers, 2, "node0", false); err == nil {
+		t.Fatal("expected error for mismatched -bootstrap-expect")
+	}
+	if err := checkBootstrap(peers, 3, "node3", false); err == nil {
+		t.Fatal("expected error for node missing from -peers")
+	}
+	if err := checkBootstrap(peers, 3, "node0", true); err == nil {
+		t.Fatal("expected error when combined with -join")
+	}
+	if err := checkBootstrap(nil, 3, "node0", false); err == nil {
+		t.Fatal("expected error for -bootstrap-expect without -peers")
+	}
+}
+
+func TestJoinClusterRetries(t *testing.T) {
+	var attempts int32
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		if atomic.AddInt32(&attempts, 1) < 2 {
+			http.Error(w, "node is not the leader", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"cluster_id":"test-cluster"}`))
+	}))
+	defer leader.Close()
+
+	down := "localhost:1"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addr := strings.TrimPrefix(leader.URL, "http://")
+	if err := joinCluster(ctx, []string{down, addr}, "localhost:7001", "node1", "", ""); err != nil {
+		t.Fatalf("failed to join: %s", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("expected 2 join attempts on the leader, got %d", n)
+	}
+}
+
+func TestJoinClusterStopsOnRejection(t *testing.T) {
+	var attempts int32
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, "invalid join token", http.StatusForbidden)
+	}))
+	defer leader.Close()
+
+	addr := strings.TrimPrefix(leader.URL, "http://")
+	err := joinCluster(context.Background(), []string{addr}, "localhost:7001", "node1", "wrong", "")
+	if !errors.Is(err, errJoinRejected) {
+		t.Fatalf("expected errJoinRejected, got %v", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Fatalf("expected a single attempt, got %d", n)
+	}
+}
+
+func TestJoinClusterStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := joinCluster(ctx, []string{"localhost:1"}, "localhost:7001", "node1", "", ""); err == nil {
+		t.Fatal("expected error after cancellation")
+	}
+}
+
+// TestJoinClusterCancelsAttempt checks that cancelling the join interrupts
+// an attempt on a node that never answers.
+func TestJoinClusterCancelsAttempt(t *testing.T) {
+	unblock := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer stuck.Close()
+	defer close(unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- joinCluster(ctx, []string{strings.TrimPrefix(stuck.URL, "http://")}, "localhost:7001", "node1", "", "")
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the deadline error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("join attempt not interrupted")
+	}
+}
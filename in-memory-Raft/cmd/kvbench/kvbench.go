@@ -0,0 +1,368 @@
+// Command kvbench runs YCSB-like workloads against the HTTP API of the store
+// and reports throughput and latency percentiles.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"inmemoryraft/internal/client"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultEndpoints = "localhost:8000"
+
+	EnvEndpoints  = "KVBENCH_ENDPOINTS"
+	EnvStandalone = "KVBENCH_STANDALONE"
+)
+
+type config struct {
+	endpoints    string
+	standalone   bool
+	workload     string
+	distribution string // zipfian, uniform or latest
+	records      uint64
+	valueSize    int
+	concurrency  int
+	duration     time.Duration
+	ops          int64 // stop after this many operations, 0 for no limit
+	load         bool
+	output       string
+	seed         int64
+}
+
+func (c *config) validate() error {
+	w, ok := workloads[c.workload]
+	if !ok {
+		return fmt.Errorf("unknown workload '%s', expected one of %s", c.workload, strings.Join(workloadNames(), ", "))
+	}
+	if c.distribution == "" {
+		c.distribution = "zipfian"
+		if w.latest {
+			c.distribution = "latest"
+		}
+	}
+	switch {
+	case c.distribution != "zipfian" && c.distribution != "uniform" && c.distribution != "latest":
+		return fmt.Errorf("unknown distribution '%s', expected zipfian, uniform or latest", c.distribution)
+	case c.records == 0:
+		return errors.New("records must be positive")
+	case c.valueSize < 1:
+		return errors.New("value size must be positive")
+	case c.concurrency < 1:
+		return errors.New("concurrency must be positive")
+	case c.duration <= 0 && c.ops <= 0:
+		return errors.New("either the duration or the number of operations must be positive")
+	case c.output != "text" && c.output != "json":
+		return fmt.Errorf("unknown output format '%s'", c.output)
+	}
+	return nil
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.endpoints, "endpoints", envOr(EnvEndpoints, DefaultEndpoints), "Comma-separated list of HTTP endpoints (env "+EnvEndpoints+")")
+	flag.BoolVar(&cfg.standalone, "standalone", os.Getenv(EnvStandalone) == "true", "Talk to the in-memory server without Raft (env "+EnvStandalone+")")
+	flag.StringVar(&cfg.workload, "workload", "a", "YCSB workload: "+strings.Join(workloadNames(), ", "))
+	flag.StringVar(&cfg.distribution, "distribution", "", "Key distribution: zipfian, uniform or latest (latest for workload d, zipfian otherwise)")
+	flag.Uint64Var(&cfg.records, "records", 1000, "Number of keys loaded before the run")
+	flag.IntVar(&cfg.valueSize, "value-size", 100, "Value size in bytes")
+	flag.IntVar(&cfg.concurrency, "concurrency", 16, "Number of concurrent clients")
+	flag.DurationVar(&cfg.duration, "duration", 30*time.Second, "Duration of the run (0 runs until -ops operations are done)")
+	flag.Int64Var(&cfg.ops, "ops", 0, "Stop after this many operations (0 for no limit)")
+	flag.BoolVar(&cfg.load, "load", true, "Load the records before the run")
+	flag.StringVar(&cfg.output, "o", "text", "Output format: text or json")
+	flag.Int64Var(&cfg.seed, "seed", 0, "Seed of the random choices (0 for a random seed)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Workloads:\n")
+		for _, name := range workloadNames() {
+			w := workloads[name]
+			fmt.Fprintf(os.Stderr, "  %s  %s: %s\n", name, w.name, w)
+		}
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(2)
+	}
+	if cfg.seed == 0 {
+		cfg.seed = time.Now().UnixNano()
+	}
+
+	// Every client keeps its connection instead of dialing anew per request.
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.MaxIdleConnsPerHost = cfg.concurrency
+	}
+	var c *client.Client
+	if cfg.standalone {
+		c = client.NewStandalone(splitEndpoints(cfg.endpoints))
+	} else {
+		c = client.New(splitEndpoints(cfg.endpoints))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := benchmark(ctx, c, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	if cfg.output == "json" {
+		err = report.writeJSON(os.Stdout)
+	} else {
+		err = report.writeText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// store is the part of client.Client the workloads use.
+type store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	List(prefix string) (map[string]string, error)
+}
+
+// benchmark loads the records unless told not to, then runs the workload
+// until the duration or the number of operations is reached, or ctx is
+// cancelled. Progress and errors go to stderr.
+func benchmark(ctx context.Context, s store, cfg config) (Report, error) {
+	b := &bench{cfg: cfg, store: s, workload: workloads[cfg.workload]}
+	if cfg.distribution != "uniform" {
+		b.zipf = newZipfian(cfg.records)
+	}
+
+	if cfg.load {
+		start := time.Now()
+		if err := b.loadRecords(ctx); err != nil {
+			return Report{}, fmt.Errorf("load: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "loaded %d records in %s\n", cfg.records, time.Since(start).Round(time.Millisecond))
+	}
+
+	if cfg.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.duration)
+		defer cancel()
+	}
+	byOp, elapsed := b.run(ctx)
+	for k, s := range byOp {
+		if s.lastErr != nil {
+			fmt.Fprintf(os.Stderr, "%s: %d errors, last: %s\n", opKind(k), s.errors, s.lastErr)
+		}
+	}
+	return newReport(cfg, elapsed, byOp), nil
+}
+
+type bench struct {
+	cfg      config
+	store    store
+	workload workload
+	zipf     *zipfian // copied by every client, nil for uniform keys
+
+	nextInsert uint64 // inserts started during the run
+	inserted   acknowledged
+	issued     int64
+}
+
+// acknowledged counts the inserts that completed along with every insert
+// started before them, so that reads only pick keys that exist, as YCSB's
+// acknowledged counter does.
+type acknowledged struct {
+	count uint64 // read atomically
+
+	mutex sync.Mutex
+	done  map[uint64]bool // completed ahead of an earlier insert
+}
+
+func (a *acknowledged) load() uint64 {
+	return atomic.LoadUint64(&a.count)
+}
+
+func (a *acknowledged) complete(i uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.done == nil {
+		a.done = make(map[uint64]bool)
+	}
+	a.done[i] = true
+	count := a.count
+	for a.done[count] {
+		delete(a.done, count)
+		count++
+	}
+	atomic.StoreUint64(&a.count, count)
+}
+
+// loadRecords stops at the first failed write.
+func (b *bench) loadRecords(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var next uint64
+	var mutex sync.Mutex
+	var failed error
+	var wg sync.WaitGroup
+	for i := 0; i < b.cfg.concurrency; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(b.cfg.seed - int64(id) - 1))
+			for ctx.Err() == nil {
+				n := atomic.AddUint64(&next, 1) - 1
+				if n >= b.cfg.records {
+					return
+				}
+				if err := b.store.Put(keyName(n), randomValue(r, b.cfg.valueSize)); err != nil {
+					mutex.Lock()
+					if failed == nil {
+						failed = err
+					}
+					mutex.Unlock()
+					cancel()
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if failed != nil {
+		return failed
+	}
+	return ctx.Err()
+}
+
+func (b *bench) run(ctx context.Context) ([numOps]*samples, time.Duration) {
+	workers := make([]*worker, b.cfg.concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range workers {
+		w := &worker{bench: b, rand: rand.New(rand.NewSource(b.cfg.seed + int64(i)))}
+		if b.zipf != nil {
+			z := *b.zipf
+			w.zipf = &z
+		}
+		for k := range w.samples {
+			w.samples[k] = &samples{}
+		}
+		workers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var byOp [numOps]*samples
+	for k := range byOp {
+		byOp[k] = &samples{}
+		for _, w := range workers {
+			byOp[k].merge(w.samples[k])
+		}
+	}
+	return byOp, elapsed
+}
+
+type worker struct {
+	*bench
+	rand    *rand.Rand
+	zipf    *zipfian
+	samples [numOps]*samples
+}
+
+func (w *worker) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if w.cfg.ops > 0 && atomic.AddInt64(&w.issued, 1) > w.cfg.ops {
+			return
+		}
+		kind := w.workload.next(w.rand)
+		start := time.Now()
+		err := w.do(kind)
+		latency := time.Since(start)
+
+		s := w.samples[kind]
+		switch {
+		case err == nil:
+		case errors.Is(err, client.ErrNotFound):
+			s.notFound++
+		default:
+			s.errors++
+			s.lastErr = err
+			continue
+		}
+		s.latencies = append(s.latencies, latency)
+	}
+}
+
+func (w *worker) do(kind opKind) error {
+	switch kind {
+	case opRead:
+		_, err := w.store.Get(w.key())
+		return err
+	case opUpdate:
+		return w.store.Put(w.key(), randomValue(w.rand, w.cfg.valueSize))
+	case opInsert:
+		i := atomic.AddUint64(&w.nextInsert, 1) - 1
+		err := w.store.Put(keyName(w.cfg.records+i), randomValue(w.rand, w.cfg.valueSize))
+		// A failed insert is not retried, so that later ones are not held
+		// back; its key may be missing.
+		w.inserted.complete(i)
+		return err
+	case opScan:
+		_, err := w.store.List(scanPrefix(w.key()))
+		return err
+	default:
+		key := w.key()
+		if _, err := w.store.Get(key); err != nil && !errors.Is(err, client.ErrNotFound) {
+			return err
+		}
+		return w.store.Put(key, randomValue(w.rand, w.cfg.valueSize))
+	}
+}
+
+// key picks a loaded or inserted key.
+func (w *worker) key() string {
+	n := w.cfg.records + w.inserted.load()
+	switch w.cfg.distribution {
+	case "uniform":
+		return keyName(uint64(w.rand.Int63n(int64(n))))
+	case "latest":
+		return keyName(n - 1 - w.zipf.next(w.rand, n))
+	default:
+		return keyName(scramble(w.zipf.next(w.rand, n), n))
+	}
+}
+
+func splitEndpoints(s string) []string {
+	var result []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"inmemoryraft/internal/client"
+	"inmemoryraft/internal/testcluster"
+)
+
+func TestZipfian(t *testing.T) {
+	const n = 1000
+	z := newZipfian(n)
+	r := rand.New(rand.NewSource(1))
+	counts := make([]int, n)
+	for i := 0; i < 100000; i++ {
+		item := z.next(r, n)
+		if item >= n {
+			t.Fatalf("item %d out of range", item)
+		}
+		counts[item]++
+	}
+	if counts[0] < counts[1] || counts[1] < counts[10] || counts[10] < counts[500] {
+		t.Fatalf("expected popularity to fall with the item number, got %d, %d, %d, %d",
+			counts[0], counts[1], counts[10], counts[500])
+	}
+
+	// Growing the item count extends zeta as if it was computed from scratch.
+	z.next(r, 2*n)
+	if fresh := newZipfian(2 * n); fresh.zetan-z.zetan > 1e-9 || z.zetan-fresh.zetan > 1e-9 {
+		t.Fatalf("zeta %g after growing, %g from scratch", z.zetan, fresh.zetan)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 1000)
+	for i := range latencies {
+		latencies[len(latencies)-1-i] = time.Duration(i+1) * time.Millisecond
+	}
+	l := summarize(latencies)
+	if l.P50 != 500 || l.P99 != 990 || l.P999 != 999 || l.Max != 1000 {
+		t.Fatalf("unexpected percentiles %+v", l)
+	}
+}
+
+func TestAcknowledged(t *testing.T) {
+	var a acknowledged
+	a.complete(1)
+	a.complete(2)
+	if a.load() != 0 {
+		t.Fatalf("expected inserts after a pending one not to count, got %d", a.load())
+	}
+	a.complete(0)
+	if a.load() != 3 {
+		t.Fatalf("expected 3 acknowledged inserts, got %d", a.load())
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	c := testcluster.Start(t, testcluster.Config{Nodes: 1, HTTP: true})
+	kv := client.New([]string{c.WaitForLeader().HTTPAddr})
+
+	for _, name := range workloadNames() {
+		cfg := config{workload: name, records: 100, valueSize: 10, concurrency: 4, ops: 200, load: true, output: "text", seed: 1}
+		if err := cfg.validate(); err != nil {
+			t.Fatalf("invalid config: %s", err)
+		}
+		report, err := benchmark(context.Background(), kv, cfg)
+		if err != nil {
+			t.Fatalf("workload %s: %s", name, err)
+		}
+		if report.Ops != 200 || report.Errors != 0 {
+			t.Fatalf("workload %s: expected 200 ops without errors, got %d ops, %d errors", name, report.Ops, report.Errors)
+		}
+		for op := range report.Operations {
+			if workloads[name].mix[opIndex(t, op)] == 0 {
+				t.Fatalf("workload %s ran %s", name, op)
+			}
+		}
+	}
+}
+
+func opIndex(t *testing.T, name string) opKind {
+	for k := opKind(0); k < numOps; k++ {
+		if k.String() == name {
+			return k
+		}
+	}
+	t.Fatalf("unknown operation %s", name)
+	return 0
+}
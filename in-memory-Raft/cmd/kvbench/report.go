@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// samples are the latencies of one operation, recorded by one client.
+type samples struct {
+	latencies []time.Duration
+	errors    int
+	notFound  int
+	lastErr   error
+}
+
+func (s *samples) merge(o *samples) {
+	s.latencies = append(s.latencies, o.latencies...)
+	s.errors += o.errors
+	s.notFound += o.notFound
+	if o.lastErr != nil {
+		s.lastErr = o.lastErr
+	}
+}
+
+// Latency is in milliseconds.
+type Latency struct {
+	Mean float64 `json:"mean_ms"`
+	P50  float64 `json:"p50_ms"`
+	P95  float64 `json:"p95_ms"`
+	P99  float64 `json:"p99_ms"`
+	P999 float64 `json:"p999_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+type OpReport struct {
+	Ops      int     `json:"ops"`
+	Errors   int     `json:"errors"`
+	NotFound int     `json:"not_found,omitempty"`
+	Latency  Latency `json:"latency"`
+}
+
+type Report struct {
+	Workload     string              `json:"workload"`
+	Mix          string              `json:"mix"`
+	Distribution string              `json:"distribution"`
+	Records      uint64              `json:"records"`
+	ValueSize    int                 `json:"value_size"`
+	Concurrency  int                 `json:"concurrency"`
+	Duration     float64             `json:"duration_seconds"`
+	Ops          int                 `json:"ops"`
+	Errors       int                 `json:"errors"`
+	Throughput   float64             `json:"ops_per_second"`
+	Latency      Latency             `json:"latency"`
+	Operations   map[string]OpReport `json:"operations"`
+}
+
+func newReport(cfg config, elapsed time.Duration, byOp [numOps]*samples) Report {
+	w := workloads[cfg.workload]
+	r := Report{
+		Workload:     cfg.workload,
+		Mix:          w.String(),
+		Distribution: cfg.distribution,
+		Records:      cfg.records,
+		ValueSize:    cfg.valueSize,
+		Concurrency:  cfg.concurrency,
+		Duration:     elapsed.Seconds(),
+		Operations:   make(map[string]OpReport),
+	}
+	all := &samples{}
+	for k, s := range byOp {
+		if s == nil || len(s.latencies)+s.errors == 0 {
+			continue
+		}
+		all.merge(s)
+		r.Operations[opKind(k).String()] = OpReport{
+			Ops:      len(s.latencies),
+			Errors:   s.errors,
+			NotFound: s.notFound,
+			Latency:  summarize(s.latencies),
+		}
+	}
+	r.Ops = len(all.latencies)
+	r.Errors = all.errors
+	r.Latency = summarize(all.latencies)
+	if elapsed > 0 {
+		r.Throughput = float64(r.Ops) / elapsed.Seconds()
+	}
+	return r
+}
+
+// summarize sorts latencies in place.
+func summarize(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+	return Latency{
+		Mean: ms(sum / time.Duration(len(latencies))),
+		P50:  ms(percentile(latencies, 0.50)),
+		P95:  ms(percentile(latencies, 0.95)),
+		P99:  ms(percentile(latencies, 0.99)),
+		P999: ms(percentile(latencies, 0.999)),
+		Max:  ms(latencies[len(latencies)-1]),
+	}
+}
+
+// percentile returns the nearest-rank percentile q of sorted latencies.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r Report) writeJSON(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r Report) writeText(out io.Writer) error {
+	fmt.Fprintf(out, "workload %s (%s), %s keys, %d records, %d-byte values, %d clients\n",
+		r.Workload, r.Mix, r.Distribution, r.Records, r.ValueSize, r.Concurrency)
+	fmt.Fprintf(out, "%d ops in %.1fs, %.1f ops/s, %d errors\n\n", r.Ops, r.Duration, r.Throughput, r.Errors)
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "OPERATION\tOPS\tERRORS\tMEAN\tP50\tP95\tP99\tP99.9\tMAX\t")
+	row := func(name string, ops, errors int, l Latency) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			name, ops, errors, l.Mean, l.P50, l.P95, l.P99, l.P999, l.Max)
+	}
+	for k := opKind(0); k < numOps; k++ {
+		if op, ok := r.Operations[k.String()]; ok {
+			row(k.String(), op.Ops, op.Errors, op.Latency)
+		}
+	}
+	row("total", r.Ops, r.Errors, r.Latency)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(out, "\nlatencies in milliseconds")
+	return err
+}
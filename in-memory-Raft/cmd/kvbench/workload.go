@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+type opKind int
+
+const (
+	opRead opKind = iota
+	opUpdate
+	opInsert
+	opScan
+	opReadModifyWrite
+	numOps
+)
+
+var opNames = [numOps]string{"read", "update", "insert", "scan", "read-modify-write"}
+
+func (k opKind) String() string {
+	return opNames[k]
+}
+
+// workload is a YCSB core workload: the share of every operation, and
+// whether reads favour the most recently inserted keys.
+type workload struct {
+	name   string
+	mix    [numOps]float64
+	latest bool
+}
+
+var workloads = map[string]workload{
+	"a": {name: "update heavy", mix: [numOps]float64{opRead: 0.5, opUpdate: 0.5}},
+	"b": {name: "read mostly", mix: [numOps]float64{opRead: 0.95, opUpdate: 0.05}},
+	"c": {name: "read only", mix: [numOps]float64{opRead: 1}},
+	"d": {name: "read latest", mix: [numOps]float64{opRead: 0.95, opInsert: 0.05}, latest: true},
+	"e": {name: "short ranges", mix: [numOps]float64{opScan: 0.95, opInsert: 0.05}},
+	"f": {name: "read-modify-write", mix: [numOps]float64{opRead: 0.5, opReadModifyWrite: 0.5}},
+}
+
+func workloadNames() []string {
+	names := make([]string, 0, len(workloads))
+	for name := range workloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (w workload) next(r *rand.Rand) opKind {
+	x := r.Float64()
+	for k, share := range w.mix {
+		if x < share {
+			return opKind(k)
+		}
+		x -= share
+	}
+	return opRead
+}
+
+// String describes the mix, such as "50% read, 50% update".
+func (w workload) String() string {
+	var parts []string
+	for k, share := range w.mix {
+		if share > 0 {
+			parts = append(parts, fmt.Sprintf("%g%% %s", share*100, opKind(k)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// keyName formats key numbers so that the ten keys differing only in the
+// last digit share a prefix, which is what a scan lists.
+func keyName(n uint64) string {
+	return fmt.Sprintf("user%010d", n)
+}
+
+func scanPrefix(key string) string {
+	return key[:len(key)-1]
+}
+
+const zipfianConstant = 0.99
+
+// zipfian picks item numbers from 0 to n-1, 0 being the most popular, with
+// the algorithm of Gray et al. that YCSB uses. The item count may grow
+// between calls, as inserts add keys; zeta is then extended incrementally.
+// A zipfian is not safe for concurrent use, so every client has a copy.
+type zipfian struct {
+	theta, alpha, zeta2 float64
+	n                   uint64
+	zetan, eta          float64
+}
+
+func newZipfian(n uint64) *zipfian {
+	z := &zipfian{theta: zipfianConstant, alpha: 1 / (1 - zipfianConstant)}
+	z.zeta2 = 1 + math.Pow(0.5, z.theta)
+	z.grow(n)
+	return z
+}
+
+func (z *zipfian) grow(n uint64) {
+	for i := z.n + 1; i <= n; i++ {
+		z.zetan += 1 / math.Pow(float64(i), z.theta)
+	}
+	z.n = n
+	z.eta = (1 - math.Pow(2/float64(n), 1-z.theta)) / (1 - z.zeta2/z.zetan)
+}
+
+func (z *zipfian) next(r *rand.Rand, n uint64) uint64 {
+	if n > z.n {
+		z.grow(n)
+	}
+	u := r.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < z.zeta2 {
+		return 1
+	}
+	item := uint64(float64(n) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	if item >= n {
+		item = n - 1
+	}
+	return item
+}
+
+// scramble spreads the popular items over the key space, as YCSB's
+// scrambled zipfian does, so that they do not all share a scan prefix.
+func scramble(item, n uint64) uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	for i := range b {
+		b[i] = byte(item >> (8 * i))
+	}
+	h.Write(b[:])
+	return h.Sum64() % n
+}
+
+const valueAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func randomValue(r *rand.Rand, size int) string {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = valueAlphabet[r.Intn(len(valueAlphabet))]
+	}
+	return string(b)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"inmemoryraft/internal/client"
+	"inmemoryraft/internal/services"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	DefaultEndpoints = "localhost:8000"
+
+	EnvEndpoints  = "KVCTL_ENDPOINTS"
+	EnvOutput     = "KVCTL_OUTPUT"
+	EnvStandalone = "KVCTL_STANDALONE"
+)
+
+var endpoints string
+var output string
+var standalone bool
+
+func init() {
+	flag.StringVar(&endpoints, "endpoints", envOr(EnvEndpoints, DefaultEndpoints), "Comma-separated list of HTTP endpoints (env "+EnvEndpoints+")")
+	flag.StringVar(&output, "o", envOr(EnvOutput, "table"), "Output format: table or json (env "+EnvOutput+")")
+	flag.BoolVar(&standalone, "standalone", os.Getenv(EnvStandalone) == "true", "Talk to the in-memory server without Raft (env "+EnvStandalone+")")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <command> [args]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  get <key>\n")
+		fmt.Fprintf(os.Stderr, "  put <key> <value>\n")
+		fmt.Fprintf(os.Stderr, "  del <key>\n")
+		fmt.Fprintf(os.Stderr, "  ls [--prefix <prefix>]\n")
+		fmt.Fprintf(os.Stderr, "  watch [--prefix <prefix>]\n")
+		fmt.Fprintf(os.Stderr, "  members list|remove <id>|transfer-leader [id]\n")
+		fmt.Fprintf(os.Stderr, "  snapshot save <file>|restore <file>\n")
+		fmt.Fprintf(os.Stderr, "  status\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if output != "table" && output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format '%s'\n", output)
+		os.Exit(2)
+	}
+
+	var c *client.Client
+	if standalone {
+		c = client.NewStandalone(splitEndpoints(endpoints))
+	} else {
+		c = client.New(splitEndpoints(endpoints))
+	}
+
+	if err := run(c, flag.Args(), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(c *client.Client, args []string, out io.Writer) error {
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: get <key>")
+		}
+		val, err := c.Get(args[0])
+		if err != nil {
+			return err
+		}
+		return printKeys(out, map[string]string{args[0]: val})
+	case "put":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: put <key> <value>")
+		}
+		return c.Put(args[0], args[1])
+	case "del":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: del <key>")
+		}
+		return c.Delete(args[0])
+	case "ls":
+		fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+		prefix := fs.String("prefix", "", "List only keys with this prefix")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		kv, err := c.List(*prefix)
+		if err != nil {
+			return err
+		}
+		return printKeys(out, kv)
+	case "watch":
+		fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+		prefix := fs.String("prefix", "", "Watch only keys with this prefix")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		return c.Watch(ctx, *prefix, func(ev services.Event) {
+			printEvent(out, ev)
+		})
+	case "members":
+		return runMembers(c, args, out)
+	case "snapshot":
+		return runSnapshot(c, args)
+	case "status":
+		st, err := c.Status()
+		if err != nil {
+			return err
+		}
+		return printStatus(out, st)
+	default:
+		return fmt.Errorf("unknown command '%s'", cmd)
+	}
+}
+
+func runMembers(c *client.Client, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: members list|remove <id>|transfer-leader [id]")
+	}
+	switch args[0] {
+	case "list":
+		members, err := c.Members()
+		if err != nil {
+			return err
+		}
+		return printMembers(out, members)
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: members remove <id>")
+		}
+		return c.RemoveMember(args[1])
+	case "transfer-leader":
+		id := ""
+		if len(args) > 1 {
+			id = args[1]
+		}
+		return c.TransferLeader(id)
+	default:
+		return fmt.Errorf("unknown members command '%s'", args[0])
+	}
+}
+
+func runSnapshot(c *client.Client, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: snapshot save|restore <file>")
+	}
+	switch args[0] {
+	case "save":
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return c.SaveSnapshot(f)
+	case "restore":
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return c.RestoreSnapshot(f)
+	default:
+		return fmt.Errorf("unknown snapshot command '%s'", args[0])
+	}
+}
+
+func printKeys(out io.Writer, kv map[string]string) error {
+	if output == "json" {
+		return printJSON(out, kv)
+	}
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%s\t%s\n", k, kv[k])
+	}
+	return tw.Flush()
+}
+
+func printEvent(out io.Writer, ev services.Event) {
+	if output == "json" {
+		printJSON(out, ev)
+		return
+	}
+	fmt.Fprintf(out, "%d\t%s\t%s\t%s\n", ev.Index, strings.ToUpper(ev.Type), ev.Key, ev.Value)
+}
+
+func printMembers(out io.Writer, members []services.Member) error {
+	if output == "json" {
+		return printJSON(out, members)
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tADDRESS\tSUFFRAGE\tLEADER")
+	for _, m := range members {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\n", m.ID, m.Address, m.Suffrage, m.Leader)
+	}
+	return tw.Flush()
+}
+
+func printStatus(out io.Writer, st map[string]services.Status) error {
+	if output == "json" {
+		return printJSON(out, st)
+	}
+	endpoints := make([]string, 0, len(st))
+	for e := range st {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tID\tSTATE\tLEADER\tLAST INDEX\tAPPLIED INDEX\tKEYS")
+	for _, e := range endpoints {
+		s := st[e]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", e, s.ID, s.State, s.LeaderID, s.LastIndex, s.AppliedIndex, s.Keys)
+	}
+	return tw.Flush()
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "    ")
+	return enc.Encode(v)
+}
+
+func splitEndpoints(s string) []string {
+	var result []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"inmemoryraft/internal/mirror"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	source     string
+	dest       string
+	prefixes   string
+	rewrites   string
+	checkpoint string
+	httpAddr   string
+	interval   time.Duration
+)
+
+func init() {
+	flag.StringVar(&source, "source", "", "Comma-separated HTTP endpoints of the source cluster")
+	flag.StringVar(&dest, "dest", "", "Comma-separated HTTP endpoints of the destination cluster")
+	flag.StringVar(&prefixes, "prefix", "", "Comma-separated prefixes of the mirrored keys (all keys if empty)")
+	flag.StringVar(&rewrites, "rewrite", "", "Comma-separated from=to prefix rewrites of the mirrored keys")
+	flag.StringVar(&checkpoint, "checkpoint", "mirror-checkpoint.json", "Checkpoint file")
+	flag.StringVar(&httpAddr, "http-addr", "", "Address serving /status and /metrics (disabled if empty)")
+	flag.DurationVar(&interval, "interval", time.Second, "Interval of the checkpoint saves and the lag polls")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -source <endpoints> -dest <endpoints> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Mirrors the changes of a source cluster to a destination cluster.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	rw, err := parseRewrites(rewrites)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := mirror.New(mirror.Config{
+		Source:      splitList(source),
+		Destination: splitList(dest),
+		Prefixes:    splitList(prefixes),
+		Rewrites:    rw,
+		Checkpoint:  checkpoint,
+		Interval:    interval,
+	})
+	if err != nil {
+		flag.Usage()
+		log.Fatal(err)
+	}
+
+	if httpAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(httpAddr, m.Handler()); err != nil {
+				log.Fatalf("HTTP serve: %s", err)
+			}
+		}()
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := m.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("stopped")
+}
+
+func parseRewrites(s string) ([]mirror.Rewrite, error) {
+	var result []mirror.Rewrite
+	for _, r := range splitList(s) {
+		from, to, ok := strings.Cut(r, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad rewrite '%s', want from=to", r)
+		}
+		result = append(result, mirror.Rewrite{From: from, To: to})
+	}
+	return result, nil
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			result = append(result, e)
+		}
+	}
+	return result
+}
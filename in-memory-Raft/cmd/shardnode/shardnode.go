@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"inmemoryraft/internal/shard"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+var (
+	id       string
+	raftAddr string
+	httpAddr string
+	dir      string
+	peers    string
+	join     string
+)
+
+func init() {
+	flag.StringVar(&id, "id", "", "Node ID")
+	flag.StringVar(&raftAddr, "raft-addr", "localhost:13000", "Raft address shared by the groups of the node")
+	flag.StringVar(&httpAddr, "http-addr", "localhost:18000", "HTTP API address")
+	flag.StringVar(&dir, "dir", "shard-data", "Directory of the Raft state, one subdirectory per group")
+	flag.StringVar(&peers, "peers", "", "First nodes of the cluster as id=raft-addr,... (same on each of them)")
+	flag.StringVar(&join, "join", "", "Comma-separated HTTP addresses of nodes already in the cluster")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -id <id> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Starts a node hosting key-range shards, each one a Raft group.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if id == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	peerMap, err := parsePeers(peers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(peerMap) == 0 && join == "" {
+		log.Fatal("either -peers or -join is required")
+	}
+
+	node := shard.NewNode(shard.Config{
+		ID:       id,
+		RaftAddr: raftAddr,
+		HTTPAddr: httpAddr,
+		Dir:      dir,
+		Peers:    peerMap,
+		Join:     splitList(join),
+	})
+	if err := node.Start(); err != nil {
+		log.Fatalf("failed to start node: %s", err)
+	}
+	log.Printf("node %s serving HTTP on %s, Raft on %s", id, node.HTTPAddr(), node.RaftAddr())
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
+	<-terminate
+	log.Println("shutting down")
+	node.Close()
+}
+
+func parsePeers(s string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, p := range splitList(s) {
+		id, addr, ok := strings.Cut(p, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("bad peer '%s', want id=raft-addr", p)
+		}
+		result[id] = addr
+	}
+	return result, nil
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			result = append(result, e)
+		}
+	}
+	return result
+}
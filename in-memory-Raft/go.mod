@@ -2,7 +2,29 @@ module inmemoryraft
 
 go 1.21.6
 
-require github.com/hashicorp/raft v1.6.1
+require (
+	github.com/coreos/etcd v3.3.27+incompatible
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/hashicorp/raft v1.6.1
+	google.golang.org/grpc v1.26.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/coreos/go-semver v0.3.1 // indirect
+	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
+	github.com/coreos/pkg v0.0.0-20240122114842-bbd7aa9bf6fb // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/google/uuid v1.4.0 // indirect
+	go.etcd.io/etcd v3.3.27+incompatible // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	go.uber.org/zap v1.26.0 // indirect
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
 
 require (
 	github.com/armon/go-metrics v0.4.1 // indirect
@@ -15,4 +37,10 @@ require (
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	golang.org/x/sys v0.13.0 // indirect
+	common v0.0.0
+	kv v0.0.0
 )
+
+replace kv => ../kv
+
+replace common => ../common
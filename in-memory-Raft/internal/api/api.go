@@ -1,7 +1,12 @@
 package api
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"inmemoryraft/internal/jsonpatch"
+	"inmemoryraft/internal/jsonschema"
 	"inmemoryraft/internal/services"
 	"io"
 	"log"
@@ -12,32 +17,98 @@ import (
 )
 
 type StorageController struct {
-	addr string
-	ln   net.Listener
+	RateLimits RateLimits
 
-	store *services.InMemoryStore
+	addr   string
+	ln     net.Listener
+	server *http.Server
+
+	store   *services.InMemoryStore
+	limiter *rateLimiter
+	metrics *metrics
 }
 
 func NewInMemoryStore(addr string, store *services.InMemoryStore) *StorageController {
 	return &StorageController{
-		addr:  addr,
-		store: store,
+		addr:    addr,
+		store:   store,
+		metrics: newMetrics(),
 	}
 }
 
 func (sc *StorageController) Starter() error {
 	r := mux.NewRouter()
 	r.HandleFunc("/keys/{key}", sc.HandleGet).Methods("GET")
+	r.HandleFunc("/keys", sc.HandleList).Methods("GET")
 	r.HandleFunc("/keys", sc.HandlePut).Methods("POST")
 	r.HandleFunc("/keys/{key}", sc.HandleDelete).Methods("DELETE")
+	r.HandleFunc("/keys/{key}/history", sc.HandleHistory).Methods("GET")
+	r.HandleFunc("/keys/{key}/cas", sc.HandleCompareAndSwap).Methods("POST")
+	r.HandleFunc("/compact", sc.HandleCompact).Methods("POST")
+	r.HandleFunc("/keys/{key}", sc.HandlePutValue).Methods("PUT")
+	r.HandleFunc("/keys/{key}", sc.HandlePatch).Methods("PATCH")
+	r.HandleFunc("/watch", sc.HandleWatch).Methods("GET")
+	r.HandleFunc("/schemas", sc.HandleSchemas).Methods("GET")
+	r.HandleFunc("/schemas/{prefix:.+}", sc.HandleGetSchema).Methods("GET")
+	r.HandleFunc("/schemas/{prefix:.+}", sc.HandlePutSchema).Methods("PUT")
+	r.HandleFunc("/schemas/{prefix:.+}", sc.HandleDeleteSchema).Methods("DELETE")
+	r.HandleFunc("/locks", sc.HandleLocks).Methods("GET")
+	r.HandleFunc("/locks/{name}", sc.HandleGetLock).Methods("GET")
+	r.HandleFunc("/locks/{name}", sc.HandleAcquireLock).Methods("POST")
+	r.HandleFunc("/locks/{name}/renew", sc.HandleRenewLock).Methods("POST")
+	r.HandleFunc("/locks/{name}", sc.HandleReleaseLock).Methods("DELETE")
+	r.HandleFunc("/elections/{name}", sc.HandleLeader).Methods("GET")
+	r.HandleFunc("/elections/{name}", sc.HandleCampaign).Methods("POST")
+	r.HandleFunc("/elections/{name}/renew", sc.HandleRenewLeadership).Methods("POST")
+	r.HandleFunc("/elections/{name}", sc.HandleResign).Methods("DELETE")
+	r.HandleFunc("/counters", sc.HandleCounters).Methods("GET")
+	r.HandleFunc("/counters/{name}", sc.HandleGetCounter).Methods("GET")
+	r.HandleFunc("/counters/{name}", sc.HandleDeleteCounter).Methods("DELETE")
+	r.HandleFunc("/counters/{name}/incr", sc.HandleIncrement).Methods("POST")
+	r.HandleFunc("/counters/{name}/decr", sc.HandleDecrement).Methods("POST")
+	r.HandleFunc("/counters/{name}/sequence", sc.HandleSequence).Methods("POST")
+	r.HandleFunc("/quotas", sc.HandleQuotas).Methods("GET")
+	r.HandleFunc("/quotas", sc.HandleSetQuotas).Methods("PUT")
+	r.HandleFunc("/ns", sc.HandleNamespaces).Methods("GET")
+	r.HandleFunc("/ns/{namespace}", sc.HandleGetNamespace).Methods("GET")
+	r.HandleFunc("/ns/{namespace}", sc.HandlePutNamespace).Methods("PUT")
+	r.HandleFunc("/ns/{namespace}", sc.HandleDeleteNamespace).Methods("DELETE")
+	r.HandleFunc("/ns/{namespace}/keys", sc.HandleNamespaceList).Methods("GET")
+	r.HandleFunc("/ns/{namespace}/keys", sc.HandleNamespacePut).Methods("POST")
+	r.HandleFunc("/ns/{namespace}/keys/{key}", sc.HandleNamespaceGet).Methods("GET")
+	r.HandleFunc("/ns/{namespace}/keys/{key}", sc.HandleNamespaceDelete).Methods("DELETE")
+	r.HandleFunc("/ns/{namespace}/watch", sc.HandleNamespaceWatch).Methods("GET")
 	r.HandleFunc("/join", sc.HandleJoin).Methods("POST")
+	r.HandleFunc("/cluster", sc.HandleCluster).Methods("GET")
+	r.HandleFunc("/cluster/token", sc.HandleRotateJoinToken).Methods("POST")
+	r.HandleFunc("/members", sc.HandleMembers).Methods("GET")
+	r.HandleFunc("/members/{id}", sc.HandleRemoveMember).Methods("DELETE")
+	r.HandleFunc("/leader/transfer", sc.HandleTransferLeader).Methods("POST")
+	r.HandleFunc("/snapshot", sc.HandleSnapshotSave).Methods("GET")
+	r.HandleFunc("/snapshot", sc.HandleSnapshotRestore).Methods("PUT")
+	r.HandleFunc("/status", sc.HandleStatus).Methods("GET")
 	r.HandleFunc("/load-transaction-log", sc.HandleLoadTransactionLog).Methods("GET")
 	r.HandleFunc("/save-transaction-log", sc.HandleSaveTransactionLog).Methods("GET")
+	r.HandleFunc("/metrics", sc.HandleMetrics).Methods("GET")
+	r.HandleFunc("/audit", sc.HandleAudit).Methods("GET")
+	if sc.store.Faults != nil {
+		r.HandleFunc("/debug/faults", sc.HandleFaults).Methods("GET")
+		r.HandleFunc("/debug/faults", sc.HandleResetFaults).Methods("DELETE")
+		r.HandleFunc("/debug/faults/{peer}", sc.HandleSetFault).Methods("PUT")
+		r.HandleFunc("/debug/faults/{peer}", sc.HandleClearFault).Methods("DELETE")
+	}
 	r.Handle("/", http.FileServer(http.Dir("configs")))
 
-	server := http.Server{
+	r.Use(sc.withOrigin)
+	sc.limiter = newRateLimiter(sc.RateLimits)
+	if sc.limiter.enabled() {
+		r.Use(sc.rateLimit)
+	}
+
+	server := &http.Server{
 		Handler: r,
 	}
+	sc.server = server
 
 	ln, err := net.Listen("tcp", sc.addr)
 	if err != nil {
@@ -45,11 +116,9 @@ func (sc *StorageController) Starter() error {
 	}
 	sc.ln = ln
 
-	http.Handle("/", r)
-
 	go func() {
 		err := server.Serve(sc.ln)
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP serve: %s", err)
 		}
 	}()
@@ -61,6 +130,12 @@ func (sc *StorageController) Close() {
 	sc.ln.Close()
 }
 
+// Shutdown stops accepting connections and waits for active requests until
+// ctx expires.
+func (sc *StorageController) Shutdown(ctx context.Context) error {
+	return sc.server.Shutdown(ctx)
+}
+
 func (sc *StorageController) HandleJoin(w http.ResponseWriter, r *http.Request) {
 	m := map[string]string{}
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
@@ -68,11 +143,6 @@ func (sc *StorageController) HandleJoin(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if len(m) != 2 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
 	remoteAddr, ok := m["addr"]
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
@@ -85,8 +155,40 @@ func (sc *StorageController) HandleJoin(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if err := sc.store.CheckJoin(m["token"], m["cluster_id"]); err != nil {
+		log.Printf("rejected join of node %s at %s: %s", nodeID, remoteAddr, err)
+		writeError(w, err)
+		return
+	}
+
 	if err := sc.store.Join(nodeID, remoteAddr); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{"cluster_id": sc.store.ClusterID()})
+}
+
+func (sc *StorageController) HandleCluster(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"cluster_id":     sc.store.ClusterID(),
+		"join_token_set": sc.store.HasJoinToken(),
+	})
+}
+
+// HandleRotateJoinToken expects the current token in the X-Join-Token header
+// and the new one in the body.
+func (sc *StorageController) HandleRotateJoinToken(w http.ResponseWriter, r *http.Request) {
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if m["token"] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := sc.store.RotateJoinToken(r.Context(), r.Header.Get("X-Join-Token"), m["token"]); err != nil {
+		writeError(w, err)
 		return
 	}
 }
@@ -98,9 +200,36 @@ func (sc *StorageController) HandleGet(w http.ResponseWriter, r *http.Request) {
 	if key == "" {
 		w.WriteHeader(http.StatusBadRequest)
 	}
-	val, err := sc.store.Get(key)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if r.URL.Query().Has("path") {
+		sc.handleGetPath(w, key, r.URL.Query().Get("path"))
+		return
+	}
+	if r.URL.Query().Has("revision") {
+		sc.handleGetAt(w, r, key)
+		return
+	}
+	if r.URL.Query().Has("consistent") {
+		if err := sc.store.Linearize(r.Context()); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	val, typ, ok := sc.store.Lookup(key)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeValue(w, r, key, val, typ)
+}
+
+// writeValue answers with the value of key: raw bytes for binary values or
+// when asked for with Accept, otherwise a JSON object.
+func writeValue(w http.ResponseWriter, r *http.Request, key, val, typ string) {
+	w.Header().Set("X-Value-Type", typ)
+
+	if typ == services.TypeBinary || r.Header.Get("Accept") == "application/octet-stream" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, val)
 		return
 	}
 
@@ -123,8 +252,8 @@ func (sc *StorageController) HandlePut(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if err := sc.store.Put(k, v); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if err := sc.store.Put(r.Context(), k, v); err != nil {
+			writeError(w, err)
 			return
 		}
 	}
@@ -138,10 +267,237 @@ func (sc *StorageController) HandleDelete(w http.ResponseWriter, r *http.Request
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if err := sc.store.Delete(k); err != nil {
+	if err := sc.store.Delete(r.Context(), k); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) HandleList(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.URL.Query().Has("revision") {
+		sc.handleListAt(w, r, prefix)
+		return
+	}
+	kvs := sc.store.List(prefix)
+	for k, v := range kvs {
+		// JSON strings cannot carry arbitrary bytes.
+		if sc.store.ValueType(k) == services.TypeBinary {
+			kvs[k] = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+	}
+	writeJSON(w, kvs)
+}
+
+func (sc *StorageController) HandleWatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case query.Get("snapshot") == "true":
+		sc.handleWatchSnapshot(w, r, flusher, query.Get("prefix"))
+		return
+	case query.Has("revision"):
+		sc.handleWatchFrom(w, r, flusher, query.Get("prefix"))
+		return
+	}
+	events, cancel := sc.store.Watch(query.Get("prefix"))
+	defer cancel()
+	streamEvents(w, r, flusher, events)
+}
+
+func streamEvents(w http.ResponseWriter, r *http.Request, flusher http.Flusher, events <-chan services.Event) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (sc *StorageController) HandleMembers(w http.ResponseWriter, r *http.Request) {
+	members, err := sc.store.Members()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, members)
+}
+
+func (sc *StorageController) HandleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := sc.store.RemoveMember(id); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) HandleTransferLeader(w http.ResponseWriter, r *http.Request) {
+	m := map[string]string{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if err := sc.store.TransferLeadership(m["id"]); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// snapshotEntry is a key of a backup. Binary values are base64-encoded, as
+// JSON strings cannot carry arbitrary bytes.
+type snapshotEntry struct {
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+func (sc *StorageController) HandleSnapshotSave(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("raft") == "true" {
+		if err := sc.store.Snapshot(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	values, types := sc.store.ListWithTypes("")
+	backup := make(map[string]snapshotEntry, len(values))
+	for k, v := range values {
+		e := snapshotEntry{Value: v, Type: types[k]}
+		switch e.Type {
+		case "":
+			e.Type = services.TypeString
+		case services.TypeBinary:
+			e.Value = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		backup[k] = e
+	}
+	writeJSON(w, backup)
+}
+
+// HandleSnapshotRestore also takes the backups of plain strings saved
+// before the values carried their types.
+func (sc *StorageController) HandleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	backup := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&backup); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	values := make(map[string]string, len(backup))
+	types := make(map[string]string)
+	for k, raw := range backup {
+		var e snapshotEntry
+		if err := json.Unmarshal(raw, &e.Value); err != nil {
+			if err := json.Unmarshal(raw, &e); err != nil {
+				http.Error(w, "key '"+k+"': "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if e.Type == services.TypeBinary {
+			b, err := base64.StdEncoding.DecodeString(e.Value)
+			if err != nil {
+				http.Error(w, "key '"+k+"': "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			e.Value = string(b)
+		}
+		values[k] = e.Value
+		if e.Type != "" && e.Type != services.TypeString {
+			types[k] = e.Type
+		}
+	}
+	if err := sc.store.Restore(r.Context(), values, types); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, sc.store.Status())
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, services.ErrNotLeader):
+		return http.StatusMisdirectedRequest
+	case errors.Is(err, services.ErrShuttingDown), errors.Is(err, services.ErrBusy):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, services.ErrInvalidJoinToken), errors.Is(err, services.ErrClusterMismatch),
+		errors.Is(err, services.ErrAccessDenied):
+		return http.StatusForbidden
+	case errors.Is(err, services.ErrNamespaceNotFound), errors.Is(err, services.ErrKeyNotFound),
+		errors.Is(err, services.ErrSchemaNotFound), errors.Is(err, services.ErrLockNotFound),
+		errors.Is(err, services.ErrCounterNotFound),
+		errors.Is(err, jsonpatch.ErrPathNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrCompacted):
+		return http.StatusGone
+	case errors.Is(err, services.ErrInvalidNamespace), errors.Is(err, services.ErrInvalidJSON),
+		errors.Is(err, services.ErrInvalidType),
+		errors.Is(err, services.ErrFutureRevision), errors.Is(err, services.ErrInvalidLock),
+		errors.Is(err, services.ErrInvalidCounter),
+		errors.Is(err, services.ErrInvalidQuota), errors.Is(err, jsonschema.ErrInvalidSchema),
+		errors.Is(err, jsonpatch.ErrInvalidPointer):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrNotJSON), errors.Is(err, jsonpatch.ErrTestFailed),
+		errors.Is(err, services.ErrLockHeld), errors.Is(err, services.ErrLockNotHeld),
+		errors.Is(err, services.ErrCounterRange), errors.Is(err, services.ErrCounterKind),
+		errors.Is(err, services.ErrCASMismatch):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrKeyTooLarge), errors.Is(err, services.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, services.ErrSchemaViolation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, services.ErrQuotaExceeded), errors.Is(err, services.ErrNoSpace):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError answers with the status matching err. Clients are asked to
+// retry later when the node is only temporarily overloaded.
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, services.ErrBusy) {
+		w.Header().Set("Retry-After", "1")
+	}
+	var violation *services.SchemaViolationError
+	if errors.As(err, &violation) {
+		writeSchemaViolation(w, violation)
+		return
+	}
+	http.Error(w, err.Error(), statusFor(err))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
 func (sc *StorageController) Addr() net.Addr {
@@ -149,7 +505,7 @@ func (sc *StorageController) Addr() net.Addr {
 }
 
 func (sc *StorageController) HandleLoadTransactionLog(w http.ResponseWriter, r *http.Request) {
-	if err := sc.store.LoadTransactionLog(); err != nil {
+	if err := sc.store.LoadTransactionLog(r.Context()); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
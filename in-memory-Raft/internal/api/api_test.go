@@ -1,37 +1,52 @@
-package api
+package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
+
+	"inmemoryraft/internal/services"
+	"inmemoryraft/internal/testcluster"
 )
 
-func PostTestingFunc() *http.Response {
+// startCluster runs a single node with its HTTP API and returns the base URL
+// of the API once the node leads.
+func startCluster(tb testing.TB) (*testcluster.Cluster, string) {
+	c := testcluster.Start(tb, testcluster.Config{Nodes: 1, HTTP: true})
+	return c, "http://" + c.WaitForLeader().HTTPAddr
+}
+
+func PostTestingFunc(t testing.TB, base string) *http.Response {
 	values := map[string]string{"testKey": "testValue"}
 	jsonData, _ := json.Marshal(values)
 
-	resp, err := http.Post("http://localhost:8080/keys", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := http.Post(base+"/keys", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		// _ = fmt.Errorf("failed to add test data, got %v", err)
-		return resp
+		t.Fatalf("failed to add test data, got %v", err)
 	}
 	defer resp.Body.Close()
 	return resp
 }
 
 func TestHandlePostKey(t *testing.T) {
-	resp := PostTestingFunc()
+	_, base := startCluster(t)
+	resp := PostTestingFunc(t, base)
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
 	}
 }
 
 func TestHandleGetKey(t *testing.T) {
-	_ = PostTestingFunc()
+	_, base := startCluster(t)
+	_ = PostTestingFunc(t, base)
 
-	resp, err := http.Get("http://localhost:8081/keys/testKey")
+	resp, err := http.Get(base + "/keys/testKey")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -52,9 +67,10 @@ func TestHandleGetKey(t *testing.T) {
 }
 
 func TestHandleDeleteKey(t *testing.T) {
-	_ = PostTestingFunc()
+	_, base := startCluster(t)
+	_ = PostTestingFunc(t, base)
 
-	req, _ := http.NewRequest("DELETE", "http://localhost:8080/keys/testKey", nil)
+	req, _ := http.NewRequest("DELETE", base+"/keys/testKey", nil)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
@@ -67,10 +83,13 @@ func TestHandleDeleteKey(t *testing.T) {
 }
 
 func TestHandleJoin(t *testing.T) {
-	values := map[string]string{"addr": "localhost:8081", "id": "node1"}
+	c, base := startCluster(t)
+	node := c.AddNode()
+
+	values := map[string]string{"addr": node.RaftAddr, "id": node.ID}
 	jsonData, _ := json.Marshal(values)
 
-	resp, err := http.Post("http://localhost:8080/join", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := http.Post(base+"/join", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -79,56 +98,221 @@ func TestHandleJoin(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
 	}
+
+	c.Sync()
+	members, err := node.Store.Members()
+	if err != nil || len(members) != 2 {
+		t.Fatalf("Expected the joined node to see 2 members, got %v, %v", members, err)
+	}
+}
+
+func TestHandleFaults(t *testing.T) {
+	c := testcluster.Start(t, testcluster.Config{Nodes: 2, Network: true, HTTP: true})
+	node := c.Node(0)
+	base := "http://" + node.HTTPAddr
+	peer := c.Node(1)
+
+	req, _ := http.NewRequest(http.MethodPut, base+"/debug/faults/"+peer.ID,
+		bytes.NewBufferString(`{"latency": "20ms", "drop": 0.1}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if r := node.Faults.Rule(peer.RaftAddr); r.Latency != 20*time.Millisecond || r.Drop != 0.1 {
+		t.Fatalf("Expected the rule to be set for %s, got %+v", peer.RaftAddr, r)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, base+"/debug/faults/*", bytes.NewBufferString(`{"drop": 2}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, base+"/debug/faults", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resp.Body.Close()
+	if rules := node.Faults.Rules(); len(rules) != 0 {
+		t.Fatalf("Expected no rules after reset, got %v", rules)
+	}
+}
+
+// TestSnapshotRoundTrip checks that a backup restores every value with its
+// type, and that a restore is refused values a write would be refused.
+func TestSnapshotRoundTrip(t *testing.T) {
+	c, base := startCluster(t)
+	store := c.WaitForLeader().Store
+	ctx := context.Background()
+	if err := store.Put(ctx, "s", "plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutJSON(ctx, "j", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutBinary(ctx, "b", []byte{0xff, 0xfe, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(base + "/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err := store.Delete(ctx, "j"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "b", "overwritten"); err != nil {
+		t.Fatal(err)
+	}
+	restore := func(body []byte) int {
+		req, _ := http.NewRequest(http.MethodPut, base+"/snapshot", bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := restore(backup); code != http.StatusOK {
+		t.Fatalf("restore: status %d", code)
+	}
+	for key, want := range map[string][2]string{
+		"s": {"plain", services.TypeString},
+		"j": {`{"a":1}`, services.TypeJSON},
+		"b": {"\xff\xfe\x00", services.TypeBinary},
+	} {
+		if v, typ, ok := store.Lookup(key); !ok || v != want[0] || typ != want[1] {
+			t.Errorf("%s is %q of type %s, want %q of type %s", key, v, typ, want[0], want[1])
+		}
+	}
+
+	if code := restore([]byte(`{"legacy": "value"}`)); code != http.StatusOK {
+		t.Fatalf("restore of a legacy backup: status %d", code)
+	}
+	if got := store.List(""); len(got) != 1 || got["legacy"] != "value" {
+		t.Errorf("after a legacy restore the keys are %v", got)
+	}
+
+	store.MaxValueSize = 4
+	if code := restore([]byte(`{"big": {"value": "too large", "type": "string"}}`)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("restore of an oversized value: status %d", code)
+	}
+	if code := restore([]byte(`{"k": {"value": "{", "type": "json"}}`)); code != http.StatusBadRequest {
+		t.Errorf("restore of invalid JSON: status %d", code)
+	}
+}
+
+func TestPatchSizeLimit(t *testing.T) {
+	c, base := startCluster(t)
+	store := c.WaitForLeader().Store
+	store.MaxValueSize = 64
+	if err := store.PutJSON(context.Background(), "doc", []byte(`{"items":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	patch := func(contentType, body string) int {
+		req, _ := http.NewRequest(http.MethodPatch, base+"/keys/doc", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Every patch is small, the document they build is not.
+	for _, contentType := range []string{"application/json-patch+json", "application/merge-patch+json"} {
+		code := http.StatusOK
+		for i := 0; i < 10 && code == http.StatusOK; i++ {
+			body := `[{"op":"add","path":"/items/-","value":"xxxxxxxxxx"}]`
+			if contentType == "application/merge-patch+json" {
+				body = fmt.Sprintf(`{"k%d":"xxxxxxxxxx"}`, i)
+			}
+			code = patch(contentType, body)
+		}
+		if code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%s: expected growing the document past the limit to fail with 413, got %d", contentType, code)
+		}
+		if v, _ := store.Get("doc"); len(v) > store.MaxValueSize {
+			t.Fatalf("%s: stored %d bytes over a limit of %d", contentType, len(v), store.MaxValueSize)
+		}
+		if err := store.PutJSON(context.Background(), "doc", []byte(`{"items":[]}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
 }
 
 func BenchmarkHandlePostKey(b *testing.B) {
+	_, base := startCluster(b)
 	values := map[string]string{"testKey": "testValue"}
 	jsonData, _ := json.Marshal(values)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := http.Post("http://localhost:8080/keys", "application/json", bytes.NewBuffer(jsonData))
+		resp, err := http.Post(base+"/keys", "application/json", bytes.NewBuffer(jsonData))
 		if err != nil {
 			b.Fatalf("Error posting key: %v", err)
 		}
+		resp.Body.Close()
 	}
 }
 
 func BenchmarkHandleGetKey(b *testing.B) {
+	_, base := startCluster(b)
+	_ = PostTestingFunc(b, base)
+
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := http.Get("http://localhost:8080/keys/testKey")
+		resp, err := http.Get(base + "/keys/testKey")
 		if err != nil {
 			b.Fatalf("Error fetching key: %v", err)
 		}
+		resp.Body.Close()
 	}
 }
 
 func BenchmarkHandleDeleteKey(b *testing.B) {
-	req, _ := http.NewRequest("DELETE", "http://localhost:8080/keys/testKey", nil)
+	_, base := startCluster(b)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := http.DefaultClient.Do(req)
+		req, _ := http.NewRequest("DELETE", base+"/keys/testKey", nil)
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			b.Fatalf("Error deleting key: %v", err)
 		}
+		resp.Body.Close()
 	}
 }
 
+// BenchmarkHandleJoin measures joins of a node that is already a member,
+// which the leader acknowledges without changing the configuration.
 func BenchmarkHandleJoin(b *testing.B) {
+	c, base := startCluster(b)
+	node := c.AddNode()
+	jsonData, _ := json.Marshal(map[string]string{"addr": node.RaftAddr, "id": node.ID})
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		port := 5000 + i
-		if port == 8080 {
-			continue
-		}
-		addr := fmt.Sprintf("localhost:%d", port)
-		values := map[string]string{"addr": addr, "id": fmt.Sprintf("node%d", i)}
-		jsonData, _ := json.Marshal(values)
-
-		_, err := http.Post("http://localhost:8080/join", "application/json", bytes.NewBuffer(jsonData))
+		resp, err := http.Post(base+"/join", "application/json", bytes.NewBuffer(jsonData))
 		if err != nil {
 			b.Fatalf("Error joining node: %v", err)
 		}
+		if resp.StatusCode != http.StatusOK {
+			b.Fatalf("join failed with status %d", resp.StatusCode)
+		}
+		resp.Body.Close()
 	}
 }
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"inmemoryraft/internal/services"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxRequestIDLength = 128
+
+// principal names the authenticated client by its bearer token (hashed).
+// Only a token that known verifies counts, so that made-up tokens cannot
+// pose as clients. It is empty for anonymous clients.
+func principal(r *http.Request, known func(token string) bool) string {
+	if token := bearerToken(r); token != "" && known(token) {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:8])
+	}
+	return ""
+}
+
+// withOrigin is a middleware attaching the caller to the request context, so
+// that the writes it makes are audited. The request ID is taken from
+// X-Request-ID or generated, and echoed back.
+func (sc *StorageController) withOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		origin := services.Origin{
+			Principal: principal(r, sc.store.KnownToken),
+			Source:    r.RemoteAddr,
+			RequestID: id,
+		}
+		if origin.Principal == "" {
+			origin.Principal = "anonymous"
+		}
+		next.ServeHTTP(w, r.WithContext(services.WithOrigin(r.Context(), origin)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// HandleAudit returns the audit records matching the prefix, namespace, user,
+// since and until (RFC 3339) and limit parameters, as a JSON array or, with
+// format=ndjson, one record per line. Records of namespaces the caller may
+// not read are left out.
+func (sc *StorageController) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := services.AuditFilter{
+		Prefix:    q.Get("prefix"),
+		Namespace: q.Get("namespace"),
+		Principal: q.Get("user"),
+	}
+	var err error
+	if s := q.Get("since"); s != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if filter.Limit, err = strconv.Atoi(s); err != nil || filter.Limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records := sc.store.AuditLog(filter)
+	allowed := records[:0]
+	readable := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Namespace != "" {
+			ok, seen := readable[rec.Namespace]
+			if !seen {
+				ok = sc.store.CheckNamespace(rec.Namespace, bearerToken(r), false) == nil
+				readable[rec.Namespace] = ok
+			}
+			if !ok {
+				continue
+			}
+		}
+		allowed = append(allowed, rec)
+	}
+
+	if q.Get("format") != "ndjson" && r.Header.Get("Accept") != "application/x-ndjson" {
+		writeJSON(w, allowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, rec := range allowed {
+		if err := enc.Encode(rec); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"inmemoryraft/internal/services"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func (sc *StorageController) HandleCounters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, sc.store.Counters())
+}
+
+func (sc *StorageController) HandleGetCounter(w http.ResponseWriter, r *http.Request) {
+	c, err := sc.store.Counter(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, c)
+}
+
+func (sc *StorageController) HandleIncrement(w http.ResponseWriter, r *http.Request) {
+	sc.handleCounterChange(w, r, sc.store.Increment)
+}
+
+func (sc *StorageController) HandleDecrement(w http.ResponseWriter, r *http.Request) {
+	sc.handleCounterChange(w, r, sc.store.Decrement)
+}
+
+// handleCounterChange reads {"by": N, "min": ..., "max": ...} from the body,
+// where "by" defaults to 1 and the bounds are optional, and answers with the
+// new value of the counter.
+func (sc *StorageController) handleCounterChange(w http.ResponseWriter, r *http.Request,
+	change func(ctx context.Context, req services.CounterRequest) (services.Counter, error)) {
+	var body struct {
+		By  *int64 `json:"by"`
+		Min *int64 `json:"min"`
+		Max *int64 `json:"max"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	req := services.CounterRequest{Name: mux.Vars(r)["name"], Delta: 1, Min: body.Min, Max: body.Max}
+	if body.By != nil {
+		req.Delta = *body.By
+	}
+	c, err := change(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, c)
+}
+
+// HandleSequence reserves {"count": N} IDs, one by default, and answers with
+// the first and last of them.
+func (sc *StorageController) HandleSequence(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Count int64 `json:"count"`
+	}{Count: 1}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	block, err := sc.store.NextIDs(r.Context(), mux.Vars(r)["name"], body.Count)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, block)
+}
+
+func (sc *StorageController) HandleDeleteCounter(w http.ResponseWriter, r *http.Request) {
+	if err := sc.store.DeleteCounter(r.Context(), mux.Vars(r)["name"]); err != nil {
+		writeError(w, err)
+		return
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"inmemoryraft/internal/chaos"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// faultBody is a chaos.Rule in requests and responses. Durations use the
+// time.ParseDuration syntax, the bandwidth is in bytes per second.
+type faultBody struct {
+	Latency   string  `json:"latency,omitempty"`
+	Jitter    string  `json:"jitter,omitempty"`
+	Drop      float64 `json:"drop,omitempty"`
+	Partition bool    `json:"partition,omitempty"`
+	Bandwidth int64   `json:"bandwidth,omitempty"`
+}
+
+func newFaultBody(r chaos.Rule) faultBody {
+	body := faultBody{Drop: r.Drop, Partition: r.Partition, Bandwidth: r.Bandwidth}
+	if r.Latency > 0 {
+		body.Latency = r.Latency.String()
+	}
+	if r.Jitter > 0 {
+		body.Jitter = r.Jitter.String()
+	}
+	return body
+}
+
+func (sc *StorageController) HandleFaults(w http.ResponseWriter, r *http.Request) {
+	rules := sc.store.Faults.Rules()
+	m := make(map[string]faultBody, len(rules))
+	for peer, rule := range rules {
+		m[peer] = newFaultBody(rule)
+	}
+	writeJSON(w, m)
+}
+
+// HandleSetFault replaces the rule of the peer, given by Raft address, by
+// member ID or as "*" for every peer without a rule of its own.
+func (sc *StorageController) HandleSetFault(w http.ResponseWriter, r *http.Request) {
+	var body faultBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rule := chaos.Rule{Drop: body.Drop, Partition: body.Partition, Bandwidth: body.Bandwidth}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{{"latency", body.Latency, &rule.Latency}, {"jitter", body.Jitter, &rule.Jitter}} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s '%s'", d.name, d.value), http.StatusBadRequest)
+			return
+		}
+		*d.dst = v
+	}
+
+	if err := sc.store.Faults.Set(sc.faultPeer(r), rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, newFaultBody(rule))
+}
+
+func (sc *StorageController) HandleClearFault(w http.ResponseWriter, r *http.Request) {
+	sc.store.Faults.Set(sc.faultPeer(r), chaos.Rule{})
+}
+
+func (sc *StorageController) HandleResetFaults(w http.ResponseWriter, r *http.Request) {
+	sc.store.Faults.Reset()
+}
+
+// faultPeer returns the Raft address of the peer named in the request.
+func (sc *StorageController) faultPeer(r *http.Request) string {
+	peer := mux.Vars(r)["peer"]
+	members, err := sc.store.Members()
+	if err != nil {
+		return peer
+	}
+	for _, m := range members {
+		if m.ID == peer {
+			return m.Address
+		}
+	}
+	return peer
+}
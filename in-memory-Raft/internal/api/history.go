@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"inmemoryraft/internal/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// progressInterval is how often a resumable watch reports the revision it
+// reached, so that a client can tell an idle stream from a lagging one.
+const progressInterval = time.Second
+
+func (sc *StorageController) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	versions, err := sc.store.History(mux.Vars(r)["key"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for i := range versions {
+		if versions[i].Type == services.TypeBinary {
+			versions[i].Value = base64.StdEncoding.EncodeToString([]byte(versions[i].Value))
+		}
+	}
+	writeJSON(w, versions)
+}
+
+// HandleCompact drops the history older than the revision in the body.
+func (sc *StorageController) HandleCompact(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Revision uint64 `json:"revision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Revision == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := sc.store.Compact(r.Context(), body.Revision); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) handleGetAt(w http.ResponseWriter, r *http.Request, key string) {
+	revision, ok := parseRevision(w, r)
+	if !ok {
+		return
+	}
+	val, typ, err := sc.store.GetAt(key, revision)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("X-Revision", strconv.FormatUint(revision, 10))
+	writeValue(w, r, key, val, typ)
+}
+
+func (sc *StorageController) handleListAt(w http.ResponseWriter, r *http.Request, prefix string) {
+	revision, ok := parseRevision(w, r)
+	if !ok {
+		return
+	}
+	versions, err := sc.store.ListAt(prefix, revision)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	kvs := make(map[string]string, len(versions))
+	for k, v := range versions {
+		if v.Type == services.TypeBinary {
+			kvs[k] = base64.StdEncoding.EncodeToString([]byte(v.Value))
+		} else {
+			kvs[k] = v.Value
+		}
+	}
+	w.Header().Set("X-Revision", strconv.FormatUint(revision, 10))
+	writeJSON(w, kvs)
+}
+
+func parseRevision(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	revision, err := strconv.ParseUint(r.URL.Query().Get("revision"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return 0, false
+	}
+	return revision, true
+}
+
+// handleWatchFrom streams the changes since the revision asked, replayed
+// from the history, then the new ones. When the history no longer holds
+// them, it answers 410 Gone with the first revision a watch can start from
+// in X-Compact-Revision.
+func (sc *StorageController) handleWatchFrom(w http.ResponseWriter, r *http.Request, flusher http.Flusher, prefix string) {
+	revision, ok := parseRevision(w, r)
+	if !ok {
+		return
+	}
+	replayed, events, cancel, err := sc.store.WatchFrom(prefix, revision)
+	if err != nil {
+		var compacted *services.CompactedError
+		if errors.As(err, &compacted) {
+			w.Header().Set("X-Compact-Revision", strconv.FormatUint(compacted.Revision, 10))
+		}
+		writeError(w, err)
+		return
+	}
+	defer cancel()
+	sc.streamChanges(w, r, flusher, replayed, events)
+}
+
+// handleWatchSnapshot streams the keys as put events, then a sync event
+// carrying the revision they were read at, then the changes after it.
+func (sc *StorageController) handleWatchSnapshot(w http.ResponseWriter, r *http.Request, flusher http.Flusher, prefix string) {
+	snapshot, revision, events, cancel := sc.store.WatchSnapshot(prefix)
+	defer cancel()
+	snapshot = append(snapshot, services.Event{Type: services.EventSync, Index: revision})
+	sc.streamChanges(w, r, flusher, snapshot, events)
+}
+
+// streamChanges is streamEvents starting with head and sending a progress
+// event every progressInterval.
+func (sc *StorageController) streamChanges(w http.ResponseWriter, r *http.Request, flusher http.Flusher, head []services.Event, events <-chan services.Event) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	for _, ev := range head {
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			// The FSM sends changes with its lock held, so the ones before the
+			// revision read here are all in the channel already; those of the
+			// command at the revision may still be on their way.
+			revision := sc.store.Revision()
+			if revision > 0 {
+				revision--
+			}
+			for pending := true; pending; {
+				select {
+				case ev, ok := <-events:
+					if !ok {
+						return
+					}
+					if err := enc.Encode(ev); err != nil {
+						return
+					}
+				default:
+					pending = false
+				}
+			}
+			if err := enc.Encode(services.Event{Type: services.EventProgress, Index: revision}); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
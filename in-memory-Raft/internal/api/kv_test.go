@@ -0,0 +1,35 @@
+package api_test
+
+import (
+	"testing"
+
+	"inmemoryraft/internal/testcluster"
+
+	"kv"
+	"kv/kvtest"
+)
+
+// newKV returns an adapter for every node of the cluster, the leader first
+// so that reads see the writes before them.
+func newKV(tb testing.TB, c *testcluster.Cluster) kv.KV {
+	leader := c.WaitForLeader()
+	addrs := []string{leader.HTTPAddr}
+	for _, n := range c.Nodes() {
+		if n != leader {
+			addrs = append(addrs, n.HTTPAddr)
+		}
+	}
+	store := kv.NewRaft(addrs...)
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestKVConformance(t *testing.T) {
+	c := testcluster.Start(t, testcluster.Config{Nodes: 3, HTTP: true})
+	kvtest.Run(t, newKV(t, c))
+}
+
+func BenchmarkKV(b *testing.B) {
+	c, _ := startCluster(b)
+	kvtest.Benchmark(b, newKV(b, c))
+}
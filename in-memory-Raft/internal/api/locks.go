@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"inmemoryraft/internal/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// lockBody is the body of lock and election requests. Durations use the
+// time.ParseDuration syntax, such as "10s".
+type lockBody struct {
+	Holder string `json:"holder"`
+	Value  string `json:"value"`
+	TTL    string `json:"ttl"`
+	Wait   string `json:"wait"`
+	Token  uint64 `json:"token"`
+}
+
+func readLockBody(w http.ResponseWriter, r *http.Request) (body lockBody, ttl, wait time.Duration, ok bool) {
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return body, 0, 0, false
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{{"ttl", body.TTL, &ttl}, {"wait", body.Wait, &wait}} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			http.Error(w, fmt.Sprintf("invalid %s '%s'", d.name, d.value), http.StatusBadRequest)
+			return body, 0, 0, false
+		}
+		*d.dst = v
+	}
+	return body, ttl, wait, true
+}
+
+func (sc *StorageController) HandleLocks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, sc.store.Locks())
+}
+
+func (sc *StorageController) HandleGetLock(w http.ResponseWriter, r *http.Request) {
+	l, err := sc.store.LockInfo(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, l)
+}
+
+// HandleAcquireLock takes the lock for the holder in the body. With "wait"
+// the request blocks until the lock is free or the wait is over.
+func (sc *StorageController) HandleAcquireLock(w http.ResponseWriter, r *http.Request) {
+	body, ttl, wait, ok := readLockBody(w, r)
+	if !ok {
+		return
+	}
+	req := services.LockRequest{Name: mux.Vars(r)["name"], Holder: body.Holder, Value: body.Value, TTL: ttl}
+	l, err := sc.store.AcquireLock(r.Context(), req, wait)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, l)
+}
+
+func (sc *StorageController) HandleRenewLock(w http.ResponseWriter, r *http.Request) {
+	body, ttl, _, ok := readLockBody(w, r)
+	if !ok {
+		return
+	}
+	l, err := sc.store.RenewLock(r.Context(), mux.Vars(r)["name"], body.Token, ttl)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, l)
+}
+
+func (sc *StorageController) HandleReleaseLock(w http.ResponseWriter, r *http.Request) {
+	token, ok := lockToken(w, r)
+	if !ok {
+		return
+	}
+	if err := sc.store.ReleaseLock(r.Context(), mux.Vars(r)["name"], token); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) HandleLeader(w http.ResponseWriter, r *http.Request) {
+	l, err := sc.store.Leader(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, l)
+}
+
+// HandleCampaign makes the holder in the body the leader of the election,
+// blocking up to "wait" while someone else leads.
+func (sc *StorageController) HandleCampaign(w http.ResponseWriter, r *http.Request) {
+	body, ttl, wait, ok := readLockBody(w, r)
+	if !ok {
+		return
+	}
+	req := services.LockRequest{Name: mux.Vars(r)["name"], Holder: body.Holder, Value: body.Value, TTL: ttl}
+	l, err := sc.store.Campaign(r.Context(), req, wait)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, l)
+}
+
+func (sc *StorageController) HandleRenewLeadership(w http.ResponseWriter, r *http.Request) {
+	body, ttl, _, ok := readLockBody(w, r)
+	if !ok {
+		return
+	}
+	l, err := sc.store.RenewLeadership(r.Context(), mux.Vars(r)["name"], body.Token, ttl)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, l)
+}
+
+func (sc *StorageController) HandleResign(w http.ResponseWriter, r *http.Request) {
+	token, ok := lockToken(w, r)
+	if !ok {
+		return
+	}
+	if err := sc.store.Resign(r.Context(), mux.Vars(r)["name"], token); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func lockToken(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	token, err := strconv.ParseUint(r.URL.Query().Get("token"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusBadRequest)
+		return 0, false
+	}
+	return token, true
+}
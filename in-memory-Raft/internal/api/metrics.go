@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+type throttleKey struct {
+	route string
+	class string
+}
+
+type metrics struct {
+	mutex     sync.Mutex
+	throttled map[throttleKey]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{throttled: make(map[throttleKey]uint64)}
+}
+
+func (m *metrics) throttle(route, class string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.throttled[throttleKey{route, class}]++
+}
+
+// HandleMetrics writes the counters in the Prometheus text format.
+func (sc *StorageController) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	sc.metrics.mutex.Lock()
+	keys := make([]throttleKey, 0, len(sc.metrics.throttled))
+	for k := range sc.metrics.throttled {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].class < keys[j].class
+	})
+	counts := make([]uint64, len(keys))
+	for i, k := range keys {
+		counts[i] = sc.metrics.throttled[k]
+	}
+	sc.metrics.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP kv_http_throttled_total Requests rejected by the per-client rate limiter.")
+	fmt.Fprintln(w, "# TYPE kv_http_throttled_total counter")
+	for i, k := range keys {
+		fmt.Fprintf(w, "kv_http_throttled_total{route=%q,class=%q} %d\n", k.route, k.class, counts[i])
+	}
+}
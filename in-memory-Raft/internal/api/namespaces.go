@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"inmemoryraft/internal/services"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// bearerToken returns the token of an "Authorization: Bearer" header, which
+// is checked against the ACL of a namespace.
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// checkNamespace writes the error response and returns false if the request
+// may not access the namespace.
+func (sc *StorageController) checkNamespace(w http.ResponseWriter, r *http.Request, write bool) bool {
+	if err := sc.store.CheckNamespace(mux.Vars(r)["namespace"], bearerToken(r), write); err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+func (sc *StorageController) HandleNamespaces(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, sc.store.Namespaces())
+}
+
+func (sc *StorageController) HandleGetNamespace(w http.ResponseWriter, r *http.Request) {
+	if !sc.checkNamespace(w, r, false) {
+		return
+	}
+	info, err := sc.store.NamespaceInfo(mux.Vars(r)["namespace"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, info)
+}
+
+func (sc *StorageController) HandlePutNamespace(w http.ResponseWriter, r *http.Request) {
+	var opts services.NamespaceOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if err := sc.store.PutNamespace(r.Context(), mux.Vars(r)["namespace"], bearerToken(r), opts); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) HandleDeleteNamespace(w http.ResponseWriter, r *http.Request) {
+	if err := sc.store.DeleteNamespace(r.Context(), mux.Vars(r)["namespace"], bearerToken(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) HandleNamespaceList(w http.ResponseWriter, r *http.Request) {
+	if !sc.checkNamespace(w, r, false) {
+		return
+	}
+	kv, err := sc.store.NamespaceList(mux.Vars(r)["namespace"], r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, kv)
+}
+
+func (sc *StorageController) HandleNamespaceGet(w http.ResponseWriter, r *http.Request) {
+	if !sc.checkNamespace(w, r, false) {
+		return
+	}
+	vars := mux.Vars(r)
+	val, err := sc.store.NamespaceGet(vars["namespace"], vars["key"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{vars["key"]: val})
+}
+
+func (sc *StorageController) HandleNamespacePut(w http.ResponseWriter, r *http.Request) {
+	if !sc.checkNamespace(w, r, true) {
+		return
+	}
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ns := mux.Vars(r)["namespace"]
+	for k, v := range m {
+		if k == "" || v == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := sc.store.NamespacePut(r.Context(), ns, k, v); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+}
+
+func (sc *StorageController) HandleNamespaceDelete(w http.ResponseWriter, r *http.Request) {
+	if !sc.checkNamespace(w, r, true) {
+		return
+	}
+	vars := mux.Vars(r)
+	if err := sc.store.NamespaceDelete(r.Context(), vars["namespace"], vars["key"]); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) HandleNamespaceWatch(w http.ResponseWriter, r *http.Request) {
+	if !sc.checkNamespace(w, r, false) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := sc.store.WatchNamespace(mux.Vars(r)["namespace"], r.URL.Query().Get("prefix"))
+	defer cancel()
+	streamEvents(w, r, flusher, events)
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"encoding/json"
+	"inmemoryraft/internal/services"
+	"net/http"
+)
+
+func (sc *StorageController) HandleQuotas(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, sc.store.Quotas())
+}
+
+// HandleSetQuotas replaces the cluster-wide and prefix quotas with the ones
+// in the body.
+func (sc *StorageController) HandleSetQuotas(w http.ResponseWriter, r *http.Request) {
+	var config services.QuotaConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := sc.store.SetQuotas(r.Context(), config); err != nil {
+		writeError(w, err)
+		return
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	classRead  = "read"
+	classWrite = "write"
+
+	limiterSweepInterval = time.Minute
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second and
+// holding at most Burst tokens. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits applies per client. A route listed in Routes, keyed as
+// "METHOD /path/{template}", uses its own bucket instead of the read or
+// write one.
+type RateLimits struct {
+	Read   RateLimit
+	Write  RateLimit
+	Routes map[string]RateLimit
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// take removes a token if one is available, and otherwise returns how long
+// until the next one.
+func (b *bucket) take(now time.Time) (bool, time.Duration) {
+	burst := b.limit.burst()
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= b.limit.burst()
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+type rateLimiter struct {
+	limits RateLimits
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (rl *rateLimiter) enabled() bool {
+	return rl.limits.Read.Rate > 0 || rl.limits.Write.Rate > 0 || len(rl.limits.Routes) > 0
+}
+
+// allow charges a request of client to route and class.
+func (rl *rateLimiter) allow(client, route, class string) (bool, time.Duration) {
+	limit, key := rl.limits.Read, classRead+" "+client
+	if class == classWrite {
+		limit, key = rl.limits.Write, classWrite+" "+client
+	}
+	if l, ok := rl.limits.Routes[route]; ok {
+		limit, key = l, route+" "+client
+	}
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.burst(), last: now, limit: limit}
+		rl.buckets[key] = b
+	}
+	return b.take(now)
+}
+
+// sweep forgets clients whose buckets refilled, so that idle clients do not
+// accumulate.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < limiterSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for key, b := range rl.buckets {
+		if b.full(now) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rateLimit is a middleware throttling every client per route class. Limited
+// requests get 429 with Retry-After and are counted in the metrics.
+func (sc *StorageController) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " " + routeTemplate(r)
+		class := classWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			class = classRead
+		}
+
+		ok, wait := sc.limiter.allow(clientIdentity(r, sc.store.KnownToken), route, class)
+		if !ok {
+			sc.metrics.throttle(route, class)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			return t
+		}
+	}
+	return r.URL.Path
+}
+
+// clientIdentity names the client a request is charged to: its verified
+// bearer token or, for any other client, its IP address.
+func clientIdentity(r *http.Request, known func(token string) bool) string {
+	if p := principal(r, known); p != "" {
+		return p
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(RateLimits{
+		Read:   RateLimit{Rate: 1, Burst: 2},
+		Routes: map[string]RateLimit{"GET /status": {}},
+	})
+	now := time.Unix(0, 0)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow("ip:a", "GET /keys/{key}", classRead); !ok {
+			t.Fatalf("request %d within burst was throttled", i)
+		}
+	}
+	ok, wait := rl.allow("ip:a", "GET /keys", classRead)
+	if ok || wait != time.Second {
+		t.Fatalf("expected throttling with 1s wait, got %v, %s", ok, wait)
+	}
+	if ok, _ := rl.allow("ip:b", "GET /keys", classRead); !ok {
+		t.Fatalf("another client must have its own bucket")
+	}
+	if ok, _ := rl.allow("ip:a", "POST /keys", classWrite); !ok {
+		t.Fatalf("writes without a limit must not be throttled")
+	}
+	if ok, _ := rl.allow("ip:a", "GET /status", classRead); !ok {
+		t.Fatalf("route with a zero rate must not be throttled")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := rl.allow("ip:a", "GET /keys", classRead); !ok {
+		t.Fatalf("expected a token after refilling")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	sc := &StorageController{metrics: newMetrics()}
+	sc.limiter = newRateLimiter(RateLimits{Write: RateLimit{Rate: 0.5, Burst: 1}})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+	r.HandleFunc("/metrics", sc.HandleMetrics).Methods("GET")
+	r.Use(sc.rateLimit)
+
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/keys", nil))
+		return w
+	}
+	if w := post(); w.Code != http.StatusOK {
+		t.Fatalf("expected first write to pass, got %d", w.Code)
+	}
+	w := post()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected 429 with Retry-After 2, got %d, %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `kv_http_throttled_total{route="POST /keys",class="write"} 1`) {
+		t.Fatalf("throttled request missing from metrics:\n%s", w.Body.String())
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	known := func(token string) bool { return token == "secret" }
+	identity := func(token string) string {
+		req := httptest.NewRequest("GET", "/keys", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return clientIdentity(req, known)
+	}
+
+	if id := identity("secret"); !strings.HasPrefix(id, "token:") {
+		t.Fatalf("verified token charged to %s", id)
+	}
+	// A client sending made-up tokens shares the bucket of its address.
+	for _, token := range []string{"", "random1", "random2"} {
+		if id := identity(token); id != "ip:10.0.0.1" {
+			t.Fatalf("token %q charged to %s, want ip:10.0.0.1", token, id)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"inmemoryraft/internal/services"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func (sc *StorageController) HandleSchemas(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, sc.store.Schemas())
+}
+
+func (sc *StorageController) HandleGetSchema(w http.ResponseWriter, r *http.Request) {
+	schema, err := sc.store.Schema(mux.Vars(r)["prefix"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(schema)
+}
+
+// HandlePutSchema registers the JSON Schema in the body for the prefix.
+func (sc *StorageController) HandlePutSchema(w http.ResponseWriter, r *http.Request) {
+	body, ok := sc.readBody(w, r)
+	if !ok {
+		return
+	}
+	if err := sc.store.PutSchema(r.Context(), mux.Vars(r)["prefix"], body); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) HandleDeleteSchema(w http.ResponseWriter, r *http.Request) {
+	if err := sc.store.DeleteSchema(r.Context(), mux.Vars(r)["prefix"]); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// writeSchemaViolation lists the validation errors as JSON, so that clients
+// can point at the offending fields.
+func writeSchemaViolation(w http.ResponseWriter, err *services.SchemaViolationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*services.SchemaViolationError
+	}{err.Error(), err})
+}
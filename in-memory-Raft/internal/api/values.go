@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"inmemoryraft/internal/services"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Media types accepted by PATCH /keys/{key}.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// HandleCompareAndSwap sets the key to "new" if it holds "old", answering
+// 409 Conflict otherwise.
+func (sc *StorageController) HandleCompareAndSwap(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Old *string `json:"old"`
+		New *string `json:"new"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Old == nil || body.New == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := sc.store.CompareAndSwap(r.Context(), mux.Vars(r)["key"], *body.Old, *body.New); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandlePutValue stores the request body under the key. A body sent as
+// application/json is stored as a JSON document, application/octet-stream as
+// raw bytes and anything else as a string.
+func (sc *StorageController) HandlePutValue(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	body, ok := sc.readBody(w, r)
+	if !ok {
+		return
+	}
+	var err error
+
+	switch mediaType(r) {
+	case "application/octet-stream":
+		err = sc.store.PutBinary(r.Context(), key, body)
+	case "application/json":
+		err = sc.store.PutJSON(r.Context(), key, body)
+	default:
+		if len(body) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = sc.store.Put(r.Context(), key, string(body))
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// HandlePatch applies a merge patch or a JSON Patch, depending on the
+// Content-Type, to the JSON document under the key.
+func (sc *StorageController) HandlePatch(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	body, ok := sc.readBody(w, r)
+	if !ok {
+		return
+	}
+	var err error
+
+	switch mediaType(r) {
+	case mergePatchType:
+		err = sc.store.MergePatch(r.Context(), key, body)
+	case jsonPatchType:
+		err = sc.store.JSONPatch(r.Context(), key, body)
+	default:
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (sc *StorageController) handleGetPath(w http.ResponseWriter, key, path string) {
+	value, err := sc.store.GetPath(key, path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(value)
+}
+
+// readBody reads the request body, refusing to read past the value size
+// limit of the store. On failure the error response is already written.
+func (sc *StorageController) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body := r.Body
+	if sc.store.MaxValueSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, int64(sc.store.MaxValueSize))
+	}
+	b, err := io.ReadAll(body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("%s: limit is %d bytes", services.ErrValueTooLarge, tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	return b, true
+}
+
+func mediaType(r *http.Request) string {
+	t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return t
+}
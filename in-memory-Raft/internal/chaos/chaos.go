@@ -0,0 +1,188 @@
+// Package chaos wraps the Raft stream layer to misbehave the network between
+// nodes: it delays, drops and throttles what a node sends to its peers, or
+// cuts it off, according to rules that can be changed at runtime.
+//
+// Rules apply to the connections a node dials, which carry the RPCs it sends
+// and the replies to them. Connections dialed by the peer are governed by the
+// rules of the peer, so cutting one side alone is a one-way partition: the
+// node can no longer reach the peer, while the peer still reaches the node.
+package chaos
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// AllPeers is the peer of the rule applied to peers without one of their
+// own.
+const AllPeers = "*"
+
+var (
+	ErrPartitioned = errors.New("chaos: peer is partitioned")
+	ErrDropped     = errors.New("chaos: message dropped")
+	ErrInvalidRule = errors.New("chaos: invalid rule")
+)
+
+// Rule is the misbehaviour of the link to one peer. The zero Rule leaves the
+// link alone.
+type Rule struct {
+	Latency   time.Duration // added to every dial and write
+	Jitter    time.Duration // random extra latency, up to this much
+	Drop      float64       // probability, from 0 to 1, that a dial or write is lost
+	Partition bool          // nothing gets through
+	Bandwidth int64         // bytes per second, 0 for no limit
+}
+
+func (r Rule) Validate() error {
+	if r.Latency < 0 || r.Jitter < 0 || r.Bandwidth < 0 || r.Drop < 0 || r.Drop > 1 {
+		return ErrInvalidRule
+	}
+	return nil
+}
+
+// Faults holds the rules of one node, keyed by the Raft address of the peer
+// or AllPeers. It is safe for concurrent use.
+type Faults struct {
+	mutex sync.Mutex
+	rules map[string]Rule
+	next  map[string]time.Time // when the link to a peer is free again, for Bandwidth
+	rand  *rand.Rand
+}
+
+func New() *Faults {
+	return &Faults{
+		rules: make(map[string]Rule),
+		next:  make(map[string]time.Time),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Set replaces the rule of peer. Setting the zero Rule clears it.
+func (f *Faults) Set(peer string, r Rule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r == (Rule{}) {
+		delete(f.rules, peer)
+	} else {
+		f.rules[peer] = r
+	}
+	return nil
+}
+
+// Rule returns the rule set for peer itself, without falling back to
+// AllPeers.
+func (f *Faults) Rule(peer string) Rule {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.rules[peer]
+}
+
+// Rules returns every rule set, keyed by peer.
+func (f *Faults) Rules() map[string]Rule {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rules := make(map[string]Rule, len(f.rules))
+	for peer, r := range f.rules {
+		rules[peer] = r
+	}
+	return rules
+}
+
+// Reset clears every rule.
+func (f *Faults) Reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rules = make(map[string]Rule)
+	f.next = make(map[string]time.Time)
+}
+
+// inject applies the rule of peer to sending it n bytes: it fails if the
+// message is lost, and otherwise sleeps for the latency and the time the
+// bandwidth limit takes to send n bytes.
+func (f *Faults) inject(peer string, n int) error {
+	f.mutex.Lock()
+	r, ok := f.rules[peer]
+	if !ok {
+		r = f.rules[AllPeers]
+	}
+	if r.Partition {
+		f.mutex.Unlock()
+		return ErrPartitioned
+	}
+	if r.Drop > 0 && f.rand.Float64() < r.Drop {
+		f.mutex.Unlock()
+		return ErrDropped
+	}
+	delay := r.Latency
+	if r.Jitter > 0 {
+		delay += time.Duration(f.rand.Int63n(int64(r.Jitter) + 1))
+	}
+	if r.Bandwidth > 0 && n > 0 {
+		now := time.Now()
+		start := f.next[peer]
+		if start.Before(now) {
+			start = now
+		}
+		done := start.Add(time.Duration(int64(n) * int64(time.Second) / r.Bandwidth))
+		f.next[peer] = done
+		delay += done.Sub(now)
+	}
+	f.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return nil
+}
+
+// StreamLayer injects the faults of a node into the connections it dials.
+// Accepted connections are passed through untouched.
+type StreamLayer struct {
+	raft.StreamLayer
+	faults *Faults
+}
+
+func NewStreamLayer(inner raft.StreamLayer, faults *Faults) *StreamLayer {
+	return &StreamLayer{StreamLayer: inner, faults: faults}
+}
+
+// Dial fails at once when the peer is partitioned or the dial is dropped,
+// rather than waiting for timeout, so that Raft backs off as it does on a
+// refused connection.
+func (l *StreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	peer := string(address)
+	if err := l.faults.inject(peer, 0); err != nil {
+		return nil, err
+	}
+	conn, err := l.StreamLayer.Dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyConn{Conn: conn, peer: peer, faults: l.faults}, nil
+}
+
+// faultyConn checks the rule of its peer on every write, so that new rules take
+// effect on connections already open. Raft flushes one message per write,
+// give or take buffering. A lost write closes the connection, which is how
+// a stream transport sees lost packets: the RPC fails and Raft dials again.
+type faultyConn struct {
+	net.Conn
+	peer   string
+	faults *Faults
+}
+
+func (c *faultyConn) Write(b []byte) (int, error) {
+	if err := c.faults.inject(c.peer, len(b)); err != nil {
+		c.Conn.Close()
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
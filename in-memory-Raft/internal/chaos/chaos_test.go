@@ -0,0 +1,144 @@
+package chaos
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type tcpLayer struct {
+	net.Listener
+}
+
+func (l tcpLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", string(address), timeout)
+}
+
+// startPeer listens on an ephemeral port and discards everything it reads.
+func startPeer(t *testing.T) raft.ServerAddress {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	return raft.ServerAddress(ln.Addr().String())
+}
+
+func newLayer(t *testing.T) (*StreamLayer, *Faults) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	faults := New()
+	return NewStreamLayer(tcpLayer{ln}, faults), faults
+}
+
+func TestPartition(t *testing.T) {
+	peer := startPeer(t)
+	other := startPeer(t)
+	layer, faults := newLayer(t)
+
+	conn, err := layer.Dial(peer, time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	if _, err := conn.Write([]byte("before")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	faults.Set(string(peer), Rule{Partition: true})
+	if _, err := conn.Write([]byte("after")); !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("expected an open connection to be cut, got %v", err)
+	}
+	if _, err := layer.Dial(peer, time.Second); !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("expected the dial to fail, got %v", err)
+	}
+	if conn, err := layer.Dial(other, time.Second); err != nil {
+		t.Fatalf("expected other peers to be reachable, got %v", err)
+	} else {
+		conn.Close()
+	}
+
+	faults.Set(string(peer), Rule{})
+	if conn, err := layer.Dial(peer, time.Second); err != nil {
+		t.Fatalf("expected the peer to be reachable after clearing the rule, got %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestAllPeers(t *testing.T) {
+	peer := startPeer(t)
+	layer, faults := newLayer(t)
+
+	faults.Set(AllPeers, Rule{Drop: 1})
+	if _, err := layer.Dial(peer, time.Second); !errors.Is(err, ErrDropped) {
+		t.Fatalf("expected every dial to be dropped, got %v", err)
+	}
+	faults.Set(string(peer), Rule{Latency: time.Millisecond})
+	if conn, err := layer.Dial(peer, time.Second); err != nil {
+		t.Fatalf("expected the rule of the peer to override the default, got %v", err)
+	} else {
+		conn.Close()
+	}
+
+	faults.Reset()
+	if len(faults.Rules()) != 0 {
+		t.Fatalf("expected no rules after reset, got %v", faults.Rules())
+	}
+}
+
+func TestLatencyAndBandwidth(t *testing.T) {
+	peer := startPeer(t)
+	layer, faults := newLayer(t)
+
+	conn, err := layer.Dial(peer, time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer conn.Close()
+
+	faults.Set(string(peer), Rule{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	conn.Write([]byte("x"))
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("expected a write to take 50ms, took %s", d)
+	}
+
+	// 20 KB at 100 KB/s take 200ms however they are split.
+	faults.Set(string(peer), Rule{Bandwidth: 100 << 10})
+	start = time.Now()
+	for i := 0; i < 20; i++ {
+		if _, err := conn.Write(make([]byte, 1<<10)); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Fatalf("expected the writes to take 200ms, took %s", d)
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	faults := New()
+	for _, r := range []Rule{{Drop: 1.5}, {Latency: -time.Second}, {Bandwidth: -1}} {
+		if err := faults.Set("peer", r); !errors.Is(err, ErrInvalidRule) {
+			t.Fatalf("expected %+v to be refused, got %v", r, err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"inmemoryraft/internal/services"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 10 * time.Second
+
+var ErrNotFound = errors.New("key not found")
+
+// ErrUnsupported is returned by operations the standalone server has no
+// route for.
+var ErrUnsupported = errors.New("operation not supported by standalone server")
+
+// Client talks to one or more HTTP endpoints of the store. Reads are served by
+// the first endpoint that answers, writes by the first endpoint that is the
+// leader.
+type Client struct {
+	Endpoints  []string
+	Standalone bool
+
+	httpClient *http.Client
+}
+
+func New(endpoints []string) *Client {
+	return &Client{
+		Endpoints:  endpoints,
+		httpClient: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// NewStandalone returns a client for the in-memory server without Raft.
+func NewStandalone(endpoints []string) *Client {
+	c := New(endpoints)
+	c.Standalone = true
+	return c
+}
+
+func (c *Client) Get(key string) (string, error) {
+	if c.Standalone {
+		resp, err := c.read("GET", "/get?key="+url.QueryEscape(key), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		// The standalone server answers with "Value for key 'k': 'v'".
+		prefix := "Value for key '" + key + "': '"
+		return strings.TrimSuffix(strings.TrimPrefix(string(b), prefix), "'"), nil
+	}
+
+	resp, err := c.read("GET", "/keys/"+url.PathEscape(key), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") == "application/octet-stream" {
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+	m := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return "", err
+	}
+	return m[key], nil
+}
+
+func (c *Client) Put(key, value string) error {
+	if c.Standalone {
+		b, _ := json.Marshal(map[string]string{"key": key, "value": value})
+		return c.write("POST", "/put", b)
+	}
+	b, _ := json.Marshal(map[string]string{key: value})
+	return c.write("POST", "/keys", b)
+}
+
+// PutValue writes value under key with its type: services.TypeString,
+// TypeJSON or TypeBinary.
+func (c *Client) PutValue(key string, value []byte, typ string) error {
+	switch {
+	case c.Standalone || typ == services.TypeString || typ == "":
+		return c.Put(key, string(value))
+	case typ == services.TypeBinary:
+		return c.writeAs("PUT", "/keys/"+url.PathEscape(key), "application/octet-stream", value)
+	default:
+		return c.writeAs("PUT", "/keys/"+url.PathEscape(key), "application/json", value)
+	}
+}
+
+func (c *Client) Delete(key string) error {
+	if c.Standalone {
+		return c.write("DELETE", "/delete?key="+url.QueryEscape(key), nil)
+	}
+	return c.write("DELETE", "/keys/"+url.PathEscape(key), nil)
+}
+
+func (c *Client) List(prefix string) (map[string]string, error) {
+	path := "/keys?prefix="
+	if c.Standalone {
+		path = "/list?prefix="
+	}
+	m := map[string]string{}
+	if err := c.readJSON(path+url.QueryEscape(prefix), &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Watch streams changes under prefix to fn until ctx is cancelled or the
+// server closes the stream.
+func (c *Client) Watch(ctx context.Context, prefix string, fn func(services.Event)) error {
+	if c.Standalone {
+		return ErrUnsupported
+	}
+
+	var lastErr error
+	for _, endpoint := range c.Endpoints {
+		req, err := http.NewRequestWithContext(ctx, "GET", endpointURL(endpoint, "/watch?prefix="+url.QueryEscape(prefix)), nil)
+		if err != nil {
+			return err
+		}
+		// Watches are long-lived, so the default client timeout does not apply.
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return statusError(resp)
+		}
+
+		// Values can be larger than a bufio.Scanner line.
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev services.Event
+			if err := dec.Decode(&ev); err != nil {
+				if err == io.EOF || ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			fn(ev)
+		}
+	}
+	return lastErr
+}
+
+// Changes streams the changes under prefix to fn from revision on, or
+// starting with the keys as put events followed by a services.EventSync event
+// when revision is zero. Progress events tell the revision the stream has
+// reached. Changes returns the error of fn, which stops the stream, or a
+// *services.CompactedError when the changes since revision were compacted.
+func (c *Client) Changes(ctx context.Context, prefix string, revision uint64, fn func(services.Event) error) error {
+	if c.Standalone {
+		return ErrUnsupported
+	}
+
+	query := url.Values{"prefix": {prefix}}
+	if revision == 0 {
+		query.Set("snapshot", "true")
+	} else {
+		query.Set("revision", strconv.FormatUint(revision, 10))
+	}
+	var lastErr error
+	for _, endpoint := range c.Endpoints {
+		req, err := http.NewRequestWithContext(ctx, "GET", endpointURL(endpoint, "/watch?"+query.Encode()), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			compacted, _ := strconv.ParseUint(resp.Header.Get("X-Compact-Revision"), 10, 64)
+			return &services.CompactedError{Revision: compacted}
+		}
+		if resp.StatusCode != http.StatusOK {
+			return statusError(resp)
+		}
+
+		// Values can be larger than a bufio.Scanner line.
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev services.Event
+			if err := dec.Decode(&ev); err != nil {
+				if err == io.EOF || ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+	}
+	return lastErr
+}
+
+func (c *Client) Members() ([]services.Member, error) {
+	if c.Standalone {
+		return nil, ErrUnsupported
+	}
+	var members []services.Member
+	if err := c.readJSON("/members", &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (c *Client) RemoveMember(id string) error {
+	if c.Standalone {
+		return ErrUnsupported
+	}
+	return c.write("DELETE", "/members/"+url.PathEscape(id), nil)
+}
+
+// TransferLeader moves leadership to id, or to any suitable follower when id
+// is empty.
+func (c *Client) TransferLeader(id string) error {
+	if c.Standalone {
+		return ErrUnsupported
+	}
+	var body []byte
+	if id != "" {
+		body, _ = json.Marshal(map[string]string{"id": id})
+	}
+	return c.write("POST", "/leader/transfer", body)
+}
+
+// SaveSnapshot writes the full keyspace as JSON to w.
+func (c *Client) SaveSnapshot(w io.Writer) error {
+	if c.Standalone {
+		return ErrUnsupported
+	}
+	resp, err := c.read("GET", "/snapshot?raft=true", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// RestoreSnapshot replaces the keyspace with the JSON read from r.
+func (c *Client) RestoreSnapshot(r io.Reader) error {
+	if c.Standalone {
+		return ErrUnsupported
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.write("PUT", "/snapshot", b)
+}
+
+// ClusterID returns the ID the cluster got when it was bootstrapped.
+func (c *Client) ClusterID() (string, error) {
+	if c.Standalone {
+		return "", ErrUnsupported
+	}
+	m := map[string]interface{}{}
+	if err := c.readJSON("/cluster", &m); err != nil {
+		return "", err
+	}
+	id, _ := m["cluster_id"].(string)
+	return id, nil
+}
+
+// Status queries every endpoint and returns the status of those that answer.
+func (c *Client) Status() (map[string]services.Status, error) {
+	if c.Standalone {
+		return nil, ErrUnsupported
+	}
+	result := make(map[string]services.Status)
+	var lastErr error
+	for _, endpoint := range c.Endpoints {
+		var st services.Status
+		if err := c.doJSON(endpoint, "/status", &st); err != nil {
+			lastErr = err
+			continue
+		}
+		result[endpoint] = st
+	}
+	if len(result) == 0 {
+		return nil, lastErr
+	}
+	return result, nil
+}
+
+func (c *Client) readJSON(path string, v interface{}) error {
+	resp, err := c.read("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) doJSON(endpoint, path string, v interface{}) error {
+	resp, err := c.do(endpoint, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// read returns the first successful response. A 404 from the standalone
+// server is reported as ErrNotFound.
+func (c *Client) read(method, path string, body []byte) (*http.Response, error) {
+	return c.readAs(method, path, "application/json", body)
+}
+
+// readAs moves on to the next endpoint when one cannot be reached or is not
+// the leader, and for reads also when one fails. Any other answer to a write
+// is returned as is: the write may have committed, so sending it again could
+// apply it twice.
+func (c *Client) readAs(method, path, contentType string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for _, endpoint := range c.Endpoints {
+		resp, err := c.doAs(endpoint, method, path, contentType, body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case resp.StatusCode == http.StatusNotFound:
+			resp.Body.Close()
+			return nil, ErrNotFound
+		}
+		err = statusError(resp)
+		resp.Body.Close()
+		if !retryElsewhere(method, resp.StatusCode) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no endpoints configured")
+	}
+	return nil, lastErr
+}
+
+// retryElsewhere tells whether a request answered with status may be sent
+// to another endpoint.
+func retryElsewhere(method string, status int) bool {
+	if status == http.StatusMisdirectedRequest {
+		return true // not the leader
+	}
+	return method == http.MethodGet && status >= 500
+}
+
+func (c *Client) write(method, path string, body []byte) error {
+	return c.writeAs(method, path, "application/json", body)
+}
+
+func (c *Client) writeAs(method, path, contentType string, body []byte) error {
+	resp, err := c.readAs(method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *Client) do(endpoint, method, path string, body []byte) (*http.Response, error) {
+	return c.doAs(endpoint, method, path, "application/json", body)
+}
+
+func (c *Client) doAs(endpoint, method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, endpointURL(endpoint, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.httpClient.Do(req)
+}
+
+func endpointURL(endpoint, path string) string {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "http://" + endpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + path
+}
+
+func statusError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(b))
+	if msg == "" {
+		return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	}
+	return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, msg)
+}
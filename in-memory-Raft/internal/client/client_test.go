@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"inmemoryraft/internal/services"
+	"inmemoryraft/internal/testcluster"
+)
+
+func TestWriteFallsBackToLeader(t *testing.T) {
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not leader", http.StatusMisdirectedRequest)
+	}))
+	defer follower.Close()
+
+	var got map[string]string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/keys" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer leader.Close()
+
+	c := New([]string{follower.URL, leader.URL})
+	if err := c.Put("testKey", "testValue"); err != nil {
+		t.Fatalf("failed to put key: %s", err)
+	}
+	if got["testKey"] != "testValue" {
+		t.Fatalf("leader received wrong body: %v", got)
+	}
+}
+
+// TestMembershipFallsBackToLeader runs the cluster commands against a list
+// of endpoints starting with the followers.
+func TestMembershipFallsBackToLeader(t *testing.T) {
+	cluster := testcluster.Start(t, testcluster.Config{Nodes: 3, HTTP: true})
+	leader := cluster.WaitForLeader()
+	var endpoints []string
+	var followers []*testcluster.Node
+	for _, n := range cluster.Nodes() {
+		if n != leader {
+			endpoints = append(endpoints, n.HTTPAddr)
+			followers = append(followers, n)
+		}
+	}
+	c := New(append(endpoints, leader.HTTPAddr))
+
+	if err := c.RemoveMember(followers[1].ID); err != nil {
+		t.Fatalf("failed to remove member: %s", err)
+	}
+	members, err := leader.Store.Members()
+	if err != nil || len(members) != 2 {
+		t.Fatalf("expected 2 members left, got %v, %v", members, err)
+	}
+
+	if err := c.TransferLeader(followers[0].ID); err != nil {
+		t.Fatalf("failed to transfer leadership: %s", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for cluster.Leader() != followers[0] {
+		if time.Now().After(deadline) {
+			t.Fatalf("leadership did not move to %s", followers[0].ID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestWriteNotRepeated checks that a write the first endpoint answered is
+// not sent to the next one, since it may have committed.
+func TestWriteNotRepeated(t *testing.T) {
+	var attempts int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		if r.Method == "GET" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "timed out", http.StatusInternalServerError)
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	c := New([]string{first.URL, second.URL})
+	if err := c.Put("k", "v"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected the error of the first endpoint, got %v", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Fatalf("write sent %d times", n)
+	}
+	// Reads are safe to repeat.
+	if _, err := c.Get("k"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatalf("read sent %d times", n-1)
+	}
+}
+
+func TestWatchLargeValue(t *testing.T) {
+	value := strings.Repeat("x", 1<<20)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(services.Event{Type: services.EventPut, Key: "k", Value: value})
+	}))
+	defer srv.Close()
+
+	var got []services.Event
+	err := New([]string{srv.URL}).Watch(context.Background(), "", func(ev services.Event) {
+		got = append(got, ev)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Value != value {
+		t.Fatalf("got %d events", len(got))
+	}
+}
+
+func TestStandaloneGet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list" {
+			json.NewEncoder(w).Encode(map[string]string{"testKey": "testValue"})
+			return
+		}
+		if r.URL.Path != "/get" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("key") != "testKey" {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("Value for key 'testKey': 'testValue'"))
+	}))
+	defer srv.Close()
+
+	c := NewStandalone([]string{srv.URL})
+	val, err := c.Get("testKey")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+	if val != "testValue" {
+		t.Fatalf("key has wrong value: %s", val)
+	}
+
+	if _, err := c.Get("missing"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if m, err := c.List("test"); err != nil || m["testKey"] != "testValue" {
+		t.Fatalf("expected testKey to be listed, got %v, %v", m, err)
+	}
+	if err := c.Watch(context.Background(), "", nil); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/watch" || q.Get("prefix") != "app." {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if q.Get("snapshot") != "true" {
+			w.Header().Set("X-Compact-Revision", "9")
+			http.Error(w, "compacted", http.StatusGone)
+			return
+		}
+		enc := json.NewEncoder(w)
+		enc.Encode(services.Event{Type: services.EventPut, Key: "app.a", Value: "1", Index: 7})
+		enc.Encode(services.Event{Type: services.EventSync, Index: 7})
+		enc.Encode(services.Event{Type: services.EventDelete, Key: "app.a", Index: 8})
+	}))
+	defer srv.Close()
+	c := New([]string{srv.URL})
+
+	var types []string
+	err := c.Changes(context.Background(), "app.", 0, func(ev services.Event) error {
+		types = append(types, ev.Type)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 3 || types[0] != "put" || types[1] != "sync" || types[2] != "delete" {
+		t.Fatalf("got events %v", types)
+	}
+
+	stop := errors.New("stop")
+	if err := c.Changes(context.Background(), "app.", 0, func(services.Event) error { return stop }); err != stop {
+		t.Fatalf("error of fn: got %v", err)
+	}
+
+	var compacted *services.CompactedError
+	err = c.Changes(context.Background(), "app.", 3, func(services.Event) error { return nil })
+	if !errors.As(err, &compacted) || compacted.Revision != 9 {
+		t.Fatalf("resuming before the compaction: got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+// Package config loads the settings of the Raft node from a YAML or JSON
+// file, environment variables and command-line flags, in increasing order of
+// precedence.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"common/configload"
+
+	"github.com/hashicorp/raft"
+)
+
+const EnvConfig = "RAFT_CONFIG"
+
+type Config struct {
+	NodeID          string        `yaml:"node_id" env:"RAFT_NODE_ID" flag:"id"`
+	HTTPAddr        string        `yaml:"http_addr" env:"RAFT_HTTP_ADDR" flag:"haddr"`
+	RESPAddr        string        `yaml:"resp_addr" env:"RAFT_RESP_ADDR" flag:"resp-addr"`
+	EtcdAddr        string        `yaml:"etcd_addr" env:"RAFT_ETCD_ADDR" flag:"etcd-addr"`
+	RaftAddr        string        `yaml:"raft_addr" env:"RAFT_BIND_ADDR" flag:"raddr"`
+	DataDir         string        `yaml:"data_dir" env:"RAFT_DATA_DIR" flag:"data-dir"`
+	TransactionLog  string        `yaml:"transaction_log" env:"RAFT_TRANSACTION_LOG" flag:"transaction-log"`
+	Join            string        `yaml:"join" env:"RAFT_JOIN" flag:"join"`
+	JoinToken       string        `yaml:"join_token" env:"RAFT_JOIN_TOKEN" flag:"join-token"`
+	ClusterID       string        `yaml:"cluster_id" env:"RAFT_CLUSTER_ID" flag:"cluster-id"`
+	Peers           string        `yaml:"peers" env:"RAFT_PEERS" flag:"peers"`
+	BootstrapExpect int           `yaml:"bootstrap_expect" env:"RAFT_BOOTSTRAP_EXPECT" flag:"bootstrap-expect"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"RAFT_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout"`
+	SnapshotOnExit  bool          `yaml:"snapshot_on_exit" env:"RAFT_SNAPSHOT_ON_EXIT" flag:"snapshot-on-exit"`
+	AuditLogSize    int           `yaml:"audit_log_size" env:"RAFT_AUDIT_LOG_SIZE" flag:"audit-log-size"`
+	HistorySize     int           `yaml:"history_size" env:"RAFT_HISTORY_SIZE" flag:"history-size"`
+	EncryptionKey   string        `yaml:"encryption_key_file" env:"RAFT_ENCRYPTION_KEY_FILE" flag:"encryption-key-file"`
+	DebugFaults     bool          `yaml:"debug_faults" env:"RAFT_DEBUG_FAULTS" flag:"debug-faults"`
+
+	Raft       Raft       `yaml:"raft"`
+	Limits     Limits     `yaml:"limits"`
+	RateLimits RateLimits `yaml:"rate_limits"`
+}
+
+// Raft holds the consensus tuning knobs. Zero values keep the defaults of
+// raft.DefaultConfig().
+type Raft struct {
+	HeartbeatTimeout   time.Duration `yaml:"heartbeat_timeout" env:"RAFT_HEARTBEAT_TIMEOUT" flag:"raft-heartbeat-timeout"`
+	ElectionTimeout    time.Duration `yaml:"election_timeout" env:"RAFT_ELECTION_TIMEOUT" flag:"raft-election-timeout"`
+	LeaderLeaseTimeout time.Duration `yaml:"leader_lease_timeout" env:"RAFT_LEADER_LEASE_TIMEOUT" flag:"raft-leader-lease-timeout"`
+	CommitTimeout      time.Duration `yaml:"commit_timeout" env:"RAFT_COMMIT_TIMEOUT" flag:"raft-commit-timeout"`
+	SnapshotThreshold  uint64        `yaml:"snapshot_threshold" env:"RAFT_SNAPSHOT_THRESHOLD" flag:"raft-snapshot-threshold"`
+	SnapshotInterval   time.Duration `yaml:"snapshot_interval" env:"RAFT_SNAPSHOT_INTERVAL" flag:"raft-snapshot-interval"`
+	TrailingLogs       uint64        `yaml:"trailing_logs" env:"RAFT_TRAILING_LOGS" flag:"raft-trailing-logs"`
+	RetainSnapshots    int           `yaml:"retain_snapshots" env:"RAFT_RETAIN_SNAPSHOTS" flag:"raft-retain-snapshots"`
+	ApplyTimeout       time.Duration `yaml:"apply_timeout" env:"RAFT_APPLY_TIMEOUT" flag:"raft-apply-timeout"`
+}
+
+// Limits protects the node from oversized or too many writes. Zero disables
+// a limit.
+type Limits struct {
+	MaxKeySize   int `yaml:"max_key_size" env:"RAFT_MAX_KEY_SIZE" flag:"max-key-size"`
+	MaxValueSize int `yaml:"max_value_size" env:"RAFT_MAX_VALUE_SIZE" flag:"max-value-size"`
+
+	// MaxPendingApplies is how many writes may wait for Raft at once. Writes
+	// beyond it are refused with 503 instead of queueing.
+	MaxPendingApplies int `yaml:"max_pending_applies" env:"RAFT_MAX_PENDING_APPLIES" flag:"max-pending-applies"`
+}
+
+// RateLimits throttles every client of the HTTP API, identified by its
+// verified bearer token or IP address. Rates are requests per second; zero
+// disables a limit.
+type RateLimits struct {
+	ReadRate   float64 `yaml:"read_rate" env:"RAFT_RATE_LIMIT_READ" flag:"rate-limit-read"`
+	ReadBurst  int     `yaml:"read_burst" env:"RAFT_RATE_LIMIT_READ_BURST" flag:"rate-limit-read-burst"`
+	WriteRate  float64 `yaml:"write_rate" env:"RAFT_RATE_LIMIT_WRITE" flag:"rate-limit-write"`
+	WriteBurst int     `yaml:"write_burst" env:"RAFT_RATE_LIMIT_WRITE_BURST" flag:"rate-limit-write-burst"`
+
+	// Routes overrides the read or write limit of single routes, keyed as
+	// "METHOD /path/{template}", e.g. "PUT /keys/{key}".
+	Routes map[string]RouteLimit `yaml:"routes"`
+}
+
+type RouteLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func Default() *Config {
+	return &Config{
+		HTTPAddr:        "localhost:8000",
+		RaftAddr:        "localhost:7000",
+		DataDir:         "internal/data/snapshots",
+		TransactionLog:  "internal/data/transaction_log.json",
+		ShutdownTimeout: 10 * time.Second,
+		AuditLogSize:    1024,
+		HistorySize:     16,
+		Raft: Raft{
+			RetainSnapshots: 2,
+			ApplyTimeout:    10 * time.Second,
+		},
+		Limits: Limits{
+			MaxKeySize:   4096,
+			MaxValueSize: 1 << 20,
+
+			MaxPendingApplies: 1024,
+		},
+	}
+}
+
+// RegisterFlags binds the command-line flags to the fields of c.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.NodeID, "id", c.NodeID, "Node ID. If not set, same as Raft bind address")
+	fs.StringVar(&c.HTTPAddr, "haddr", c.HTTPAddr, "Set the HTTP bind address")
+	fs.StringVar(&c.RaftAddr, "raddr", c.RaftAddr, "Set Raft bind address")
+	fs.StringVar(&c.RESPAddr, "resp-addr", c.RESPAddr, "Serve the Redis protocol on this address, if set")
+	fs.StringVar(&c.EtcdAddr, "etcd-addr", c.EtcdAddr, "Serve the etcd v3 API on this address, if set")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "Directory holding the Raft data of every node")
+	fs.StringVar(&c.TransactionLog, "transaction-log", c.TransactionLog, "File used to save and load the transaction log")
+	fs.StringVar(&c.Join, "join", c.Join, "Comma-separated HTTP addresses of cluster nodes to join, if any")
+	fs.StringVar(&c.JoinToken, "join-token", c.JoinToken, "Shared secret required to join the cluster")
+	fs.StringVar(&c.ClusterID, "cluster-id", c.ClusterID, "Expected cluster ID when joining, if any")
+	fs.StringVar(&c.Peers, "peers", c.Peers, "Static list of initial cluster nodes as id=raft-addr,id=raft-addr,...")
+	fs.IntVar(&c.BootstrapExpect, "bootstrap-expect", c.BootstrapExpect, "Number of nodes listed in -peers that form the initial cluster")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "Time allowed for draining HTTP requests on shutdown")
+	fs.BoolVar(&c.SnapshotOnExit, "snapshot-on-exit", c.SnapshotOnExit, "Take a Raft snapshot before shutting down")
+	fs.IntVar(&c.AuditLogSize, "audit-log-size", c.AuditLogSize, "Number of audit records kept (0 keeps all of them)")
+	fs.IntVar(&c.HistorySize, "history-size", c.HistorySize, "Number of versions kept per key (0 keeps all of them)")
+	fs.StringVar(&c.EncryptionKey, "encryption-key-file", c.EncryptionKey, "File with the keys encrypting snapshots and the transaction log, if any")
+	fs.BoolVar(&c.DebugFaults, "debug-faults", c.DebugFaults, "Serve /debug/faults to inject network faults between nodes (for chaos testing only)")
+
+	fs.DurationVar(&c.Raft.HeartbeatTimeout, "raft-heartbeat-timeout", c.Raft.HeartbeatTimeout, "Raft heartbeat timeout (0 keeps the default)")
+	fs.DurationVar(&c.Raft.ElectionTimeout, "raft-election-timeout", c.Raft.ElectionTimeout, "Raft election timeout (0 keeps the default)")
+	fs.DurationVar(&c.Raft.LeaderLeaseTimeout, "raft-leader-lease-timeout", c.Raft.LeaderLeaseTimeout, "Raft leader lease timeout (0 keeps the default)")
+	fs.DurationVar(&c.Raft.CommitTimeout, "raft-commit-timeout", c.Raft.CommitTimeout, "Raft commit timeout (0 keeps the default)")
+	fs.Uint64Var(&c.Raft.SnapshotThreshold, "raft-snapshot-threshold", c.Raft.SnapshotThreshold, "Log entries between Raft snapshots (0 keeps the default)")
+	fs.DurationVar(&c.Raft.SnapshotInterval, "raft-snapshot-interval", c.Raft.SnapshotInterval, "How often Raft checks whether to snapshot (0 keeps the default)")
+	fs.Uint64Var(&c.Raft.TrailingLogs, "raft-trailing-logs", c.Raft.TrailingLogs, "Log entries kept after a snapshot (0 keeps the default)")
+	fs.IntVar(&c.Raft.RetainSnapshots, "raft-retain-snapshots", c.Raft.RetainSnapshots, "Number of Raft snapshots kept on disk")
+	fs.DurationVar(&c.Raft.ApplyTimeout, "raft-apply-timeout", c.Raft.ApplyTimeout, "Time allowed for a command to be committed")
+
+	fs.IntVar(&c.Limits.MaxKeySize, "max-key-size", c.Limits.MaxKeySize, "Maximum key size in bytes (0 disables the limit)")
+	fs.IntVar(&c.Limits.MaxValueSize, "max-value-size", c.Limits.MaxValueSize, "Maximum value size in bytes (0 disables the limit)")
+	fs.Float64Var(&c.RateLimits.ReadRate, "rate-limit-read", c.RateLimits.ReadRate, "Reads per second allowed to each client (0 disables the limit)")
+	fs.IntVar(&c.RateLimits.ReadBurst, "rate-limit-read-burst", c.RateLimits.ReadBurst, "Burst of reads allowed to each client")
+	fs.Float64Var(&c.RateLimits.WriteRate, "rate-limit-write", c.RateLimits.WriteRate, "Writes per second allowed to each client (0 disables the limit)")
+	fs.IntVar(&c.RateLimits.WriteBurst, "rate-limit-write-burst", c.RateLimits.WriteBurst, "Burst of writes allowed to each client")
+	fs.IntVar(&c.Limits.MaxPendingApplies, "max-pending-applies", c.Limits.MaxPendingApplies, "Writes allowed to wait for Raft at once (0 disables the limit)")
+}
+
+// Load builds the configuration from defaults, the file named by -config (or
+// RAFT_CONFIG), the environment and the flags explicitly set in args.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	fromFlags := Default()
+	fromFlags.RegisterFlags(fs)
+	path := fs.String("config", os.Getenv(EnvConfig), "YAML or JSON configuration file (env "+EnvConfig+")")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if err := configload.Apply(cfg, fromFlags, *path, fs); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("http_addr: %w", err))
+	}
+	if _, _, err := net.SplitHostPort(c.RaftAddr); err != nil {
+		errs = append(errs, fmt.Errorf("raft_addr: %w", err))
+	}
+	if c.RESPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.RESPAddr); err != nil {
+			errs = append(errs, fmt.Errorf("resp_addr: %w", err))
+		}
+	}
+	if c.EtcdAddr != "" {
+		if _, _, err := net.SplitHostPort(c.EtcdAddr); err != nil {
+			errs = append(errs, fmt.Errorf("etcd_addr: %w", err))
+		}
+	}
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("data_dir must not be empty"))
+	}
+	if c.BootstrapExpect < 0 {
+		errs = append(errs, errors.New("bootstrap_expect must not be negative"))
+	}
+	if c.AuditLogSize < 0 {
+		errs = append(errs, errors.New("audit_log_size must not be negative"))
+	}
+	if c.HistorySize < 0 {
+		errs = append(errs, errors.New("history_size must not be negative"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if c.Raft.RetainSnapshots < 1 {
+		errs = append(errs, errors.New("raft.retain_snapshots must be at least 1"))
+	}
+	if c.Raft.ApplyTimeout <= 0 {
+		errs = append(errs, errors.New("raft.apply_timeout must be positive"))
+	}
+	if c.Limits.MaxKeySize < 0 || c.Limits.MaxValueSize < 0 || c.Limits.MaxPendingApplies < 0 {
+		errs = append(errs, errors.New("limits must not be negative"))
+	}
+	if c.RateLimits.ReadRate < 0 || c.RateLimits.WriteRate < 0 || c.RateLimits.ReadBurst < 0 || c.RateLimits.WriteBurst < 0 {
+		errs = append(errs, errors.New("rate_limits must not be negative"))
+	}
+	for route, l := range c.RateLimits.Routes {
+		if method, path, ok := strings.Cut(route, " "); !ok || method == "" || !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("rate_limits.routes: '%s' is not \"METHOD /path\"", route))
+		}
+		if l.Rate < 0 || l.Burst < 0 {
+			errs = append(errs, fmt.Errorf("rate_limits.routes: '%s' must not be negative", route))
+		}
+	}
+
+	rc := c.Raft.RaftConfig("validate")
+	if err := raft.ValidateConfig(rc); err != nil {
+		errs = append(errs, fmt.Errorf("raft: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// RaftConfig returns raft.DefaultConfig() with the configured tuning applied.
+func (r Raft) RaftConfig(localID string) *raft.Config {
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(localID)
+	if r.HeartbeatTimeout > 0 {
+		rc.HeartbeatTimeout = r.HeartbeatTimeout
+	}
+	if r.ElectionTimeout > 0 {
+		rc.ElectionTimeout = r.ElectionTimeout
+	}
+	if r.LeaderLeaseTimeout > 0 {
+		rc.LeaderLeaseTimeout = r.LeaderLeaseTimeout
+	}
+	if r.CommitTimeout > 0 {
+		rc.CommitTimeout = r.CommitTimeout
+	}
+	if r.SnapshotThreshold > 0 {
+		rc.SnapshotThreshold = r.SnapshotThreshold
+	}
+	if r.SnapshotInterval > 0 {
+		rc.SnapshotInterval = r.SnapshotInterval
+	}
+	if r.TrailingLogs > 0 {
+		rc.TrailingLogs = r.TrailingLogs
+	}
+	return rc
+}
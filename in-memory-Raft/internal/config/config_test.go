@@ -0,0 +1,97 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %s", err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+http_addr: localhost:9000
+raft_addr: localhost:9100
+data_dir: /tmp/raft
+raft:
+  heartbeat_timeout: 2s
+  election_timeout: 3s
+  snapshot_threshold: 100
+`)
+	t.Setenv("RAFT_BIND_ADDR", "localhost:9200")
+	t.Setenv("RAFT_ELECTION_TIMEOUT", "4s")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, err := Load(fs, []string{"-config", path, "-raddr", "localhost:9300", "node0"})
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	if cfg.HTTPAddr != "localhost:9000" {
+		t.Errorf("expected http_addr from file, got %s", cfg.HTTPAddr)
+	}
+	if cfg.RaftAddr != "localhost:9300" {
+		t.Errorf("expected raft_addr from flag, got %s", cfg.RaftAddr)
+	}
+	if cfg.Raft.HeartbeatTimeout != 2*time.Second {
+		t.Errorf("expected heartbeat timeout from file, got %s", cfg.Raft.HeartbeatTimeout)
+	}
+	if cfg.Raft.ElectionTimeout != 4*time.Second {
+		t.Errorf("expected election timeout from env, got %s", cfg.Raft.ElectionTimeout)
+	}
+	if cfg.Raft.RetainSnapshots != 2 {
+		t.Errorf("expected default retain_snapshots, got %d", cfg.Raft.RetainSnapshots)
+	}
+	if fs.Arg(0) != "node0" {
+		t.Errorf("expected positional argument to be kept, got %q", fs.Arg(0))
+	}
+
+	rc := cfg.Raft.RaftConfig("node0")
+	if rc.SnapshotThreshold != 100 || rc.HeartbeatTimeout != 2*time.Second {
+		t.Errorf("tuning not applied to raft config: %+v", rc)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	path := writeFile(t, "config.json", `{"http_addr": "localhost:9000", "raft": {"apply_timeout": "5s"}}`)
+
+	cfg, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path})
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if cfg.HTTPAddr != "localhost:9000" || cfg.Raft.ApplyTimeout != 5*time.Second {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field":    "http_adr: localhost:9000\n",
+		"bad address":      "http_addr: localhost\n",
+		"bad RESP address": "resp_addr: 6379\n",
+		"bad etcd address": "etcd_addr: 2379\n",
+		"bad timeouts":     "raft:\n  heartbeat_timeout: 2s\n  leader_lease_timeout: 3s\n",
+		"retain too low":   "raft:\n  retain_snapshots: 0\n",
+		"negative expect":  "bootstrap_expect: -1\n",
+	} {
+		path := writeFile(t, "config.yaml", content)
+		if _, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	t.Setenv("RAFT_SHUTDOWN_TIMEOUT", "soon")
+	_, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err == nil || !strings.Contains(err.Error(), "RAFT_SHUTDOWN_TIMEOUT") {
+		t.Fatalf("expected env parse error, got %v", err)
+	}
+}
@@ -0,0 +1,362 @@
+package etcdapi_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+
+	"inmemoryraft/internal/etcdapi"
+	"inmemoryraft/internal/services"
+	"inmemoryraft/internal/testcluster"
+)
+
+// newClient serves the store over the etcd API and connects a client to it.
+func newClient(t *testing.T, store *services.InMemoryStore) *clientv3.Client {
+	t.Helper()
+	s := etcdapi.NewServer("127.0.0.1:0", store)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{s.Addr().String()}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func startCluster(t *testing.T) (*testcluster.Cluster, *clientv3.Client) {
+	c := testcluster.Start(t, testcluster.Config{Nodes: 3})
+	return c, newClient(t, c.WaitForLeader().Store)
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func keys(kvs []*mvccpb.KeyValue) []string {
+	var result []string
+	for _, kv := range kvs {
+		result = append(result, string(kv.Key))
+	}
+	return result
+}
+
+func checkKeys(t *testing.T, kvs []*mvccpb.KeyValue, want ...string) {
+	t.Helper()
+	got := keys(kvs)
+	if len(got) != len(want) {
+		t.Fatalf("expected keys %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected keys %v, got %v", want, got)
+		}
+	}
+}
+
+func TestKV(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := testContext(t)
+
+	put, err := client.Put(ctx, "app/a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := put.Header.Revision
+	if _, err := client.Put(ctx, "app/b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	put, err = client.Put(ctx, "app/a", "3", clientv3.WithPrevKV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put.PrevKv == nil || string(put.PrevKv.Value) != "1" {
+		t.Fatalf("expected the previous value 1, got %v", put.PrevKv)
+	}
+	if _, err := client.Put(ctx, "other", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	get, err := client.Get(ctx, "app/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := get.Kvs[0]
+	if string(kv.Value) != "3" || kv.Version != 2 || kv.CreateRevision != first || kv.ModRevision != put.Header.Revision {
+		t.Fatalf("unexpected key %+v", kv)
+	}
+
+	get, err = client.Get(ctx, "app/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, get.Kvs, "app/a", "app/b")
+
+	get, err = client.Get(ctx, "app/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, get.Kvs, "app/b")
+	if !get.More || get.Count != 2 {
+		t.Fatalf("expected more keys out of 2, got more=%v count=%d", get.More, get.Count)
+	}
+
+	get, err = client.Get(ctx, "app/a", clientv3.WithRev(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(get.Kvs[0].Value) != "1" {
+		t.Fatalf("expected value 1 at revision %d, got %q", first, get.Kvs[0].Value)
+	}
+
+	// Binary values go through unchanged.
+	if _, err := client.Put(ctx, "bin", "\x00\xff"); err != nil {
+		t.Fatal(err)
+	}
+	if get, err = client.Get(ctx, "bin"); err != nil || string(get.Kvs[0].Value) != "\x00\xff" {
+		t.Fatalf("expected the binary value back, got %v, %v", get, err)
+	}
+
+	del, err := client.Delete(ctx, "app/", clientv3.WithPrefix(), clientv3.WithPrevKV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if del.Deleted != 2 {
+		t.Fatalf("expected 2 keys deleted, got %d", del.Deleted)
+	}
+	checkKeys(t, del.PrevKvs, "app/a", "app/b")
+	if get, err = client.Get(ctx, "app/", clientv3.WithPrefix(), clientv3.WithCountOnly()); err != nil || get.Count != 0 {
+		t.Fatalf("expected no key left, got %v, %v", get, err)
+	}
+
+	if _, err := client.Put(ctx, "", "x"); !errors.Is(err, rpctypes.ErrEmptyKey) {
+		t.Fatalf("expected ErrEmptyKey, got %v", err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := testContext(t)
+
+	// Create the key if it does not exist.
+	create := func() *clientv3.TxnResponse {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Version("lock"), "=", 0)).
+			Then(clientv3.OpPut("lock", "me")).
+			Else(clientv3.OpGet("lock")).
+			Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := create(); !resp.Succeeded {
+		t.Fatal("expected the first transaction to succeed")
+	}
+	resp := create()
+	if resp.Succeeded {
+		t.Fatal("expected the second transaction to fail")
+	}
+	kv := resp.Responses[0].GetResponseRange().Kvs[0]
+	if string(kv.Value) != "me" {
+		t.Fatalf("expected the key to be read, got %+v", kv)
+	}
+
+	// Compare and swap on the mod revision.
+	resp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision("lock"), "=", kv.ModRevision)).
+		Then(clientv3.OpPut("lock", "you"), clientv3.OpDelete("other")).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		t.Fatalf("expected the swap to succeed, got %v, %v", resp, err)
+	}
+	resp, err = client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value("lock"), "=", "you")).
+		Then(clientv3.OpGet("lock")).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		t.Fatalf("expected the value compare to succeed, got %v, %v", resp, err)
+	}
+
+	if _, err := client.Txn(ctx).Then(clientv3.OpPut("k", "1"), clientv3.OpPut("k", "2")).Commit(); err == nil {
+		t.Fatal("expected a key written twice to be refused")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := testContext(t)
+
+	put, err := client.Put(ctx, "app/a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(ctx, "app/b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A watch from a past revision replays the history first.
+	replay := client.Watch(ctx, "app/", clientv3.WithPrefix(), clientv3.WithRev(put.Header.Revision))
+	live := client.Watch(ctx, "app/a", clientv3.WithPrevKV())
+	time.Sleep(100 * time.Millisecond) // let the live watch be created
+
+	if _, err := client.Put(ctx, "app/a", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(ctx, "app/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(ch clientv3.WatchChan) *clientv3.Event {
+		t.Helper()
+		select {
+		case resp := <-ch:
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			return resp.Events[0]
+		case <-ctx.Done():
+			t.Fatal("no event received")
+			return nil
+		}
+	}
+	for _, want := range []string{"PUT app/a 1", "PUT app/b 2", "PUT app/a 3", "DELETE app/a "} {
+		ev := next(replay)
+		if got := ev.Type.String() + " " + string(ev.Kv.Key) + " " + string(ev.Kv.Value); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	ev := next(live)
+	if !ev.IsModify() || string(ev.PrevKv.Value) != "1" {
+		t.Fatalf("expected a modification of value 1, got %+v", ev)
+	}
+	if ev = next(live); ev.Type != mvccpb.DELETE || string(ev.PrevKv.Value) != "3" {
+		t.Fatalf("expected the deletion of value 3, got %+v", ev)
+	}
+}
+
+func TestLease(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := testContext(t)
+
+	lease, err := client.Grant(ctx, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(ctx, "session", "x", clientv3.WithLease(lease.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.KeepAliveOnce(ctx, lease.ID); err != nil {
+		t.Fatal(err)
+	}
+	ttl, err := client.TimeToLive(ctx, lease.ID, clientv3.WithAttachedKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl.GrantedTTL != 60 || ttl.TTL <= 0 || len(ttl.Keys) != 1 || string(ttl.Keys[0]) != "session" {
+		t.Fatalf("unexpected lease %+v", ttl)
+	}
+	leases, err := client.Leases(ctx)
+	if err != nil || len(leases.Leases) != 1 {
+		t.Fatalf("expected one lease, got %v, %v", leases, err)
+	}
+
+	if _, err := client.Revoke(ctx, lease.ID); err != nil {
+		t.Fatal(err)
+	}
+	if get, err := client.Get(ctx, "session"); err != nil || len(get.Kvs) != 0 {
+		t.Fatalf("expected the key to be deleted with the lease, got %v, %v", get, err)
+	}
+	if _, err := client.KeepAliveOnce(ctx, lease.ID); !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		t.Fatalf("expected ErrLeaseNotFound, got %v", err)
+	}
+	if _, err := client.Put(ctx, "k", "v", clientv3.WithLease(lease.ID)); !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		t.Fatalf("expected ErrLeaseNotFound, got %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := testContext(t)
+
+	put, err := client.Put(ctx, "k", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put2, err := client.Put(ctx, "k", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Compact(ctx, put2.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, "k", clientv3.WithRev(put.Header.Revision)); !errors.Is(err, rpctypes.ErrCompacted) {
+		t.Fatalf("expected ErrCompacted, got %v", err)
+	}
+
+	resp := <-client.Watch(ctx, "k", clientv3.WithRev(put.Header.Revision))
+	if !errors.Is(resp.Err(), rpctypes.ErrCompacted) || resp.CompactRevision != put2.Header.Revision {
+		t.Fatalf("expected the watch to be compacted at %d, got %v at %d", put2.Header.Revision, resp.Err(), resp.CompactRevision)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	c, leader := startCluster(t)
+	ctx := testContext(t)
+
+	var follower *clientv3.Client
+	for _, n := range c.Nodes() {
+		if !n.Store.IsLeader() {
+			follower = newClient(t, n.Store)
+			break
+		}
+	}
+
+	if _, err := leader.Put(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	c.Sync()
+	get, err := follower.Get(ctx, "k", clientv3.WithSerializable())
+	if err != nil || string(get.Kvs[0].Value) != "v" {
+		t.Fatalf("expected a serializable read on the follower, got %v, %v", get, err)
+	}
+	if _, err := follower.Put(ctx, "k", "w"); !errors.Is(err, rpctypes.ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader, got %v", err)
+	}
+}
+
+func TestAuditOrigin(t *testing.T) {
+	c, client := startCluster(t)
+	ctx := testContext(t)
+
+	if _, err := client.Put(ctx, "audited", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Txn(ctx).Then(clientv3.OpPut("audited", "2")).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(ctx, "audited"); err != nil {
+		t.Fatal(err)
+	}
+
+	records := c.WaitForLeader().Store.AuditLog(services.AuditFilter{Principal: "etcd"})
+	if len(records) != 3 {
+		t.Fatalf("expected 3 writes attributed to etcd, got %+v", records)
+	}
+	for _, rec := range records {
+		if rec.Source == "" {
+			t.Fatalf("expected the address of the client, got %+v", rec)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package etcdapi
+
+import (
+	"context"
+	"sort"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"inmemoryraft/internal/services"
+)
+
+type kvServer struct {
+	s *Server
+}
+
+func toKV(kv services.KeyValue, keysOnly bool) *mvccpb.KeyValue {
+	pkv := &mvccpb.KeyValue{
+		Key:            []byte(kv.Key),
+		CreateRevision: int64(kv.CreateRevision),
+		ModRevision:    int64(kv.ModRevision),
+		Version:        kv.Version,
+		Lease:          kv.Lease,
+	}
+	if !keysOnly {
+		pkv.Value = []byte(kv.Value)
+	}
+	return pkv
+}
+
+// Range reads the local state of the node, after confirming that it still
+// leads unless the request is serializable.
+func (k *kvServer) Range(ctx context.Context, r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	if err := checkKey(r.Key); err != nil {
+		return nil, err
+	}
+	if !r.Serializable {
+		if err := k.s.store.Linearize(ctx); err != nil {
+			return nil, rpcError(err)
+		}
+	}
+	var revision uint64
+	if r.Revision > 0 {
+		revision = uint64(r.Revision)
+	}
+	kvs, current, err := k.s.store.Range(string(r.Key), string(r.RangeEnd), revision)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	resp := rangeResponse(r, kvs)
+	resp.Header = k.s.header(current)
+	return resp, nil
+}
+
+// rangeResponse applies the filters, order and limit of the request to the
+// keys of the range.
+func rangeResponse(r *pb.RangeRequest, kvs []services.KeyValue) *pb.RangeResponse {
+	filtered := kvs[:0]
+	for _, kv := range kvs {
+		switch {
+		case r.MinModRevision > 0 && int64(kv.ModRevision) < r.MinModRevision,
+			r.MaxModRevision > 0 && int64(kv.ModRevision) > r.MaxModRevision,
+			r.MinCreateRevision > 0 && int64(kv.CreateRevision) < r.MinCreateRevision,
+			r.MaxCreateRevision > 0 && int64(kv.CreateRevision) > r.MaxCreateRevision:
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	kvs = filtered
+	sortKVs(kvs, r.SortOrder, r.SortTarget)
+
+	resp := &pb.RangeResponse{Count: int64(len(kvs))}
+	if r.CountOnly {
+		return resp
+	}
+	if r.Limit > 0 && int64(len(kvs)) > r.Limit {
+		kvs = kvs[:r.Limit]
+		resp.More = true
+	}
+	for _, kv := range kvs {
+		resp.Kvs = append(resp.Kvs, toKV(kv, r.KeysOnly))
+	}
+	return resp
+}
+
+// sortKVs orders keys sorted by key as etcd does: a target without an order
+// sorts ascending, and keys stay sorted by key within equal targets.
+func sortKVs(kvs []services.KeyValue, order pb.RangeRequest_SortOrder, target pb.RangeRequest_SortTarget) {
+	if order == pb.RangeRequest_NONE {
+		if target == pb.RangeRequest_KEY {
+			return
+		}
+		order = pb.RangeRequest_ASCEND
+	}
+	less := func(a, b services.KeyValue) bool {
+		switch target {
+		case pb.RangeRequest_VERSION:
+			return a.Version < b.Version
+		case pb.RangeRequest_CREATE:
+			return a.CreateRevision < b.CreateRevision
+		case pb.RangeRequest_MOD:
+			return a.ModRevision < b.ModRevision
+		case pb.RangeRequest_VALUE:
+			return a.Value < b.Value
+		default:
+			return a.Key < b.Key
+		}
+	}
+	sort.SliceStable(kvs, func(i, j int) bool {
+		if order == pb.RangeRequest_DESCEND {
+			return less(kvs[j], kvs[i])
+		}
+		return less(kvs[i], kvs[j])
+	})
+}
+
+func (k *kvServer) Put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
+	op, err := putOp(r)
+	if err != nil {
+		return nil, err
+	}
+	result, err := k.s.store.Txn(ctx, &services.Txn{Success: []services.TxnOp{op}})
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return putResponse(k.s.header(result.Revision), r, result.Results[0]), nil
+}
+
+func putOp(r *pb.PutRequest) (services.TxnOp, error) {
+	if err := checkKey(r.Key); err != nil {
+		return services.TxnOp{}, err
+	}
+	if r.IgnoreValue && len(r.Value) > 0 {
+		return services.TxnOp{}, rpctypes.ErrGRPCValueProvided
+	}
+	if r.IgnoreLease && r.Lease != 0 {
+		return services.TxnOp{}, rpctypes.ErrGRPCLeaseProvided
+	}
+	return services.TxnOp{
+		Type:        services.OpPut,
+		Key:         string(r.Key),
+		Value:       r.Value,
+		Lease:       r.Lease,
+		PrevKV:      r.PrevKv,
+		IgnoreValue: r.IgnoreValue,
+		IgnoreLease: r.IgnoreLease,
+	}, nil
+}
+
+func putResponse(header *pb.ResponseHeader, r *pb.PutRequest, result services.OpResult) *pb.PutResponse {
+	resp := &pb.PutResponse{Header: header}
+	if r.PrevKv && len(result.KVs) > 0 {
+		resp.PrevKv = toKV(result.KVs[0], false)
+	}
+	return resp
+}
+
+func (k *kvServer) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	op, err := deleteOp(r)
+	if err != nil {
+		return nil, err
+	}
+	result, err := k.s.store.Txn(ctx, &services.Txn{Success: []services.TxnOp{op}})
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return deleteResponse(k.s.header(result.Revision), r, result.Results[0]), nil
+}
+
+func deleteOp(r *pb.DeleteRangeRequest) (services.TxnOp, error) {
+	if err := checkKey(r.Key); err != nil {
+		return services.TxnOp{}, err
+	}
+	return services.TxnOp{Type: services.OpDelete, Key: string(r.Key), End: r.RangeEnd, PrevKV: r.PrevKv}, nil
+}
+
+func deleteResponse(header *pb.ResponseHeader, r *pb.DeleteRangeRequest, result services.OpResult) *pb.DeleteRangeResponse {
+	resp := &pb.DeleteRangeResponse{Header: header, Deleted: result.Deleted}
+	if r.PrevKv {
+		for _, kv := range result.KVs {
+			resp.PrevKvs = append(resp.PrevKvs, toKV(kv, false))
+		}
+	}
+	return resp
+}
+
+// Txn runs the transaction as one Raft command, ranges included, so they are
+// linearizable. Nested transactions and ranges at a past revision are not
+// supported.
+func (k *kvServer) Txn(ctx context.Context, r *pb.TxnRequest) (*pb.TxnResponse, error) {
+	txn := &services.Txn{}
+	for _, c := range r.Compare {
+		cmp, err := compare(c)
+		if err != nil {
+			return nil, err
+		}
+		txn.Compare = append(txn.Compare, cmp)
+	}
+	var err error
+	if txn.Success, err = txnOps(r.Success); err != nil {
+		return nil, err
+	}
+	if txn.Failure, err = txnOps(r.Failure); err != nil {
+		return nil, err
+	}
+
+	result, err := k.s.store.Txn(ctx, txn)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	header := k.s.header(result.Revision)
+	ops := r.Success
+	if !result.Succeeded {
+		ops = r.Failure
+	}
+	resp := &pb.TxnResponse{Header: header, Succeeded: result.Succeeded}
+	for i, op := range ops {
+		var ro *pb.ResponseOp
+		switch req := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			rr := rangeResponse(req.RequestRange, result.Results[i].KVs)
+			rr.Header = header
+			ro = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: rr}}
+		case *pb.RequestOp_RequestPut:
+			pr := putResponse(header, req.RequestPut, result.Results[i])
+			ro = &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{ResponsePut: pr}}
+		case *pb.RequestOp_RequestDeleteRange:
+			dr := deleteResponse(header, req.RequestDeleteRange, result.Results[i])
+			ro = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: dr}}
+		}
+		resp.Responses = append(resp.Responses, ro)
+	}
+	return resp, nil
+}
+
+func compare(c *pb.Compare) (services.Compare, error) {
+	if err := checkKey(c.Key); err != nil {
+		return services.Compare{}, err
+	}
+	cmp := services.Compare{Key: string(c.Key), End: c.RangeEnd}
+	switch c.Result {
+	case pb.Compare_EQUAL:
+		cmp.Result = "="
+	case pb.Compare_NOT_EQUAL:
+		cmp.Result = "!="
+	case pb.Compare_LESS:
+		cmp.Result = "<"
+	case pb.Compare_GREATER:
+		cmp.Result = ">"
+	}
+	switch c.Target {
+	case pb.Compare_VALUE:
+		cmp.Target, cmp.Value = services.CompareValue, c.GetValue()
+	case pb.Compare_VERSION:
+		cmp.Target, cmp.Number = services.CompareVersion, c.GetVersion()
+	case pb.Compare_CREATE:
+		cmp.Target, cmp.Number = services.CompareCreate, c.GetCreateRevision()
+	case pb.Compare_MOD:
+		cmp.Target, cmp.Number = services.CompareMod, c.GetModRevision()
+	case pb.Compare_LEASE:
+		cmp.Target, cmp.Number = services.CompareLease, c.GetLease()
+	}
+	return cmp, nil
+}
+
+func txnOps(ops []*pb.RequestOp) ([]services.TxnOp, error) {
+	result := make([]services.TxnOp, 0, len(ops))
+	for _, op := range ops {
+		var top services.TxnOp
+		var err error
+		switch req := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			if err := checkKey(req.RequestRange.Key); err != nil {
+				return nil, err
+			}
+			if req.RequestRange.Revision > 0 {
+				return nil, status.Error(codes.Unimplemented, "etcdserver: ranges at a revision are not supported in transactions")
+			}
+			top = services.TxnOp{Type: services.OpRange, Key: string(req.RequestRange.Key), End: req.RequestRange.RangeEnd}
+		case *pb.RequestOp_RequestPut:
+			top, err = putOp(req.RequestPut)
+		case *pb.RequestOp_RequestDeleteRange:
+			top, err = deleteOp(req.RequestDeleteRange)
+		case *pb.RequestOp_RequestTxn:
+			return nil, status.Error(codes.Unimplemented, "etcdserver: nested transactions are not supported")
+		default:
+			return nil, status.Error(codes.InvalidArgument, "etcdserver: empty request")
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, top)
+	}
+	return result, nil
+}
+
+func (k *kvServer) Compact(ctx context.Context, r *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	if r.Revision <= 0 {
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
+	if err := k.s.store.Compact(ctx, uint64(r.Revision)); err != nil {
+		return nil, rpcError(err)
+	}
+	return &pb.CompactionResponse{Header: k.s.header(0)}, nil
+}
@@ -0,0 +1,117 @@
+package etcdapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"inmemoryraft/internal/services"
+)
+
+// errShuttingDown ends the streams of a server being closed.
+var errShuttingDown = status.Error(codes.Unavailable, "etcdserver: server is shutting down")
+
+type leaseServer struct {
+	s *Server
+}
+
+// Leases of the store count in milliseconds and those of etcd in seconds.
+func seconds(ms int64) int64 {
+	return (ms + 999) / 1000
+}
+
+func (l *leaseServer) LeaseGrant(ctx context.Context, r *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	lease, err := l.s.store.GrantLease(ctx, r.ID, time.Duration(r.TTL)*time.Second)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &pb.LeaseGrantResponse{Header: l.s.header(0), ID: lease.ID, TTL: seconds(lease.TTL)}, nil
+}
+
+func (l *leaseServer) LeaseRevoke(ctx context.Context, r *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	if err := l.s.store.RevokeLease(ctx, r.ID); err != nil {
+		return nil, rpcError(err)
+	}
+	return &pb.LeaseRevokeResponse{Header: l.s.header(0)}, nil
+}
+
+// LeaseKeepAlive renews the leases the client names, answering a TTL of zero
+// for the ones that no longer exist, as etcd does.
+func (l *leaseServer) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	reqs := make(chan *pb.LeaseKeepAliveRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-l.s.ctx.Done():
+			return errShuttingDown
+		case err := <-errc:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case req := <-reqs:
+			resp := &pb.LeaseKeepAliveResponse{ID: req.ID}
+			lease, err := l.s.store.KeepAliveLease(stream.Context(), req.ID)
+			switch {
+			case errors.Is(err, services.ErrLeaseNotFound):
+			case err != nil:
+				return rpcError(err)
+			default:
+				resp.TTL = seconds(lease.TTL)
+			}
+			resp.Header = l.s.header(0)
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// LeaseTimeToLive reads the local state of the node, so a follower may lag
+// behind the leader by the replication delay.
+func (l *leaseServer) LeaseTimeToLive(ctx context.Context, r *pb.LeaseTimeToLiveRequest) (*pb.LeaseTimeToLiveResponse, error) {
+	resp := &pb.LeaseTimeToLiveResponse{Header: l.s.header(0), ID: r.ID, TTL: -1}
+	lease, err := l.s.store.LeaseInfo(r.ID)
+	if errors.Is(err, services.ErrLeaseNotFound) {
+		return resp, nil
+	}
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	resp.TTL = int64(time.Until(lease.Expires).Seconds())
+	resp.GrantedTTL = seconds(lease.TTL)
+	if r.Keys {
+		for _, k := range lease.Keys {
+			resp.Keys = append(resp.Keys, []byte(k))
+		}
+	}
+	return resp, nil
+}
+
+func (l *leaseServer) LeaseLeases(ctx context.Context, r *pb.LeaseLeasesRequest) (*pb.LeaseLeasesResponse, error) {
+	resp := &pb.LeaseLeasesResponse{Header: l.s.header(0)}
+	for _, lease := range l.s.store.Leases() {
+		resp.Leases = append(resp.Leases, &pb.LeaseStatus{ID: lease.ID})
+	}
+	return resp, nil
+}
@@ -0,0 +1,169 @@
+// Package etcdapi serves the keyspace of the store over the etcd v3 gRPC API,
+// so that etcd clients (clientv3, etcdctl) can be pointed at a node. It
+// covers the KV service (Range, Put, DeleteRange, Txn and Compact), Watch
+// and Lease; other services answer Unimplemented.
+//
+// Revisions are Raft indexes, so they grow with every command applied, not
+// only with writes to the keyspace. Writes and linearizable reads have to be
+// sent to the leader: other nodes refuse them with "etcdserver: not leader".
+package etcdapi
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"unicode/utf8"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"inmemoryraft/internal/services"
+)
+
+type Server struct {
+	addr   string
+	store  *services.InMemoryStore
+	member uint64
+
+	ln     net.Listener
+	server *grpc.Server
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewServer(addr string, store *services.InMemoryStore) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		addr:   addr,
+		store:  store,
+		member: hashID(store.Status().ID),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start listens on the address of the server and serves the clients in the
+// background until Close.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	s.server = grpc.NewServer(grpc.UnaryInterceptor(withOrigin), grpc.StreamInterceptor(withStreamOrigin))
+	pb.RegisterKVServer(s.server, &kvServer{s})
+	pb.RegisterWatchServer(s.server, &watchServer{s})
+	pb.RegisterLeaseServer(s.server, &leaseServer{s})
+	go s.server.Serve(ln)
+	return nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close ends the watch and keep-alive streams and stops the server once the
+// other calls have returned.
+func (s *Server) Close() error {
+	s.cancel()
+	s.server.GracefulStop()
+	return nil
+}
+
+// origin marks the writes of a call as made over the etcd API by the peer of
+// the call, for the audit log.
+func origin(ctx context.Context) context.Context {
+	o := services.Origin{Principal: "etcd"}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		o.Source = p.Addr.String()
+	}
+	return services.WithOrigin(ctx, o)
+}
+
+func withOrigin(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(origin(ctx), req)
+}
+
+func withStreamOrigin(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, originStream{ss, origin(ss.Context())})
+}
+
+// originStream is a server stream whose context carries the origin.
+type originStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s originStream) Context() context.Context {
+	return s.ctx
+}
+
+// header describes the node answering and the revision of the answer, or the
+// current one when revision is zero.
+func (s *Server) header(revision uint64) *pb.ResponseHeader {
+	if revision == 0 {
+		revision = s.store.Revision()
+	}
+	return &pb.ResponseHeader{
+		ClusterId: hashID(s.store.ClusterID()),
+		MemberId:  s.member,
+		Revision:  int64(revision),
+	}
+}
+
+// hashID turns the string IDs of the cluster and its nodes into the numbers
+// etcd uses.
+func hashID(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()
+}
+
+// rpcError returns the error an etcd server gives in the same situation, so
+// that clients recognize it.
+func rpcError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrNotLeader):
+		return rpctypes.ErrGRPCNotLeader
+	case errors.Is(err, services.ErrCompacted):
+		return rpctypes.ErrGRPCCompacted
+	case errors.Is(err, services.ErrFutureRevision):
+		return rpctypes.ErrGRPCFutureRev
+	case errors.Is(err, services.ErrLeaseNotFound):
+		return rpctypes.ErrGRPCLeaseNotFound
+	case errors.Is(err, services.ErrLeaseExists):
+		return rpctypes.ErrGRPCLeaseExist
+	case errors.Is(err, services.ErrKeyNotFound):
+		return rpctypes.ErrGRPCKeyNotFound
+	case errors.Is(err, services.ErrKeyTooLarge), errors.Is(err, services.ErrValueTooLarge):
+		return rpctypes.ErrGRPCRequestTooLarge
+	case errors.Is(err, services.ErrQuotaExceeded), errors.Is(err, services.ErrNoSpace):
+		return rpctypes.ErrGRPCNoSpace
+	case errors.Is(err, services.ErrInvalidTxn), errors.Is(err, services.ErrInvalidLease),
+		errors.Is(err, services.ErrSchemaViolation):
+		return status.Error(codes.InvalidArgument, "etcdserver: "+err.Error())
+	case errors.Is(err, services.ErrBusy), errors.Is(err, services.ErrShuttingDown):
+		return status.Error(codes.Unavailable, "etcdserver: "+err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		return status.Error(codes.Unknown, err.Error())
+	}
+}
+
+// checkKey refuses empty keys, and keys that would not survive the JSON of
+// Raft commands and snapshots.
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return rpctypes.ErrGRPCEmptyKey
+	}
+	if !utf8.Valid(key) {
+		return status.Error(codes.InvalidArgument, "etcdserver: keys must be valid UTF-8")
+	}
+	return nil
+}
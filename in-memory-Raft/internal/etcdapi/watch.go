@@ -0,0 +1,325 @@
+package etcdapi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+
+	"common/keyrange"
+	"inmemoryraft/internal/services"
+)
+
+type watchServer struct {
+	s *Server
+}
+
+// Watch serves the watches of one stream. Each watch follows a watcher of
+// the store and resubscribes from the last revision it sent when it falls
+// behind, so slow clients see every event unless the history was compacted
+// in between. Progress notifications and fragments are not supported.
+func (w *watchServer) Watch(stream pb.Watch_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	ws := &watchStream{s: w.s, stream: stream, watches: make(map[int64]context.CancelFunc)}
+	defer func() {
+		cancel()
+		ws.wg.Wait()
+	}()
+
+	reqs := make(chan *pb.WatchRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-w.s.ctx.Done():
+			return errShuttingDown
+		case err := <-errc:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case req := <-reqs:
+			var err error
+			switch r := req.RequestUnion.(type) {
+			case *pb.WatchRequest_CreateRequest:
+				err = ws.create(ctx, r.CreateRequest)
+			case *pb.WatchRequest_CancelRequest:
+				err = ws.cancel(r.CancelRequest.WatchId)
+			case *pb.WatchRequest_ProgressRequest:
+				err = ws.send(&pb.WatchResponse{Header: w.s.header(0), WatchId: -1})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type watchStream struct {
+	s      *Server
+	stream pb.Watch_WatchServer
+	wg     sync.WaitGroup
+
+	sendMutex sync.Mutex
+
+	mutex   sync.Mutex
+	nextID  int64
+	watches map[int64]context.CancelFunc
+}
+
+// send serializes the responses of the watches of the stream.
+func (ws *watchStream) send(resp *pb.WatchResponse) error {
+	ws.sendMutex.Lock()
+	defer ws.sendMutex.Unlock()
+	return ws.stream.Send(resp)
+}
+
+// watch is a single watch of a stream.
+type watch struct {
+	ws       *watchStream
+	id       int64
+	key, end []byte
+	prefix   string
+	noPut    bool
+	noDelete bool
+	prevKV   bool
+}
+
+func (ws *watchStream) create(ctx context.Context, r *pb.WatchCreateRequest) error {
+	ws.mutex.Lock()
+	id := r.WatchId
+	if id == 0 {
+		for {
+			id = ws.nextID
+			ws.nextID++
+			if _, ok := ws.watches[id]; !ok {
+				break
+			}
+		}
+	} else if _, ok := ws.watches[id]; ok {
+		ws.mutex.Unlock()
+		return ws.send(&pb.WatchResponse{
+			Header: ws.s.header(0), WatchId: id, Created: true, Canceled: true,
+			CancelReason: "etcdserver: watch ID already in use",
+		})
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	ws.watches[id] = cancel
+	ws.mutex.Unlock()
+
+	w := &watch{ws: ws, id: id, key: r.Key, end: r.RangeEnd, prefix: watchPrefix(string(r.Key), string(r.RangeEnd)), prevKV: r.PrevKv}
+	for _, f := range r.Filters {
+		switch f {
+		case pb.WatchCreateRequest_NOPUT:
+			w.noPut = true
+		case pb.WatchCreateRequest_NODELETE:
+			w.noDelete = true
+		}
+	}
+	if err := checkKey(r.Key); err != nil {
+		ws.remove(id)
+		return ws.send(&pb.WatchResponse{
+			Header: ws.s.header(0), WatchId: id, Created: true, Canceled: true, CancelReason: err.Error(),
+		})
+	}
+
+	// The watcher is subscribed before Created is sent, so that the client
+	// sees every change after the revision of the response.
+	var events []services.Event
+	var ch <-chan services.Event
+	var stop func()
+	header := ws.s.header(0)
+	if r.StartRevision > 0 {
+		var err error
+		events, ch, stop, err = ws.s.store.WatchFrom(w.prefix, uint64(r.StartRevision))
+		if err != nil {
+			ws.remove(id)
+			if err := ws.send(&pb.WatchResponse{Header: header, WatchId: id, Created: true}); err != nil {
+				return err
+			}
+			return w.compacted(err)
+		}
+	} else {
+		ch, stop = ws.s.store.Watch(w.prefix)
+	}
+	if err := ws.send(&pb.WatchResponse{Header: header, WatchId: id, Created: true}); err != nil {
+		stop()
+		return err
+	}
+
+	ws.wg.Add(1)
+	go func() {
+		defer ws.wg.Done()
+		defer ws.remove(id)
+		w.run(watchCtx, events, ch, stop)
+	}()
+	return nil
+}
+
+func (ws *watchStream) cancel(id int64) error {
+	if !ws.remove(id) {
+		return nil
+	}
+	return ws.send(&pb.WatchResponse{Header: ws.s.header(0), WatchId: id, Canceled: true})
+}
+
+// remove stops the watch and tells whether it was running.
+func (ws *watchStream) remove(id int64) bool {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	cancel, ok := ws.watches[id]
+	if ok {
+		cancel()
+		delete(ws.watches, id)
+	}
+	return ok
+}
+
+// watchPrefix is the longest prefix shared by the keys of the range, which
+// the watcher of the store is subscribed to.
+func watchPrefix(key, end string) string {
+	switch end {
+	case "":
+		return key
+	case "\x00":
+		return ""
+	}
+	i := 0
+	for i < len(key) && i < len(end) && key[i] == end[i] {
+		i++
+	}
+	return key[:i]
+}
+
+// run sends the replayed events, then the live ones, until the watch is
+// canceled. When the store drops the watcher, run resubscribes from the last
+// revision sent, skipping the events of that revision already sent.
+func (w *watch) run(ctx context.Context, events []services.Event, ch <-chan services.Event, stop func()) {
+	defer func() { stop() }()
+
+	var last uint64
+	var sent []string // keys sent at revision last
+	deliver := func(ev services.Event) error {
+		if ev.Index == last {
+			for _, k := range sent {
+				if k == ev.Key {
+					return nil
+				}
+			}
+		} else {
+			last, sent = ev.Index, sent[:0]
+		}
+		sent = append(sent, ev.Key)
+		if !keyrange.Contains(ev.Key, string(w.key), string(w.end)) ||
+			(ev.Type == services.EventPut && w.noPut) || (ev.Type == services.EventDelete && w.noDelete) {
+			return nil
+		}
+		return w.ws.send(&pb.WatchResponse{
+			Header:  w.ws.s.header(ev.Index),
+			WatchId: w.id,
+			Events:  []*mvccpb.Event{w.event(ev)},
+		})
+	}
+
+	for {
+		for _, ev := range events {
+			if err := deliver(ev); err != nil {
+				return
+			}
+		}
+		events = nil
+
+		for ch != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-ch:
+				if !ok {
+					ch = nil
+					break
+				}
+				if err := deliver(ev); err != nil {
+					return
+				}
+			}
+		}
+
+		var err error
+		from := last
+		if from == 0 {
+			// Nothing was sent yet: every change after the subscription counts.
+			from = w.ws.s.store.Revision()
+		}
+		events, ch, stop, err = w.ws.s.store.WatchFrom(w.prefix, from)
+		if err != nil {
+			stop = func() {}
+			w.compacted(err)
+			return
+		}
+	}
+}
+
+// compacted cancels the watch, telling the client from which revision it can
+// watch again.
+func (w *watch) compacted(err error) error {
+	resp := &pb.WatchResponse{Header: w.ws.s.header(0), WatchId: w.id, Canceled: true, CancelReason: err.Error()}
+	var cerr *services.CompactedError
+	if errors.As(err, &cerr) {
+		resp.CompactRevision = int64(cerr.Revision)
+	}
+	return w.ws.send(resp)
+}
+
+func (w *watch) event(ev services.Event) *mvccpb.Event {
+	kv := &mvccpb.KeyValue{Key: []byte(ev.Key), ModRevision: int64(ev.Index)}
+	e := &mvccpb.Event{Type: mvccpb.PUT, Kv: kv}
+	if ev.Type == services.EventDelete {
+		e.Type = mvccpb.DELETE
+	} else {
+		kv.Value = []byte(ev.Value)
+		if ev.ValueType == services.TypeBinary {
+			kv.Value, _ = base64.StdEncoding.DecodeString(ev.Value)
+		}
+		kv.CreateRevision = int64(ev.CreateRevision)
+		kv.Version = ev.Version
+		kv.Lease = ev.Lease
+	}
+	if w.prevKV {
+		e.PrevKv = w.previous(ev.Key, ev.Index)
+	}
+	return e
+}
+
+// previous returns the version of key before revision, when the history
+// still holds it and the key was not deleted.
+func (w *watch) previous(key string, revision uint64) *mvccpb.KeyValue {
+	versions, err := w.ws.s.store.History(key)
+	if err != nil {
+		return nil
+	}
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].Revision >= revision })
+	if i == 0 || versions[i-1].Deleted {
+		return nil
+	}
+	v := versions[i-1]
+	return &mvccpb.KeyValue{Key: []byte(key), Value: []byte(v.Value), ModRevision: int64(v.Revision)}
+}
@@ -0,0 +1,291 @@
+// Package jepsen runs concurrent clients against an in-process test cluster
+// while a nemesis injects faults, and records the history of their
+// operations for the linearizability checker.
+package jepsen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"inmemoryraft/internal/linearizability"
+	"inmemoryraft/internal/services"
+	"inmemoryraft/internal/testcluster"
+)
+
+// Fault is something the nemesis does to the cluster.
+type Fault string
+
+const (
+	// FaultPartition splits the nodes into a random minority and majority.
+	FaultPartition Fault = "partition"
+	// FaultPause cuts the leader off every other node while it keeps
+	// running, as a long GC or SIGSTOP pause would: it still believes it
+	// leads until its lease runs out, and resumes with a stale view.
+	FaultPause Fault = "pause"
+	// FaultKillLeader kills the leader and restarts it on its Raft state.
+	FaultKillLeader Fault = "kill-leader"
+)
+
+var AllFaults = []Fault{FaultPartition, FaultPause, FaultKillLeader}
+
+type Config struct {
+	Clients  int           // concurrent clients, 5 if zero
+	Keys     int           // registers the clients share, 3 if zero
+	Values   int           // distinct values written, 5 if zero
+	Duration time.Duration // of the whole run
+	Interval time.Duration // a fault lasts this long, then the cluster heals for as long
+	Faults   []Fault       // picked at random, none if empty
+	Seed     int64
+}
+
+// Stats counts the recorded operations by outcome.
+type Stats struct {
+	Ok      int // completed, successfully or not
+	Unknown int // writes that may or may not have taken effect
+	Failed  int // refused before taking effect, left out of the history
+	Faults  int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d ok, %d unknown, %d failed, %d faults", s.Ok, s.Unknown, s.Failed, s.Faults)
+}
+
+// Run drives the workload for config.Duration and returns the history. The
+// nemesis runs on the calling goroutine, as it may fail the test; the
+// cluster is healed and every node restarted before Run returns.
+func Run(t testing.TB, c *testcluster.Cluster, config Config) ([]linearizability.Operation, Stats) {
+	t.Helper()
+	if config.Clients == 0 {
+		config.Clients = 5
+	}
+	if config.Keys == 0 {
+		config.Keys = 3
+	}
+	if config.Values == 0 {
+		config.Values = 5
+	}
+	if config.Interval == 0 {
+		config.Interval = 200 * time.Millisecond
+	}
+
+	r := &recorder{start: time.Now()}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < config.Clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			cl := &client{id: id, cluster: c, recorder: r, config: config,
+				rand: rand.New(rand.NewSource(config.Seed + int64(id) + 1))}
+			cl.run(ctx)
+		}(i)
+	}
+
+	n := &nemesis{t: t, cluster: c, rand: rand.New(rand.NewSource(config.Seed))}
+	deadline := time.Now().Add(config.Duration)
+	for time.Now().Before(deadline) && len(config.Faults) > 0 {
+		n.inject(config.Faults[n.rand.Intn(len(config.Faults))])
+		time.Sleep(config.Interval)
+		n.heal()
+		time.Sleep(config.Interval)
+	}
+	if wait := time.Until(deadline); wait > 0 {
+		time.Sleep(wait)
+	}
+	n.heal()
+	c.WaitForLeader()
+
+	cancel()
+	wg.Wait()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stats.Faults = n.faults
+	return r.history, r.stats
+}
+
+// recorder collects the history on a clock shared by every client.
+type recorder struct {
+	start time.Time
+
+	mutex   sync.Mutex
+	history []linearizability.Operation
+	stats   Stats
+}
+
+func (r *recorder) now() int64 {
+	return int64(time.Since(r.start))
+}
+
+func (r *recorder) record(op linearizability.Operation) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.history = append(r.history, op)
+	if op.Return == linearizability.Pending {
+		r.stats.Unknown++
+	} else {
+		r.stats.Ok++
+	}
+}
+
+func (r *recorder) fail() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stats.Failed++
+}
+
+type client struct {
+	id       int
+	cluster  *testcluster.Cluster
+	recorder *recorder
+	config   Config
+	rand     *rand.Rand
+}
+
+// run sends every operation to a node that believes it is leader, which
+// during a partition may be a deposed leader that has not noticed yet.
+func (cl *client) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		var leaders []*services.InMemoryStore
+		for _, store := range cl.cluster.Stores() {
+			if store.IsLeader() {
+				leaders = append(leaders, store)
+			}
+		}
+		if len(leaders) == 0 {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		cl.invoke(leaders[cl.rand.Intn(len(leaders))], cl.nextInput())
+	}
+}
+
+func (cl *client) nextInput() linearizability.KVInput {
+	in := linearizability.KVInput{
+		Key:   fmt.Sprintf("jepsen-%d", cl.rand.Intn(cl.config.Keys)),
+		Value: fmt.Sprint(cl.rand.Intn(cl.config.Values)),
+	}
+	switch cl.rand.Intn(3) {
+	case 0:
+		in.Op = "get"
+		in.Value = ""
+	case 1:
+		in.Op = "put"
+	default:
+		in.Op = "cas"
+		in.Old = fmt.Sprint(cl.rand.Intn(cl.config.Values))
+	}
+	return in
+}
+
+// invoke runs one operation against store. Operations refused before they
+// could take effect are left out of the history; writes whose outcome is
+// unknown are recorded as pending.
+func (cl *client) invoke(store *services.InMemoryStore, in linearizability.KVInput) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	op := linearizability.Operation{ClientID: cl.id, Input: in, Call: cl.recorder.now()}
+	var out linearizability.KVOutput
+	var err error
+	switch in.Op {
+	case "get":
+		if err = store.Linearize(ctx); err == nil {
+			out.Value, _, out.Found = store.Lookup(in.Key)
+		}
+	case "put":
+		err = store.Put(ctx, in.Key, in.Value)
+	case "cas":
+		err = store.CompareAndSwap(ctx, in.Key, in.Old, in.Value)
+		out.OK = err == nil
+		if errors.Is(err, services.ErrCASMismatch) {
+			err = nil
+		}
+	}
+	op.Return = cl.recorder.now()
+
+	switch {
+	case err == nil:
+	case in.Op == "get" || definite(err):
+		cl.recorder.fail()
+		return
+	default:
+		op.Return = linearizability.Pending
+		out = linearizability.KVOutput{Unknown: true}
+	}
+	op.Output = out
+	cl.recorder.record(op)
+}
+
+// definite reports whether a write failed before reaching the Raft log, so
+// that it certainly did not take effect.
+func definite(err error) bool {
+	return errors.Is(err, services.ErrNotLeader) || errors.Is(err, raft.ErrNotLeader) ||
+		errors.Is(err, services.ErrShuttingDown) || errors.Is(err, services.ErrBusy)
+}
+
+type nemesis struct {
+	t       testing.TB
+	cluster *testcluster.Cluster
+	rand    *rand.Rand
+	faults  int
+	killed  []int
+}
+
+func (n *nemesis) inject(f Fault) {
+	n.t.Helper()
+	nodes := n.cluster.Nodes()
+	leader := n.leader()
+
+	switch f {
+	case FaultPartition:
+		order := n.rand.Perm(len(nodes))
+		minority := (len(nodes) - 1) / 2
+		n.cluster.Partition(order[:minority], order[minority:])
+	case FaultPause:
+		if leader < 0 {
+			return
+		}
+		var others []int
+		for i := range nodes {
+			if i != leader {
+				others = append(others, i)
+			}
+		}
+		n.cluster.Partition(others)
+	case FaultKillLeader:
+		if leader < 0 {
+			return
+		}
+		n.cluster.KillNode(leader)
+		n.killed = append(n.killed, leader)
+	}
+	n.faults++
+}
+
+func (n *nemesis) heal() {
+	n.t.Helper()
+	n.cluster.Heal()
+	for _, i := range n.killed {
+		n.cluster.RestartNode(i)
+	}
+	n.killed = nil
+}
+
+// leader returns the index of the current leader, or -1.
+func (n *nemesis) leader() int {
+	leader := n.cluster.Leader()
+	for i, node := range n.cluster.Nodes() {
+		if node == leader {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,49 @@
+package jepsen
+
+import (
+	"testing"
+	"time"
+
+	"inmemoryraft/internal/linearizability"
+	"inmemoryraft/internal/testcluster"
+)
+
+func TestLinearizability(t *testing.T) {
+	duration := 3 * time.Second
+	if testing.Short() {
+		duration = time.Second
+	}
+
+	for _, tt := range []struct {
+		name   string
+		faults []Fault
+	}{
+		{"no faults", nil},
+		{"partition", []Fault{FaultPartition}},
+		{"pause", []Fault{FaultPause}},
+		{"kill leader", []Fault{FaultKillLeader}},
+		{"all faults", AllFaults},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testcluster.Start(t, testcluster.Config{Nodes: 5})
+			c.WaitForLeader()
+
+			history, stats := Run(t, c, Config{Duration: duration, Faults: tt.faults, Seed: time.Now().UnixNano()})
+			t.Logf("%s", stats)
+			if stats.Ok == 0 {
+				t.Fatalf("no operation completed")
+			}
+
+			result, bad := linearizability.Check(linearizability.KVModel, history, time.Minute)
+			switch result {
+			case linearizability.Illegal:
+				for _, op := range bad {
+					t.Logf("client %d %+v -> %+v [%d, %d]", op.ClientID, op.Input, op.Output, op.Call, op.Return)
+				}
+				t.Fatalf("history is not linearizable")
+			case linearizability.Unknown:
+				t.Logf("linearizability check timed out")
+			}
+		})
+	}
+}
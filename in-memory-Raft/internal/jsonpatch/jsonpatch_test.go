@@ -0,0 +1,115 @@
+package jsonpatch
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`["a"]`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{``, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`{"n":1.50}`, `{"m":2}`, `{"m":2,"n":1.50}`},
+	}
+
+	for _, tt := range tests {
+		var doc []byte
+		if tt.doc != "" {
+			doc = []byte(tt.doc)
+		}
+		got, err := MergePatch(doc, []byte(tt.patch))
+		if err != nil {
+			t.Fatalf("MergePatch(%s, %s) failed: %v", tt.doc, tt.patch, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("MergePatch(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"baz"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo"}`},
+		{`{"foo":{"bar":"baz"}}`, `[{"op":"move","from":"/foo/bar","path":"/qux"}]`, `{"foo":{},"qux":"baz"}`},
+		{`{"foo":["a","b","c"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/2"}]`, `{"foo":["a","c","b"]}`},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1.0},{"op":"remove","path":"/m~0n"}]`, `{"a/b":1}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	}
+
+	for _, tt := range tests {
+		got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+		if err != nil {
+			t.Fatalf("Apply(%s, %s) failed: %v", tt.doc, tt.patch, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Apply(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		doc, patch string
+		want       error
+	}{
+		{`{"foo":"bar"}`, `[{"op":"test","path":"/foo","value":"baz"}]`, ErrTestFailed},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, ErrPathNotFound},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":1}]`, ErrPathNotFound},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/5","value":1}]`, ErrPathNotFound},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/01","value":1}]`, ErrInvalidPointer},
+		{`{}`, `[{"op":"add","path":"foo","value":1}]`, ErrInvalidPointer},
+	}
+
+	for _, tt := range tests {
+		if _, err := Apply([]byte(tt.doc), []byte(tt.patch)); !errors.Is(err, tt.want) {
+			t.Errorf("Apply(%s, %s) error = %v, want %v", tt.doc, tt.patch, err, tt.want)
+		}
+	}
+
+	if _, err := ParsePatch([]byte(`[{"op":"frobnicate","path":"/a"}]`)); err == nil {
+		t.Errorf("expected unknown op to be rejected")
+	}
+	if _, err := ParsePatch([]byte(`[{"op":"add","path":"/a"}]`)); err == nil {
+		t.Errorf("expected add without value to be rejected")
+	}
+}
+
+func TestGet(t *testing.T) {
+	doc := []byte(`{"db":{"host":"localhost","ports":[5432,5433]},"":0}`)
+
+	tests := map[string]string{
+		"":            `{"":0,"db":{"host":"localhost","ports":[5432,5433]}}`,
+		"/db/host":    `"localhost"`,
+		"/db/ports/1": `5433`,
+		"/":           `0`,
+	}
+	for pointer, want := range tests {
+		got, err := Get(doc, pointer)
+		if err != nil {
+			t.Fatalf("Get(%q) failed: %v", pointer, err)
+		}
+		if string(got) != want {
+			t.Errorf("Get(%q) = %s, want %s", pointer, got, want)
+		}
+	}
+
+	if _, err := Get(doc, "/db/user"); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("expected ErrPathNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,770 @@
+// Package jsonschema validates JSON documents against a JSON Schema.
+//
+// It implements the validation vocabulary shared by drafts 7 and 2020-12:
+// type, enum, const, the numeric, string, array and object keywords, the
+// allOf/anyOf/oneOf/not combinators and local "$ref"s into "$defs" or
+// "definitions". Annotations such as title, description or format are
+// accepted and ignored.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalidSchema = errors.New("invalid JSON schema")
+
+// Error is a single validation failure. Path is a JSON pointer to the part of
+// the document that failed.
+type Error struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e Error) String() string {
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	return path + ": " + e.Message
+}
+
+// ValidationError lists every way a document failed its schema.
+type ValidationError struct {
+	Errors []Error
+}
+
+func (ve *ValidationError) Error() string {
+	msgs := make([]string, len(ve.Errors))
+	for i, e := range ve.Errors {
+		msgs[i] = e.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	root *node
+}
+
+// node is one compiled (sub)schema. Keywords that are absent keep their zero
+// value, with pointers and has* flags marking the optional ones.
+type node struct {
+	always *bool // boolean schema
+
+	ref  string
+	refd *node
+
+	types    []string
+	enum     []interface{}
+	hasConst bool
+	constant interface{}
+
+	minimum, maximum                   *big.Rat
+	exclusiveMinimum, exclusiveMaximum *big.Rat
+	multipleOf                         *big.Rat
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	items       *node
+	prefixItems []*node
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	properties        map[string]*node
+	patternProperties []patternNode
+	additional        *node
+	required          []string
+	minProperties     *int
+	maxProperties     *int
+
+	allOf, anyOf, oneOf []*node
+	not                 *node
+}
+
+type patternNode struct {
+	re   *regexp.Regexp
+	node *node
+}
+
+var typeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// Compile parses a schema document and checks that it is well-formed.
+func Compile(schema []byte) (*Schema, error) {
+	doc, err := decode(schema)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err)
+	}
+	c := &compiler{doc: doc, nodes: make(map[string]*node)}
+	root, err := c.compile(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := c.resolve(); err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+// Validate checks doc against the schema. It returns a *ValidationError when
+// the document does not match and another error if doc is not JSON.
+func (s *Schema) Validate(doc []byte) error {
+	v, err := decode(doc)
+	if err != nil {
+		return err
+	}
+	return s.ValidateValue(v)
+}
+
+// ValidateValue checks a document decoded with json.Number numbers.
+func (s *Schema) ValidateValue(v interface{}) error {
+	var errs []Error
+	s.root.validate(v, "", &errs)
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+func decode(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("unexpected data after the JSON document")
+	}
+	return v, nil
+}
+
+type compiler struct {
+	doc   interface{}
+	nodes map[string]*node // by JSON pointer into doc
+	refs  []*node
+}
+
+func (c *compiler) errorf(ptr, format string, args ...interface{}) error {
+	if ptr == "" {
+		ptr = "/"
+	}
+	return fmt.Errorf("%w: at %s: %s", ErrInvalidSchema, ptr, fmt.Sprintf(format, args...))
+}
+
+func (c *compiler) compile(v interface{}, ptr string) (*node, error) {
+	n := &node{}
+	c.nodes[ptr] = n
+
+	switch s := v.(type) {
+	case bool:
+		n.always = &s
+		return n, nil
+	case map[string]interface{}:
+		return n, c.compileObject(n, s, ptr)
+	default:
+		return nil, c.errorf(ptr, "schema must be an object or a boolean")
+	}
+}
+
+func (c *compiler) compileObject(n *node, s map[string]interface{}, ptr string) error {
+	sub := func(key string) (*node, error) {
+		v, ok := s[key]
+		if !ok {
+			return nil, nil
+		}
+		return c.compile(v, ptr+"/"+escape(key))
+	}
+	list := func(key string) ([]*node, error) {
+		v, ok := s[key]
+		if !ok {
+			return nil, nil
+		}
+		arr, ok := v.([]interface{})
+		if !ok || len(arr) == 0 {
+			return nil, c.errorf(ptr+"/"+key, "must be a non-empty array of schemas")
+		}
+		nodes := make([]*node, len(arr))
+		for i, item := range arr {
+			var err error
+			if nodes[i], err = c.compile(item, fmt.Sprintf("%s/%s/%d", ptr, key, i)); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	count := func(key string) (*int, error) {
+		v, ok := s[key]
+		if !ok {
+			return nil, nil
+		}
+		num, ok := v.(json.Number)
+		if !ok {
+			return nil, c.errorf(ptr+"/"+key, "must be a non-negative integer")
+		}
+		i, err := strconv.Atoi(num.String())
+		if err != nil || i < 0 {
+			return nil, c.errorf(ptr+"/"+key, "must be a non-negative integer")
+		}
+		return &i, nil
+	}
+	number := func(key string) (*big.Rat, error) {
+		v, ok := s[key]
+		if !ok {
+			return nil, nil
+		}
+		num, ok := v.(json.Number)
+		if !ok {
+			return nil, c.errorf(ptr+"/"+key, "must be a number")
+		}
+		r, ok := new(big.Rat).SetString(num.String())
+		if !ok {
+			return nil, c.errorf(ptr+"/"+key, "must be a number")
+		}
+		return r, nil
+	}
+
+	var err error
+	if ref, ok := s["$ref"]; ok {
+		if n.ref, ok = ref.(string); !ok {
+			return c.errorf(ptr+"/$ref", "must be a string")
+		}
+		c.refs = append(c.refs, n)
+	}
+
+	switch t := s["type"].(type) {
+	case nil:
+	case string:
+		n.types = []string{t}
+	case []interface{}:
+		for _, name := range t {
+			str, _ := name.(string)
+			n.types = append(n.types, str)
+		}
+	default:
+		return c.errorf(ptr+"/type", "must be a string or an array of strings")
+	}
+	for _, t := range n.types {
+		if !typeNames[t] {
+			return c.errorf(ptr+"/type", "unknown type '%s'", t)
+		}
+	}
+
+	if e, ok := s["enum"]; ok {
+		if n.enum, ok = e.([]interface{}); !ok {
+			return c.errorf(ptr+"/enum", "must be an array")
+		}
+	}
+	n.constant, n.hasConst = s["const"]
+
+	for key, dst := range map[string]**big.Rat{
+		"minimum":          &n.minimum,
+		"maximum":          &n.maximum,
+		"exclusiveMinimum": &n.exclusiveMinimum,
+		"exclusiveMaximum": &n.exclusiveMaximum,
+		"multipleOf":       &n.multipleOf,
+	} {
+		if *dst, err = number(key); err != nil {
+			return err
+		}
+	}
+	if n.multipleOf != nil && n.multipleOf.Sign() <= 0 {
+		return c.errorf(ptr+"/multipleOf", "must be greater than 0")
+	}
+
+	for key, dst := range map[string]**int{
+		"minLength":     &n.minLength,
+		"maxLength":     &n.maxLength,
+		"minItems":      &n.minItems,
+		"maxItems":      &n.maxItems,
+		"minProperties": &n.minProperties,
+		"maxProperties": &n.maxProperties,
+	} {
+		if *dst, err = count(key); err != nil {
+			return err
+		}
+	}
+
+	if p, ok := s["pattern"]; ok {
+		str, ok := p.(string)
+		if !ok {
+			return c.errorf(ptr+"/pattern", "must be a string")
+		}
+		if n.pattern, err = regexp.Compile(str); err != nil {
+			return c.errorf(ptr+"/pattern", "%s", err)
+		}
+	}
+
+	// Before 2020-12 an array under "items" described a tuple.
+	if arr, ok := s["items"].([]interface{}); ok {
+		for i, item := range arr {
+			sn, err := c.compile(item, fmt.Sprintf("%s/items/%d", ptr, i))
+			if err != nil {
+				return err
+			}
+			n.prefixItems = append(n.prefixItems, sn)
+		}
+		if n.items, err = sub("additionalItems"); err != nil {
+			return err
+		}
+	} else {
+		if n.items, err = sub("items"); err != nil {
+			return err
+		}
+		if n.prefixItems, err = list("prefixItems"); err != nil {
+			return err
+		}
+	}
+	if u, ok := s["uniqueItems"]; ok {
+		if n.uniqueItems, ok = u.(bool); !ok {
+			return c.errorf(ptr+"/uniqueItems", "must be a boolean")
+		}
+	}
+
+	if p, ok := s["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return c.errorf(ptr+"/properties", "must be an object")
+		}
+		n.properties = make(map[string]*node, len(props))
+		for name, ps := range props {
+			if n.properties[name], err = c.compile(ps, ptr+"/properties/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	}
+	if p, ok := s["patternProperties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return c.errorf(ptr+"/patternProperties", "must be an object")
+		}
+		patterns := make([]string, 0, len(props))
+		for pattern := range props {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			sp := ptr + "/patternProperties/" + escape(pattern)
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return c.errorf(sp, "%s", err)
+			}
+			pn, err := c.compile(props[pattern], sp)
+			if err != nil {
+				return err
+			}
+			n.patternProperties = append(n.patternProperties, patternNode{re: re, node: pn})
+		}
+	}
+	if n.additional, err = sub("additionalProperties"); err != nil {
+		return err
+	}
+	if r, ok := s["required"]; ok {
+		arr, ok := r.([]interface{})
+		if !ok {
+			return c.errorf(ptr+"/required", "must be an array of strings")
+		}
+		for _, name := range arr {
+			str, ok := name.(string)
+			if !ok {
+				return c.errorf(ptr+"/required", "must be an array of strings")
+			}
+			n.required = append(n.required, str)
+		}
+	}
+
+	if n.allOf, err = list("allOf"); err != nil {
+		return err
+	}
+	if n.anyOf, err = list("anyOf"); err != nil {
+		return err
+	}
+	if n.oneOf, err = list("oneOf"); err != nil {
+		return err
+	}
+	if n.not, err = sub("not"); err != nil {
+		return err
+	}
+
+	// Definitions are only compiled here so that references to them can
+	// be resolved; they do not validate anything by themselves.
+	for _, key := range []string{"$defs", "definitions"} {
+		defs, ok := s[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for name, def := range defs {
+			if _, err := c.compile(def, ptr+"/"+key+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve links every "$ref" to the schema it points to. Only references
+// within the document are supported.
+func (c *compiler) resolve() error {
+	// Compiling a referenced schema can add references of its own, so the
+	// list may grow while it is walked.
+	for i := 0; i < len(c.refs); i++ {
+		n := c.refs[i]
+		if !strings.HasPrefix(n.ref, "#") {
+			return fmt.Errorf("%w: only local references are supported, got '%s'", ErrInvalidSchema, n.ref)
+		}
+		ptr := n.ref[1:]
+		if target, ok := c.nodes[ptr]; ok {
+			n.refd = target
+			continue
+		}
+		v, err := lookup(c.doc, ptr)
+		if err != nil {
+			return fmt.Errorf("%w: unresolvable reference '%s'", ErrInvalidSchema, n.ref)
+		}
+		if n.refd, err = c.compile(v, ptr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lookup(doc interface{}, ptr string) (interface{}, error) {
+	if ptr == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, errors.New("invalid pointer")
+	}
+	v := doc
+	for _, token := range strings.Split(ptr[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = node[token]; !ok {
+				return nil, errors.New("not found")
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, errors.New("not found")
+			}
+			v = node[i]
+		default:
+			return nil, errors.New("not found")
+		}
+	}
+	return v, nil
+}
+
+func escape(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// maxRefDepth stops a schema that refers to itself without consuming any
+// part of the document.
+const maxRefDepth = 64
+
+func (n *node) validate(v interface{}, path string, errs *[]Error) {
+	n.validateDepth(v, path, errs, 0)
+}
+
+func (n *node) validateDepth(v interface{}, path string, errs *[]Error, depth int) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, Error{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if n.always != nil {
+		if !*n.always {
+			fail("no value is allowed here")
+		}
+		return
+	}
+	if n.refd != nil {
+		if depth >= maxRefDepth {
+			fail("schema references nest too deeply")
+			return
+		}
+		n.refd.validateDepth(v, path, errs, depth+1)
+	}
+
+	if len(n.types) > 0 && !hasType(v, n.types) {
+		fail("expected %s, got %s", strings.Join(n.types, " or "), typeOf(v))
+		return
+	}
+	if n.enum != nil && !contains(n.enum, v) {
+		fail("must be one of %s", encode(n.enum))
+	}
+	if n.hasConst && !equal(n.constant, v) {
+		fail("must be %s", encode(n.constant))
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		n.validateNumber(v, fail)
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n.minLength != nil && length < *n.minLength {
+			fail("must be at least %d characters long", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			fail("must be at most %d characters long", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(v) {
+			fail("must match pattern '%s'", n.pattern)
+		}
+	case []interface{}:
+		n.validateArray(v, path, errs, depth, fail)
+	case map[string]interface{}:
+		n.validateObject(v, path, errs, depth, fail)
+	}
+
+	for _, sn := range n.allOf {
+		sn.validateDepth(v, path, errs, depth)
+	}
+	if len(n.anyOf) > 0 {
+		matched := false
+		for _, sn := range n.anyOf {
+			if sn.matches(v, path, depth) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one of the schemas in anyOf")
+		}
+	}
+	if len(n.oneOf) > 0 {
+		matched := 0
+		for _, sn := range n.oneOf {
+			if sn.matches(v, path, depth) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one of the schemas in oneOf, matches %d", matched)
+		}
+	}
+	if n.not != nil && n.not.matches(v, path, depth) {
+		fail("must not match the schema in not")
+	}
+}
+
+func (n *node) matches(v interface{}, path string, depth int) bool {
+	var errs []Error
+	n.validateDepth(v, path, &errs, depth)
+	return len(errs) == 0
+}
+
+func (n *node) validateNumber(num json.Number, fail func(string, ...interface{})) {
+	r, ok := new(big.Rat).SetString(num.String())
+	if !ok {
+		fail("invalid number %s", num)
+		return
+	}
+	if n.minimum != nil && r.Cmp(n.minimum) < 0 {
+		fail("must be >= %s", n.minimum.RatString())
+	}
+	if n.maximum != nil && r.Cmp(n.maximum) > 0 {
+		fail("must be <= %s", n.maximum.RatString())
+	}
+	if n.exclusiveMinimum != nil && r.Cmp(n.exclusiveMinimum) <= 0 {
+		fail("must be > %s", n.exclusiveMinimum.RatString())
+	}
+	if n.exclusiveMaximum != nil && r.Cmp(n.exclusiveMaximum) >= 0 {
+		fail("must be < %s", n.exclusiveMaximum.RatString())
+	}
+	if n.multipleOf != nil && !new(big.Rat).Quo(r, n.multipleOf).IsInt() {
+		fail("must be a multiple of %s", n.multipleOf.RatString())
+	}
+}
+
+func (n *node) validateArray(arr []interface{}, path string, errs *[]Error, depth int, fail func(string, ...interface{})) {
+	if n.minItems != nil && len(arr) < *n.minItems {
+		fail("must have at least %d items", *n.minItems)
+	}
+	if n.maxItems != nil && len(arr) > *n.maxItems {
+		fail("must have at most %d items", *n.maxItems)
+	}
+	for i, item := range arr {
+		itemPath := path + "/" + strconv.Itoa(i)
+		switch {
+		case i < len(n.prefixItems):
+			n.prefixItems[i].validateDepth(item, itemPath, errs, depth)
+		case n.items != nil:
+			n.items.validateDepth(item, itemPath, errs, depth)
+		}
+	}
+	if n.uniqueItems {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if equal(arr[i], arr[j]) {
+					fail("items %d and %d are equal", i, j)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (n *node) validateObject(obj map[string]interface{}, path string, errs *[]Error, depth int, fail func(string, ...interface{})) {
+	if n.minProperties != nil && len(obj) < *n.minProperties {
+		fail("must have at least %d properties", *n.minProperties)
+	}
+	if n.maxProperties != nil && len(obj) > *n.maxProperties {
+		fail("must have at most %d properties", *n.maxProperties)
+	}
+	for _, name := range n.required {
+		if _, ok := obj[name]; !ok {
+			fail("missing required property '%s'", name)
+		}
+	}
+
+	// Properties are visited in order so that errors are reported the same
+	// way every time.
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propPath := path + "/" + escape(name)
+		known := false
+		if pn, ok := n.properties[name]; ok {
+			pn.validateDepth(obj[name], propPath, errs, depth)
+			known = true
+		}
+		for _, pp := range n.patternProperties {
+			if pp.re.MatchString(name) {
+				pp.node.validateDepth(obj[name], propPath, errs, depth)
+				known = true
+			}
+		}
+		if known || n.additional == nil {
+			continue
+		}
+		if n.additional.always != nil && !*n.additional.always {
+			*errs = append(*errs, Error{Path: propPath, Message: "property is not allowed"})
+			continue
+		}
+		n.additional.validateDepth(obj[name], propPath, errs, depth)
+	}
+}
+
+func hasType(v interface{}, types []string) bool {
+	for _, t := range types {
+		switch t {
+		case "integer":
+			if num, ok := v.(json.Number); ok && isInteger(num) {
+				return true
+			}
+		default:
+			if typeOf(v) == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func isInteger(num json.Number) bool {
+	if _, err := num.Int64(); err == nil {
+		return true
+	}
+	r, ok := new(big.Rat).SetString(num.String())
+	return ok && r.IsInt()
+}
+
+func contains(values []interface{}, v interface{}) bool {
+	for _, candidate := range values {
+		if equal(candidate, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal compares decoded JSON values; numbers are equal when their values
+// are, so 1 and 1.0 match.
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		ra, okA := new(big.Rat).SetString(a.String())
+		rb, okB := new(big.Rat).SetString(b.String())
+		if !okA || !okB {
+			fa, _ := a.Float64()
+			fb, _ := b.Float64()
+			return fa == fb && !math.IsNaN(fa)
+		}
+		return ra.Cmp(rb) == 0
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, va := range a {
+			vb, ok := b[k]
+			if !ok || !equal(va, vb) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func encode(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
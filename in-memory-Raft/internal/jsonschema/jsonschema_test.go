@@ -0,0 +1,127 @@
+package jsonschema
+
+import (
+	"errors"
+	"testing"
+)
+
+const configSchema = `{
+	"type": "object",
+	"required": ["name", "port"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "pattern": "^[a-z-]+$"},
+		"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+		"ratio": {"type": "number", "exclusiveMaximum": 1, "multipleOf": 0.05},
+		"mode": {"enum": ["fast", "safe"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true, "maxItems": 3},
+		"upstream": {"$ref": "#/$defs/endpoint"}
+	},
+	"$defs": {
+		"endpoint": {
+			"type": "object",
+			"required": ["host"],
+			"properties": {"host": {"type": "string"}, "next": {"$ref": "#/$defs/endpoint"}}
+		}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	schema, err := Compile([]byte(configSchema))
+	if err != nil {
+		t.Fatalf("failed to compile schema: %v", err)
+	}
+
+	tests := []struct {
+		doc  string
+		want []Error
+	}{
+		{`{"name": "api", "port": 8080}`, nil},
+		{`{"name": "api", "port": 8080.0, "ratio": 0.25, "mode": "safe", "tags": ["a", "b"]}`, nil},
+		{`{"name": "api", "port": 1, "upstream": {"host": "a", "next": {"host": "b"}}}`, nil},
+		{`[]`, []Error{{"", "expected object, got array"}}},
+		{`{"name": "api"}`, []Error{{"", "missing required property 'port'"}}},
+		{`{"name": "API", "port": "80"}`, []Error{
+			{"/name", "must match pattern '^[a-z-]+$'"},
+			{"/port", "expected integer, got string"},
+		}},
+		{`{"name": "api", "port": 70000, "debug": true}`, []Error{
+			{"/debug", "property is not allowed"},
+			{"/port", "must be <= 65535"},
+		}},
+		{`{"name": "api", "port": 1.5}`, []Error{{"/port", "expected integer, got number"}}},
+		{`{"name": "api", "port": 1, "ratio": 0.33}`, []Error{{"/ratio", "must be a multiple of 1/20"}}},
+		{`{"name": "api", "port": 1, "mode": "slow"}`, []Error{{"/mode", `must be one of ["fast","safe"]`}}},
+		{`{"name": "api", "port": 1, "tags": ["a", "a", 1]}`, []Error{
+			{"/tags/2", "expected string, got number"},
+			{"/tags", "items 0 and 1 are equal"},
+		}},
+		{`{"name": "api", "port": 1, "upstream": {"next": {"host": 1}}}`, []Error{
+			{"/upstream", "missing required property 'host'"},
+			{"/upstream/next/host", "expected string, got number"},
+		}},
+	}
+
+	for _, tt := range tests {
+		err := schema.Validate([]byte(tt.doc))
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("Validate(%s) failed: %v", tt.doc, err)
+			}
+			continue
+		}
+		var ve *ValidationError
+		if !errors.As(err, &ve) {
+			t.Errorf("Validate(%s) = %v, want a validation error", tt.doc, err)
+			continue
+		}
+		if len(ve.Errors) != len(tt.want) {
+			t.Errorf("Validate(%s) = %v, want %v", tt.doc, ve.Errors, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if ve.Errors[i] != tt.want[i] {
+				t.Errorf("Validate(%s) error %d = %v, want %v", tt.doc, i, ve.Errors[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestCombinators(t *testing.T) {
+	schema, err := Compile([]byte(`{
+		"oneOf": [{"type": "integer"}, {"type": "number", "minimum": 10}],
+		"not": {"const": 42}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to compile schema: %v", err)
+	}
+	for doc, valid := range map[string]bool{
+		`1`:    true,
+		`10.5`: true,
+		`12`:   false, // matches both
+		`42`:   false,
+		`2.5`:  false,
+		`"x"`:  false,
+	} {
+		if err := schema.Validate([]byte(doc)); (err == nil) != valid {
+			t.Errorf("Validate(%s) = %v, want valid %v", doc, err, valid)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, schema := range []string{
+		`"string"`,
+		`{"type": "text"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"$ref": "https://example.com/schema.json"}`,
+		`{"allOf": []}`,
+		`{"properties": {"a": 1}}`,
+	} {
+		if _, err := Compile([]byte(schema)); !errors.Is(err, ErrInvalidSchema) {
+			t.Errorf("Compile(%s) = %v, want ErrInvalidSchema", schema, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package linearizability
+
+// KVInput is a Get, Put or CAS of one key. CAS sets Value if the key holds
+// Old.
+type KVInput struct {
+	Op    string // "get", "put" or "cas"
+	Key   string
+	Value string
+	Old   string
+}
+
+// KVOutput is what the store answered. Found tells a missing key from an
+// empty value; OK tells whether a CAS swapped. Unknown marks operations
+// recorded with the Pending return time.
+type KVOutput struct {
+	Value   string
+	Found   bool
+	OK      bool
+	Unknown bool
+}
+
+type kvState struct {
+	value string
+	found bool
+}
+
+// KVModel is a map of independent registers, partitioned by key.
+var KVModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		byKey := make(map[string][]Operation)
+		var keys []string
+		for _, op := range history {
+			key := op.Input.(KVInput).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		partitions := make([][]Operation, 0, len(keys))
+		for _, key := range keys {
+			partitions = append(partitions, byKey[key])
+		}
+		return partitions
+	},
+	Init: func() interface{} {
+		return kvState{}
+	},
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		st := state.(kvState)
+		in := input.(KVInput)
+		out := output.(KVOutput)
+
+		switch in.Op {
+		case "get":
+			return out.Unknown || (out.Found == st.found && out.Value == st.value), st
+		case "put":
+			return true, kvState{value: in.Value, found: true}
+		case "cas":
+			swapped := st.found && st.value == in.Old
+			if out.Unknown {
+				if swapped {
+					return true, kvState{value: in.Value, found: true}
+				}
+				return true, st
+			}
+			if out.OK != swapped {
+				return false, st
+			}
+			if swapped {
+				return true, kvState{value: in.Value, found: true}
+			}
+			return true, st
+		default:
+			return false, st
+		}
+	},
+	Equal: func(a, b interface{}) bool {
+		return a.(kvState) == b.(kvState)
+	},
+}
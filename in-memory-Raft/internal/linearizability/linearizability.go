@@ -0,0 +1,258 @@
+// Package linearizability checks recorded histories of concurrent operations
+// against a sequential model, in the manner of Porcupine: the search of Wing
+// and Gong with the state cache of Lowe, run on each partition of the
+// history (usually one per key) independently.
+package linearizability
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Result of a check.
+type Result int
+
+const (
+	Ok      Result = iota // the history is linearizable
+	Illegal               // no linearization exists
+	Unknown               // the check timed out
+)
+
+func (r Result) String() string {
+	switch r {
+	case Ok:
+		return "ok"
+	case Illegal:
+		return "illegal"
+	default:
+		return "unknown"
+	}
+}
+
+// Pending is the return time of an operation whose outcome is unknown, such
+// as a write that timed out. It may take effect at any point after its call
+// or not at all, so the model must accept any output for it.
+const Pending int64 = math.MaxInt64
+
+// Operation is one call recorded by a client. Call and Return are
+// timestamps on a clock shared by every client.
+type Operation struct {
+	ClientID int
+	Input    interface{}
+	Output   interface{}
+	Call     int64
+	Return   int64
+}
+
+// Model is the sequential specification the history is checked against.
+type Model struct {
+	// Partition splits the history into independent parts, such as the
+	// operations of every key. Nil checks the history as a whole.
+	Partition func(history []Operation) [][]Operation
+	Init      func() interface{}
+	// Step applies input to state and reports whether the model could have
+	// produced output, and the resulting state.
+	Step  func(state, input, output interface{}) (bool, interface{})
+	Equal func(a, b interface{}) bool
+}
+
+// Check reports whether history is linearizable with respect to model, and
+// on Illegal the partition that is not. A timeout of zero waits for the
+// search to end.
+func Check(model Model, history []Operation, timeout time.Duration) (Result, []Operation) {
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	result := Ok
+	for _, p := range partitions {
+		switch checkPartition(model, p, deadline) {
+		case Illegal:
+			return Illegal, p
+		case Unknown:
+			result = Unknown
+		}
+	}
+	return result, nil
+}
+
+// entry is a call or a return in the doubly linked list of events the search
+// walks. A call points to its return through match.
+type entry struct {
+	id     int
+	input  interface{}
+	output interface{}
+	match  *entry
+	prev   *entry
+	next   *entry
+}
+
+type event struct {
+	id     int
+	call   bool
+	time   int64
+	input  interface{}
+	output interface{}
+}
+
+func makeList(history []Operation) *entry {
+	events := make([]event, 0, 2*len(history))
+	for i, op := range history {
+		events = append(events,
+			event{id: i, call: true, time: op.Call, input: op.Input},
+			event{id: i, time: op.Return, output: op.Output})
+	}
+	// Calls go first on equal times, so that such operations count as
+	// concurrent.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &entry{id: -1}
+	last := head
+	calls := make(map[int]*entry, len(history))
+	for _, ev := range events {
+		e := &entry{id: ev.id, prev: last}
+		if ev.call {
+			e.input = ev.input
+			calls[ev.id] = e
+		} else {
+			e.output = ev.output
+			calls[ev.id].match = e
+		}
+		last.next = e
+		last = e
+	}
+	return head
+}
+
+// lift takes a call and its return out of the list once the call is
+// linearized; unlift puts them back when the search backtracks.
+func lift(e *entry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func unlift(e *entry) {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << (uint(i) % 64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << (uint(i) % 64) }
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) equal(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h = (h ^ w) * 1099511628211
+	}
+	return h
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type frame struct {
+	entry *entry
+	state interface{}
+}
+
+func checkPartition(model Model, history []Operation, deadline time.Time) Result {
+	if len(history) == 0 {
+		return Ok
+	}
+	head := makeList(history)
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]cacheEntry)
+	var calls []frame
+
+	state := model.Init()
+	e := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if steps%1024 == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			return Unknown
+		}
+
+		if e.match != nil {
+			ok, next := model.Step(state, e.input, e.match.output)
+			if ok {
+				candidate := linearized.clone()
+				candidate.set(e.id)
+				if !cached(model, cache, candidate, next) {
+					h := candidate.hash()
+					cache[h] = append(cache[h], cacheEntry{candidate, next})
+					calls = append(calls, frame{e, state})
+					state = next
+					linearized.set(e.id)
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// A return was reached before its call could be linearized: undo
+		// the latest choice and try the next call after it.
+		if len(calls) == 0 {
+			return Illegal
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		state = top.state
+		linearized.clear(top.entry.id)
+		unlift(top.entry)
+		e = top.entry.next
+	}
+	return Ok
+}
+
+func cached(model Model, cache map[uint64][]cacheEntry, linearized bitset, state interface{}) bool {
+	for _, c := range cache[linearized.hash()] {
+		if c.linearized.equal(linearized) && model.Equal(c.state, state) {
+			return true
+		}
+	}
+	return false
+}
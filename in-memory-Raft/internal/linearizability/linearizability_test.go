@@ -0,0 +1,79 @@
+package linearizability
+
+import (
+	"testing"
+	"time"
+)
+
+func put(client int, key, value string, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KVInput{Op: "put", Key: key, Value: value}, Output: KVOutput{}, Call: call, Return: ret}
+}
+
+func get(client int, key, value string, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KVInput{Op: "get", Key: key}, Output: KVOutput{Value: value, Found: value != ""}, Call: call, Return: ret}
+}
+
+func cas(client int, key, old, value string, ok bool, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: KVInput{Op: "cas", Key: key, Old: old, Value: value}, Output: KVOutput{OK: ok}, Call: call, Return: ret}
+}
+
+func pending(op Operation) Operation {
+	op.Return = Pending
+	op.Output = KVOutput{Unknown: true}
+	return op
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []Operation
+		want    Result
+	}{
+		{"sequential", []Operation{
+			put(0, "x", "1", 0, 10), get(1, "x", "1", 20, 30), put(0, "x", "2", 40, 50), get(1, "x", "2", 60, 70),
+		}, Ok},
+		{"stale read", []Operation{
+			put(0, "x", "1", 0, 10), put(0, "x", "2", 20, 30), get(1, "x", "1", 40, 50),
+		}, Illegal},
+		{"read during a write", []Operation{
+			put(0, "x", "1", 0, 100), get(1, "x", "", 10, 20), get(1, "x", "1", 30, 40), get(2, "x", "1", 50, 60),
+		}, Ok},
+		{"value goes back", []Operation{
+			put(0, "x", "1", 0, 100), get(1, "x", "1", 10, 20), get(1, "x", "", 30, 40),
+		}, Illegal},
+		{"concurrent reads disagree", []Operation{
+			put(0, "x", "1", 0, 100), get(1, "x", "1", 10, 50), get(2, "x", "", 60, 70),
+		}, Illegal},
+		{"pending write seen", []Operation{
+			put(0, "x", "1", 0, 10), pending(put(1, "x", "2", 20, 0)), get(2, "x", "2", 30, 40), get(2, "x", "2", 50, 60),
+		}, Ok},
+		{"pending write never seen", []Operation{
+			put(0, "x", "1", 0, 10), pending(put(1, "x", "2", 20, 0)), get(2, "x", "1", 30, 40),
+		}, Ok},
+		{"one CAS wins", []Operation{
+			put(0, "x", "0", 0, 10), cas(1, "x", "0", "1", true, 20, 40), cas(2, "x", "0", "2", false, 20, 40), get(0, "x", "1", 50, 60),
+		}, Ok},
+		{"two CAS win", []Operation{
+			put(0, "x", "0", 0, 10), cas(1, "x", "0", "1", true, 20, 40), cas(2, "x", "0", "2", true, 20, 40),
+		}, Illegal},
+		{"keys are independent", []Operation{
+			put(0, "x", "1", 0, 10), put(1, "y", "1", 0, 10), get(2, "x", "1", 20, 30), get(2, "y", "1", 20, 30),
+		}, Ok},
+	}
+	for _, tt := range tests {
+		if got, _ := Check(KVModel, tt.history, time.Second); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckReportsPartition(t *testing.T) {
+	history := []Operation{
+		put(0, "x", "1", 0, 10), get(1, "x", "1", 20, 30),
+		put(0, "y", "1", 0, 10), get(1, "y", "2", 20, 30),
+	}
+	result, bad := Check(KVModel, history, time.Second)
+	if result != Illegal || len(bad) != 2 || bad[0].Input.(KVInput).Key != "y" {
+		t.Fatalf("expected key y to be reported, got %s %v", result, bad)
+	}
+}
@@ -0,0 +1,48 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Handler serves the status of the agent as JSON on /status and in the
+// Prometheus text format on /metrics.
+func (m *Mirror) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/status", m.handleStatus).Methods("GET")
+	r.HandleFunc("/metrics", m.handleMetrics).Methods("GET")
+	return r
+}
+
+func (m *Mirror) handleStatus(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(m.Status())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (m *Mirror) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	st := m.Status()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"mirror_checkpoint_revision", "gauge", "Source revision the destination caught up with.", st.Checkpoint},
+		{"mirror_source_revision", "gauge", "Latest revision of the source known to the agent.", st.SourceRevision},
+		{"mirror_lag_revisions", "gauge", "Source revisions the destination has not caught up with.", st.Lag},
+		{"mirror_lag_seconds", "gauge", "Age of the source state the destination reflects.", st.LagSeconds},
+		{"mirror_applied_total", "counter", "Changes written to the destination.", st.Applied},
+		{"mirror_resyncs_total", "counter", "Full copies of the source after a lost checkpoint.", st.Resyncs},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+		fmt.Fprintf(w, "%s %v\n", metric.name, metric.value)
+	}
+}
@@ -0,0 +1,459 @@
+// Package mirror copies the changes of a source cluster to a destination
+// cluster asynchronously, as a primary to secondary mirror between
+// datacenters. The agent tails the change stream of the source and writes
+// the changes of the mirrored keys to the destination, optionally under
+// other prefixes.
+//
+// The source revision the destination reached is kept in a checkpoint file,
+// so that a restarted agent resumes where it stopped. When the source
+// compacted its history past the checkpoint, or is another cluster than the
+// one the checkpoint belongs to, the agent copies a snapshot of the source
+// instead and deletes the mirrored keys the source no longer has.
+package mirror
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"inmemoryraft/internal/client"
+	"inmemoryraft/internal/services"
+)
+
+const defaultInterval = time.Second
+
+// Rewrite moves the keys starting with From under To on the destination.
+type Rewrite struct {
+	From string
+	To   string
+}
+
+type Config struct {
+	Source      []string // HTTP endpoints of the source cluster
+	Destination []string // HTTP endpoints of the destination cluster
+
+	// Prefixes selects the mirrored keys, every key if empty. Rewrites
+	// apply to them, the longest matching From winning.
+	Prefixes []string
+	Rewrites []Rewrite
+
+	Checkpoint string        // path of the checkpoint file
+	Interval   time.Duration // of the checkpoint saves and the lag polls, 1s if zero
+}
+
+// Status describes the progress of the agent. Lag counts the revisions of
+// the source the destination has not caught up with; LagSeconds is how old
+// the state of the source the destination reflects is, as seen by the
+// polls of the source.
+type Status struct {
+	ClusterID      string    `json:"cluster_id"`
+	Checkpoint     uint64    `json:"checkpoint"`
+	SourceRevision uint64    `json:"source_revision"`
+	Lag            uint64    `json:"lag"`
+	LagSeconds     float64   `json:"lag_seconds"`
+	Applied        uint64    `json:"applied"`
+	Resyncs        uint64    `json:"resyncs"`
+	LastError      string    `json:"last_error,omitempty"`
+	LastErrorAt    time.Time `json:"last_error_at,omitempty"`
+}
+
+type checkpoint struct {
+	ClusterID string `json:"cluster_id"`
+	Revision  uint64 `json:"revision"`
+}
+
+// sample is a revision the source had reached at some point.
+type sample struct {
+	at       time.Time
+	revision uint64
+}
+
+type Mirror struct {
+	config Config
+	source *client.Client
+	dest   *client.Client
+	logger *log.Logger
+
+	mutex      sync.Mutex
+	checkpoint checkpoint
+	savedAt    time.Time
+	status     Status
+	pending    []sample  // polls of the source beyond the checkpoint, oldest first
+	syncedAt   time.Time // the destination reflects the source as of then
+}
+
+func New(config Config) (*Mirror, error) {
+	if len(config.Source) == 0 || len(config.Destination) == 0 {
+		return nil, errors.New("source and destination endpoints are required")
+	}
+	if config.Checkpoint == "" {
+		return nil, errors.New("checkpoint file is required")
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultInterval
+	}
+	return &Mirror{
+		config:   config,
+		source:   client.New(config.Source),
+		dest:     client.New(config.Destination),
+		logger:   log.New(os.Stderr, "[mirror] ", log.LstdFlags),
+		syncedAt: time.Now(),
+	}, nil
+}
+
+// Run mirrors the source until ctx is cancelled, saving the checkpoint
+// before returning. Errors are retried; only a checkpoint that cannot be
+// read stops it.
+func (m *Mirror) Run(ctx context.Context) error {
+	if err := m.load(); err != nil {
+		return err
+	}
+	defer m.save()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.pollSource(ctx)
+	}()
+	defer wg.Wait()
+
+	for {
+		err := m.follow(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var compacted *services.CompactedError
+		if errors.As(err, &compacted) {
+			m.logger.Printf("changes since revision %d are compacted (history starts at %d), resyncing",
+				m.Status().Checkpoint, compacted.Revision)
+			m.mutex.Lock()
+			m.checkpoint.Revision = 0
+			m.mutex.Unlock()
+			continue
+		}
+		if err != nil {
+			m.fail(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(m.config.Interval):
+		}
+	}
+}
+
+// follow applies the change stream of the source from the checkpoint on, or
+// from a snapshot when there is none.
+func (m *Mirror) follow(ctx context.Context) error {
+	id, err := m.source.ClusterID()
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	if id != m.checkpoint.ClusterID {
+		if m.checkpoint.ClusterID != "" {
+			m.logger.Printf("source is cluster %s, not %s as checkpointed, resyncing", id, m.checkpoint.ClusterID)
+		}
+		m.checkpoint = checkpoint{ClusterID: id}
+		m.status.ClusterID = id
+	}
+	revision := m.checkpoint.Revision
+	m.mutex.Unlock()
+
+	// The checkpoint is resumed from itself on: the changes at its revision
+	// may not all have been applied, and applying them twice is harmless.
+	var snapshot map[string]services.Event
+	if revision == 0 {
+		snapshot = make(map[string]services.Event)
+	}
+	return m.source.Changes(ctx, m.streamPrefix(), revision, func(ev services.Event) error {
+		switch {
+		case ev.Type == services.EventSync:
+			if err := m.resync(snapshot); err != nil {
+				return err
+			}
+			snapshot = nil
+			m.advance(ev.Index)
+			return m.save()
+		case snapshot != nil:
+			if m.mirrored(ev.Key) {
+				snapshot[ev.Key] = ev
+			}
+			return nil
+		case ev.Type == services.EventProgress, !m.mirrored(ev.Key):
+			m.advance(ev.Index)
+		default:
+			if err := m.apply(ev); err != nil {
+				return err
+			}
+			m.advance(ev.Index)
+		}
+		m.mutex.Lock()
+		due := time.Since(m.savedAt) >= m.config.Interval
+		m.mutex.Unlock()
+		if due {
+			return m.save()
+		}
+		return nil
+	})
+}
+
+// apply writes a change of the source to the destination.
+func (m *Mirror) apply(ev services.Event) error {
+	key := m.rewrite(ev.Key)
+	var err error
+	if ev.Type == services.EventDelete {
+		if err = m.dest.Delete(key); errors.Is(err, client.ErrNotFound) {
+			err = nil
+		}
+	} else {
+		var value []byte
+		if value, err = eventValue(ev); err == nil {
+			err = m.dest.PutValue(key, value, ev.ValueType)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s of '%s' at revision %d: %w", ev.Type, ev.Key, ev.Index, err)
+	}
+	m.mutex.Lock()
+	m.status.Applied++
+	m.mutex.Unlock()
+	return nil
+}
+
+// resync makes the mirrored keys of the destination those of the snapshot.
+func (m *Mirror) resync(snapshot map[string]services.Event) error {
+	want := make(map[string]services.Event, len(snapshot))
+	for k, ev := range snapshot {
+		want[m.rewrite(k)] = ev
+	}
+	have := make(map[string]string)
+	for _, prefix := range m.destPrefixes() {
+		kvs, err := m.dest.List(prefix)
+		if err != nil {
+			return fmt.Errorf("list destination: %w", err)
+		}
+		for k, v := range kvs {
+			have[k] = v
+		}
+	}
+
+	var deleted, written int
+	for k := range have {
+		if _, ok := want[k]; !ok {
+			if err := m.dest.Delete(k); err != nil && !errors.Is(err, client.ErrNotFound) {
+				return fmt.Errorf("delete '%s': %w", k, err)
+			}
+			deleted++
+		}
+	}
+	for k, ev := range want {
+		// Lists carry binary values in base64, as events do.
+		if v, ok := have[k]; ok && v == ev.Value {
+			continue
+		}
+		value, err := eventValue(ev)
+		if err != nil {
+			return err
+		}
+		if err := m.dest.PutValue(k, value, ev.ValueType); err != nil {
+			return fmt.Errorf("put '%s': %w", k, err)
+		}
+		written++
+	}
+
+	m.mutex.Lock()
+	m.status.Resyncs++
+	m.status.Applied += uint64(deleted + written)
+	m.mutex.Unlock()
+	m.logger.Printf("resynced %d keys from a snapshot: %d written, %d deleted", len(want), written, deleted)
+	return nil
+}
+
+func eventValue(ev services.Event) ([]byte, error) {
+	if ev.ValueType == services.TypeBinary {
+		return base64.StdEncoding.DecodeString(ev.Value)
+	}
+	return []byte(ev.Value), nil
+}
+
+// advance moves the checkpoint to revision, every change of the mirrored
+// keys up to it being applied.
+func (m *Mirror) advance(revision uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if revision <= m.checkpoint.Revision {
+		return
+	}
+	m.checkpoint.Revision = revision
+	m.status.SourceRevision = max(m.status.SourceRevision, revision)
+	for len(m.pending) > 0 && m.pending[0].revision <= revision {
+		m.syncedAt = m.pending[0].at
+		m.pending = m.pending[1:]
+	}
+}
+
+// pollSource samples the revision of the source, for the lag.
+func (m *Mirror) pollSource(ctx context.Context) {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		statuses, err := m.source.Status()
+		if err != nil {
+			continue
+		}
+		var revision uint64
+		for _, st := range statuses {
+			revision = max(revision, st.Revision)
+		}
+		now := time.Now()
+		m.mutex.Lock()
+		m.status.SourceRevision = max(m.status.SourceRevision, revision)
+		if revision > m.checkpoint.Revision {
+			m.pending = append(m.pending, sample{at: now, revision: revision})
+		} else {
+			m.syncedAt = now
+		}
+		m.mutex.Unlock()
+	}
+}
+
+func (m *Mirror) Status() Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	st := m.status
+	st.Checkpoint = m.checkpoint.Revision
+	if st.SourceRevision > st.Checkpoint {
+		st.Lag = st.SourceRevision - st.Checkpoint
+	}
+	if len(m.pending) > 0 {
+		st.LagSeconds = time.Since(m.syncedAt).Seconds()
+	}
+	return st
+}
+
+func (m *Mirror) fail(err error) {
+	m.logger.Printf("mirroring failed: %s", err)
+	m.mutex.Lock()
+	m.status.LastError = err.Error()
+	m.status.LastErrorAt = time.Now()
+	m.mutex.Unlock()
+}
+
+func (m *Mirror) mirrored(key string) bool {
+	if len(m.config.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range m.config.Prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mirror) rewrite(key string) string {
+	best := -1
+	for i, r := range m.config.Rewrites {
+		if strings.HasPrefix(key, r.From) && (best < 0 || len(r.From) > len(m.config.Rewrites[best].From)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return key
+	}
+	r := m.config.Rewrites[best]
+	return r.To + key[len(r.From):]
+}
+
+// streamPrefix is the longest prefix common to the mirrored keys, which the
+// source filters on; the agent filters further.
+func (m *Mirror) streamPrefix() string {
+	if len(m.config.Prefixes) == 0 {
+		return ""
+	}
+	common := m.config.Prefixes[0]
+	for _, p := range m.config.Prefixes[1:] {
+		for !strings.HasPrefix(p, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	return common
+}
+
+// destPrefixes returns the prefixes the mirrored keys are written under on
+// the destination, none of them under another.
+func (m *Mirror) destPrefixes() []string {
+	prefixes := m.config.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	var result []string
+	for _, p := range prefixes {
+		result = append(result, m.rewrite(p))
+		for _, r := range m.config.Rewrites {
+			if strings.HasPrefix(r.From, p) {
+				result = append(result, r.To)
+			}
+		}
+	}
+	sort.Strings(result)
+	kept := result[:0]
+	for _, p := range result {
+		if len(kept) == 0 || !strings.HasPrefix(p, kept[len(kept)-1]) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+func (m *Mirror) load() error {
+	b, err := os.ReadFile(m.config.Checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := json.Unmarshal(b, &m.checkpoint); err != nil {
+		return fmt.Errorf("checkpoint %s: %w", m.config.Checkpoint, err)
+	}
+	m.status.ClusterID = m.checkpoint.ClusterID
+	m.logger.Printf("resuming cluster %s at revision %d", m.checkpoint.ClusterID, m.checkpoint.Revision)
+	return nil
+}
+
+// save writes the checkpoint to a temporary file first, so that a crash
+// never leaves a truncated one.
+func (m *Mirror) save() error {
+	m.mutex.Lock()
+	cp := m.checkpoint
+	m.savedAt = time.Now()
+	m.mutex.Unlock()
+	if cp.ClusterID == "" {
+		return nil
+	}
+
+	b, _ := json.Marshal(cp)
+	tmp := m.config.Checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.config.Checkpoint)
+}
@@ -0,0 +1,214 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"inmemoryraft/internal/services"
+	"inmemoryraft/internal/testcluster"
+)
+
+func startCluster(t *testing.T) (*testcluster.Cluster, *services.InMemoryStore) {
+	t.Helper()
+	c := testcluster.Start(t, testcluster.Config{Nodes: 1, HTTP: true})
+	return c, c.WaitForLeader().Store
+}
+
+func endpoints(c *testcluster.Cluster) []string {
+	var result []string
+	for _, n := range c.Nodes() {
+		result = append(result, n.HTTPAddr)
+	}
+	return result
+}
+
+// run starts an agent and returns a function stopping it.
+func run(t *testing.T, config Config) (*Mirror, func()) {
+	t.Helper()
+	config.Interval = 50 * time.Millisecond
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- m.Run(ctx) }()
+	stop := func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("run: %s", err)
+		}
+	}
+	t.Cleanup(func() {
+		if ctx.Err() == nil {
+			stop()
+		}
+	})
+	return m, stop
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForKeys(t *testing.T, store *services.InMemoryStore, prefix string, want map[string]string) {
+	t.Helper()
+	waitFor(t, "the destination to hold "+prefix+"*", func() bool {
+		return reflect.DeepEqual(store.List(prefix), want)
+	})
+}
+
+func put(t *testing.T, store *services.InMemoryStore, key, value string) {
+	t.Helper()
+	if err := store.Put(context.Background(), key, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func del(t *testing.T, store *services.InMemoryStore, key string) {
+	t.Helper()
+	if err := store.Delete(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	src, source := startCluster(t)
+	dst, dest := startCluster(t)
+	ctx := context.Background()
+
+	put(t, source, "app.a", "1")
+	put(t, source, "app.db.host", "db1")
+	put(t, source, "other.x", "no")
+	if err := source.PutBinary(ctx, "app.bin", []byte{0xff, 0}); err != nil {
+		t.Fatal(err)
+	}
+	put(t, dest, "dc1.app.stale", "old")
+	put(t, dest, "local", "kept")
+
+	m, _ := run(t, Config{
+		Source:      endpoints(src),
+		Destination: endpoints(dst),
+		Prefixes:    []string{"app."},
+		Rewrites:    []Rewrite{{From: "app.", To: "dc1.app."}, {From: "app.db.", To: "dc1.db."}},
+		Checkpoint:  filepath.Join(t.TempDir(), "checkpoint.json"),
+	})
+
+	waitForKeys(t, dest, "dc1.", map[string]string{
+		"dc1.app.a":   "1",
+		"dc1.app.bin": "\xff\x00",
+		"dc1.db.host": "db1",
+	})
+	if typ := dest.ValueType("dc1.app.bin"); typ != services.TypeBinary {
+		t.Errorf("dc1.app.bin is of type %s", typ)
+	}
+
+	put(t, source, "app.b", "2")
+	del(t, source, "app.a")
+	put(t, source, "app.db.host", "db2")
+	put(t, source, "other.y", "no")
+	waitForKeys(t, dest, "dc1.", map[string]string{
+		"dc1.app.b":   "2",
+		"dc1.app.bin": "\xff\x00",
+		"dc1.db.host": "db2",
+	})
+	if got := dest.List(""); got["local"] != "kept" || got["other.x"] != "" || got["other.y"] != "" {
+		t.Errorf("destination holds %v", got)
+	}
+
+	waitFor(t, "the lag to vanish", func() bool {
+		st := m.Status()
+		return st.Lag == 0 && st.LagSeconds == 0 && st.Checkpoint >= source.Revision()-1
+	})
+	if st := m.Status(); st.Resyncs != 1 || st.ClusterID != source.ClusterID() {
+		t.Errorf("status is %+v", st)
+	}
+
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "mirror_lag_revisions 0\n") || !strings.Contains(string(b), "mirror_resyncs_total 1\n") {
+		t.Errorf("metrics are\n%s", b)
+	}
+}
+
+// TestResume checks that a restarted agent goes on from its checkpoint
+// rather than copying the source again.
+func TestResume(t *testing.T) {
+	src, source := startCluster(t)
+	dst, dest := startCluster(t)
+	config := Config{
+		Source:      endpoints(src),
+		Destination: endpoints(dst),
+		Prefixes:    []string{"app."},
+		Checkpoint:  filepath.Join(t.TempDir(), "checkpoint.json"),
+	}
+
+	put(t, source, "app.a", "1")
+	_, stop := run(t, config)
+	waitForKeys(t, dest, "app.", map[string]string{"app.a": "1"})
+	stop()
+
+	put(t, source, "app.b", "2")
+	del(t, source, "app.a")
+	// A resync would delete it.
+	put(t, dest, "app.local", "kept")
+
+	m, _ := run(t, config)
+	waitForKeys(t, dest, "app.", map[string]string{"app.b": "2", "app.local": "kept"})
+	if st := m.Status(); st.Resyncs != 0 {
+		t.Errorf("resumed agent resynced: %+v", st)
+	}
+}
+
+// TestResyncAfterCompaction checks that an agent whose checkpoint fell
+// behind the history of the source copies it again.
+func TestResyncAfterCompaction(t *testing.T) {
+	src, source := startCluster(t)
+	dst, dest := startCluster(t)
+	config := Config{
+		Source:      endpoints(src),
+		Destination: endpoints(dst),
+		Checkpoint:  filepath.Join(t.TempDir(), "checkpoint.json"),
+	}
+
+	put(t, source, "a", "1")
+	put(t, source, "b", "1")
+	_, stop := run(t, config)
+	waitForKeys(t, dest, "", map[string]string{"a": "1", "b": "1"})
+	stop()
+
+	del(t, source, "a")
+	put(t, source, "b", "2")
+	put(t, source, "c", "3")
+	if err := source.Compact(context.Background(), source.Revision()); err != nil {
+		t.Fatal(err)
+	}
+
+	m, _ := run(t, config)
+	waitForKeys(t, dest, "", map[string]string{"b": "2", "c": "3"})
+	if st := m.Status(); st.Resyncs != 1 {
+		t.Errorf("agent did not resync: %+v", st)
+	}
+
+	put(t, source, "d", "4")
+	waitForKeys(t, dest, "", map[string]string{"b": "2", "c": "3", "d": "4"})
+}
@@ -0,0 +1,386 @@
+package resp
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"inmemoryraft/internal/services"
+)
+
+const defaultScanCount = 10
+
+const (
+	errSyntax        = "ERR syntax error"
+	errNotInteger    = "ERR value is not an integer or out of range"
+	errReadOnly      = "READONLY You can't write against a read only replica."
+	errBinaryMSET    = "ERR MSET values must be valid UTF-8, use SET for binary values"
+	errDecrOverflow  = "ERR decrement would overflow"
+	errInvalidCursor = "ERR invalid cursor"
+)
+
+// command is a Redis command. arity counts the command name too; a negative
+// arity is a minimum, as in the COMMAND reply of Redis.
+type command struct {
+	arity int
+	fn    func(s *Server, ctx context.Context, w *writer, args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":    {-1, (*Server).ping},
+		"echo":    {2, (*Server).echo},
+		"select":  {2, (*Server).selectDB},
+		"command": {-1, (*Server).commandInfo},
+		"get":     {2, (*Server).get},
+		"set":     {-3, (*Server).set},
+		"del":     {-2, (*Server).del},
+		"exists":  {-2, (*Server).exists},
+		"keys":    {2, (*Server).keys},
+		"scan":    {-2, (*Server).scan},
+		"dbsize":  {1, (*Server).dbsize},
+		"ttl":     {2, (*Server).ttl},
+		"pttl":    {2, (*Server).ttl},
+		"incr":    {2, (*Server).incr},
+		"decr":    {2, (*Server).incr},
+		"incrby":  {3, (*Server).incr},
+		"decrby":  {3, (*Server).incr},
+		"mget":    {-2, (*Server).mget},
+		"mset":    {-3, (*Server).mset},
+	}
+}
+
+// exec runs one command and tells whether the client asked to disconnect.
+func (s *Server) exec(ctx context.Context, w *writer, args []string) (quit bool) {
+	name := strings.ToLower(args[0])
+	if name == "quit" {
+		w.simple("OK")
+		return true
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		var b strings.Builder
+		for _, arg := range args[1:] {
+			b.WriteString("'" + arg + "' ")
+		}
+		w.error("ERR unknown command '" + args[0] + "', with args beginning with: " + b.String())
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		w.error("ERR wrong number of arguments for '" + name + "' command")
+		return false
+	}
+	cmd.fn(s, ctx, w, args)
+	return false
+}
+
+// writeError answers with the Redis error closest to err.
+func writeError(w *writer, err error) {
+	switch {
+	case errors.Is(err, services.ErrNotLeader):
+		w.error(errReadOnly)
+	case errors.Is(err, services.ErrNotInteger):
+		w.error(errNotInteger)
+	default:
+		w.error("ERR " + err.Error())
+	}
+}
+
+func (s *Server) ping(ctx context.Context, w *writer, args []string) {
+	switch len(args) {
+	case 1:
+		w.simple("PONG")
+	case 2:
+		w.bulk(args[1])
+	default:
+		w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *Server) echo(ctx context.Context, w *writer, args []string) {
+	w.bulk(args[1])
+}
+
+// selectDB accepts the only database there is, which clients select on
+// connect.
+func (s *Server) selectDB(ctx context.Context, w *writer, args []string) {
+	if args[1] != "0" {
+		w.error("ERR DB index is out of range")
+		return
+	}
+	w.simple("OK")
+}
+
+// commandInfo answers COMMAND and its subcommands, which redis-cli sends on
+// connect, with an empty array: clients then fall back to their defaults.
+func (s *Server) commandInfo(ctx context.Context, w *writer, args []string) {
+	w.array(0)
+}
+
+func (s *Server) get(ctx context.Context, w *writer, args []string) {
+	value, _, ok := s.store.Lookup(args[1])
+	if !ok {
+		w.null()
+		return
+	}
+	w.bulk(value)
+}
+
+// set supports the EX and PX options, which attach the key to a lease
+// granted for it. Without them the key loses its TTL, as in Redis.
+func (s *Server) set(ctx context.Context, w *writer, args []string) {
+	key, value := args[1], args[2]
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToLower(args[i])
+		if (opt != "ex" && opt != "px") || ttl != 0 || i+1 == len(args) {
+			w.error(errSyntax)
+			return
+		}
+		i++
+		n, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil {
+			w.error(errNotInteger)
+			return
+		}
+		unit := time.Millisecond
+		if opt == "ex" {
+			unit = time.Second
+		}
+		if n <= 0 || n > int64(math.MaxInt64/unit) {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(n) * unit
+	}
+
+	var lease int64
+	if ttl > 0 {
+		l, err := s.store.GrantLease(ctx, 0, ttl)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		lease = l.ID
+	}
+	if err := s.store.PutWithLease(ctx, key, value, lease); err != nil {
+		if lease != 0 {
+			s.store.RevokeLease(ctx, lease)
+		}
+		writeError(w, err)
+		return
+	}
+	w.simple("OK")
+}
+
+func (s *Server) del(ctx context.Context, w *writer, args []string) {
+	n, err := s.store.DeleteMany(ctx, args[1:]...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.integer(int64(n))
+}
+
+// exists counts a key given several times once per time, as Redis does.
+func (s *Server) exists(ctx context.Context, w *writer, args []string) {
+	var n int64
+	for _, key := range args[1:] {
+		if _, _, ok := s.store.Lookup(key); ok {
+			n++
+		}
+	}
+	w.integer(n)
+}
+
+func (s *Server) keys(ctx context.Context, w *writer, args []string) {
+	pattern := args[1]
+	var keys []string
+	for k := range s.store.List(literalPrefix(pattern)) {
+		if match(pattern, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	w.array(len(keys))
+	for _, k := range keys {
+		w.bulk(k)
+	}
+}
+
+// scanPosition orders the keys for SCAN. The cursor is the position to
+// resume from, so that keys written or deleted between calls do not shift
+// the others: every key present for the whole scan is returned, as Redis
+// guarantees. Zero is kept for the start and the end of a scan.
+func scanPosition(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()>>1 + 1
+}
+
+// scan walks the whole keyspace on every call, sorting it by position, which
+// is fine for the sizes an in-memory store holds.
+func (s *Server) scan(ctx context.Context, w *writer, args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		w.error(errInvalidCursor)
+		return
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.error(errSyntax)
+			return
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				w.error(errNotInteger)
+				return
+			}
+			if n < 1 {
+				w.error(errSyntax)
+				return
+			}
+			count = n
+		default:
+			w.error(errSyntax)
+			return
+		}
+	}
+
+	type entry struct {
+		pos uint64
+		key string
+	}
+	var entries []entry
+	for k := range s.store.List(literalPrefix(pattern)) {
+		if pos := scanPosition(k); pos >= cursor {
+			entries = append(entries, entry{pos, k})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].pos != entries[j].pos {
+			return entries[i].pos < entries[j].pos
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	// Keys sharing a position are returned together, as the cursor cannot
+	// point between them. COUNT is a hint, as in Redis: keys that do not
+	// match still count against it.
+	var keys []string
+	next := uint64(0)
+	for i, e := range entries {
+		if i >= count && e.pos != entries[i-1].pos {
+			next = e.pos
+			break
+		}
+		if match(pattern, e.key) {
+			keys = append(keys, e.key)
+		}
+	}
+
+	w.array(2)
+	w.bulk(strconv.FormatUint(next, 10))
+	w.array(len(keys))
+	for _, k := range keys {
+		w.bulk(k)
+	}
+}
+
+func (s *Server) dbsize(ctx context.Context, w *writer, args []string) {
+	w.integer(int64(len(s.store.List(""))))
+}
+
+// ttl answers TTL and PTTL: -2 for a missing key, -1 for a key without a
+// lease, otherwise the time left on its lease.
+func (s *Server) ttl(ctx context.Context, w *writer, args []string) {
+	key := args[1]
+	if _, _, ok := s.store.Lookup(key); !ok {
+		w.integer(-2)
+		return
+	}
+	l, err := s.store.KeyLease(key)
+	if err != nil {
+		w.integer(-1)
+		return
+	}
+	left := time.Until(l.Expires)
+	if strings.ToLower(args[0]) == "pttl" {
+		w.integer(left.Milliseconds())
+		return
+	}
+	w.integer(int64((left + time.Second/2) / time.Second))
+}
+
+// incr answers INCR, DECR, INCRBY and DECRBY.
+func (s *Server) incr(ctx context.Context, w *writer, args []string) {
+	name := strings.ToLower(args[0])
+	delta := int64(1)
+	if len(args) == 3 {
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			w.error(errNotInteger)
+			return
+		}
+		delta = n
+	}
+	if strings.HasPrefix(name, "decr") {
+		if delta == math.MinInt64 {
+			w.error(errDecrOverflow)
+			return
+		}
+		delta = -delta
+	}
+	n, err := s.store.IncrementKey(ctx, args[1], delta)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.integer(n)
+}
+
+func (s *Server) mget(ctx context.Context, w *writer, args []string) {
+	w.array(len(args) - 1)
+	for _, key := range args[1:] {
+		if value, _, ok := s.store.Lookup(key); ok {
+			w.bulk(value)
+		} else {
+			w.null()
+		}
+	}
+}
+
+// mset writes every pair in one Raft command. The last value given for a key
+// wins, as in Redis.
+func (s *Server) mset(ctx context.Context, w *writer, args []string) {
+	if len(args)%2 != 1 {
+		w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	data := make(map[string]string, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		if !utf8.ValidString(args[i+1]) {
+			w.error(errBinaryMSET)
+			return
+		}
+		data[args[i]] = args[i+1]
+	}
+	if err := s.store.PutMany(ctx, data); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.simple("OK")
+}
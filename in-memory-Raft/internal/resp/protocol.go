@@ -0,0 +1,150 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxInlineSize bounds a command line, inline commands included, as
+	// readers keep the whole line in their buffer.
+	maxInlineSize = 64 << 10
+	// maxArgs and maxBulkSize follow the limits of Redis. The store usually
+	// bounds bulk strings much further.
+	maxArgs     = 1024 * 1024
+	maxBulkSize = 512 << 20
+)
+
+var errProtocol = errors.New("Protocol error")
+
+// reader reads the commands of a client: arrays of bulk strings, as sent by
+// client libraries, or inline commands typed into telnet.
+type reader struct {
+	r       *bufio.Reader
+	maxBulk int
+}
+
+// newReader refuses bulk strings longer than maxBulk bytes, or than
+// maxBulkSize if maxBulk is zero.
+func newReader(r io.Reader, maxBulk int) *reader {
+	if maxBulk <= 0 || maxBulk > maxBulkSize {
+		maxBulk = maxBulkSize
+	}
+	return &reader{r: bufio.NewReaderSize(r, maxInlineSize), maxBulk: maxBulk}
+}
+
+// buffered tells whether the client has pipelined more commands.
+func (r *reader) buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+// readCommand returns the arguments of the next command, none for an empty
+// inline command.
+func (r *reader) readCommand() ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > r.maxBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		arg, err := r.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readBulk reads a bulk string of size bytes and its CRLF. The buffer grows
+// as the bytes arrive rather than by the announced size, so that a client
+// cannot claim memory it does not send.
+func (r *reader) readBulk(size int) (string, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r.r, int64(size)+2))
+	if err != nil {
+		return "", err
+	}
+	if n < int64(size)+2 {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := buf.Bytes()
+	if b[size] != '\r' || b[size+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+	}
+	return string(b[:size]), nil
+}
+
+func (r *reader) readLine() (string, error) {
+	line, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: too big request", errProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// writer buffers the replies until flushed, so that pipelined commands are
+// answered in one write.
+type writer struct {
+	w *bufio.Writer
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: bufio.NewWriter(w)}
+}
+
+func (w *writer) simple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+func (w *writer) error(s string) {
+	w.w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(s) + "\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *writer) null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// array starts an array of n replies, written next.
+func (w *writer) array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
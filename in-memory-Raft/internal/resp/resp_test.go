@@ -0,0 +1,276 @@
+package resp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"inmemoryraft/internal/resp"
+	"inmemoryraft/internal/services"
+	"inmemoryraft/internal/testcluster"
+)
+
+// newClient serves the store over RESP and connects a client to it.
+func newClient(t *testing.T, store *services.InMemoryStore) *redis.Client {
+	t.Helper()
+	s := resp.NewServer("127.0.0.1:0", store)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	client := redis.NewClient(&redis.Options{Addr: s.Addr().String(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func startCluster(t *testing.T) (*testcluster.Cluster, *redis.Client) {
+	c := testcluster.Start(t, testcluster.Config{Nodes: 3})
+	return c, newClient(t, c.WaitForLeader().Store)
+}
+
+func check(t *testing.T, cmd redis.Cmder, want interface{}) {
+	t.Helper()
+	if err := cmd.Err(); err != nil {
+		t.Fatalf("%v: %s", cmd.Args(), err)
+	}
+	var got interface{}
+	switch c := cmd.(type) {
+	case *redis.StringCmd:
+		got = c.Val()
+	case *redis.IntCmd:
+		got = c.Val()
+	case *redis.StatusCmd:
+		got = c.Val()
+	case *redis.StringSliceCmd:
+		got = c.Val()
+	case *redis.SliceCmd:
+		got = c.Val()
+	case *redis.Cmd:
+		got = c.Val()
+	default:
+		t.Fatalf("unexpected reply type %T", cmd)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%v: expected %#v, got %#v", cmd.Args(), want, got)
+	}
+}
+
+func checkError(t *testing.T, cmd redis.Cmder, prefix string) {
+	t.Helper()
+	if err := cmd.Err(); err == nil || !strings.HasPrefix(err.Error(), prefix) {
+		t.Fatalf("%v: expected an error starting with %q, got %v", cmd.Args(), prefix, err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := context.Background()
+
+	check(t, client.Ping(ctx), "PONG")
+	check(t, client.Echo(ctx, "hello"), "hello")
+
+	check(t, client.Set(ctx, "a", "1", 0), "OK")
+	check(t, client.Get(ctx, "a"), "1")
+	if err := client.Get(ctx, "missing").Err(); !errors.Is(err, redis.Nil) {
+		t.Fatalf("expected redis.Nil for a missing key, got %v", err)
+	}
+
+	check(t, client.MSet(ctx, "b", "2", "c", "3"), "OK")
+	check(t, client.MGet(ctx, "a", "missing", "c"), []interface{}{"1", nil, "3"})
+	check(t, client.Exists(ctx, "a", "b", "missing", "a"), int64(3))
+	check(t, client.Del(ctx, "a", "b", "missing"), int64(2))
+	check(t, client.Exists(ctx, "a", "b"), int64(0))
+	check(t, client.DBSize(ctx), int64(1))
+
+	check(t, client.Incr(ctx, "n"), int64(1))
+	check(t, client.IncrBy(ctx, "n", 41), int64(42))
+	check(t, client.Decr(ctx, "n"), int64(41))
+	check(t, client.DecrBy(ctx, "n", 50), int64(-9))
+	check(t, client.Get(ctx, "n"), "-9")
+	check(t, client.Set(ctx, "text", "abc", 0), "OK")
+	checkError(t, client.Incr(ctx, "text"), "ERR value is not an integer")
+	check(t, client.Set(ctx, "max", "9223372036854775807", 0), "OK")
+	checkError(t, client.Incr(ctx, "max"), "ERR value is not an integer")
+
+	// Values are binary safe.
+	binary := "\x00\xff\r\nbinary"
+	check(t, client.Set(ctx, "bin", binary, 0), "OK")
+	check(t, client.Get(ctx, "bin"), binary)
+	checkError(t, client.MSet(ctx, "bin", binary), "ERR MSET values must be valid UTF-8")
+
+	checkError(t, client.Do(ctx, "nosuchcommand", "x"), "ERR unknown command 'nosuchcommand'")
+	checkError(t, client.Do(ctx, "get"), "ERR wrong number of arguments for 'get' command")
+	checkError(t, client.Do(ctx, "set", "a", "1", "NX"), "ERR syntax error")
+	checkError(t, client.Do(ctx, "set", "a", "1", "EX", "0"), "ERR invalid expire time")
+}
+
+func TestPipeline(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := context.Background()
+
+	pipe := client.Pipeline()
+	for i := 0; i < 10; i++ {
+		pipe.Set(ctx, fmt.Sprintf("key%d", i), i, 0)
+	}
+	get := pipe.Get(ctx, "key9")
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatalf("pipeline: %s", err)
+	}
+	check(t, get, "9")
+}
+
+func TestKeysAndScan(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := context.Background()
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user:%02d", i)
+		want = append(want, key)
+		check(t, client.Set(ctx, key, "x", 0), "OK")
+	}
+	check(t, client.Set(ctx, "other", "x", 0), "OK")
+
+	check(t, client.Keys(ctx, "user:*"), want)
+	check(t, client.Keys(ctx, "user:0[1-3]"), []string{"user:01", "user:02", "user:03"})
+
+	// A key deleted during the scan must not make it skip the others.
+	var got []string
+	var cursor uint64
+	for calls := 0; ; calls++ {
+		keys, next, err := client.Scan(ctx, cursor, "user:*", 7).Result()
+		if err != nil {
+			t.Fatalf("scan: %s", err)
+		}
+		got = append(got, keys...)
+		if calls == 0 {
+			check(t, client.Del(ctx, keys[0]), int64(1))
+		}
+		if next == 0 {
+			break
+		}
+		if calls > 50 {
+			t.Fatal("scan does not terminate")
+		}
+		cursor = next
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("scan: expected %v, got %v", want, got)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	_, client := startCluster(t)
+	ctx := context.Background()
+
+	check(t, client.Set(ctx, "short", "v", 300*time.Millisecond), "OK")
+	check(t, client.Get(ctx, "short"), "v")
+	if ttl := client.PTTL(ctx, "short").Val(); ttl <= 0 || ttl > 300*time.Millisecond {
+		t.Fatalf("expected a PTTL within 300ms, got %v", ttl)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Exists(ctx, "short").Val() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the key did not expire")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := client.Get(ctx, "short").Err(); !errors.Is(err, redis.Nil) {
+		t.Fatalf("expected the expired key to be gone, got %v", err)
+	}
+	check(t, client.Do(ctx, "ttl", "short"), int64(-2))
+
+	// Setting the key again without EX removes its TTL.
+	check(t, client.Set(ctx, "long", "v", time.Hour), "OK")
+	check(t, client.Do(ctx, "ttl", "long"), int64(3600))
+	check(t, client.Set(ctx, "long", "v2", 0), "OK")
+	check(t, client.Do(ctx, "ttl", "long"), int64(-1))
+}
+
+func TestFollower(t *testing.T) {
+	c, leader := startCluster(t)
+	ctx := context.Background()
+
+	var follower *redis.Client
+	for _, n := range c.Nodes() {
+		if !n.Store.IsLeader() {
+			follower = newClient(t, n.Store)
+			break
+		}
+	}
+
+	check(t, leader.Set(ctx, "k", "v", 0), "OK")
+	c.Sync()
+	check(t, follower.Get(ctx, "k"), "v")
+
+	checkError(t, follower.Set(ctx, "k", "w", 0), "READONLY")
+	checkError(t, follower.Incr(ctx, "n"), "READONLY")
+	checkError(t, follower.Del(ctx, "k"), "READONLY")
+	check(t, leader.Get(ctx, "k"), "v")
+}
+
+// TestInline speaks the protocol by hand, as telnet would.
+func TestInline(t *testing.T) {
+	c := testcluster.Start(t, testcluster.Config{Nodes: 1})
+	s := resp.NewServer("127.0.0.1:0", c.WaitForLeader().Store)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PING\r\n\r\nSET greeting hello\r\nGET greeting\r\nQUIT\r\n")
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "+PONG\r\n+OK\r\n$5\r\nhello\r\n+OK\r\n"; string(got) != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+// TestLimits checks that a bulk string longer than the store accepts is
+// refused before it is read, and that INCR obeys the schemas as SET does.
+func TestLimits(t *testing.T) {
+	c := testcluster.Start(t, testcluster.Config{Nodes: 1})
+	store := c.WaitForLeader().Store
+	ctx := context.Background()
+	if err := store.PutSchema(ctx, "port/", []byte(`{"type": "integer", "maximum": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(t, store)
+
+	check(t, client.Incr(ctx, "port/a"), int64(1))
+	check(t, client.Incr(ctx, "port/a"), int64(2))
+	checkError(t, client.Incr(ctx, "port/a"), "ERR ")
+	check(t, client.Get(ctx, "port/a"), "2")
+
+	conn, err := net.Dial("tcp", client.Options().Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$%d\r\n", store.MaxValueSize+1)
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-ERR Protocol error: invalid bulk length\r\n"; string(got) != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,153 @@
+// Package resp serves the keyspace of the store over the Redis protocol
+// (RESP), so that redis-cli and Redis client libraries can be pointed at a
+// node. Writes go through Raft and are refused by followers with READONLY, as
+// by a Redis replica; reads are served from the local state of the node.
+// Expiring keys (SET EX/PX) are attached to a lease of their own.
+package resp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"inmemoryraft/internal/services"
+)
+
+type Server struct {
+	addr  string
+	store *services.InMemoryStore
+
+	ln     net.Listener
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *log.Logger
+
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func NewServer(addr string, store *services.InMemoryStore) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		addr:   addr,
+		store:  store,
+		ctx:    ctx,
+		cancel: cancel,
+		logger: log.New(os.Stderr, "[resp] ", log.LstdFlags),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Start listens on the address of the server and serves the clients in the
+// background until Close.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Printf("accept failed: %v", err)
+				}
+				return
+			}
+			if !s.track(conn) {
+				conn.Close()
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer s.untrack(conn)
+				s.serveConn(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close stops listening, disconnects the clients and waits for the commands
+// being served to return.
+func (s *Server) Close() error {
+	s.cancel()
+	err := s.ln.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// track registers conn unless the server is closing.
+func (s *Server) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, conn)
+	conn.Close()
+}
+
+// maxBulk is the longest key or value the store accepts, zero if either is
+// unbounded. Longer bulk strings would be refused anyway, so they are not
+// read.
+func (s *Server) maxBulk() int {
+	if s.store.MaxKeySize == 0 || s.store.MaxValueSize == 0 {
+		return 0
+	}
+	return max(s.store.MaxKeySize, s.store.MaxValueSize)
+}
+
+// serveConn answers the commands of one client in order. Replies are flushed
+// once the client has no more pipelined commands waiting.
+func (s *Server) serveConn(conn net.Conn) {
+	r, w := newReader(conn, s.maxBulk()), newWriter(conn)
+	ctx := services.WithOrigin(s.ctx, services.Origin{Principal: "resp", Source: conn.RemoteAddr().String()})
+	for {
+		args, err := r.readCommand()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.error("ERR " + err.Error())
+				w.flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.exec(ctx, w, args)
+		if quit || !r.buffered() {
+			if err := w.flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+const defaultAuditLogSize = 1024
+
+// Origin identifies who issued a write. It travels with the command through
+// Raft and ends up in the audit log of every node.
+type Origin struct {
+	Principal string `json:"principal,omitempty"`
+	Source    string `json:"source,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// systemOrigin marks commands the store issues on its own.
+var systemOrigin = Origin{Principal: "system"}
+
+type originKey struct{}
+
+// WithOrigin returns a context carrying the origin of the writes made with it.
+func WithOrigin(ctx context.Context, o Origin) context.Context {
+	return context.WithValue(ctx, originKey{}, o)
+}
+
+func originFrom(ctx context.Context) Origin {
+	o, _ := ctx.Value(originKey{}).(Origin)
+	return o
+}
+
+// AuditRecord describes one applied command. Before is the value the key had
+// before the command, if any; binary values are base64-encoded.
+type AuditRecord struct {
+	Index     uint64    `json:"index"`
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Namespace string    `json:"namespace,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Before    *string   `json:"before,omitempty"`
+	Origin
+}
+
+// AuditFilter selects audit records. Zero fields match everything.
+type AuditFilter struct {
+	Prefix    string
+	Namespace string
+	Principal string
+	Since     time.Time
+	Until     time.Time
+	Limit     int // newest records are kept when the limit cuts
+}
+
+func (af AuditFilter) match(r *AuditRecord) bool {
+	if af.Prefix != "" && !strings.HasPrefix(r.Key, af.Prefix) {
+		return false
+	}
+	if af.Namespace != "" && r.Namespace != af.Namespace {
+		return false
+	}
+	if af.Principal != "" && r.Principal != af.Principal {
+		return false
+	}
+	if !af.Since.IsZero() && r.Time.Before(af.Since) {
+		return false
+	}
+	if !af.Until.IsZero() && !r.Time.Before(af.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog returns the records matching filter, oldest first.
+func (ims *InMemoryStore) AuditLog(filter AuditFilter) []AuditRecord {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	result := make([]AuditRecord, 0)
+	for i := range ims.audit {
+		if filter.match(&ims.audit[i]) {
+			result = append(result, ims.audit[i])
+		}
+	}
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[len(result)-filter.Limit:]
+	}
+	return result
+}
+
+// auditRecord describes c before it is applied, so that it can capture the
+// value the command replaces.
+func (f *fsm) auditRecord(index uint64, c *command) AuditRecord {
+	rec := AuditRecord{
+		Index:     index,
+		Time:      time.Unix(0, c.Time).UTC(),
+		Op:        c.Op,
+		Namespace: c.Namespace,
+		Key:       c.Key,
+	}
+	if c.Origin != nil {
+		rec.Origin = *c.Origin
+	}
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if c.Key == "" {
+		return rec
+	}
+	if c.Namespace != "" {
+		if ns, ok := f.namespaces[c.Namespace]; ok {
+			if v, ok := ns.Data[c.Key]; ok {
+				rec.Before = &v
+			}
+		}
+	} else if v, ok := f.data[c.Key]; ok {
+		v = eventValue(v, f.types[c.Key])
+		rec.Before = &v
+	}
+	return rec
+}
+
+// appendAudit keeps the newest records within the replicated retention. The
+// log is part of the FSM state, so every node holds the same records.
+func (f *fsm) appendAudit(rec AuditRecord) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.audit = append(f.audit, rec)
+	f.trimAudit()
+}
+
+// trimAudit drops the oldest records over the retention. Called with the FSM
+// lock held.
+func (f *fsm) trimAudit() {
+	if f.retention == nil {
+		return
+	}
+	if size := f.retention.AuditLogSize; size > 0 && len(f.audit) > size {
+		f.audit = append(f.audit[:0:0], f.audit[len(f.audit)-size:]...)
+	}
+}
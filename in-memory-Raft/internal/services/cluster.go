@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidJoinToken = errors.New("invalid join token")
+	ErrClusterMismatch  = errors.New("cluster ID does not match")
+)
+
+// clusterInfo identifies the cluster. Only a hash of the join token is kept,
+// so that snapshots do not carry the secret itself.
+type clusterInfo struct {
+	ID            string `json:"id,omitempty"`
+	JoinTokenHash string `json:"join_token_hash,omitempty"`
+}
+
+func (ims *InMemoryStore) ClusterID() string {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	return ims.cluster.ID
+}
+
+// HasJoinToken reports whether joining the cluster requires a token.
+func (ims *InMemoryStore) HasJoinToken() bool {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	return ims.cluster.JoinTokenHash != ""
+}
+
+// CheckJoin verifies the credentials presented by a joining node. An empty
+// clusterID means the node does not know which cluster it joins.
+func (ims *InMemoryStore) CheckJoin(token, clusterID string) error {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	if clusterID != "" && ims.cluster.ID != "" && clusterID != ims.cluster.ID {
+		return ErrClusterMismatch
+	}
+	if ims.cluster.JoinTokenHash == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(ims.cluster.JoinTokenHash)) != 1 {
+		return ErrInvalidJoinToken
+	}
+	return nil
+}
+
+// RotateJoinToken replaces the join token. The current token must be
+// presented unless the cluster has none yet.
+func (ims *InMemoryStore) RotateJoinToken(ctx context.Context, current, next string) error {
+	if err := ims.CheckJoin(current, ""); err != nil {
+		return err
+	}
+	if next == "" {
+		return fmt.Errorf("join token must not be empty")
+	}
+
+	c := &command{
+		Op:        "join-token",
+		TokenHash: hashToken(next),
+	}
+	_, err := ims.apply(ctx, c)
+	return err
+}
+
+// monitorLeadership gives a cluster without identity its ID and initial
+// join token, and one without retention the configured one, as soon as this
+// node becomes leader. The barrier makes sure every earlier entry, including
+// a previous cluster-init or retention-init, is applied first.
+func (ims *InMemoryStore) monitorLeadership() {
+	for isLeader := range ims.raft.LeaderCh() {
+		if !isLeader {
+			continue
+		}
+		if err := ims.raft.Barrier(ims.ApplyTimeout).Error(); err != nil {
+			ims.logger.Printf("failed to wait for barrier: %v", err)
+			continue
+		}
+		if err := ims.initRetention(); err != nil {
+			ims.logger.Printf("failed to record the retention: %v", err)
+		}
+		if ims.ClusterID() != "" {
+			continue
+		}
+
+		id, err := newClusterID()
+		if err != nil {
+			ims.logger.Printf("failed to generate cluster ID: %v", err)
+			continue
+		}
+		c := &command{Op: "cluster-init", ClusterID: id}
+		if ims.JoinToken != "" {
+			c.TokenHash = hashToken(ims.JoinToken)
+		}
+		if _, err := ims.apply(WithOrigin(context.Background(), systemOrigin), c); err != nil {
+			ims.logger.Printf("failed to initialize cluster identity: %v", err)
+			continue
+		}
+		ims.logger.Printf("initialized cluster %s", ims.ClusterID())
+	}
+}
+
+// applyClusterInit only takes effect once, so that concurrent leaders of a
+// freshly bootstrapped cluster agree on the first ID committed.
+func (f *fsm) applyClusterInit(id, tokenHash string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.cluster.ID == "" {
+		f.cluster.ID = id
+		f.cluster.JoinTokenHash = tokenHash
+	}
+	return nil
+}
+
+func (f *fsm) applyJoinToken(tokenHash string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.cluster.JoinTokenHash = tokenHash
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newClusterID returns a random (version 4) UUID.
+func newClusterID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+var (
+	ErrCounterNotFound = errors.New("counter not found")
+	ErrCounterRange    = errors.New("counter would leave its bounds")
+	ErrCounterKind     = errors.New("wrong kind of counter")
+	ErrInvalidCounter  = errors.New("invalid counter request")
+)
+
+// Counter is a named integer changed atomically by the FSM. A sequence only
+// ever grows: it hands out blocks of IDs and can be neither decremented nor
+// deleted, so that an ID is never issued twice.
+type Counter struct {
+	Name     string `json:"name"`
+	Value    int64  `json:"value"`
+	Sequence bool   `json:"sequence,omitempty"`
+}
+
+// Block is a range of IDs reserved from a sequence, both ends included.
+type Block struct {
+	Name  string `json:"name"`
+	First int64  `json:"first"`
+	Last  int64  `json:"last"`
+}
+
+// CounterRequest changes a counter by Delta, refusing results outside Min
+// and Max when they are set, or reserves Count IDs of a sequence.
+type CounterRequest struct {
+	Name  string `json:"name"`
+	Delta int64  `json:"delta,omitempty"`
+	Min   *int64 `json:"min,omitempty"`
+	Max   *int64 `json:"max,omitempty"`
+	Count int64  `json:"count,omitempty"`
+}
+
+func (ims *InMemoryStore) Counters() []Counter {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	result := make([]Counter, 0, len(ims.counters))
+	for _, c := range ims.counters {
+		result = append(result, *c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (ims *InMemoryStore) Counter(name string) (Counter, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	c, ok := ims.counters[name]
+	if !ok {
+		return Counter{}, ErrCounterNotFound
+	}
+	return *c, nil
+}
+
+// Increment adds req.Delta to a counter and returns its new value. A missing
+// counter starts at zero.
+func (ims *InMemoryStore) Increment(ctx context.Context, req CounterRequest) (Counter, error) {
+	return ims.changeCounter(ctx, "incr", req)
+}
+
+// Decrement subtracts req.Delta from a counter and returns its new value.
+func (ims *InMemoryStore) Decrement(ctx context.Context, req CounterRequest) (Counter, error) {
+	return ims.changeCounter(ctx, "decr", req)
+}
+
+func (ims *InMemoryStore) changeCounter(ctx context.Context, op string, req CounterRequest) (Counter, error) {
+	if req.Name == "" || req.Delta < 0 {
+		return Counter{}, fmt.Errorf("%w: name and a non-negative delta are required", ErrInvalidCounter)
+	}
+	if req.Min != nil && req.Max != nil && *req.Min > *req.Max {
+		return Counter{}, fmt.Errorf("%w: min is greater than max", ErrInvalidCounter)
+	}
+	resp, err := ims.apply(ctx, &command{Op: op, Counter: &req})
+	if err != nil {
+		return Counter{}, err
+	}
+	return resp.(Counter), nil
+}
+
+// NextIDs reserves the next count IDs of a sequence. IDs start at 1.
+func (ims *InMemoryStore) NextIDs(ctx context.Context, name string, count int64) (Block, error) {
+	if name == "" || count < 1 {
+		return Block{}, fmt.Errorf("%w: name and a positive count are required", ErrInvalidCounter)
+	}
+	resp, err := ims.apply(ctx, &command{Op: "sequence", Counter: &CounterRequest{Name: name, Count: count}})
+	if err != nil {
+		return Block{}, err
+	}
+	return resp.(Block), nil
+}
+
+// DeleteCounter removes a counter. Sequences cannot be deleted.
+func (ims *InMemoryStore) DeleteCounter(ctx context.Context, name string) error {
+	_, err := ims.apply(ctx, &command{Op: "counter-delete", Counter: &CounterRequest{Name: name}})
+	return err
+}
+
+// applyIncrement changes a counter unless the result would leave the bounds
+// of the request, in which case nothing changes.
+func (f *fsm) applyIncrement(op string, req *CounterRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delta := req.Delta
+	if op == "decr" {
+		delta = -delta
+	}
+
+	c, ok := f.counters[req.Name]
+	if !ok {
+		c = &Counter{Name: req.Name}
+	}
+	if c.Sequence {
+		return fmt.Errorf("%w: '%s' is a sequence", ErrCounterKind, req.Name)
+	}
+	if (delta > 0 && c.Value > math.MaxInt64-delta) || (delta < 0 && c.Value < math.MinInt64-delta) {
+		return fmt.Errorf("%w: %d%+d overflows", ErrCounterRange, c.Value, delta)
+	}
+	value := c.Value + delta
+	if req.Min != nil && value < *req.Min {
+		return fmt.Errorf("%w: %d%+d is below %d", ErrCounterRange, c.Value, delta, *req.Min)
+	}
+	if req.Max != nil && value > *req.Max {
+		return fmt.Errorf("%w: %d%+d is above %d", ErrCounterRange, c.Value, delta, *req.Max)
+	}
+	c.Value = value
+	f.counters[req.Name] = c
+	return *c
+}
+
+func (f *fsm) applySequence(req *CounterRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c, ok := f.counters[req.Name]
+	if !ok {
+		c = &Counter{Name: req.Name, Sequence: true}
+	}
+	if !c.Sequence {
+		return fmt.Errorf("%w: '%s' is not a sequence", ErrCounterKind, req.Name)
+	}
+	if c.Value > math.MaxInt64-req.Count {
+		return fmt.Errorf("%w: sequence is exhausted", ErrCounterRange)
+	}
+	block := Block{Name: req.Name, First: c.Value + 1, Last: c.Value + req.Count}
+	c.Value = block.Last
+	f.counters[req.Name] = c
+	return block
+}
+
+func (f *fsm) applyDeleteCounter(name string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c, ok := f.counters[name]
+	if !ok {
+		return ErrCounterNotFound
+	}
+	if c.Sequence {
+		return fmt.Errorf("%w: sequences cannot be deleted", ErrCounterKind)
+	}
+	delete(f.counters, name)
+	return nil
+}
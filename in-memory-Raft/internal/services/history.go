@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultHistorySize = 16
+
+var (
+	ErrCompacted      = errors.New("revision has been compacted")
+	ErrFutureRevision = errors.New("revision is in the future")
+)
+
+// Version is one value a key of the default keyspace had, starting at
+// Revision (the Raft index of the command that wrote it). A deleted key gets
+// a tombstone version.
+type Version struct {
+	Revision uint64    `json:"revision"`
+	Time     time.Time `json:"time"`
+	Value    string    `json:"value,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// KeyMeta is what etcd keeps with a key besides its value: the revision
+// that created it, the one that last wrote it and how many times it was
+// written since it was created. Unlike the history, it is never trimmed.
+type KeyMeta struct {
+	CreateRevision uint64 `json:"create_revision"`
+	ModRevision    uint64 `json:"mod_revision"`
+	Version        int64  `json:"version"`
+}
+
+// keyHistory holds the newest versions of a key, oldest first. Trimmed is set
+// once older versions were dropped to respect the history size, so that
+// reads before the first kept version are known to be incomplete.
+type keyHistory struct {
+	Versions []Version `json:"versions"`
+	Trimmed  bool      `json:"trimmed,omitempty"`
+}
+
+// at returns the version current at revision.
+func (h keyHistory) at(revision uint64) (Version, bool, error) {
+	i := sort.Search(len(h.Versions), func(i int) bool { return h.Versions[i].Revision > revision })
+	if i == 0 {
+		if h.Trimmed {
+			return Version{}, false, ErrCompacted
+		}
+		return Version{}, false, nil
+	}
+	v := h.Versions[i-1]
+	return v, !v.Deleted, nil
+}
+
+// Revision returns the Raft index of the last command applied to the FSM.
+func (ims *InMemoryStore) Revision() uint64 {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	return ims.revision
+}
+
+// History returns the kept versions of key, oldest first.
+func (ims *InMemoryStore) History(key string) ([]Version, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	h, ok := ims.history[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]Version(nil), h.Versions...), nil
+}
+
+// GetAt returns the value and type key had at revision.
+func (ims *InMemoryStore) GetAt(key string, revision uint64) (string, string, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	if err := ims.checkRevision(revision); err != nil {
+		return "", "", err
+	}
+	v, ok, err := ims.history[key].at(revision)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return "", "", ErrKeyNotFound
+	}
+	return v.Value, typeOrString(v.Type), nil
+}
+
+// ListAt returns every key starting with prefix as it was at revision. All
+// keys are read at the same point, so the result is consistent.
+func (ims *InMemoryStore) ListAt(prefix string, revision uint64) (map[string]Version, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	if err := ims.checkRevision(revision); err != nil {
+		return nil, err
+	}
+	result := make(map[string]Version)
+	for k, h := range ims.history {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		v, ok, err := h.at(revision)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %w", k, err)
+		}
+		if ok {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+// Compact drops the history older than revision on every node. Reads at an
+// earlier revision fail with ErrCompacted afterwards.
+func (ims *InMemoryStore) Compact(ctx context.Context, revision uint64) error {
+	if err := func() error {
+		ims.mutex.RLock()
+		defer ims.mutex.RUnlock()
+		return ims.checkRevision(revision)
+	}(); err != nil {
+		return err
+	}
+	_, err := ims.apply(ctx, &command{Op: "compact", Revision: revision})
+	return err
+}
+
+func (ims *InMemoryStore) checkRevision(revision uint64) error {
+	if revision > ims.revision {
+		return fmt.Errorf("%w: current revision is %d", ErrFutureRevision, ims.revision)
+	}
+	if revision < ims.compacted {
+		return fmt.Errorf("%w: history starts at revision %d", ErrCompacted, ims.compacted)
+	}
+	return nil
+}
+
+// recordVersion appends a version of key written at index. Called with the
+// FSM lock held.
+func (f *fsm) recordVersion(index uint64, key, value, typ string, deleted bool) {
+	h := f.history[key]
+	h.Versions = append(h.Versions, Version{
+		Revision: index,
+		Time:     f.applyTime,
+		Value:    value,
+		Type:     typ,
+		Deleted:  deleted,
+	})
+	if deleted {
+		delete(f.meta, key)
+	} else {
+		m := f.meta[key]
+		if m.Version == 0 {
+			m.CreateRevision = index
+		}
+		m.ModRevision = index
+		m.Version++
+		f.meta[key] = m
+	}
+	f.history[key] = f.trimHistory(h)
+}
+
+// trimHistory drops the oldest versions over the retention. Called with the
+// FSM lock held.
+func (f *fsm) trimHistory(h keyHistory) keyHistory {
+	if f.retention == nil {
+		return h
+	}
+	if size := f.retention.HistorySize; size > 0 && len(h.Versions) > size {
+		h.Versions = append([]Version(nil), h.Versions[len(h.Versions)-size:]...)
+		h.Trimmed = true
+	}
+	return h
+}
+
+// rebuildMeta derives the metadata of every key from its history, for
+// snapshots taken before the FSM kept it. Versions dropped from the history
+// are not counted.
+func (f *fsm) rebuildMeta() {
+	f.meta = make(map[string]KeyMeta, len(f.data))
+	for k := range f.data {
+		m := KeyMeta{CreateRevision: f.revision, ModRevision: f.revision, Version: 1}
+		if h, ok := f.history[k]; ok && len(h.Versions) > 0 {
+			m = metaAt(h.Versions, len(h.Versions)-1)
+		}
+		f.meta[k] = m
+	}
+}
+
+// metaAt derives the metadata of the version at i from the versions before
+// it, back to the last tombstone.
+func metaAt(versions []Version, i int) KeyMeta {
+	first := i
+	for first > 0 && !versions[first-1].Deleted {
+		first--
+	}
+	return KeyMeta{
+		CreateRevision: versions[first].Revision,
+		ModRevision:    versions[i].Revision,
+		Version:        int64(i - first + 1),
+	}
+}
+
+// applyCompact keeps, for every key, the versions newer than revision and
+// the one current at revision, unless that one is a tombstone.
+func (f *fsm) applyCompact(revision uint64) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if revision <= f.compacted {
+		return nil
+	}
+	for k, h := range f.history {
+		i := sort.Search(len(h.Versions), func(i int) bool { return h.Versions[i].Revision > revision })
+		if i == 0 {
+			continue
+		}
+		// The version current at revision is known, so whatever was trimmed
+		// before it no longer matters.
+		h.Trimmed = false
+		i--
+		if h.Versions[i].Deleted {
+			i++
+		}
+		if i == len(h.Versions) {
+			delete(f.history, k)
+			continue
+		}
+		h.Versions = append([]Version(nil), h.Versions[i:]...)
+		f.history[k] = h
+	}
+	f.compacted = revision
+	return nil
+}
+
+func typeOrString(typ string) string {
+	if typ == "" {
+		return TypeString
+	}
+	return typ
+}
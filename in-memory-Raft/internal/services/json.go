@@ -0,0 +1,138 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"inmemoryraft/internal/jsonpatch"
+)
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrInvalidJSON = errors.New("invalid JSON")
+	ErrNotJSON     = errors.New("value is not JSON")
+)
+
+// PutJSON stores a JSON document under key. The document is compacted so
+// that equal documents are stored identically.
+func (ims *InMemoryStore) PutJSON(ctx context.Context, key string, value []byte) error {
+	if err := ims.checkSize(key, len(value)); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidJSON, err)
+	}
+	if err := ims.checkSchemas(key, buf.String(), TypeJSON); err != nil {
+		return err
+	}
+	_, err := ims.apply(ctx, &command{Op: "set", Key: key, Value: buf.String(), Type: TypeJSON})
+	return err
+}
+
+// MergePatch applies an RFC 7396 merge patch to the JSON document under key.
+// A missing key is patched as an empty document.
+func (ims *InMemoryStore) MergePatch(ctx context.Context, key string, patch []byte) error {
+	if err := ims.checkSize(key, len(patch)); err != nil {
+		return err
+	}
+	if !json.Valid(patch) {
+		return fmt.Errorf("%w: merge patch", ErrInvalidJSON)
+	}
+	if err := ims.checkPatch(key, "merge-patch", patch); err != nil {
+		return err
+	}
+	_, err := ims.apply(ctx, &command{Op: "merge-patch", Key: key, Value: string(patch), MaxSize: ims.MaxValueSize})
+	return err
+}
+
+// JSONPatch applies an RFC 6902 JSON Patch to the JSON document under key.
+// The patch is applied atomically: if any operation fails nothing changes.
+func (ims *InMemoryStore) JSONPatch(ctx context.Context, key string, patch []byte) error {
+	if err := ims.checkSize(key, len(patch)); err != nil {
+		return err
+	}
+	if _, err := jsonpatch.ParsePatch(patch); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidJSON, err)
+	}
+	if err := ims.checkPatch(key, "json-patch", patch); err != nil {
+		return err
+	}
+	_, err := ims.apply(ctx, &command{Op: "json-patch", Key: key, Value: string(patch), MaxSize: ims.MaxValueSize})
+	return err
+}
+
+// GetPath returns the part of the JSON document under key that the RFC 6901
+// pointer refers to.
+func (ims *InMemoryStore) GetPath(key, pointer string) (json.RawMessage, error) {
+	ims.mutex.RLock()
+	value, ok := ims.data[key]
+	typ := ims.types[key]
+	ims.mutex.RUnlock()
+
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if typ != TypeJSON {
+		return nil, ErrNotJSON
+	}
+	return jsonpatch.Get([]byte(value), pointer)
+}
+
+// applyPatch patches the JSON document under key. Patch failures, and
+// results larger than maxSize unless it is zero, are returned to the caller
+// and leave the keyspace untouched.
+func (f *fsm) applyPatch(index uint64, op, key, patch string, maxSize int) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	value, ok := f.data[key]
+	if ok && f.types[key] != TypeJSON {
+		return ErrNotJSON
+	}
+
+	result, err := patchDocument(op, value, ok, patch)
+	if err != nil {
+		return err
+	}
+	// The size of the patch says nothing of the size of the document.
+	if maxSize > 0 && len(result) > maxSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrValueTooLarge, len(result), maxSize)
+	}
+	// The document may have changed since the patch was checked against the
+	// schemas on the leader, so the result is checked again.
+	if err := f.checkSchemas(key, string(result), TypeJSON); err != nil {
+		return err
+	}
+	delta := usageDelta(key, value, ok, string(result))
+	if err := f.admit("", key, delta); err != nil {
+		return err
+	}
+
+	f.data[key] = string(result)
+	f.account(key, delta)
+	f.types[key] = TypeJSON
+	f.recordVersion(index, key, string(result), TypeJSON, false)
+	f.watchers.notify(f.putEvent(index, key, string(result), TypeJSON))
+	return nil
+}
+
+// patchDocument applies a patch of the given op to the document value, which
+// is absent unless ok.
+func patchDocument(op, value string, ok bool, patch string) ([]byte, error) {
+	if op == "merge-patch" {
+		var doc []byte
+		if ok {
+			doc = []byte(value)
+		}
+		return jsonpatch.MergePatch(doc, []byte(patch))
+	}
+	doc := []byte("null")
+	if ok {
+		doc = []byte(value)
+	}
+	return jsonpatch.Apply(doc, []byte(patch))
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/raft"
+)
+
+// leaseCheckInterval is how often the leader looks for expired leases. Reads
+// hide the keys of an expired lease before it is revoked.
+const leaseCheckInterval = 250 * time.Millisecond
+
+var (
+	ErrLeaseNotFound = errors.New("lease not found")
+	ErrLeaseExists   = errors.New("lease already exists")
+	ErrInvalidLease  = errors.New("invalid lease request")
+)
+
+// Lease is a time to live shared by keys, as in etcd: the keys attached to a
+// lease are deleted when it expires or is revoked. ID is the Raft index of
+// the grant unless the client chose one. Expires is computed from the
+// leader's clock.
+type Lease struct {
+	ID      int64     `json:"id"`
+	TTL     int64     `json:"ttl_ms"`
+	Expires time.Time `json:"expires"`
+	Keys    []string  `json:"keys,omitempty"`
+}
+
+// LeaseRequest grants, renews or revokes a lease.
+type LeaseRequest struct {
+	ID  int64         `json:"id,omitempty"`
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+func (l *Lease) expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+func (l *Lease) copy() Lease {
+	c := *l
+	c.Keys = append([]string(nil), l.Keys...)
+	return c
+}
+
+// GrantLease creates a lease that expires ttl after it is applied. A
+// non-zero id asks for that ID instead of a generated one.
+func (ims *InMemoryStore) GrantLease(ctx context.Context, id int64, ttl time.Duration) (Lease, error) {
+	if ttl <= 0 || id < 0 {
+		return Lease{}, fmt.Errorf("%w: TTL must be positive and ID not negative", ErrInvalidLease)
+	}
+	resp, err := ims.apply(ctx, &command{Op: "lease-grant", Lease: &LeaseRequest{ID: id, TTL: ttl}})
+	if err != nil {
+		return Lease{}, err
+	}
+	return resp.(Lease), nil
+}
+
+// KeepAliveLease extends the lease by its TTL from now.
+func (ims *InMemoryStore) KeepAliveLease(ctx context.Context, id int64) (Lease, error) {
+	resp, err := ims.apply(ctx, &command{Op: "lease-keepalive", Lease: &LeaseRequest{ID: id}})
+	if err != nil {
+		return Lease{}, err
+	}
+	return resp.(Lease), nil
+}
+
+// RevokeLease deletes the lease and every key attached to it.
+func (ims *InMemoryStore) RevokeLease(ctx context.Context, id int64) error {
+	_, err := ims.apply(ctx, &command{Op: "lease-revoke", Lease: &LeaseRequest{ID: id}})
+	return err
+}
+
+// LeaseInfo returns the lease if it has not expired.
+func (ims *InMemoryStore) LeaseInfo(id int64) (Lease, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	l, ok := ims.leases[id]
+	if !ok || l.expired(time.Now()) {
+		return Lease{}, ErrLeaseNotFound
+	}
+	return l.copy(), nil
+}
+
+// Leases returns the leases that have not expired, by ID.
+func (ims *InMemoryStore) Leases() []Lease {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	now := time.Now()
+	result := make([]Lease, 0, len(ims.leases))
+	for _, l := range ims.leases {
+		if !l.expired(now) {
+			result = append(result, l.copy())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// KeyLease returns the lease the key is attached to, if it has not expired.
+func (ims *InMemoryStore) KeyLease(key string) (Lease, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	id, ok := ims.keyLeases[key]
+	if !ok {
+		return Lease{}, ErrLeaseNotFound
+	}
+	l, ok := ims.leases[id]
+	if !ok || l.expired(time.Now()) {
+		return Lease{}, ErrLeaseNotFound
+	}
+	return l.copy(), nil
+}
+
+// PutWithLease stores value under key and attaches the key to the lease, so
+// that it is deleted with it. A zero lease leaves the key without one, as Put
+// does. A value that is not valid UTF-8 is stored as binary, as it would not
+// survive the JSON of the command otherwise.
+func (ims *InMemoryStore) PutWithLease(ctx context.Context, key, value string, lease int64) error {
+	if err := ims.checkSize(key, len(value)); err != nil {
+		return err
+	}
+	c := &command{Op: "set", Key: key, Value: value, LeaseID: lease}
+	if !utf8.ValidString(value) {
+		c = &command{Op: "set", Key: key, Bytes: []byte(value), Type: TypeBinary, LeaseID: lease}
+	}
+	if err := ims.checkSchemas(key, value, c.Type); err != nil {
+		return err
+	}
+	_, err := ims.apply(ctx, c)
+	return err
+}
+
+// hiddenByLease tells whether key belongs to a lease that expired but has
+// not been revoked yet. Called with the FSM lock held.
+func (f *fsm) hiddenByLease(key string, now time.Time) bool {
+	id, ok := f.keyLeases[key]
+	if !ok {
+		return false
+	}
+	l, ok := f.leases[id]
+	return ok && l.expired(now)
+}
+
+// expireLeases revokes the expired leases through Raft while the node leads,
+// until Raft shuts down.
+func (ims *InMemoryStore) expireLeases() {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		switch ims.raft.State() {
+		case raft.Shutdown:
+			return
+		case raft.Leader:
+		default:
+			continue
+		}
+
+		now := time.Now()
+		var expired []int64
+		ims.mutex.RLock()
+		for id, l := range ims.leases {
+			if l.expired(now) {
+				expired = append(expired, id)
+			}
+		}
+		ims.mutex.RUnlock()
+
+		for _, id := range expired {
+			ctx := WithOrigin(context.Background(), systemOrigin)
+			_, err := ims.apply(ctx, &command{Op: "lease-expire", Lease: &LeaseRequest{ID: id}})
+			if err != nil && !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrShuttingDown) {
+				ims.logger.Printf("failed to expire lease %d: %v", id, err)
+			}
+		}
+	}
+}
+
+func (f *fsm) applyLeaseGrant(index uint64, req *LeaseRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	id := req.ID
+	if id == 0 {
+		id = int64(index)
+	}
+	if _, ok := f.leases[id]; ok {
+		return fmt.Errorf("%w: %d", ErrLeaseExists, id)
+	}
+	l := &Lease{ID: id, TTL: req.TTL.Milliseconds(), Expires: f.applyTime.Add(req.TTL)}
+	f.leases[id] = l
+	return l.copy()
+}
+
+func (f *fsm) applyLeaseKeepAlive(req *LeaseRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	l, ok := f.leases[req.ID]
+	if !ok || l.expired(f.applyTime) {
+		return ErrLeaseNotFound
+	}
+	l.Expires = f.applyTime.Add(time.Duration(l.TTL) * time.Millisecond)
+	return l.copy()
+}
+
+// applyLeaseRevoke revokes the lease unconditionally for "lease-revoke", or
+// only if it is still expired for "lease-expire", as a keep-alive may have
+// been applied since the leader found it expired.
+func (f *fsm) applyLeaseRevoke(index uint64, op string, req *LeaseRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	l, ok := f.leases[req.ID]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	if op == "lease-expire" && !l.expired(f.applyTime) {
+		return nil
+	}
+	for _, key := range l.Keys {
+		delete(f.keyLeases, key)
+		f.deleteKey(index, key)
+	}
+	delete(f.leases, req.ID)
+	return nil
+}
+
+// attachLease moves key to the lease, or detaches it from its lease when id
+// is zero. Called with the FSM lock held.
+func (f *fsm) attachLease(key string, id int64) {
+	if old, ok := f.keyLeases[key]; ok {
+		if old == id {
+			return
+		}
+		if l, ok := f.leases[old]; ok {
+			i := sort.SearchStrings(l.Keys, key)
+			if i < len(l.Keys) && l.Keys[i] == key {
+				l.Keys = append(l.Keys[:i:i], l.Keys[i+1:]...)
+			}
+		}
+		delete(f.keyLeases, key)
+	}
+	if id == 0 {
+		return
+	}
+	l := f.leases[id]
+	i := sort.SearchStrings(l.Keys, key)
+	l.Keys = append(l.Keys[:i:i], append([]string{key}, l.Keys[i:]...)...)
+	f.keyLeases[key] = id
+}
+
+// checkLease refuses writes to a lease that does not exist or has expired.
+// Called with the FSM lock held.
+func (f *fsm) checkLease(id int64) error {
+	if id == 0 {
+		return nil
+	}
+	if l, ok := f.leases[id]; !ok || l.expired(f.applyTime) {
+		return fmt.Errorf("%w: %d", ErrLeaseNotFound, id)
+	}
+	return nil
+}
+
+// restoreKeyLeases rebuilds the index of keys to leases from the leases.
+func (f *fsm) restoreKeyLeases() {
+	f.keyLeases = make(map[string]int64)
+	for id, l := range f.leases {
+		for _, key := range l.Keys {
+			f.keyLeases[key] = id
+		}
+	}
+}
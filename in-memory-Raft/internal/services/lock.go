@@ -0,0 +1,263 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLockTTL = 15 * time.Second
+
+	// electionPrefix keeps the locks behind elections apart from the ones
+	// taken directly. Lock names come from a URL segment and cannot contain
+	// a slash.
+	electionPrefix = "election/"
+)
+
+var (
+	ErrLockHeld     = errors.New("lock is held")
+	ErrLockNotHeld  = errors.New("lock is not held with this token")
+	ErrLockNotFound = errors.New("lock not found")
+	ErrInvalidLock  = errors.New("invalid lock request")
+)
+
+// Lock is a named lock or the leadership of an election. Token, the Raft
+// index of the acquisition, grows with every new holder and serves as a
+// fencing token. Expires is computed from the leader's clock.
+type Lock struct {
+	Name    string    `json:"name"`
+	Holder  string    `json:"holder"`
+	Value   string    `json:"value,omitempty"`
+	Token   uint64    `json:"token"`
+	TTL     int64     `json:"ttl_ms"`
+	Expires time.Time `json:"expires"`
+}
+
+// LockRequest asks for a lock on behalf of Holder. Value is free-form data
+// published with the lock, such as the address of an election winner.
+type LockRequest struct {
+	Name   string        `json:"name"`
+	Holder string        `json:"holder,omitempty"`
+	Value  string        `json:"value,omitempty"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+	Token  uint64        `json:"token,omitempty"`
+}
+
+func (l Lock) expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+// LockInfo returns the lock if it is currently held.
+func (ims *InMemoryStore) LockInfo(name string) (Lock, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	l, ok := ims.locks[name]
+	if !ok || l.expired(time.Now()) {
+		return Lock{}, ErrLockNotFound
+	}
+	return *l, nil
+}
+
+// Locks returns the locks currently held, elections excluded.
+func (ims *InMemoryStore) Locks() []Lock {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	now := time.Now()
+	result := make([]Lock, 0, len(ims.locks))
+	for name, l := range ims.locks {
+		if strings.HasPrefix(name, electionPrefix) {
+			continue
+		}
+		if !l.expired(now) {
+			result = append(result, *l)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// AcquireLock takes the lock for req.Holder. If the lock is held by someone
+// else it waits up to wait for it to be released or to expire; a zero wait
+// only tries once. Acquiring a lock one already holds renews it and keeps
+// its token.
+func (ims *InMemoryStore) AcquireLock(ctx context.Context, req LockRequest, wait time.Duration) (Lock, error) {
+	if req.Name == "" || req.Holder == "" {
+		return Lock{}, fmt.Errorf("%w: name and holder are required", ErrInvalidLock)
+	}
+	if req.TTL < 0 {
+		return Lock{}, fmt.Errorf("%w: TTL must not be negative", ErrInvalidLock)
+	}
+	if req.TTL == 0 {
+		req.TTL = defaultLockTTL
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		resp, err := ims.apply(ctx, &command{Op: "lock-acquire", Lock: &req})
+		if err == nil {
+			return resp.(Lock), nil
+		}
+		if !errors.Is(err, ErrLockHeld) || !time.Now().Before(deadline) {
+			return Lock{}, err
+		}
+
+		// Retry once the lock changes hands or the current holder's lease
+		// runs out, whichever comes first.
+		ims.mutex.RLock()
+		changed := ims.lockChanged
+		retry := deadline
+		if l, ok := ims.locks[req.Name]; ok && l.Expires.Before(retry) {
+			retry = l.Expires
+		}
+		ims.mutex.RUnlock()
+
+		timer := time.NewTimer(time.Until(retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Lock{}, ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// RenewLock extends the lease of the lock acquired with token by ttl, or by
+// its original TTL if ttl is zero.
+func (ims *InMemoryStore) RenewLock(ctx context.Context, name string, token uint64, ttl time.Duration) (Lock, error) {
+	if ttl < 0 {
+		return Lock{}, fmt.Errorf("%w: TTL must not be negative", ErrInvalidLock)
+	}
+	resp, err := ims.apply(ctx, &command{Op: "lock-renew", Lock: &LockRequest{Name: name, Token: token, TTL: ttl}})
+	if err != nil {
+		return Lock{}, err
+	}
+	return resp.(Lock), nil
+}
+
+// ReleaseLock gives up the lock acquired with token.
+func (ims *InMemoryStore) ReleaseLock(ctx context.Context, name string, token uint64) error {
+	_, err := ims.apply(ctx, &command{Op: "lock-release", Lock: &LockRequest{Name: name, Token: token}})
+	return err
+}
+
+// Campaign makes req.Holder the leader of the election req.Name, waiting up
+// to wait for the current leader to resign or to lose its lease.
+func (ims *InMemoryStore) Campaign(ctx context.Context, req LockRequest, wait time.Duration) (Lock, error) {
+	if req.Name == "" {
+		return Lock{}, fmt.Errorf("%w: name is required", ErrInvalidLock)
+	}
+	name := req.Name
+	req.Name = electionPrefix + name
+	l, err := ims.AcquireLock(ctx, req, wait)
+	l.Name = name
+	return l, err
+}
+
+// Leader returns the current leader of an election.
+func (ims *InMemoryStore) Leader(election string) (Lock, error) {
+	l, err := ims.LockInfo(electionPrefix + election)
+	l.Name = election
+	return l, err
+}
+
+func (ims *InMemoryStore) RenewLeadership(ctx context.Context, election string, token uint64, ttl time.Duration) (Lock, error) {
+	l, err := ims.RenewLock(ctx, electionPrefix+election, token, ttl)
+	l.Name = election
+	return l, err
+}
+
+func (ims *InMemoryStore) Resign(ctx context.Context, election string, token uint64) error {
+	return ims.ReleaseLock(ctx, electionPrefix+election, token)
+}
+
+// applyLockAcquire grants the lock if it is free, expired or already held by
+// the same holder. Expiry is judged by the leader time of the command, so
+// every replica decides alike.
+func (f *fsm) applyLockAcquire(index uint64, req *LockRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.applyTime
+	f.expireLocks(now)
+
+	if l, ok := f.locks[req.Name]; ok {
+		if l.Holder != req.Holder {
+			return fmt.Errorf("%w by '%s' until %s", ErrLockHeld, l.Holder, l.Expires.Format(time.RFC3339Nano))
+		}
+		l.Value = req.Value
+		l.TTL = req.TTL.Milliseconds()
+		l.Expires = now.Add(req.TTL)
+		f.lockUpdated()
+		return *l
+	}
+
+	l := &Lock{
+		Name:    req.Name,
+		Holder:  req.Holder,
+		Value:   req.Value,
+		Token:   index,
+		TTL:     req.TTL.Milliseconds(),
+		Expires: now.Add(req.TTL),
+	}
+	f.locks[req.Name] = l
+	f.lockUpdated()
+	return *l
+}
+
+func (f *fsm) applyLockRenew(req *LockRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	l, ok := f.locks[req.Name]
+	if !ok || l.Token != req.Token || l.expired(f.applyTime) {
+		return ErrLockNotHeld
+	}
+	ttl := req.TTL
+	if ttl == 0 {
+		ttl = time.Duration(l.TTL) * time.Millisecond
+	} else {
+		l.TTL = ttl.Milliseconds()
+	}
+	l.Expires = f.applyTime.Add(ttl)
+	f.lockUpdated()
+	return *l
+}
+
+// applyLockRelease refuses a release with a stale token, so that a holder
+// whose lease ran out cannot free the lock of its successor.
+func (f *fsm) applyLockRelease(req *LockRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	l, ok := f.locks[req.Name]
+	if !ok || l.Token != req.Token {
+		return ErrLockNotHeld
+	}
+	delete(f.locks, req.Name)
+	f.lockUpdated()
+	return nil
+}
+
+// expireLocks drops the locks whose lease ran out before now. Called with
+// the FSM lock held.
+func (f *fsm) expireLocks(now time.Time) {
+	for name, l := range f.locks {
+		if l.expired(now) {
+			delete(f.locks, name)
+		}
+	}
+}
+
+// lockUpdated wakes up the callers waiting for a lock. Called with the FSM
+// lock held.
+func (f *fsm) lockUpdated() {
+	close(f.lockChanged)
+	f.lockChanged = make(chan struct{})
+}
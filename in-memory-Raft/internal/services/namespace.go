@@ -0,0 +1,325 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrNamespaceNotFound = errors.New("namespace not found")
+	ErrInvalidNamespace  = errors.New("invalid namespace name")
+	ErrAccessDenied      = errors.New("access denied")
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+)
+
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Quota limits the size of a namespace. Zero means unlimited.
+type Quota struct {
+	MaxKeys  int   `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// ACLRule grants the holder of a token read and/or write access. Only the
+// hash of the token is replicated.
+type ACLRule struct {
+	TokenHash string `json:"token_hash"`
+	Read      bool   `json:"read"`
+	Write     bool   `json:"write"`
+}
+
+// NamespaceOptions is what a client sends to create or update a namespace.
+type NamespaceOptions struct {
+	Quota Quota `json:"quota"`
+	ACL   []struct {
+		Token string `json:"token"`
+		Read  bool   `json:"read"`
+		Write bool   `json:"write"`
+	} `json:"acl"`
+}
+
+// NamespaceInfo describes a namespace without exposing its ACL tokens.
+type NamespaceInfo struct {
+	Name     string `json:"name"`
+	Keys     int    `json:"keys"`
+	Bytes    int64  `json:"bytes"`
+	Quota    Quota  `json:"quota"`
+	ACLRules int    `json:"acl_rules"`
+}
+
+type namespace struct {
+	Data  map[string]string `json:"data"`
+	Bytes int64             `json:"bytes"`
+	Quota Quota             `json:"quota"`
+	ACL   []ACLRule         `json:"acl,omitempty"`
+}
+
+func (ns *namespace) info(name string) NamespaceInfo {
+	return NamespaceInfo{
+		Name:     name,
+		Keys:     len(ns.Data),
+		Bytes:    ns.Bytes,
+		Quota:    ns.Quota,
+		ACLRules: len(ns.ACL),
+	}
+}
+
+func (ns *namespace) copy() *namespace {
+	c := *ns
+	c.Data = make(map[string]string, len(ns.Data))
+	for k, v := range ns.Data {
+		c.Data[k] = v
+	}
+	c.ACL = append([]ACLRule(nil), ns.ACL...)
+	return &c
+}
+
+// allows reports whether token grants the requested access. A namespace
+// without rules is open to everybody.
+func (ns *namespace) allows(token string, write bool) bool {
+	if len(ns.ACL) == 0 {
+		return true
+	}
+	hash := []byte(hashToken(token))
+	for _, rule := range ns.ACL {
+		if subtle.ConstantTimeCompare(hash, []byte(rule.TokenHash)) != 1 {
+			continue
+		}
+		if write {
+			return rule.Write
+		}
+		return rule.Read || rule.Write
+	}
+	return false
+}
+
+func entrySize(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// PutNamespace creates the namespace or replaces its quota and ACL. Changing
+// an existing namespace requires write access to it.
+func (ims *InMemoryStore) PutNamespace(ctx context.Context, name, token string, opts NamespaceOptions) error {
+	if !namespaceName.MatchString(name) {
+		return ErrInvalidNamespace
+	}
+	if err := ims.CheckNamespace(name, token, true); err != nil && !errors.Is(err, ErrNamespaceNotFound) {
+		return err
+	}
+
+	c := &command{
+		Op:        "ns-put",
+		Namespace: name,
+		Quota:     &opts.Quota,
+		ACL:       make([]ACLRule, 0, len(opts.ACL)),
+	}
+	for _, rule := range opts.ACL {
+		if rule.Token == "" {
+			return fmt.Errorf("acl token must not be empty")
+		}
+		c.ACL = append(c.ACL, ACLRule{TokenHash: hashToken(rule.Token), Read: rule.Read, Write: rule.Write})
+	}
+	_, err := ims.apply(ctx, c)
+	return err
+}
+
+// DeleteNamespace drops the namespace and all of its keys in one command.
+func (ims *InMemoryStore) DeleteNamespace(ctx context.Context, name, token string) error {
+	if err := ims.CheckNamespace(name, token, true); err != nil {
+		return err
+	}
+	_, err := ims.apply(ctx, &command{Op: "ns-delete", Namespace: name})
+	return err
+}
+
+func (ims *InMemoryStore) Namespaces() []NamespaceInfo {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	result := make([]NamespaceInfo, 0, len(ims.namespaces))
+	for name, ns := range ims.namespaces {
+		result = append(result, ns.info(name))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (ims *InMemoryStore) NamespaceInfo(name string) (NamespaceInfo, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	ns, ok := ims.namespaces[name]
+	if !ok {
+		return NamespaceInfo{}, ErrNamespaceNotFound
+	}
+	return ns.info(name), nil
+}
+
+// CheckNamespace verifies that the namespace exists and token grants the
+// requested access to it.
+func (ims *InMemoryStore) CheckNamespace(name, token string, write bool) error {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	ns, ok := ims.namespaces[name]
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+	if !ns.allows(token, write) {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// KnownToken reports whether the ACL of some namespace grants token any
+// access, which is how the store tells its clients apart.
+func (ims *InMemoryStore) KnownToken(token string) bool {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	hash := []byte(hashToken(token))
+	for _, ns := range ims.namespaces {
+		for _, rule := range ns.ACL {
+			if subtle.ConstantTimeCompare(hash, []byte(rule.TokenHash)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ims *InMemoryStore) NamespaceGet(name, key string) (string, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	ns, ok := ims.namespaces[name]
+	if !ok {
+		return "", ErrNamespaceNotFound
+	}
+	value, ok := ns.Data[key]
+	if !ok {
+		return "", fmt.Errorf("key '%s' not found", key)
+	}
+	return value, nil
+}
+
+func (ims *InMemoryStore) NamespaceList(name, prefix string) (map[string]string, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	ns, ok := ims.namespaces[name]
+	if !ok {
+		return nil, ErrNamespaceNotFound
+	}
+	result := make(map[string]string)
+	for k, v := range ns.Data {
+		if strings.HasPrefix(k, prefix) {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+func (ims *InMemoryStore) NamespacePut(ctx context.Context, name, key, value string) error {
+	if err := ims.checkSize(key, len(value)); err != nil {
+		return err
+	}
+	_, err := ims.apply(ctx, &command{Op: "set", Namespace: name, Key: key, Value: value})
+	return err
+}
+
+func (ims *InMemoryStore) NamespaceDelete(ctx context.Context, name, key string) error {
+	_, err := ims.apply(ctx, &command{Op: "delete", Namespace: name, Key: key})
+	return err
+}
+
+func (f *fsm) applyNamespacePut(name string, quota *Quota, acl []ACLRule) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ns, ok := f.namespaces[name]
+	if !ok {
+		ns = &namespace{Data: make(map[string]string)}
+		f.namespaces[name] = ns
+	}
+	if quota != nil {
+		ns.Quota = *quota
+	}
+	ns.ACL = acl
+	return nil
+}
+
+func (f *fsm) applyNamespaceDelete(index uint64, name string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ns, ok := f.namespaces[name]
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+	for k := range ns.Data {
+		f.watchers.notify(Event{Type: EventDelete, Namespace: name, Key: k, Index: index})
+	}
+	delete(f.namespaces, name)
+	f.updateAlarm()
+	return nil
+}
+
+// applyNamespaceSet enforces the quota here rather than before Apply, so that
+// every replica takes the same decision.
+func (f *fsm) applyNamespaceSet(index uint64, name, key, value string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ns, ok := f.namespaces[name]
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+
+	old, exists := ns.Data[key]
+	bytes := ns.Bytes + entrySize(key, value)
+	keys := len(ns.Data)
+	if exists {
+		bytes -= entrySize(key, old)
+	} else {
+		keys++
+	}
+	if ns.Quota.MaxKeys > 0 && keys > ns.Quota.MaxKeys {
+		return fmt.Errorf("%w: namespace '%s' is limited to %d keys", ErrQuotaExceeded, name, ns.Quota.MaxKeys)
+	}
+	if ns.Quota.MaxBytes > 0 && bytes > ns.Quota.MaxBytes {
+		return fmt.Errorf("%w: namespace '%s' is limited to %d bytes", ErrQuotaExceeded, name, ns.Quota.MaxBytes)
+	}
+	delta := usageDelta(key, old, exists, value)
+	if err := f.admit(name, key, delta); err != nil {
+		return err
+	}
+
+	ns.Data[key] = value
+	ns.Bytes = bytes
+	f.updateAlarm()
+	f.watchers.notify(Event{Type: EventPut, Namespace: name, Key: key, Value: value, Index: index})
+	return nil
+}
+
+func (f *fsm) applyNamespaceUnset(index uint64, name, key string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ns, ok := f.namespaces[name]
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+	if old, exists := ns.Data[key]; exists {
+		ns.Bytes -= entrySize(key, old)
+		delete(ns.Data, key)
+		f.updateAlarm()
+		f.watchers.notify(Event{Type: EventDelete, Namespace: name, Key: key, Index: index})
+	}
+	return nil
+}
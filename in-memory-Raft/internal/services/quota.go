@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const defaultMaxPendingApplies = 1024
+
+var (
+	ErrNoSpace      = errors.New("storage alarm raised, writes are blocked until space is freed")
+	ErrBusy         = errors.New("too many pending writes")
+	ErrInvalidQuota = errors.New("invalid quota")
+)
+
+// QuotaConfig limits the whole cluster and key prefixes of the default
+// keyspace. Namespaces carry their own Quota.
+type QuotaConfig struct {
+	Cluster  Quota            `json:"cluster"`
+	Prefixes map[string]Quota `json:"prefixes,omitempty"`
+}
+
+// Usage counts keys and bytes (key plus value length).
+type Usage struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// QuotaUsage is a quota together with what it currently covers.
+type QuotaUsage struct {
+	Prefix string `json:"prefix,omitempty"`
+	Quota  Quota  `json:"quota"`
+	Usage
+}
+
+// QuotaStatus is returned by Quotas.
+type QuotaStatus struct {
+	Cluster  QuotaUsage   `json:"cluster"`
+	Prefixes []QuotaUsage `json:"prefixes"`
+	Alarm    bool         `json:"alarm"`
+}
+
+// quotaState is the replicated part of the quotas. Usage is derived from the
+// keyspace and recomputed on restore.
+type quotaState struct {
+	Config QuotaConfig `json:"config"`
+	Alarm  bool        `json:"alarm,omitempty"`
+}
+
+func (qs quotaState) copy() quotaState {
+	c := qs
+	c.Config.Prefixes = make(map[string]Quota, len(qs.Config.Prefixes))
+	for prefix, q := range qs.Config.Prefixes {
+		c.Config.Prefixes[prefix] = q
+	}
+	return c
+}
+
+func (q Quota) exceeded(u Usage) bool {
+	return (q.MaxKeys > 0 && u.Keys > q.MaxKeys) || (q.MaxBytes > 0 && u.Bytes > q.MaxBytes)
+}
+
+// reached tells whether u leaves no room for a growing write.
+func (q Quota) reached(u Usage) bool {
+	return (q.MaxKeys > 0 && u.Keys >= q.MaxKeys) || (q.MaxBytes > 0 && u.Bytes >= q.MaxBytes)
+}
+
+func (q Quota) String() string {
+	var limits []string
+	if q.MaxKeys > 0 {
+		limits = append(limits, fmt.Sprintf("%d keys", q.MaxKeys))
+	}
+	if q.MaxBytes > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes", q.MaxBytes))
+	}
+	return strings.Join(limits, " and ")
+}
+
+func (u Usage) add(d Usage) Usage {
+	return Usage{Keys: u.Keys + d.Keys, Bytes: u.Bytes + d.Bytes}
+}
+
+// usageDelta is the change of usage when key goes from old (if it existed)
+// to value.
+func usageDelta(key, old string, existed bool, value string) Usage {
+	d := Usage{Bytes: entrySize(key, value)}
+	if existed {
+		d.Bytes -= entrySize(key, old)
+	} else {
+		d.Keys = 1
+	}
+	return d
+}
+
+// Quotas returns the configured quotas, what they cover and whether the
+// storage alarm is raised.
+func (ims *InMemoryStore) Quotas() QuotaStatus {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	status := QuotaStatus{
+		Cluster:  QuotaUsage{Quota: ims.quotas.Config.Cluster, Usage: (*fsm)(ims).totalUsage()},
+		Prefixes: make([]QuotaUsage, 0, len(ims.quotas.Config.Prefixes)),
+		Alarm:    ims.quotas.Alarm,
+	}
+	for prefix, q := range ims.quotas.Config.Prefixes {
+		status.Prefixes = append(status.Prefixes, QuotaUsage{Prefix: prefix, Quota: q, Usage: *ims.prefixUsage[prefix]})
+	}
+	sort.Slice(status.Prefixes, func(i, j int) bool { return status.Prefixes[i].Prefix < status.Prefixes[j].Prefix })
+	return status
+}
+
+// SetQuotas replaces the cluster-wide and prefix quotas.
+func (ims *InMemoryStore) SetQuotas(ctx context.Context, config QuotaConfig) error {
+	for prefix, q := range config.Prefixes {
+		if prefix == "" || q.MaxKeys < 0 || q.MaxBytes < 0 {
+			return fmt.Errorf("%w for prefix '%s'", ErrInvalidQuota, prefix)
+		}
+	}
+	if config.Cluster.MaxKeys < 0 || config.Cluster.MaxBytes < 0 {
+		return fmt.Errorf("%w for the cluster", ErrInvalidQuota)
+	}
+	_, err := ims.apply(ctx, &command{Op: "quota-set", Quotas: &config})
+	return err
+}
+
+func (f *fsm) applySetQuotas(config *QuotaConfig) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if config == nil {
+		config = &QuotaConfig{}
+	}
+	f.quotas.Config = *config
+	f.recomputeUsage()
+	f.updateAlarm()
+	return nil
+}
+
+func (f *fsm) totalUsage() Usage {
+	u := Usage{Keys: len(f.data), Bytes: f.bytes}
+	for _, ns := range f.namespaces {
+		u.Keys += len(ns.Data)
+		u.Bytes += ns.Bytes
+	}
+	return u
+}
+
+// admit decides whether a write changing the usage by delta fits the quotas.
+// A write that would exceed the cluster quota is refused alone; the alarm,
+// raised once the usage reaches the quota, blocks every growing write until
+// space is freed. Being part of Apply, the decision is the same on every
+// replica.
+func (f *fsm) admit(namespace, key string, delta Usage) error {
+	if delta.Keys <= 0 && delta.Bytes <= 0 {
+		return nil
+	}
+	if f.quotas.Alarm {
+		return ErrNoSpace
+	}
+	if q := f.quotas.Config.Cluster; q.exceeded(f.totalUsage().add(delta)) {
+		return fmt.Errorf("%w: cluster is limited to %s", ErrQuotaExceeded, q)
+	}
+	if namespace != "" {
+		return nil
+	}
+	for prefix, q := range f.quotas.Config.Prefixes {
+		if strings.HasPrefix(key, prefix) && q.exceeded(f.prefixUsage[prefix].add(delta)) {
+			return fmt.Errorf("%w: prefix '%s' is limited to %s", ErrQuotaExceeded, prefix, q)
+		}
+	}
+	return nil
+}
+
+// account records a change of the default keyspace admitted by admit, or a
+// delete.
+func (f *fsm) account(key string, delta Usage) {
+	f.bytes += delta.Bytes
+	for prefix, u := range f.prefixUsage {
+		if strings.HasPrefix(key, prefix) {
+			*u = u.add(delta)
+		}
+	}
+	f.updateAlarm()
+}
+
+// updateAlarm raises the alarm while the usage is at the cluster quota and
+// clears it once the usage is back under.
+func (f *fsm) updateAlarm() {
+	f.quotas.Alarm = f.quotas.Config.Cluster.reached(f.totalUsage())
+}
+
+// recomputeUsage rebuilds the derived counters from the keyspace.
+func (f *fsm) recomputeUsage() {
+	f.bytes = 0
+	f.prefixUsage = make(map[string]*Usage, len(f.quotas.Config.Prefixes))
+	for prefix := range f.quotas.Config.Prefixes {
+		f.prefixUsage[prefix] = &Usage{}
+	}
+	for k, v := range f.data {
+		size := entrySize(k, v)
+		f.bytes += size
+		for prefix, u := range f.prefixUsage {
+			if strings.HasPrefix(k, prefix) {
+				u.Keys++
+				u.Bytes += size
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package services
+
+import "context"
+
+// retention bounds the logs the FSM keeps. The local configuration cannot be
+// used for that: nodes set up differently would trim differently and end up
+// with different states for the same index. The first leader that finds the
+// bounds unset records its own instead, and every replica trims by them from
+// that entry on.
+type retention struct {
+	AuditLogSize int `json:"audit_log_size"`
+	HistorySize  int `json:"history_size"`
+}
+
+// initRetention records the configured bounds unless the cluster has some.
+func (ims *InMemoryStore) initRetention() error {
+	ims.mutex.RLock()
+	set := ims.retention != nil
+	ims.mutex.RUnlock()
+	if set {
+		return nil
+	}
+
+	c := &command{Op: "retention-init", Retention: &retention{AuditLogSize: ims.AuditLogSize, HistorySize: ims.HistorySize}}
+	_, err := ims.apply(WithOrigin(context.Background(), systemOrigin), c)
+	return err
+}
+
+// applyRetention only takes effect once, like applyClusterInit, so that
+// concurrent leaders agree on the first bounds committed.
+func (f *fsm) applyRetention(r *retention) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.retention == nil && r != nil {
+		f.retention = r
+		f.trimAudit()
+		for k, h := range f.history {
+			f.history[k] = f.trimHistory(h)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"inmemoryraft/internal/jsonschema"
+)
+
+var (
+	ErrSchemaNotFound  = errors.New("schema not found")
+	ErrSchemaViolation = errors.New("value does not match the schema")
+)
+
+// SchemaInfo is a JSON Schema registered for a key prefix.
+type SchemaInfo struct {
+	Prefix string          `json:"prefix"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+// SchemaViolationError reports why a value was refused by the schema of a
+// prefix covering its key.
+type SchemaViolationError struct {
+	Key    string             `json:"key"`
+	Prefix string             `json:"prefix"`
+	Errors []jsonschema.Error `json:"errors"`
+}
+
+func (e *SchemaViolationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, ve := range e.Errors {
+		msgs[i] = ve.String()
+	}
+	return fmt.Sprintf("value of key '%s' does not match the schema of prefix '%s': %s",
+		e.Key, e.Prefix, strings.Join(msgs, "; "))
+}
+
+func (e *SchemaViolationError) Unwrap() error {
+	return ErrSchemaViolation
+}
+
+// prefixSchema keeps a schema as registered next to its compiled form.
+type prefixSchema struct {
+	Raw    json.RawMessage
+	schema *jsonschema.Schema
+}
+
+// Schemas returns the registered schemas ordered by prefix.
+func (ims *InMemoryStore) Schemas() []SchemaInfo {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	result := make([]SchemaInfo, 0, len(ims.schemas))
+	for prefix, ps := range ims.schemas {
+		result = append(result, SchemaInfo{Prefix: prefix, Schema: ps.Raw})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Prefix < result[j].Prefix })
+	return result
+}
+
+func (ims *InMemoryStore) Schema(prefix string) (json.RawMessage, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	ps, ok := ims.schemas[prefix]
+	if !ok {
+		return nil, ErrSchemaNotFound
+	}
+	return ps.Raw, nil
+}
+
+// PutSchema registers or replaces the JSON Schema that values of keys
+// starting with prefix must match. Keys already stored are not checked.
+func (ims *InMemoryStore) PutSchema(ctx context.Context, prefix string, schema []byte) error {
+	if prefix == "" {
+		return fmt.Errorf("%w: prefix must not be empty", jsonschema.ErrInvalidSchema)
+	}
+	if _, err := jsonschema.Compile(schema); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, schema); err != nil {
+		return fmt.Errorf("%w: %s", jsonschema.ErrInvalidSchema, err)
+	}
+	_, err := ims.apply(ctx, &command{Op: "schema-put", Prefix: prefix, Value: buf.String()})
+	return err
+}
+
+func (ims *InMemoryStore) DeleteSchema(ctx context.Context, prefix string) error {
+	_, err := ims.apply(ctx, &command{Op: "schema-delete", Prefix: prefix})
+	return err
+}
+
+// checkSchemas validates a value about to be written under key, so that a
+// bad value is refused before it reaches Raft.
+func (ims *InMemoryStore) checkSchemas(key, value, typ string) error {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	return (*fsm)(ims).checkSchemas(key, value, typ)
+}
+
+// checkPatch validates the document a patch of key would produce from the
+// current one. Patches that cannot be applied are left for the FSM to refuse.
+func (ims *InMemoryStore) checkPatch(key, op string, patch []byte) error {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	f := (*fsm)(ims)
+	if len(f.schemasFor(key)) == 0 {
+		return nil
+	}
+	value, ok := f.data[key]
+	if ok && f.types[key] != TypeJSON {
+		return nil
+	}
+	result, err := patchDocument(op, value, ok, string(patch))
+	if err != nil {
+		return nil
+	}
+	return f.checkSchemas(key, string(result), TypeJSON)
+}
+
+// schemasFor returns the prefixes with a schema covering key, shortest
+// first. Called with the FSM lock held.
+func (f *fsm) schemasFor(key string) []string {
+	var prefixes []string
+	for prefix := range f.schemas {
+		if strings.HasPrefix(key, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// checkSchemas validates value against every schema covering key. Plain
+// string values are validated as JSON; binary values never match a schema.
+func (f *fsm) checkSchemas(key, value, typ string) error {
+	for _, prefix := range f.schemasFor(key) {
+		var errs []jsonschema.Error
+		if typ == TypeBinary {
+			errs = []jsonschema.Error{{Message: "binary values are not allowed"}}
+		} else if err := f.schemas[prefix].schema.Validate([]byte(value)); err != nil {
+			var ve *jsonschema.ValidationError
+			if errors.As(err, &ve) {
+				errs = ve.Errors
+			} else {
+				errs = []jsonschema.Error{{Message: "value is not valid JSON"}}
+			}
+		}
+		if len(errs) > 0 {
+			return &SchemaViolationError{Key: key, Prefix: prefix, Errors: errs}
+		}
+	}
+	return nil
+}
+
+func (f *fsm) applyPutSchema(prefix, schema string) interface{} {
+	compiled, err := jsonschema.Compile([]byte(schema))
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.schemas[prefix] = &prefixSchema{Raw: json.RawMessage(schema), schema: compiled}
+	return nil
+}
+
+func (f *fsm) applyDeleteSchema(prefix string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.schemas[prefix]; !ok {
+		return ErrSchemaNotFound
+	}
+	delete(f.schemas, prefix)
+	return nil
+}
+
+func compileSchemas(raw map[string]json.RawMessage) (map[string]*prefixSchema, error) {
+	schemas := make(map[string]*prefixSchema, len(raw))
+	for prefix, schema := range raw {
+		compiled, err := jsonschema.Compile(schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema of prefix '%s': %w", prefix, err)
+		}
+		schemas[prefix] = &prefixSchema{Raw: schema, schema: compiled}
+	}
+	return schemas, nil
+}
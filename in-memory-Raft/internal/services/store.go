@@ -1,51 +1,214 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
+
+	"common/encryption"
+	"inmemoryraft/internal/chaos"
 )
 
 const (
 	retainSnapshotCount = 2
 	raftTimeout         = 10 * time.Second
+
+	defaultTransactionLogPath = "internal/data/transaction_log.json"
+)
+
+var (
+	ErrNotLeader    = errors.New("not leader")
+	ErrShuttingDown = errors.New("store is shutting down")
+	ErrCASMismatch  = errors.New("current value does not match")
 )
 
 type fsm InMemoryStore
 
 type fsmSnapshot struct {
-	store map[string]string
+	state   fsmState
+	keyring *encryption.Keyring
+}
+
+// fsmState is everything the FSM replicates, as written to Raft snapshots.
+type fsmState struct {
+	Data       map[string]string          `json:"data"`
+	Types      map[string]string          `json:"types,omitempty"`
+	Binary     map[string][]byte          `json:"binary,omitempty"` // values of binary keys, kept out of Data
+	Namespaces map[string]*namespace      `json:"namespaces,omitempty"`
+	Cluster    clusterInfo                `json:"cluster"`
+	Quotas     quotaState                 `json:"quotas"`
+	Audit      []AuditRecord              `json:"audit,omitempty"`
+	History    map[string]keyHistory      `json:"history,omitempty"`
+	Meta       map[string]KeyMeta         `json:"meta,omitempty"`
+	Schemas    map[string]json.RawMessage `json:"schemas,omitempty"`
+	Locks      map[string]*Lock           `json:"locks,omitempty"`
+	Counters   map[string]*Counter        `json:"counters,omitempty"`
+	Leases     map[int64]*Lease           `json:"leases,omitempty"`
+	Revision   uint64                     `json:"revision"`
+	Compacted  uint64                     `json:"compacted,omitempty"`
+	Retention  *retention                 `json:"retention,omitempty"`
 }
 
 type command struct {
-	Op    string `json:"op:omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
+	Op        string            `json:"op:omitempty"`
+	Key       string            `json:"key,omitempty"`
+	Value     string            `json:"value,omitempty"`
+	Type      string            `json:"type,omitempty"`
+	Bytes     []byte            `json:"bytes,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+	Binary    map[string][]byte `json:"binary,omitempty"`
+	Types     map[string]string `json:"types,omitempty"`
+	ClusterID string            `json:"cluster_id,omitempty"`
+	TokenHash string            `json:"token_hash,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Quota     *Quota            `json:"quota,omitempty"`
+	ACL       []ACLRule         `json:"acl,omitempty"`
+	Quotas    *QuotaConfig      `json:"quotas,omitempty"`
+	Origin    *Origin           `json:"origin,omitempty"`
+	Time      int64             `json:"time,omitempty"` // Unix nanoseconds on the leader
+	Revision  uint64            `json:"revision,omitempty"`
+	Prefix    string            `json:"prefix,omitempty"`
+	Old       string            `json:"old,omitempty"`
+	Lock      *LockRequest      `json:"lock,omitempty"`
+	Counter   *CounterRequest   `json:"counter,omitempty"`
+	Lease     *LeaseRequest     `json:"lease,omitempty"`
+	LeaseID   int64             `json:"lease_id,omitempty"`
+	Keys      []string          `json:"keys,omitempty"`
+	Txn       *Txn              `json:"txn,omitempty"`
+	Retention *retention        `json:"retention,omitempty"`
+
+	// MaxSize is the value size limit of the leader, which bounds the
+	// result of a patch the same way on every node.
+	MaxSize int `json:"max_size,omitempty"`
 }
 
 type InMemoryStore struct {
-	RaftDir  string
-	RaftBind string // localhost:7000
+	RaftDir   string
+	RaftBind  string // localhost:7000
+	JoinToken string // initial join token of a newly created cluster
+
+	RaftConfig         *raft.Config // raft.DefaultConfig() if nil
+	RetainSnapshots    int
+	ApplyTimeout       time.Duration
+	TransactionLogPath string
+	MaxKeySize         int // bytes, 0 disables the limit
+	MaxValueSize       int // bytes, 0 disables the limit
+	MaxPendingApplies  int // writes waiting for Raft before new ones get ErrBusy, 0 disables the limit
+	AuditLogSize       int // audit records kept, 0 keeps all of them; see retention
+	HistorySize        int // versions kept per key, 0 keeps all of them; see retention
+
+	// Keyring seals snapshots and the transaction log at rest. Nil leaves
+	// them in plain JSON.
+	Keyring *encryption.Keyring
+
+	// Faults misbehaves the TCP transport for chaos testing, as set at
+	// runtime. Nil leaves it alone.
+	Faults *chaos.Faults
 
-	data  map[string]string
-	mutex sync.RWMutex
+	// Transport, LogStore, StableStore and SnapshotStore replace the TCP
+	// transport on RaftBind, the in-memory log and stable stores and the
+	// file snapshot store in RaftDir when set. Tests use them to run
+	// several nodes in one process and to keep their state across restarts.
+	Transport     raft.Transport
+	LogStore      raft.LogStore
+	StableStore   raft.StableStore
+	SnapshotStore raft.SnapshotStore
 
-	raft *raft.Raft
+	data       map[string]string
+	types      map[string]string // value type of keys that are not plain strings
+	namespaces map[string]*namespace
+	cluster    clusterInfo
+	quotas     quotaState
+	audit      []AuditRecord
+	retention  *retention // nil until recorded, keeping everything
+	history    map[string]keyHistory
+	meta       map[string]KeyMeta
+	schemas    map[string]*prefixSchema
+	locks      map[string]*Lock
+	counters   map[string]*Counter
+	leases     map[int64]*Lease
+	keyLeases  map[string]int64 // lease of every key attached to one
+	revision   uint64           // index of the last applied command
+	compacted  uint64
+	mutex      sync.RWMutex
+
+	applyTime   time.Time     // leader time of the command being applied
+	lockChanged chan struct{} // closed whenever a lock changes
+
+	bytes       int64 // size of the default keyspace
+	prefixUsage map[string]*Usage
+
+	raft    *raft.Raft
+	nodeID  string
+	pending chan struct{}
+
+	closeMutex sync.RWMutex
+	closing    bool
+	inflight   sync.WaitGroup
+
+	watchers *watchHub
 
 	logger         *log.Logger
 	transactionLog *TransactionLog
 }
 
+// Member describes a single server of the Raft configuration.
+type Member struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	Leader   bool   `json:"leader"`
+}
+
+// Status is a point-in-time summary of the local node.
+type Status struct {
+	ID           string            `json:"id"`
+	Address      string            `json:"address"`
+	State        string            `json:"state"`
+	LeaderID     string            `json:"leader_id"`
+	LeaderAddr   string            `json:"leader_addr"`
+	LastIndex    uint64            `json:"last_index"`
+	AppliedIndex uint64            `json:"applied_index"`
+	Revision     uint64            `json:"revision"`
+	Keys         int               `json:"keys"`
+	Stats        map[string]string `json:"stats"`
+}
+
 func NewStore() *InMemoryStore {
 	return &InMemoryStore{
+		RetainSnapshots:    retainSnapshotCount,
+		ApplyTimeout:       raftTimeout,
+		TransactionLogPath: defaultTransactionLogPath,
+		MaxKeySize:         defaultMaxKeySize,
+		MaxValueSize:       defaultMaxValueSize,
+		MaxPendingApplies:  defaultMaxPendingApplies,
+		AuditLogSize:       defaultAuditLogSize,
+		HistorySize:        defaultHistorySize,
+
 		data:           make(map[string]string),
+		types:          make(map[string]string),
+		history:        make(map[string]keyHistory),
+		meta:           make(map[string]KeyMeta),
+		schemas:        make(map[string]*prefixSchema),
+		locks:          make(map[string]*Lock),
+		counters:       make(map[string]*Counter),
+		leases:         make(map[int64]*Lease),
+		keyLeases:      make(map[string]int64),
+		lockChanged:    make(chan struct{}),
+		namespaces:     make(map[string]*namespace),
+		prefixUsage:    make(map[string]*Usage),
+		watchers:       newWatchHub(),
 		logger:         log.New(os.Stderr, "[store] ", log.LstdFlags),
 		transactionLog: NewTransactionLog(),
 	}
@@ -53,27 +216,68 @@ func NewStore() *InMemoryStore {
 
 func (ims *InMemoryStore) InitNode(enableSingle bool, localID string) error {
 	config := raft.DefaultConfig()
+	if ims.RaftConfig != nil {
+		c := *ims.RaftConfig
+		config = &c
+	}
 	config.LocalID = raft.ServerID(localID)
 
-	addr, err := net.ResolveTCPAddr("tcp", ims.RaftBind)
-	if err != nil {
-		return err
+	transport := ims.Transport
+	if transport == nil {
+		addr, err := net.ResolveTCPAddr("tcp", ims.RaftBind)
+		if err != nil {
+			return err
+		}
+		// An ephemeral port is only known once listening.
+		var advertise net.Addr = addr
+		if addr.Port == 0 {
+			advertise = nil
+		}
+		stream, err := newClusterStreamLayer(ims.RaftBind, advertise, ims.ClusterID, ims.logger.Printf)
+		if err != nil {
+			return err
+		}
+		var layer raft.StreamLayer = stream
+		if ims.Faults != nil {
+			layer = chaos.NewStreamLayer(stream, ims.Faults)
+		}
+		transport = raft.NewNetworkTransport(layer, 3, 10*time.Second, os.Stderr)
 	}
-	transport, err := raft.NewTCPTransport(ims.RaftBind, addr, 3, 10*time.Second, os.Stderr)
-	if err != nil {
+	ims.RaftBind = string(transport.LocalAddr())
+
+	snapshots := ims.SnapshotStore
+	if snapshots == nil {
+		fss, err := raft.NewFileSnapshotStore(ims.RaftDir, ims.RetainSnapshots, os.Stderr)
+		if err != nil {
+			return fmt.Errorf("file snapshot store: %s", err)
+		}
+		snapshots = fss
+	}
+	if err := ims.checkEncryption(snapshots); err != nil {
 		return err
 	}
 
-	snapshots, err := raft.NewFileSnapshotStore(ims.RaftDir, retainSnapshotCount, os.Stderr)
-	if err != nil {
-		return fmt.Errorf("file snapshot store: %s", err)
+	logStore := ims.LogStore
+	if logStore == nil {
+		logStore = raft.NewInmemStore()
+	}
+	stableStore := ims.StableStore
+	if stableStore == nil {
+		stableStore = raft.NewInmemStore()
 	}
 
-	logStore := raft.NewInmemStore()
-	stableStore := raft.NewInmemStore()
-
-	ra, _ := raft.NewRaft(config, (*fsm)(ims), logStore, stableStore, snapshots, transport)
+	ra, err := raft.NewRaft(config, (*fsm)(ims), logStore, stableStore, snapshots, transport)
+	if err != nil {
+		return fmt.Errorf("new raft: %w", err)
+	}
 	ims.raft = ra
+	if ims.MaxPendingApplies > 0 {
+		ims.pending = make(chan struct{}, ims.MaxPendingApplies)
+	}
+	ims.nodeID = localID
+
+	go ims.monitorLeadership()
+	go ims.expireLeases()
 
 	if enableSingle {
 		configuration := raft.Configuration{
@@ -90,65 +294,384 @@ func (ims *InMemoryStore) InitNode(enableSingle bool, localID string) error {
 	return nil
 }
 
+// BootstrapPeers forms the initial cluster from a static list of node IDs and
+// Raft addresses. Every node of the list is started with the same list, so
+// the identical bootstrap configurations agree with each other.
+func (ims *InMemoryStore) BootstrapPeers(peers map[string]string) error {
+	ids := make([]string, 0, len(peers))
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	servers := make([]raft.Server, 0, len(ids))
+	for _, id := range ids {
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(id),
+			Address: raft.ServerAddress(peers[id]),
+		})
+	}
+
+	err := ims.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if errors.Is(err, raft.ErrCantBootstrap) {
+		ims.logger.Printf("raft state already present, skipping bootstrap")
+		return nil
+	}
+	return err
+}
+
 func (ims *InMemoryStore) Get(key string) (string, error) {
 	ims.mutex.RLock()
 	defer ims.mutex.RUnlock()
 	value, ok := ims.data[key]
-	if !ok {
+	if !ok || (*fsm)(ims).hiddenByLease(key, time.Now()) {
 		return "", fmt.Errorf("key '%s' not found", key)
 	}
 	return value, nil
 }
 
-func (ims *InMemoryStore) Put(key, value string) error {
-	if ims.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// List returns a copy of every key-value pair whose key starts with prefix.
+func (ims *InMemoryStore) List(prefix string) map[string]string {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	f, now := (*fsm)(ims), time.Now()
+	result := make(map[string]string)
+	for k, v := range ims.data {
+		if strings.HasPrefix(k, prefix) && !f.hiddenByLease(k, now) {
+			result[k] = v
+		}
 	}
+	return result
+}
 
+// ListWithTypes is List together with the types of the listed keys that are
+// not plain strings.
+func (ims *InMemoryStore) ListWithTypes(prefix string) (values, types map[string]string) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	f, now := (*fsm)(ims), time.Now()
+	values, types = make(map[string]string), make(map[string]string)
+	for k, v := range ims.data {
+		if strings.HasPrefix(k, prefix) && !f.hiddenByLease(k, now) {
+			values[k] = v
+			if t, ok := ims.types[k]; ok {
+				types[k] = t
+			}
+		}
+	}
+	return values, types
+}
+
+func (ims *InMemoryStore) Put(ctx context.Context, key, value string) error {
+	if err := ims.checkSize(key, len(value)); err != nil {
+		return err
+	}
+	if err := ims.checkSchemas(key, value, TypeString); err != nil {
+		return err
+	}
 	c := &command{
 		Op:    "set",
 		Key:   key,
 		Value: value,
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
-	}
-
-	f := ims.raft.Apply(b, raftTimeout)
+	_, err := ims.apply(ctx, c)
 
 	ims.transactionLog.Append(LogEntry{
 		Command:   command{Op: "Put", Key: key, Value: value},
 		ApplyTime: time.Now(),
 	})
 
-	return f.Error()
+	return err
 }
 
-func (ims *InMemoryStore) Delete(key string) error {
-	if ims.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// CompareAndSwap sets key to value if it currently holds old, and fails
+// with ErrCASMismatch otherwise, a missing key included.
+func (ims *InMemoryStore) CompareAndSwap(ctx context.Context, key, old, value string) error {
+	if err := ims.checkSize(key, len(value)); err != nil {
+		return err
+	}
+	if err := ims.checkSchemas(key, value, TypeString); err != nil {
+		return err
 	}
+	_, err := ims.apply(ctx, &command{Op: "cas", Key: key, Old: old, Value: value})
+	return err
+}
 
+func (ims *InMemoryStore) Delete(ctx context.Context, key string) error {
 	c := &command{
 		Op:  "delete",
 		Key: key,
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
-	}
-
-	f := ims.raft.Apply(b, raftTimeout)
+	_, err := ims.apply(ctx, c)
 
 	ims.transactionLog.Append(LogEntry{
 		Command:   command{Op: "Delete", Key: key},
 		ApplyTime: time.Now(),
 	})
 
+	return err
+}
+
+// PutMany stores every key of data in one Raft command. The keys are written
+// in order and a key refused by a quota stops the ones after it.
+func (ims *InMemoryStore) PutMany(ctx context.Context, data map[string]string) error {
+	for k, v := range data {
+		if err := ims.checkSize(k, len(v)); err != nil {
+			return err
+		}
+		if err := ims.checkSchemas(k, v, TypeString); err != nil {
+			return err
+		}
+	}
+	_, err := ims.apply(ctx, &command{Op: "mset", Data: data})
+	return err
+}
+
+// DeleteMany deletes the keys in one Raft command and returns how many of
+// them existed.
+func (ims *InMemoryStore) DeleteMany(ctx context.Context, keys ...string) (int, error) {
+	resp, err := ims.apply(ctx, &command{Op: "delete-many", Keys: keys})
+	if err != nil {
+		return 0, err
+	}
+	return resp.(int), nil
+}
+
+// Restore replaces the whole keyspace with data through the Raft log, so that
+// every node ends up with the same state. types holds the type of the keys
+// that are not plain strings, as ListWithTypes returns them. Every value is
+// checked as a write of it would be.
+func (ims *InMemoryStore) Restore(ctx context.Context, data, types map[string]string) error {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	c := &command{
+		Op:     "restore",
+		Data:   make(map[string]string, len(data)),
+		Binary: make(map[string][]byte),
+		Types:  make(map[string]string),
+	}
+	for _, k := range keys {
+		v, typ := data[k], types[k]
+		if err := ims.checkSize(k, len(v)); err != nil {
+			return fmt.Errorf("'%s': %w", k, err)
+		}
+		switch typ {
+		case "", TypeString:
+			typ = TypeString
+			c.Data[k] = v
+		case TypeJSON:
+			if !json.Valid([]byte(v)) {
+				return fmt.Errorf("%w: '%s'", ErrInvalidJSON, k)
+			}
+			c.Data[k] = v
+			c.Types[k] = typ
+		case TypeBinary:
+			// Command strings cannot carry arbitrary bytes either.
+			c.Binary[k] = []byte(v)
+			c.Types[k] = typ
+		default:
+			return fmt.Errorf("%w: '%s' has unknown type '%s'", ErrInvalidType, k, typ)
+		}
+		if err := ims.checkSchemas(k, v, typ); err != nil {
+			return err
+		}
+	}
+	_, err := ims.apply(ctx, c)
+	return err
+}
+
+// apply replicates c through Raft and returns the FSM response. Writes are
+// refused once the store started shutting down, and every accepted write is
+// tracked so that Shutdown can wait for it.
+func (ims *InMemoryStore) apply(ctx context.Context, c *command) (interface{}, error) {
+	ims.closeMutex.RLock()
+	if ims.closing {
+		ims.closeMutex.RUnlock()
+		return nil, ErrShuttingDown
+	}
+	ims.inflight.Add(1)
+	ims.closeMutex.RUnlock()
+	defer ims.inflight.Done()
+
+	if ims.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+
+	// Refuse new writes right away when the apply queue is full instead of
+	// letting them wait for ApplyTimeout.
+	if ims.pending != nil {
+		select {
+		case ims.pending <- struct{}{}:
+			defer func() { <-ims.pending }()
+		default:
+			return nil, ErrBusy
+		}
+	}
+
+	if o := originFrom(ctx); o != (Origin{}) {
+		c.Origin = &o
+	}
+	c.Time = time.Now().UnixNano()
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	f := ims.raft.Apply(b, ims.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrEnqueueTimeout) {
+			return nil, fmt.Errorf("%w: %s", ErrBusy, err)
+		}
+		// Unlike a lost leadership, this is reported before the command is
+		// appended to the log.
+		if errors.Is(err, raft.ErrNotLeader) {
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+	if err, ok := f.Response().(error); ok {
+		return nil, err
+	}
+	return f.Response(), nil
+}
+
+// StopWrites makes every following write fail with ErrShuttingDown and waits
+// for the writes already handed to Raft to finish.
+func (ims *InMemoryStore) StopWrites() {
+	ims.closeMutex.Lock()
+	ims.closing = true
+	ims.closeMutex.Unlock()
+
+	ims.inflight.Wait()
+}
+
+// Linearize returns once this node has applied every write committed
+// before the call, after a Raft barrier has confirmed that it is still
+// leader. Reads that follow observe every write that completed before
+// Linearize was called.
+func (ims *InMemoryStore) Linearize(ctx context.Context) error {
+	if ims.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	timeout := ims.ApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	err := ims.raft.Barrier(timeout).Error()
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		return ErrNotLeader
+	}
+	return err
+}
+
+func (ims *InMemoryStore) IsLeader() bool {
+	return ims.raft.State() == raft.Leader
+}
+
+// Shutdown stops the Raft node, taking a final snapshot first if requested.
+func (ims *InMemoryStore) Shutdown(snapshot bool) error {
+	if snapshot {
+		err := ims.raft.Snapshot().Error()
+		if err != nil && !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+			ims.logger.Printf("failed to take final snapshot: %v", err)
+		}
+	}
+	return ims.raft.Shutdown().Error()
+}
+
+// Snapshot asks Raft to take a snapshot of the FSM right away.
+func (ims *InMemoryStore) Snapshot() error {
+	return ims.raft.Snapshot().Error()
+}
+
+func (ims *InMemoryStore) Members() ([]Member, error) {
+	configFuture := ims.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+
+	_, leaderID := ims.raft.LeaderWithID()
+	servers := configFuture.Configuration().Servers
+	members := make([]Member, 0, len(servers))
+	for _, srv := range servers {
+		members = append(members, Member{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+			Leader:   srv.ID == leaderID,
+		})
+	}
+	return members, nil
+}
+
+func (ims *InMemoryStore) RemoveMember(nodeID string) error {
+	if ims.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	f := ims.raft.RemoveServer(raft.ServerID(nodeID), 0, 0)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	ims.logger.Printf("node %s removed from cluster", nodeID)
+	return nil
+}
+
+// TransferLeadership hands leadership over to nodeID, or to the most
+// up-to-date follower when nodeID is empty.
+func (ims *InMemoryStore) TransferLeadership(nodeID string) error {
+	if ims.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	var f raft.Future
+	if nodeID == "" {
+		f = ims.raft.LeadershipTransfer()
+	} else {
+		var addr raft.ServerAddress
+		members, err := ims.Members()
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if m.ID == nodeID {
+				addr = raft.ServerAddress(m.Address)
+			}
+		}
+		if addr == "" {
+			return fmt.Errorf("node '%s' is not a member of the cluster", nodeID)
+		}
+		f = ims.raft.LeadershipTransferToServer(raft.ServerID(nodeID), addr)
+	}
 	return f.Error()
 }
 
+func (ims *InMemoryStore) Status() Status {
+	leaderAddr, leaderID := ims.raft.LeaderWithID()
+
+	ims.mutex.RLock()
+	keys := len(ims.data)
+	revision := ims.revision
+	ims.mutex.RUnlock()
+
+	return Status{
+		ID:           ims.nodeID,
+		Address:      ims.RaftBind,
+		State:        ims.raft.State().String(),
+		LeaderID:     string(leaderID),
+		LeaderAddr:   string(leaderAddr),
+		LastIndex:    ims.raft.LastIndex(),
+		AppliedIndex: ims.raft.AppliedIndex(),
+		Revision:     revision,
+		Keys:         keys,
+		Stats:        ims.raft.Stats(),
+	}
+}
+
 func (ims *InMemoryStore) Join(nodeID, addr string) error {
 	ims.logger.Printf("received join request for remote node %s at %s", nodeID, addr)
 
@@ -180,6 +703,19 @@ func (ims *InMemoryStore) Join(nodeID, addr string) error {
 	return nil
 }
 
+// JoinNonvoter adds a node that receives the log but neither votes nor
+// counts towards the quorum, so that it can read the state locally.
+func (ims *InMemoryStore) JoinNonvoter(nodeID, addr string) error {
+	if ims.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if err := ims.raft.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0).Error(); err != nil {
+		return err
+	}
+	ims.logger.Printf("node %s at %s joined as nonvoter", nodeID, addr)
+	return nil
+}
+
 func (f *fsm) Apply(l *raft.Log) interface{} {
 	var c command
 
@@ -187,27 +723,221 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
 	}
 
+	rec := f.auditRecord(l.Index, &c)
+	f.mutex.Lock()
+	f.revision = l.Index
+	f.applyTime = rec.Time
+	f.mutex.Unlock()
+
+	resp := f.applyCommand(l.Index, &c)
+	if _, failed := resp.(error); !failed {
+		f.appendAudit(rec)
+	}
+	return resp
+}
+
+func (f *fsm) applyCommand(index uint64, c *command) interface{} {
 	switch c.Op {
 	case "set":
-		return f.applyPut(c.Key, c.Value)
+		if c.Namespace != "" {
+			return f.applyNamespaceSet(index, c.Namespace, c.Key, c.Value)
+		}
+		if c.Type == TypeBinary {
+			return f.applyPutWithLease(index, c.Key, string(c.Bytes), c.Type, c.LeaseID)
+		}
+		return f.applyPutWithLease(index, c.Key, c.Value, c.Type, c.LeaseID)
+	case "mset":
+		return f.applyPutMany(index, c.Data)
+	case "cas":
+		return f.applyCompareAndSwap(index, c.Key, c.Old, c.Value)
 	case "delete":
-		return f.applyDelete(c.Key)
+		if c.Namespace != "" {
+			return f.applyNamespaceUnset(index, c.Namespace, c.Key)
+		}
+		return f.applyDelete(index, c.Key)
+	case "delete-many":
+		return f.applyDeleteMany(index, c.Keys)
+	case "txn":
+		return f.applyTxn(index, c.Txn)
+	case "incr-key":
+		return f.applyIncrementKey(index, c.Key, c.Counter.Delta)
+	case "merge-patch", "json-patch":
+		return f.applyPatch(index, c.Op, c.Key, c.Value, c.MaxSize)
+	case "compact":
+		return f.applyCompact(c.Revision)
+	case "schema-put":
+		return f.applyPutSchema(c.Prefix, c.Value)
+	case "schema-delete":
+		return f.applyDeleteSchema(c.Prefix)
+	case "lock-acquire":
+		return f.applyLockAcquire(index, c.Lock)
+	case "lock-renew":
+		return f.applyLockRenew(c.Lock)
+	case "lock-release":
+		return f.applyLockRelease(c.Lock)
+	case "incr", "decr":
+		return f.applyIncrement(c.Op, c.Counter)
+	case "sequence":
+		return f.applySequence(c.Counter)
+	case "lease-grant":
+		return f.applyLeaseGrant(index, c.Lease)
+	case "lease-keepalive":
+		return f.applyLeaseKeepAlive(c.Lease)
+	case "lease-revoke", "lease-expire":
+		return f.applyLeaseRevoke(index, c.Op, c.Lease)
+	case "counter-delete":
+		return f.applyDeleteCounter(c.Counter.Name)
+	case "quota-set":
+		return f.applySetQuotas(c.Quotas)
+	case "ns-put":
+		return f.applyNamespacePut(c.Namespace, c.Quota, c.ACL)
+	case "ns-delete":
+		return f.applyNamespaceDelete(index, c.Namespace)
+	case "restore":
+		if c.Data == nil {
+			c.Data = make(map[string]string, len(c.Binary))
+		}
+		for k, v := range c.Binary {
+			c.Data[k] = string(v)
+		}
+		return f.applyRestore(index, c.Data, c.Types)
+	case "cluster-init":
+		return f.applyClusterInit(c.ClusterID, c.TokenHash)
+	case "retention-init":
+		return f.applyRetention(c.Retention)
+	case "join-token":
+		return f.applyJoinToken(c.TokenHash)
 	default:
 		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
 	}
 }
 
-func (f *fsm) applyPut(key, value string) interface{} {
+func (f *fsm) applyPut(index uint64, key, value, typ string) interface{} {
+	return f.applyPutWithLease(index, key, value, typ, 0)
+}
+
+// applyPutWithLease attaches the key to the lease, or detaches it from its
+// lease when lease is zero.
+func (f *fsm) applyPutWithLease(index uint64, key, value, typ string, lease int64) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.checkLease(lease); err != nil {
+		return err
+	}
+	return f.putWithLease(index, key, value, typ, lease)
+}
+
+// putWithLease attaches the key to the lease before writing it, so that the
+// watchers see the lease, and restores the previous one if the write is
+// refused. Called with the FSM lock held.
+func (f *fsm) putWithLease(index uint64, key, value, typ string, lease int64) error {
+	old := f.keyLeases[key]
+	f.attachLease(key, lease)
+	if err, ok := f.put(index, key, value, typ).(error); ok {
+		f.attachLease(key, old)
+		return err
+	}
+	return nil
+}
+
+// applyPutMany stores the keys in order and stops at the first one refused,
+// by a quota for instance, keeping the ones before it.
+func (f *fsm) applyPutMany(index uint64, data map[string]string) interface{} {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := f.putWithLease(index, k, data[k], TypeString, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fsm) applyCompareAndSwap(index uint64, key, old, value string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if current, ok := f.data[key]; !ok || current != old || f.hiddenByLease(key, f.applyTime) {
+		return ErrCASMismatch
+	}
+	return f.put(index, key, value, TypeString)
+}
+
+// put is called with the FSM lock held.
+func (f *fsm) put(index uint64, key, value, typ string) interface{} {
+	old, existed := f.data[key]
+	delta := usageDelta(key, old, existed, value)
+	if err := f.admit("", key, delta); err != nil {
+		return err
+	}
 	f.data[key] = value
+	f.account(key, delta)
+	f.setType(key, typ)
+	f.recordVersion(index, key, value, f.types[key], false)
+	f.watchers.notify(f.putEvent(index, key, eventValue(value, typ), typ))
+	return nil
+}
+
+func (f *fsm) applyDelete(index uint64, key string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.attachLease(key, 0)
+	f.deleteKey(index, key)
 	return nil
 }
 
-func (f *fsm) applyDelete(key string) interface{} {
+// applyDeleteMany returns how many of the keys existed.
+func (f *fsm) applyDeleteMany(index uint64, keys []string) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	deleted := 0
+	for _, key := range keys {
+		if _, ok := f.data[key]; ok && !f.hiddenByLease(key, f.applyTime) {
+			deleted++
+		}
+		f.attachLease(key, 0)
+		f.deleteKey(index, key)
+	}
+	return deleted
+}
+
+// deleteKey is called with the FSM lock held.
+func (f *fsm) deleteKey(index uint64, key string) {
+	if old, ok := f.data[key]; ok {
+		delete(f.data, key)
+		f.account(key, Usage{Keys: -1, Bytes: -entrySize(key, old)})
+		f.recordVersion(index, key, "", "", true)
+		f.watchers.notify(Event{Type: EventDelete, Key: key, Index: index})
+	}
+	delete(f.types, key)
+}
+
+func (f *fsm) applyRestore(index uint64, data, types map[string]string) interface{} {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-	delete(f.data, key)
+	for k := range f.data {
+		if _, ok := data[k]; !ok {
+			f.attachLease(k, 0)
+			f.recordVersion(index, k, "", "", true)
+			f.watchers.notify(Event{Type: EventDelete, Key: k, Index: index})
+		}
+	}
+	f.data = make(map[string]string, len(data))
+	f.types = make(map[string]string)
+	for k, v := range data {
+		f.data[k] = v
+		f.setType(k, types[k])
+		f.recordVersion(index, k, v, types[k], false)
+		f.watchers.notify(f.putEvent(index, k, v, types[k]))
+	}
+	// A restore is an administrative operation and is not refused by the
+	// quotas, but it can leave the cluster in alarm.
+	f.recomputeUsage()
+	f.updateAlarm()
 	return nil
 }
 
@@ -216,30 +946,157 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 	defer f.mutex.RUnlock()
 
 	dataCopy := make(map[string]string)
+	binary := make(map[string][]byte)
 	for k, v := range f.data {
-		dataCopy[k] = v
+		if f.types[k] == TypeBinary {
+			binary[k] = []byte(v)
+		} else {
+			dataCopy[k] = v
+		}
+	}
+	types := make(map[string]string, len(f.types))
+	for k, t := range f.types {
+		types[k] = t
+	}
+	// Versions are only ever appended or replaced by new slices, so the
+	// snapshot can share them.
+	history := make(map[string]keyHistory, len(f.history))
+	for k, h := range f.history {
+		history[k] = h
+	}
+	meta := make(map[string]KeyMeta, len(f.meta))
+	for k, m := range f.meta {
+		meta[k] = m
 	}
-	return &fsmSnapshot{store: dataCopy}, nil
+	namespaces := make(map[string]*namespace, len(f.namespaces))
+	for name, ns := range f.namespaces {
+		namespaces[name] = ns.copy()
+	}
+	locks := make(map[string]*Lock, len(f.locks))
+	for name, l := range f.locks {
+		lc := *l
+		locks[name] = &lc
+	}
+	counters := make(map[string]*Counter, len(f.counters))
+	for name, c := range f.counters {
+		cc := *c
+		counters[name] = &cc
+	}
+	leases := make(map[int64]*Lease, len(f.leases))
+	for id, l := range f.leases {
+		lc := l.copy()
+		leases[id] = &lc
+	}
+	schemas := make(map[string]json.RawMessage, len(f.schemas))
+	for prefix, ps := range f.schemas {
+		schemas[prefix] = ps.Raw
+	}
+	return &fsmSnapshot{state: fsmState{
+		Data:       dataCopy,
+		Types:      types,
+		Binary:     binary,
+		Namespaces: namespaces,
+		Cluster:    f.cluster,
+		Quotas:     f.quotas.copy(),
+		Audit:      append([]AuditRecord(nil), f.audit...),
+		Retention:  f.retention,
+		History:    history,
+		Meta:       meta,
+		Schemas:    schemas,
+		Locks:      locks,
+		Counters:   counters,
+		Leases:     leases,
+		Revision:   f.revision,
+		Compacted:  f.compacted,
+	}, keyring: f.Keyring}, nil
 }
 
 func (f *fsm) Restore(rc io.ReadCloser) error {
-	o := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if b, err = f.Keyring.Open(b); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+
+	var state fsmState
+	if err := json.Unmarshal(b, &state); err != nil || state.Data == nil {
+		// Snapshots taken before the FSM kept more than the keyspace are a
+		// plain key-value map.
+		state = fsmState{Data: make(map[string]string)}
+		if err := json.Unmarshal(b, &state.Data); err != nil {
+			return err
+		}
+	}
+
+	for k, v := range state.Binary {
+		state.Data[k] = string(v)
+	}
+	if state.Types == nil {
+		state.Types = make(map[string]string)
+	}
+	if state.Namespaces == nil {
+		state.Namespaces = make(map[string]*namespace)
+	}
+	for _, ns := range state.Namespaces {
+		if ns.Data == nil {
+			ns.Data = make(map[string]string)
+		}
+	}
+
+	schemas, err := compileSchemas(state.Schemas)
+	if err != nil {
 		return err
 	}
 
 	// Set the state from the snapshot, no lock required according to
 	// Hashicorp docs.
-	f.data = o
+	f.data = state.Data
+	f.types = state.Types
+	f.namespaces = state.Namespaces
+	f.cluster = state.Cluster
+	f.quotas = state.Quotas
+	f.audit = state.Audit
+	f.retention = state.Retention
+	f.history = state.History
+	if f.history == nil {
+		f.history = make(map[string]keyHistory)
+	}
+	f.meta = state.Meta
+	if f.meta == nil {
+		f.rebuildMeta()
+	}
+	f.schemas = schemas
+	f.locks = state.Locks
+	if f.locks == nil {
+		f.locks = make(map[string]*Lock)
+	}
+	f.counters = state.Counters
+	if f.counters == nil {
+		f.counters = make(map[string]*Counter)
+	}
+	f.leases = state.Leases
+	if f.leases == nil {
+		f.leases = make(map[int64]*Lease)
+	}
+	f.restoreKeyLeases()
+	f.revision = state.Revision
+	f.compacted = state.Compacted
+	f.recomputeUsage()
+	f.watchers.closeAll()
 	return nil
 }
 
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
-		b, err := json.Marshal(f.store)
+		b, err := json.Marshal(f.state)
 		if err != nil {
 			return err
 		}
+		if b, err = f.keyring.Seal(b); err != nil {
+			return err
+		}
 
 		if _, err := sink.Write(b); err != nil {
 			return err
@@ -257,10 +1114,48 @@ func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 
 func (f *fsmSnapshot) Release() {}
 
-func (ims *InMemoryStore) LoadTransactionLog() error {
-	return ims.transactionLog.Load("internal/data/transaction_log.json", ims)
+func (ims *InMemoryStore) LoadTransactionLog(ctx context.Context) error {
+	return ims.transactionLog.Load(ctx, ims.TransactionLogPath, ims.Keyring, ims)
 }
 
 func (ims *InMemoryStore) SaveTransactionLog() error {
-	return ims.transactionLog.Save("internal/data/transaction_log.json")
+	return ims.transactionLog.Save(ims.TransactionLogPath, ims.Keyring)
+}
+
+// checkEncryption refuses to start on a newest snapshot or a transaction log
+// the keyring cannot open, rather than failing on the first restore or load.
+// Files left plain or sealed with a retired key are only reported: they are
+// sealed with the active key the next time they are written.
+func (ims *InMemoryStore) checkEncryption(snapshots raft.SnapshotStore) error {
+	check := func(name string, header []byte) error {
+		if err := ims.Keyring.Check(header); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if len(header) > 0 && ims.Keyring.NeedsRotation(header) {
+			ims.logger.Printf("%s is not sealed with the active key %s, it is re-encrypted when next written",
+				name, ims.Keyring.ActiveKeyID())
+		}
+		return nil
+	}
+
+	if metas, err := snapshots.List(); err == nil && len(metas) > 0 {
+		_, rc, err := snapshots.Open(metas[0].ID)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", metas[0].ID, err)
+		}
+		header, err := encryption.ReadHeader(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", metas[0].ID, err)
+		}
+		if err := check("snapshot "+metas[0].ID, header); err != nil {
+			return err
+		}
+	}
+
+	header, err := encryption.ReadFileHeader(ims.TransactionLogPath)
+	if err != nil {
+		return err
+	}
+	return check(ims.TransactionLogPath, header)
 }
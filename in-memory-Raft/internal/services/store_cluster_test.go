@@ -0,0 +1,80 @@
+package services_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"inmemoryraft/internal/services"
+	"inmemoryraft/internal/testcluster"
+)
+
+// tests that a command applied on the leader reaches every node.
+func TestStoreOperations(t *testing.T) {
+	c := testcluster.Start(t, testcluster.Config{Nodes: 3})
+	leader := c.WaitForLeader().Store
+
+	tkey := "testkey"
+	tvalue := "testvalue"
+
+	if err := leader.Put(context.Background(), tkey, tvalue); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	c.Sync()
+	for _, n := range c.Nodes() {
+		val, err := n.Store.Get(tkey)
+		if err != nil {
+			t.Fatalf("failed to get key on %s: %s", n.ID, err.Error())
+		}
+		if val != tvalue {
+			t.Fatalf("key has wrong value on %s: %s", n.ID, val)
+		}
+	}
+
+	if err := leader.Delete(context.Background(), tkey); err != nil {
+		t.Fatalf("failed to delete key: %s", err.Error())
+	}
+	c.Sync()
+	for _, n := range c.Nodes() {
+		if val, _ := n.Store.Get(tkey); val != "" {
+			t.Fatalf("key has wrong value on %s: %s", n.ID, val)
+		}
+	}
+}
+
+// tests that nodes configured with different audit log and history sizes
+// keep the same logs, trimmed by the sizes the leader recorded.
+func TestRetentionAgreed(t *testing.T) {
+	size := 0
+	c := testcluster.Start(t, testcluster.Config{Nodes: 3, Configure: func(s *services.InMemoryStore) {
+		size += 3
+		s.AuditLogSize, s.HistorySize = size, size
+	}})
+	leader := c.WaitForLeader().Store
+
+	for i := 0; i < 20; i++ {
+		if err := leader.Put(context.Background(), "k", fmt.Sprint(i)); err != nil {
+			t.Fatalf("failed to set key: %s", err)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(leader.AuditLog(services.AuditFilter{})) >= 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the audit log was never trimmed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Sync()
+	want := leader.AuditLog(services.AuditFilter{})
+	versions, _ := leader.History("k")
+	for _, n := range c.Nodes() {
+		if got := n.Store.AuditLog(services.AuditFilter{}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("audit log of %s differs from the leader's:\n%+v\n%+v", n.ID, got, want)
+		}
+		if got, _ := n.Store.History("k"); !reflect.DeepEqual(got, versions) {
+			t.Fatalf("history of %s differs from the leader's:\n%+v\n%+v", n.ID, got, versions)
+		}
+	}
+}
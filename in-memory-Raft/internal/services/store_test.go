@@ -1,129 +1,1093 @@
 package services
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/raft"
+
+	"common/encryption"
 )
 
 func TestStoreOpen(t *testing.T) {
 	store := NewStore()
-	mkDir, _ := os.MkdirTemp("", "store_test")
-	defer os.RemoveAll(mkDir)
-
 	if store == nil {
 		t.Fatal("failed to create store")
 	}
-	store.RaftBind = "localhost:8888"
-	store.RaftDir = mkDir
+	store.RaftBind = "127.0.0.1:0"
+	store.RaftDir = t.TempDir()
 
 	err := store.InitNode(false, "nodeTest")
 	if err != nil {
 		t.Fatalf("failed to init node: %s", err)
 	}
+	defer store.Shutdown(false)
+	if store.RaftBind == "127.0.0.1:0" {
+		t.Fatalf("expected the bound port to be advertised, got %s", store.RaftBind)
+	}
 }
 
-func initTestNode() (*InMemoryStore, error) {
+// initTestNode starts a single node on an ephemeral port and waits for it
+// to become leader.
+func initTestNode(tb testing.TB) *InMemoryStore {
 	store := NewStore()
-	mkDir, _ := os.MkdirTemp("", "store_test")
-	defer os.RemoveAll(mkDir)
+	store.RaftBind = "127.0.0.1:0"
+	store.RaftDir = tb.TempDir()
 
-	if store == nil {
-		err := fmt.Errorf("failed to create store")
-		return store, err
+	if err := store.InitNode(true, "nodeTest"); err != nil {
+		tb.Fatalf("InitNode failed: %s", err)
+	}
+	tb.Cleanup(func() { store.Shutdown(false) })
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !store.IsLeader() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("node did not become leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return store
+}
+
+func TestStopWritesRejectsWrites(t *testing.T) {
+	store := NewStore()
+	store.StopWrites()
+
+	if err := store.Put(context.Background(), "testkey", "testvalue"); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown on put, got %v", err)
+	}
+	if err := store.Delete(context.Background(), "testkey"); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("expected ErrShuttingDown on delete, got %v", err)
 	}
-	store.RaftBind = "localhost:8888"
-	store.RaftDir = mkDir
+}
 
-	err := store.InitNode(true, "nodeTest")
+func TestCheckJoin(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	if err := store.CheckJoin("", ""); err != nil {
+		t.Fatalf("expected open cluster to accept join, got %v", err)
+	}
+
+	f.applyClusterInit("cluster-a", hashToken("secret"))
+	f.applyClusterInit("cluster-b", "")
+	if store.ClusterID() != "cluster-a" {
+		t.Fatalf("cluster ID changed after second init: %s", store.ClusterID())
+	}
+
+	if err := store.CheckJoin("secret", ""); err != nil {
+		t.Fatalf("expected valid token to be accepted, got %v", err)
+	}
+	if err := store.CheckJoin("wrong", ""); !errors.Is(err, ErrInvalidJoinToken) {
+		t.Fatalf("expected ErrInvalidJoinToken, got %v", err)
+	}
+	if err := store.CheckJoin("secret", "cluster-b"); !errors.Is(err, ErrClusterMismatch) {
+		t.Fatalf("expected ErrClusterMismatch, got %v", err)
+	}
+
+	f.applyJoinToken(hashToken("rotated"))
+	if err := store.CheckJoin("secret", ""); !errors.Is(err, ErrInvalidJoinToken) {
+		t.Fatalf("expected old token to be rejected, got %v", err)
+	}
+}
+
+func TestStreamLayerRejectsForeignCluster(t *testing.T) {
+	local := "cluster-a"
+	remote := "cluster-b"
+	logf := func(string, ...interface{}) {}
+
+	server, err := newClusterStreamLayer("127.0.0.1:0", nil, func() string { return local }, logf)
 	if err != nil {
-		return store, err
+		t.Fatalf("failed to listen: %s", err)
 	}
+	defer server.Close()
+	foreign, err := newClusterStreamLayer("127.0.0.1:0", nil, func() string { return remote }, logf)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer foreign.Close()
+
+	for _, tc := range []struct {
+		dialer *clusterStreamLayer
+		want   error
+	}{
+		{dialer: foreign, want: errForeignCluster},
+		{dialer: server, want: nil},
+	} {
+		conn, err := tc.dialer.Dial(raft.ServerAddress(server.Addr().String()), time.Second)
+		if err != nil {
+			t.Fatalf("failed to dial: %s", err)
+		}
+		conn.Write([]byte("x"))
 
-	// enshure that leader is chosen
-	time.Sleep(3 * time.Second)
-	return store, nil
+		accepted, err := server.Accept()
+		if err != nil {
+			t.Fatalf("failed to accept: %s", err)
+		}
+		_, err = accepted.Read(make([]byte, 1))
+		if err != tc.want {
+			t.Fatalf("expected %v, got %v", tc.want, err)
+		}
+		accepted.Close()
+		conn.Close()
+	}
 }
 
-// tests that a command can be applied to the log stored in RAM.
-func TestStoreOperations(t *testing.T) {
-	store, err := initTestNode()
+type testSink struct {
+	bytes.Buffer
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { return nil }
+func (s *testSink) Close() error  { return nil }
+
+// snapshotRoundTrip persists the FSM of store and restores it into a new one.
+func snapshotRoundTrip(t *testing.T, store *InMemoryStore) *InMemoryStore {
+	snap, err := (*fsm)(store).Snapshot()
 	if err != nil {
-		t.Fatalf("InitNode failed: %s", err)
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+
+	restored := NewStore()
+	if err := (*fsm)(restored).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	return restored
+}
+
+func TestNamespaces(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	if err, _ := f.applyNamespaceSet(1, "team-a", "key", "value").(error); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("expected ErrNamespaceNotFound, got %v", err)
 	}
 
-	tkey := "testkey"
-	tvalue := "testvalue"
+	f.applyNamespacePut("team-a", &Quota{MaxKeys: 2}, nil)
+	f.applyNamespacePut("team-b", &Quota{}, []ACLRule{{TokenHash: hashToken("b-token"), Read: true}})
+	f.applyPut(2, "key", "default", "")
 
-	err = store.Put(tkey, tvalue)
+	for i, key := range []string{"key", "other", "key"} {
+		if err := f.applyNamespaceSet(uint64(3+i), "team-a", key, "a"); err != nil {
+			t.Fatalf("failed to set %s: %v", key, err)
+		}
+	}
+	if err, _ := f.applyNamespaceSet(6, "team-a", "third", "a").(error); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+
+	if val, _ := store.NamespaceGet("team-a", "key"); val != "a" {
+		t.Fatalf("namespace key has wrong value: %s", val)
+	}
+	if val, _ := store.Get("key"); val != "default" {
+		t.Fatalf("default keyspace key has wrong value: %s", val)
+	}
+
+	if err := store.CheckNamespace("team-b", "b-token", false); err != nil {
+		t.Fatalf("expected read access, got %v", err)
+	}
+	if err := store.CheckNamespace("team-b", "b-token", true); !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("expected ErrAccessDenied on write, got %v", err)
+	}
+	if err := store.CheckNamespace("team-b", "", false); !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("expected ErrAccessDenied without token, got %v", err)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	infos := restored.Namespaces()
+	if len(infos) != 2 || infos[0].Name != "team-a" || infos[0].Keys != 2 || infos[0].Bytes != 10 {
+		t.Fatalf("unexpected namespaces after restore: %+v", infos)
+	}
+	if err := restored.CheckNamespace("team-b", "", false); !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("ACL lost in snapshot, got %v", err)
+	}
+
+	f.applyNamespaceDelete(7, "team-a")
+	if _, err := store.NamespaceList("team-a", ""); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("expected deleted namespace to be gone, got %v", err)
+	}
+}
+
+func TestJSONValues(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	f.applyPut(1, "config", `{"db":{"host":"a","port":5432},"tags":["x"]}`, TypeJSON)
+	f.applyPut(2, "plain", "text", "")
+
+	if err := f.applyPatch(3, "merge-patch", "config", `{"db":{"host":"b","port":null}}`, 0); err != nil {
+		t.Fatalf("merge patch failed: %v", err)
+	}
+	if val, _ := store.Get("config"); val != `{"db":{"host":"b"},"tags":["x"]}` {
+		t.Fatalf("unexpected value after merge patch: %s", val)
+	}
+
+	patch := `[{"op":"add","path":"/tags/-","value":"y"},{"op":"test","path":"/db/host","value":"b"}]`
+	if err := f.applyPatch(4, "json-patch", "config", patch, 0); err != nil {
+		t.Fatalf("JSON patch failed: %v", err)
+	}
+	failing := `[{"op":"remove","path":"/tags"},{"op":"test","path":"/db/host","value":"c"}]`
+	if err, _ := f.applyPatch(5, "json-patch", "config", failing, 0).(error); err == nil {
+		t.Fatalf("expected failing JSON patch to return an error")
+	}
+	if val, _ := store.Get("config"); val != `{"db":{"host":"b"},"tags":["x","y"]}` {
+		t.Fatalf("failed patch must not change the value: %s", val)
+	}
+
+	if err, _ := f.applyPatch(6, "merge-patch", "plain", `{}`, 0).(error); !errors.Is(err, ErrNotJSON) {
+		t.Fatalf("expected ErrNotJSON, got %v", err)
+	}
+
+	host, err := store.GetPath("config", "/db/host")
+	if err != nil || string(host) != `"b"` {
+		t.Fatalf("unexpected pointer read: %s, %v", host, err)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	if restored.ValueType("config") != TypeJSON || restored.ValueType("plain") != TypeString {
+		t.Fatalf("value types lost in snapshot")
+	}
+
+	f.applyDelete(7, "config")
+	if store.ValueType("config") != TypeString {
+		t.Fatalf("value type not removed with the key")
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	value := []byte{0x00, 0xff, 0xfe, '\n', 0x80}
+	b, err := json.Marshal(&command{Op: "set", Key: "cert", Bytes: value, Type: TypeBinary})
 	if err != nil {
-		t.Fatalf("failed to set key: %s", err.Error())
+		t.Fatalf("failed to marshal command: %s", err)
+	}
+	if err, _ := f.Apply(&raft.Log{Index: 1, Data: b}).(error); err != nil {
+		t.Fatalf("failed to apply binary value: %s", err)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	val, typ, ok := restored.Lookup("cert")
+	if !ok || typ != TypeBinary || val != string(value) {
+		t.Fatalf("binary value changed in snapshot: %q (%s)", val, typ)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	store := NewStore()
+	store.MaxKeySize = 4
+	store.MaxValueSize = 8
+
+	if err := store.Put(context.Background(), "toolong", "v"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := store.PutBinary(context.Background(), "key", make([]byte, 9)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	if err := store.NamespacePut(context.Background(), "ns", "key", "123456789"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	f.applySetQuotas(&QuotaConfig{
+		Cluster:  Quota{MaxKeys: 4},
+		Prefixes: map[string]Quota{"logs/": {MaxBytes: 20}},
+	})
+	f.applyNamespacePut("team", &Quota{}, nil)
+
+	f.applyPut(1, "logs/a", "0123456789", "")
+	if err, _ := f.applyPut(2, "logs/b", "0123456789", "").(error); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected prefix ErrQuotaExceeded, got %v", err)
+	}
+	if err := f.applyNamespaceSet(3, "team", "x", "1"); err != nil {
+		t.Fatalf("failed to set namespace key: %v", err)
+	}
+	f.applyPut(4, "a", "1", "")
+	f.applyPut(5, "b", "1", "")
+
+	if err, _ := f.applyPut(6, "c", "1", "").(error); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("expected ErrNoSpace over the cluster quota, got %v", err)
+	}
+	if !store.Quotas().Alarm {
+		t.Fatalf("expected the alarm to be raised")
+	}
+	// Overwriting with a value of the same size does not grow the keyspace.
+	if err, _ := f.applyPut(7, "a", "2", "").(error); err != nil {
+		t.Fatalf("expected non-growing write to pass during the alarm, got %v", err)
+	}
+	if err, _ := f.applyPut(8, "a", "22", "").(error); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("expected growing write to be blocked by the alarm, got %v", err)
 	}
 
-	// Wait for committed log entry to be applied
-	time.Sleep(500 * time.Millisecond)
+	restored := snapshotRoundTrip(t, store)
+	status := restored.Quotas()
+	if !status.Alarm || status.Cluster.Keys != 4 || status.Prefixes[0].Bytes != 16 {
+		t.Fatalf("unexpected quota status after restore: %+v", status)
+	}
+
+	f.applyDelete(9, "b")
+	if store.Quotas().Alarm {
+		t.Fatalf("expected delete to clear the alarm")
+	}
+	if err, _ := f.applyPut(10, "c", "1", "").(error); err != nil {
+		t.Fatalf("expected write after freeing space to pass, got %v", err)
+	}
+}
 
-	val, err := store.Get(tkey)
+func TestQuotaOversizedWrite(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+	f.applySetQuotas(&QuotaConfig{Cluster: Quota{MaxBytes: 20}})
+
+	f.applyPut(1, "a", "0123456789", "")
+	if err, _ := f.applyPut(2, "b", "0123456789", "").(error); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected the oversized write to be refused, got %v", err)
+	}
+	if store.Quotas().Alarm {
+		t.Fatalf("a refused write must not raise the alarm")
+	}
+	if err, _ := f.applyPut(3, "c", "1", "").(error); err != nil {
+		t.Fatalf("expected a small write to pass, got %v", err)
+	}
+
+	// The alarm follows the committed usage: raised at the quota, cleared
+	// below it.
+	f.applyPut(4, "d", "123456", "")
+	if status := store.Quotas(); !status.Alarm || status.Cluster.Bytes != 20 {
+		t.Fatalf("expected the alarm at the quota, got %+v", status)
+	}
+	if err, _ := f.applyPut(5, "e", "", "").(error); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("expected ErrNoSpace during the alarm, got %v", err)
+	}
+	f.applyDelete(6, "c")
+	if store.Quotas().Alarm {
+		t.Fatalf("expected the alarm to clear below the quota")
+	}
+}
+
+// TestRetentionReplicated applies the same log to nodes configured with
+// different bounds: they trim by the bounds of the log, not their own.
+func TestRetentionReplicated(t *testing.T) {
+	small, large := NewStore(), NewStore()
+	small.AuditLogSize, small.HistorySize = 1, 1
+	large.AuditLogSize, large.HistorySize = 100, 100
+	log := []command{
+		{Op: "set", Key: "k", Value: "before"},
+		{Op: "retention-init", Retention: &retention{AuditLogSize: 3, HistorySize: 2}},
+		// Only the first bounds committed count.
+		{Op: "retention-init", Retention: &retention{AuditLogSize: 1, HistorySize: 1}},
+	}
+	for i := 0; i < 5; i++ {
+		log = append(log, command{Op: "set", Key: "k", Value: fmt.Sprint(i)})
+	}
+	for i, c := range log {
+		b, _ := json.Marshal(&c)
+		for _, store := range []*InMemoryStore{small, large} {
+			(*fsm)(store).Apply(&raft.Log{Index: uint64(i + 1), Data: b})
+		}
+	}
+
+	want := small.AuditLog(AuditFilter{})
+	if len(want) != 3 {
+		t.Fatalf("expected 3 audit records, got %+v", want)
+	}
+	if got := large.AuditLog(AuditFilter{}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("audit logs differ:\n%+v\n%+v", got, want)
+	}
+	if h := small.history["k"]; len(h.Versions) != 2 || !h.Trimmed {
+		t.Fatalf("expected 2 versions of k, got %+v", h)
+	}
+	if !reflect.DeepEqual(large.history, small.history) {
+		t.Fatalf("histories differ:\n%+v\n%+v", large.history, small.history)
+	}
+	if _, _, err := large.GetAt("k", 3); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected revision 3 to be trimmed, got %v", err)
+	}
+	restored := snapshotRoundTrip(t, large)
+	if restored.retention == nil || *restored.retention != *large.retention {
+		t.Fatalf("retention lost in snapshot: %+v", restored.retention)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+	f.applyRetention(&retention{AuditLogSize: 3})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	apply := func(index uint64, c command, principal string) interface{} {
+		c.Origin = &Origin{Principal: principal, Source: "10.0.0.1:1234", RequestID: fmt.Sprint("req-", index)}
+		c.Time = start.Add(time.Duration(index) * time.Minute).UnixNano()
+		b, err := json.Marshal(&c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+
+	apply(1, command{Op: "set", Key: "app/a", Value: "1"}, "alice")
+	apply(2, command{Op: "set", Key: "app/a", Value: "2"}, "bob")
+	apply(3, command{Op: "set", Key: "other", Value: "x"}, "alice")
+	apply(4, command{Op: "delete", Key: "app/a"}, "alice")
+	if err, _ := apply(5, command{Op: "merge-patch", Key: "other", Value: "{}"}, "bob").(error); err == nil {
+		t.Fatalf("expected patching a string to fail")
+	}
+
+	records := store.AuditLog(AuditFilter{})
+	if len(records) != 3 || records[0].Index != 2 {
+		t.Fatalf("expected the 3 newest successful records, got %+v", records)
+	}
+	if rec := records[2]; rec.Op != "delete" || rec.Before == nil || *rec.Before != "2" || rec.RequestID != "req-4" {
+		t.Fatalf("unexpected delete record: %+v", rec)
+	}
+
+	alice := store.AuditLog(AuditFilter{Prefix: "app/", Principal: "alice"})
+	if len(alice) != 1 || alice[0].Index != 4 {
+		t.Fatalf("unexpected filtered records: %+v", alice)
+	}
+	window := store.AuditLog(AuditFilter{Since: start.Add(2 * time.Minute), Until: start.Add(4 * time.Minute)})
+	if len(window) != 2 || window[0].Index != 2 || window[1].Index != 3 {
+		t.Fatalf("unexpected records in time range: %+v", window)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	if got := restored.AuditLog(AuditFilter{Limit: 1}); len(got) != 1 || got[0].Index != 4 || got[0].Principal != "alice" {
+		t.Fatalf("audit log lost in snapshot: %+v", got)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+	f.applyRetention(&retention{HistorySize: 3})
+
+	apply := func(index uint64, c command) interface{} {
+		b, err := json.Marshal(&c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+
+	apply(1, command{Op: "set", Key: "app/a", Value: "1"})
+	apply(2, command{Op: "set", Key: "app/b", Value: "x"})
+	apply(3, command{Op: "set", Key: "app/a", Value: "2"})
+	apply(4, command{Op: "delete", Key: "app/b"})
+
+	if v, _, err := store.GetAt("app/a", 2); err != nil || v != "1" {
+		t.Fatalf("expected '1' at revision 2, got %q, %v", v, err)
+	}
+	if _, _, err := store.GetAt("app/b", 4); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected deleted key to be missing, got %v", err)
+	}
+	if _, _, err := store.GetAt("app/a", 5); !errors.Is(err, ErrFutureRevision) {
+		t.Fatalf("expected ErrFutureRevision, got %v", err)
+	}
+	if kvs, err := store.ListAt("app/", 3); err != nil || len(kvs) != 2 || kvs["app/a"].Value != "2" || kvs["app/b"].Value != "x" {
+		t.Fatalf("unexpected list at revision 3: %+v, %v", kvs, err)
+	}
+	if versions, err := store.History("app/b"); err != nil || len(versions) != 2 || !versions[1].Deleted {
+		t.Fatalf("expected a tombstone, got %+v, %v", versions, err)
+	}
+
+	apply(5, command{Op: "set", Key: "app/a", Value: "3"})
+	apply(6, command{Op: "set", Key: "app/a", Value: "4"})
+	if _, _, err := store.GetAt("app/a", 2); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected trimmed version to be gone, got %v", err)
+	}
+	if v, _, err := store.GetAt("app/a", 4); err != nil || v != "2" {
+		t.Fatalf("expected '2' at revision 4, got %q, %v", v, err)
+	}
+
+	if err, _ := apply(7, command{Op: "compact", Revision: 5}).(error); err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	if _, _, err := store.GetAt("app/a", 4); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected ErrCompacted before the compaction revision, got %v", err)
+	}
+	if _, err := store.History("app/b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected compaction to drop the tombstone, got %v", err)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	if v, _, err := restored.GetAt("app/a", 5); err != nil || v != "3" {
+		t.Fatalf("history lost in snapshot: %q, %v", v, err)
+	}
+	if _, _, err := restored.GetAt("app/a", 4); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("compaction lost in snapshot: %v", err)
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	apply := func(index uint64, c command) interface{} {
+		b, err := json.Marshal(&c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+
+	schema := `{"type":"object","required":["port"],"properties":{"port":{"type":"integer","maximum":65535}}}`
+	if err, _ := apply(1, command{Op: "schema-put", Prefix: "app/", Value: schema}).(error); err != nil {
+		t.Fatalf("failed to register schema: %v", err)
+	}
+
+	if err := store.checkSchemas("app/a", `{"port":8080}`, TypeJSON); err != nil {
+		t.Fatalf("expected valid value to pass, got %v", err)
+	}
+	if err := store.checkSchemas("other", `not json`, TypeString); err != nil {
+		t.Fatalf("expected keys outside the prefix to pass, got %v", err)
+	}
+	err := store.checkSchemas("app/a", `{"port":"80"}`, TypeJSON)
+	var violation *SchemaViolationError
+	if !errors.As(err, &violation) || violation.Prefix != "app/" || len(violation.Errors) != 1 || violation.Errors[0].Path != "/port" {
+		t.Fatalf("expected a violation at /port, got %v", err)
+	}
+	if err := store.checkSchemas("app/a", `port=80`, TypeString); !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("expected a string that is not JSON to be refused, got %v", err)
+	}
+	if err := store.checkSchemas("app/a", "\x00", TypeBinary); !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("expected a binary value to be refused, got %v", err)
+	}
+
+	apply(2, command{Op: "set", Key: "app/a", Value: `{"port":8080}`, Type: TypeJSON})
+	if err := store.checkPatch("app/a", "merge-patch", []byte(`{"port":null}`)); !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("expected patch removing a required property to be refused, got %v", err)
+	}
+	if err, _ := apply(3, command{Op: "merge-patch", Key: "app/a", Value: `{"port":70000}`}).(error); !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("expected the FSM to refuse an invalid patch result, got %v", err)
+	}
+	if v, _ := store.Get("app/a"); v != `{"port":8080}` {
+		t.Fatalf("refused patch changed the value: %s", v)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	if got := restored.Schemas(); len(got) != 1 || string(got[0].Schema) != schema {
+		t.Fatalf("schemas lost in snapshot: %+v", got)
+	}
+	if err := restored.checkSchemas("app/b", `{}`, TypeJSON); !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("restored schema does not validate, got %v", err)
+	}
+
+	apply(4, command{Op: "schema-delete", Prefix: "app/"})
+	if err := store.checkSchemas("app/a", `{}`, TypeJSON); err != nil {
+		t.Fatalf("expected deleted schema to stop validating, got %v", err)
+	}
+	if err, _ := apply(5, command{Op: "schema-delete", Prefix: "app/"}).(error); !errors.Is(err, ErrSchemaNotFound) {
+		t.Fatalf("expected ErrSchemaNotFound, got %v", err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	start := time.Now().Add(-time.Minute)
+	apply := func(index uint64, at time.Duration, op string, req LockRequest) interface{} {
+		c := command{Op: op, Lock: &req, Time: start.Add(at).UnixNano()}
+		b, err := json.Marshal(&c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+
+	first, ok := apply(1, 0, "lock-acquire", LockRequest{Name: "job", Holder: "a", TTL: 10 * time.Second}).(Lock)
+	if !ok || first.Token != 1 || first.Holder != "a" {
+		t.Fatalf("expected lock with token 1, got %+v", first)
+	}
+	if err, _ := apply(2, time.Second, "lock-acquire", LockRequest{Name: "job", Holder: "b", TTL: time.Second}).(error); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+	again, _ := apply(3, 2*time.Second, "lock-acquire", LockRequest{Name: "job", Holder: "a", TTL: 10 * time.Second}).(Lock)
+	if again.Token != 1 || !again.Expires.After(first.Expires) {
+		t.Fatalf("expected re-acquiring to renew with the same token, got %+v", again)
+	}
+	if err, _ := apply(4, 3*time.Second, "lock-renew", LockRequest{Name: "job", Token: 2}).(error); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("expected renewing with a wrong token to fail, got %v", err)
+	}
+
+	// The lease of "a" ran out, so "b" gets the lock with a larger token.
+	second, ok := apply(5, 20*time.Second, "lock-acquire", LockRequest{Name: "job", Holder: "b", TTL: time.Hour}).(Lock)
+	if !ok || second.Token != 5 {
+		t.Fatalf("expected expired lock to go to b with token 5, got %+v", second)
+	}
+	if err, _ := apply(6, 21*time.Second, "lock-release", LockRequest{Name: "job", Token: 1}).(error); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("expected a stale token not to release the lock, got %v", err)
+	}
+	apply(7, 22*time.Second, "lock-acquire", LockRequest{Name: electionPrefix + "primary", Holder: "n1", Value: "10.0.0.1", TTL: time.Hour})
+
+	restored := snapshotRoundTrip(t, store)
+	if l, err := restored.LockInfo("job"); err != nil || l.Holder != "b" || l.Token != 5 {
+		t.Fatalf("lock lost in snapshot: %+v, %v", l, err)
+	}
+	if l, err := restored.Leader("primary"); err != nil || l.Holder != "n1" || l.Value != "10.0.0.1" || l.Name != "primary" {
+		t.Fatalf("election lost in snapshot: %+v, %v", l, err)
+	}
+	if locks := restored.Locks(); len(locks) != 1 {
+		t.Fatalf("expected elections to be listed apart from locks, got %+v", locks)
+	}
+
+	if err, _ := apply(8, 23*time.Second, "lock-release", LockRequest{Name: "job", Token: 5}).(error); err != nil {
+		t.Fatalf("failed to release lock: %v", err)
+	}
+	if _, err := store.LockInfo("job"); !errors.Is(err, ErrLockNotFound) {
+		t.Fatalf("expected released lock to be gone, got %v", err)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	apply := func(index uint64, op string, req CounterRequest) interface{} {
+		b, err := json.Marshal(&command{Op: op, Counter: &req})
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+	limit := func(v int64) *int64 { return &v }
+
+	if c, _ := apply(1, "incr", CounterRequest{Name: "hits", Delta: 5}).(Counter); c.Value != 5 {
+		t.Fatalf("expected 5, got %+v", c)
+	}
+	if c, _ := apply(2, "decr", CounterRequest{Name: "hits", Delta: 2}).(Counter); c.Value != 3 {
+		t.Fatalf("expected 3, got %+v", c)
+	}
+	if err, _ := apply(3, "decr", CounterRequest{Name: "hits", Delta: 4, Min: limit(0)}).(error); !errors.Is(err, ErrCounterRange) {
+		t.Fatalf("expected decrement below the minimum to fail, got %v", err)
+	}
+	if err, _ := apply(4, "incr", CounterRequest{Name: "hits", Delta: math.MaxInt64}).(error); !errors.Is(err, ErrCounterRange) {
+		t.Fatalf("expected overflow to fail, got %v", err)
+	}
+	if c, _ := store.Counter("hits"); c.Value != 3 {
+		t.Fatalf("refused changes modified the counter: %+v", c)
+	}
+
+	if b, _ := apply(5, "sequence", CounterRequest{Name: "ids", Count: 100}).(Block); b.First != 1 || b.Last != 100 {
+		t.Fatalf("expected IDs 1-100, got %+v", b)
+	}
+	if err, _ := apply(6, "decr", CounterRequest{Name: "ids", Delta: 1}).(error); !errors.Is(err, ErrCounterKind) {
+		t.Fatalf("expected a sequence to refuse decrements, got %v", err)
+	}
+	if err, _ := apply(7, "counter-delete", CounterRequest{Name: "ids"}).(error); !errors.Is(err, ErrCounterKind) {
+		t.Fatalf("expected a sequence to refuse deletion, got %v", err)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	b, _ := (*fsm)(restored).applySequence(&CounterRequest{Name: "ids", Count: 1}).(Block)
+	if b.First != 101 {
+		t.Fatalf("sequence went back after restore: %+v", b)
+	}
+	if c, err := restored.Counter("hits"); err != nil || c.Value != 3 {
+		t.Fatalf("counter lost in snapshot: %+v, %v", c, err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	apply := func(index uint64, c command) interface{} {
+		b, err := json.Marshal(&c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+
+	if err, _ := apply(1, command{Op: "cas", Key: "k", Old: "", Value: "a"}).(error); !errors.Is(err, ErrCASMismatch) {
+		t.Fatalf("expected a missing key not to match, got %v", err)
+	}
+	apply(2, command{Op: "set", Key: "k", Value: "a"})
+	if err, _ := apply(3, command{Op: "cas", Key: "k", Old: "b", Value: "c"}).(error); !errors.Is(err, ErrCASMismatch) {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+	if err, _ := apply(4, command{Op: "cas", Key: "k", Old: "a", Value: "c"}).(error); err != nil {
+		t.Fatalf("failed to swap: %s", err)
+	}
+	if v, _, ok := store.Lookup("k"); !ok || v != "c" {
+		t.Fatalf("expected c, got %q", v)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	// Reads hide expired keys by the local clock, so the commands are
+	// applied around it.
+	now := time.Now()
+	apply := func(index uint64, at time.Duration, c command) interface{} {
+		c.Time = now.Add(at).UnixNano()
+		b, err := json.Marshal(&c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+
+	short, ok := apply(1, -time.Minute, command{Op: "lease-grant", Lease: &LeaseRequest{TTL: 10 * time.Second}}).(Lease)
+	if !ok || short.ID != 1 {
+		t.Fatalf("expected lease 1, got %+v", short)
+	}
+	long, _ := apply(2, 0, command{Op: "lease-grant", Lease: &LeaseRequest{ID: 42, TTL: time.Hour}}).(Lease)
+	if err, _ := apply(3, 0, command{Op: "lease-grant", Lease: &LeaseRequest{ID: 42, TTL: time.Hour}}).(error); !errors.Is(err, ErrLeaseExists) {
+		t.Fatalf("expected ErrLeaseExists, got %v", err)
+	}
+
+	apply(4, -time.Minute, command{Op: "set", Key: "session", Value: "a", LeaseID: short.ID})
+	apply(5, 0, command{Op: "set", Key: "job", Value: "b", LeaseID: long.ID})
+	if err, _ := apply(6, 0, command{Op: "set", Key: "x", Value: "c", LeaseID: 7}).(error); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("expected a write to a missing lease to fail, got %v", err)
+	}
+
+	// The short lease expired, so its key is hidden before the leader
+	// revokes it.
+	if _, _, ok := store.Lookup("session"); ok {
+		t.Fatalf("expected the key of an expired lease to be hidden")
+	}
+	if l, err := store.LeaseInfo(long.ID); err != nil || len(l.Keys) != 1 || l.Keys[0] != "job" {
+		t.Fatalf("expected job attached to lease 42, got %+v, %v", l, err)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	if l, err := restored.LeaseInfo(long.ID); err != nil || l.Keys[0] != "job" {
+		t.Fatalf("lease lost in snapshot: %+v, %v", l, err)
+	}
+
+	if err, _ := apply(7, 0, command{Op: "lease-expire", Lease: &LeaseRequest{ID: long.ID}}).(error); err != nil {
+		t.Fatalf("failed to expire lease: %v", err)
+	}
+	if _, err := store.Get("job"); err != nil {
+		t.Fatalf("expected a lease that has not expired to survive an expiry, got %v", err)
+	}
+	apply(8, 0, command{Op: "lease-expire", Lease: &LeaseRequest{ID: short.ID}})
+	if _, ok := store.data["session"]; ok {
+		t.Fatalf("expected the expired lease to delete its key")
+	}
+
+	// Writing the key without a lease detaches it.
+	apply(9, 0, command{Op: "set", Key: "job", Value: "c"})
+	apply(10, 0, command{Op: "lease-revoke", Lease: &LeaseRequest{ID: long.ID}})
+	if v, err := store.Get("job"); err != nil || v != "c" {
+		t.Fatalf("expected the detached key to survive the revoke, got %q, %v", v, err)
+	}
+	if leases := store.Leases(); len(leases) != 0 {
+		t.Fatalf("expected no leases, got %+v", leases)
+	}
+}
+
+func TestKeyOperations(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+
+	apply := func(index uint64, c command) interface{} {
+		b, err := json.Marshal(&c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+
+	apply(1, command{Op: "mset", Data: map[string]string{"a": "1", "b": "2", "c": "x"}})
+	if kvs := store.List(""); len(kvs) != 3 || kvs["b"] != "2" {
+		t.Fatalf("unexpected keys after mset: %v", kvs)
+	}
+
+	if n, _ := apply(2, command{Op: "incr-key", Key: "a", Counter: &CounterRequest{Delta: 5}}).(int64); n != 6 {
+		t.Fatalf("expected 6, got %d", n)
+	}
+	if n, _ := apply(3, command{Op: "incr-key", Key: "new", Counter: &CounterRequest{Delta: -1}}).(int64); n != -1 {
+		t.Fatalf("expected a missing key to start at zero, got %d", n)
+	}
+	if err, _ := apply(4, command{Op: "incr-key", Key: "c", Counter: &CounterRequest{Delta: 1}}).(error); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("expected ErrNotInteger, got %v", err)
+	}
+	apply(5, command{Op: "set", Key: "max", Value: fmt.Sprint(int64(math.MaxInt64))})
+	if err, _ := apply(6, command{Op: "incr-key", Key: "max", Counter: &CounterRequest{Delta: 1}}).(error); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("expected overflow to fail, got %v", err)
+	}
+
+	if n, _ := apply(7, command{Op: "delete-many", Keys: []string{"a", "b", "missing"}}).(int); n != 2 {
+		t.Fatalf("expected 2 deleted keys, got %d", n)
+	}
+	if v, _ := store.Get("a"); v != "" {
+		t.Fatalf("expected a to be deleted, got %q", v)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	store := NewStore()
+	f := (*fsm)(store)
+	apply := func(index uint64, c command) interface{} {
+		c.Time = time.Now().UnixNano()
+		b, err := json.Marshal(&c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		return f.Apply(&raft.Log{Index: index, Data: b})
+	}
+	txn := func(index uint64, txn Txn) TxnResult {
+		t.Helper()
+		resp := apply(index, command{Op: "txn", Txn: &txn})
+		r, ok := resp.(TxnResult)
+		if !ok {
+			t.Fatalf("txn %d failed: %v", index, resp)
+		}
+		return r
+	}
+
+	// Creating a key only if it is missing, as etcd clients do.
+	create := Txn{
+		Compare: []Compare{{Key: "a", Target: CompareVersion, Result: "=", Number: 0}},
+		Success: []TxnOp{{Type: OpPut, Key: "a", Value: []byte("1")}},
+		Failure: []TxnOp{{Type: OpRange, Key: "a"}},
+	}
+	if r := txn(1, create); !r.Succeeded || r.Revision != 1 {
+		t.Fatalf("expected the first create to succeed, got %+v", r)
+	}
+	r := txn(2, create)
+	if r.Succeeded || len(r.Results[0].KVs) != 1 || r.Results[0].KVs[0].Value != "1" {
+		t.Fatalf("expected the second create to read the key, got %+v", r)
+	}
+
+	txn(3, Txn{Success: []TxnOp{
+		{Type: OpPut, Key: "a", Value: []byte("2")},
+		{Type: OpPut, Key: "b", Value: []byte{0xff, 0x00}},
+	}})
+	kvs, rev, err := store.Range("a", "c", 0)
+	if err != nil || rev != 3 || len(kvs) != 2 {
+		t.Fatalf("unexpected range: %+v, %d, %v", kvs, rev, err)
+	}
+	if m := kvs[0].KeyMeta; m != (KeyMeta{CreateRevision: 1, ModRevision: 3, Version: 2}) {
+		t.Fatalf("unexpected metadata of a: %+v", m)
+	}
+	if kvs[1].Type != TypeBinary || kvs[1].Value != "\xff\x00" {
+		t.Fatalf("expected a binary value, got %+v", kvs[1])
+	}
+	if kvs, _, _ := store.Range("a", "c", 1); len(kvs) != 1 || kvs[0].Value != "1" || kvs[0].Version != 1 {
+		t.Fatalf("unexpected range at revision 1: %+v", kvs)
+	}
+
+	// A compare on the mod revision guards an update.
+	stale := Txn{
+		Compare: []Compare{{Key: "a", Target: CompareMod, Result: "=", Number: 1}},
+		Success: []TxnOp{{Type: OpPut, Key: "a", Value: []byte("lost")}},
+	}
+	if r := txn(4, stale); r.Succeeded {
+		t.Fatalf("expected a stale update to fail")
+	}
+	if err, _ := apply(5, command{Op: "txn", Txn: &Txn{Success: []TxnOp{
+		{Type: OpPut, Key: "c", Value: []byte("x")},
+		{Type: OpPut, Key: "a", IgnoreValue: true, Lease: 99},
+	}}}).(error); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("expected a missing lease to fail the txn, got %v", err)
+	}
+	if _, err := store.Get("c"); err == nil {
+		t.Fatalf("expected a failed txn to write nothing")
+	}
+
+	r = txn(6, Txn{Success: []TxnOp{{Type: OpDelete, Key: "a", End: []byte{0}, PrevKV: true}}})
+	if r.Results[0].Deleted != 2 || len(r.Results[0].KVs) != 2 {
+		t.Fatalf("expected two keys deleted, got %+v", r.Results[0])
+	}
+	if _, ok := store.meta["a"]; ok {
+		t.Fatalf("expected a deleted key to lose its metadata")
+	}
+	txn(7, create)
+	if kvs, _, _ := store.Range("a", "", 0); kvs[0].CreateRevision != 7 || kvs[0].Version != 1 {
+		t.Fatalf("expected a recreated key to start over, got %+v", kvs)
+	}
+
+	events, ch, cancel, err := store.WatchFrom("", 6)
 	if err != nil {
-		t.Fatalf("failed to get key: %s", err.Error())
+		t.Fatalf("failed to watch: %s", err)
 	}
-	if val != tvalue {
-		t.Fatalf("key has wrong value: %s", val)
+	defer cancel()
+	if len(events) != 3 || events[0].Type != EventDelete || events[2].Index != 7 || events[2].Version != 1 {
+		t.Fatalf("unexpected replayed events: %+v", events)
+	}
+	txn(8, Txn{Success: []TxnOp{{Type: OpPut, Key: "a", Value: []byte("3")}}})
+	if ev := <-ch; ev.Index != 8 || ev.Version != 2 || ev.CreateRevision != 7 {
+		t.Fatalf("unexpected live event: %+v", ev)
+	}
+
+	restored := snapshotRoundTrip(t, store)
+	if !reflect.DeepEqual(restored.meta, store.meta) {
+		t.Fatalf("metadata lost in snapshot: %+v", restored.meta)
 	}
 
-	err = store.Delete(tkey)
+	if _, err := store.Txn(context.Background(), &Txn{Success: []TxnOp{
+		{Type: OpPut, Key: "k", Value: []byte("1")},
+		{Type: OpDelete, Key: "a", End: []byte("z")},
+	}}); !errors.Is(err, ErrInvalidTxn) {
+		t.Fatalf("expected a key written twice to be refused, got %v", err)
+	}
+}
+
+func TestRestoreEndsWatches(t *testing.T) {
+	apply := func(store *InMemoryStore, index uint64, c command) {
+		b, _ := json.Marshal(&c)
+		if err, _ := (*fsm)(store).Apply(&raft.Log{Index: index, Data: b}).(error); err != nil {
+			t.Fatalf("failed to apply %+v: %s", c, err)
+		}
+	}
+	leader, follower := NewStore(), NewStore()
+	apply(leader, 1, command{Op: "set", Key: "a", Value: "1"})
+	apply(follower, 1, command{Op: "set", Key: "a", Value: "1"})
+	apply(leader, 2, command{Op: "set", Key: "b", Value: "2"})
+
+	// A follower that lags behind is sent a snapshot while a change stream
+	// is open on it: the change at revision 2 never goes through its FSM.
+	_, ch, cancel, err := follower.WatchFrom("", 2)
 	if err != nil {
-		t.Fatalf("failed to delete key: %s", err.Error())
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer cancel()
+	snap, _ := (*fsm)(leader).Snapshot()
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	if err := (*fsm)(follower).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	select {
+	case ev, ok := <-ch:
+		if ok {
+			t.Fatalf("expected the stream to end on restore, got %+v", ev)
+		}
+	default:
+		t.Fatalf("expected the stream to end on restore")
 	}
 
-	// Wait for committed log entry to be applied
-	time.Sleep(500 * time.Millisecond)
-	val, _ = store.Get(tkey)
-	if val != "" {
-		t.Fatalf("key has wrong value: %s", val)
+	// Resuming from the last revision seen replays the change.
+	events, _, cancel, err := follower.WatchFrom("", 2)
+	if err != nil {
+		t.Fatalf("failed to resume: %s", err)
+	}
+	defer cancel()
+	if len(events) != 1 || events[0].Key != "b" || events[0].Index != 2 {
+		t.Fatalf("expected the put of b at revision 2, got %+v", events)
 	}
 }
 
-func BenchmarkInMemoryStore_Put(b *testing.B) {
-	store, err := initTestNode()
+func TestEncryptedSnapshot(t *testing.T) {
+	kr, err := encryption.NewKeyring(bytes.Repeat([]byte{7}, 32))
 	if err != nil {
-		b.Fatalf("InitNode failed: %s", err)
+		t.Fatalf("failed to create keyring: %s", err)
+	}
+	store := NewStore()
+	store.Keyring = kr
+	b, _ := json.Marshal(&command{Op: "set", Key: "password", Value: "hunter2"})
+	if err, _ := (*fsm)(store).Apply(&raft.Log{Index: 1, Data: b}).(error); err != nil {
+		t.Fatalf("failed to apply: %s", err)
+	}
+
+	snap, _ := (*fsm)(store).Snapshot()
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	if !encryption.IsSealed(sink.Bytes()) || bytes.Contains(sink.Bytes(), []byte("hunter2")) {
+		t.Fatalf("snapshot is not encrypted")
 	}
 
+	plain := NewStore()
+	if err := (*fsm)(plain).Restore(io.NopCloser(bytes.NewReader(sink.Bytes()))); !errors.Is(err, encryption.ErrNoKey) {
+		t.Fatalf("expected restore without a key to fail, got %v", err)
+	}
+	restored := NewStore()
+	restored.Keyring = kr
+	if err := (*fsm)(restored).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if val, _ := restored.Get("password"); val != "hunter2" {
+		t.Fatalf("key has wrong value: %s", val)
+	}
+
+	store.TransactionLogPath = t.TempDir() + "/transaction_log.json"
+	store.transactionLog.Append(LogEntry{Command: command{Op: "Put", Key: "password", Value: "hunter2"}})
+	if err := store.SaveTransactionLog(); err != nil {
+		t.Fatalf("failed to save transaction log: %s", err)
+	}
+	if b, _ := os.ReadFile(store.TransactionLogPath); !encryption.IsSealed(b) {
+		t.Fatalf("transaction log is not encrypted")
+	}
+	other, _ := encryption.NewKeyring(bytes.Repeat([]byte{8}, 32))
+	if err := other.CheckFile(store.TransactionLogPath); !errors.Is(err, encryption.ErrUnknownKey) {
+		t.Fatalf("expected another key to be refused, got %v", err)
+	}
+}
+
+func TestRestoreLegacySnapshot(t *testing.T) {
+	restored := NewStore()
+	legacy := `{"key": "value"}`
+	if err := (*fsm)(restored).Restore(io.NopCloser(strings.NewReader(legacy))); err != nil {
+		t.Fatalf("failed to restore legacy snapshot: %s", err)
+	}
+	if val, _ := restored.Get("key"); val != "value" {
+		t.Fatalf("key has wrong value: %s", val)
+	}
+}
+
+func BenchmarkInMemoryStore_Put(b *testing.B) {
+	store := initTestNode(b)
+
 	key := "testKey"
 	value := "testValue"
 
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		store.Put(key, value)
+		store.Put(context.Background(), key, value)
 	}
 }
 
 func BenchmarkInMemoryStore_Get(b *testing.B) {
-	store, err := initTestNode()
-	if err != nil {
-		b.Fatalf("InitNode failed: %s", err)
-	}
+	store := initTestNode(b)
 
 	key := "testKey"
 	value := "testValue"
 	store.data[key] = value
 
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		store.Get(key)
 	}
 }
 
 func BenchmarkInMemoryStore_Delete(b *testing.B) {
-	store, err := initTestNode()
-	if err != nil {
-		b.Errorf("InitNode failed: %s", err)
-	}
+	store := initTestNode(b)
 
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		key := fmt.Sprintf("testKey%d", i)
 		value := fmt.Sprintf("testValue%d", i)
 		store.data[key] = value
-		store.Delete(key)
+		store.Delete(context.Background(), key)
 	}
 }
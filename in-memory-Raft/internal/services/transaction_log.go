@@ -1,11 +1,13 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 	"sync"
 	"time"
+
+	"common/encryption"
 )
 
 type LogEntry struct {
@@ -28,41 +30,36 @@ func (tl *TransactionLog) Append(entry LogEntry) {
 	tl.Entries = append(tl.Entries, entry)
 }
 
-func (tl *TransactionLog) Save(filename string) error {
+// Save writes the log to filename, sealed with kr unless it is nil.
+func (tl *TransactionLog) Save(filename string, kr *encryption.Keyring) error {
 	tl.mutex.RLock()
 	defer tl.mutex.RUnlock()
-	file, err := os.Create(filename)
+	b, err := json.MarshalIndent(tl.Entries, "", "    ")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "    ")
-	return encoder.Encode(tl.Entries)
+	return kr.WriteFile(filename, append(b, '\n'), 0644)
 }
 
-func (tl *TransactionLog) Load(filename string, store *InMemoryStore) error {
-	file, err := os.Open(filename)
+func (tl *TransactionLog) Load(ctx context.Context, filename string, kr *encryption.Keyring, store *InMemoryStore) error {
+	b, err := kr.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
 	var entries []LogEntry
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&entries); err != nil {
+	if err := json.Unmarshal(b, &entries); err != nil {
 		return err
 	}
 
 	for _, entry := range entries {
 		switch entry.Command.Op {
 		case "Put":
-			if err := store.Put(entry.Command.Key, entry.Command.Value); err != nil {
+			if err := store.Put(ctx, entry.Command.Key, entry.Command.Value); err != nil {
 				return err
 			}
 		case "Delete":
-			if err := store.Delete(entry.Command.Key); err != nil {
+			if err := store.Delete(ctx, entry.Command.Key); err != nil {
 				return err
 			}
 		default:
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// clusterPreamble starts every Raft connection, followed by one length byte
+// and the cluster ID of the dialing node (empty while it is not known yet).
+const clusterPreamble = "IMRS"
+
+var errForeignCluster = errors.New("connection from a node of a different cluster")
+
+// clusterStreamLayer is a TCP stream layer that tags outgoing Raft connections
+// with the local cluster ID and refuses incoming ones tagged with another.
+type clusterStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	clusterID func() string
+	logger    func(format string, v ...interface{})
+}
+
+func newClusterStreamLayer(bind string, advertise net.Addr, clusterID func() string, logger func(string, ...interface{})) (*clusterStreamLayer, error) {
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	if advertise == nil {
+		advertise = ln.Addr()
+	}
+	return &clusterStreamLayer{
+		Listener:  ln,
+		advertise: advertise,
+		clusterID: clusterID,
+		logger:    logger,
+	}, nil
+}
+
+func (l *clusterStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	id := l.clusterID()
+	header := append([]byte(clusterPreamble), byte(len(id)))
+	header = append(header, id...)
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Accept does not block on the preamble; it is checked by the first Read so
+// that one slow peer cannot stall the listener.
+func (l *clusterStreamLayer) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &clusterConn{Conn: conn, layer: l, reader: bufio.NewReader(conn)}, nil
+}
+
+func (l *clusterStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+type clusterConn struct {
+	net.Conn
+	layer   *clusterStreamLayer
+	reader  *bufio.Reader
+	checked bool
+}
+
+func (c *clusterConn) Read(b []byte) (int, error) {
+	if !c.checked {
+		if err := c.checkPreamble(); err != nil {
+			c.Conn.Close()
+			return 0, err
+		}
+		c.checked = true
+	}
+	return c.reader.Read(b)
+}
+
+func (c *clusterConn) checkPreamble() error {
+	header := make([]byte, len(clusterPreamble)+1)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	if string(header[:len(clusterPreamble)]) != clusterPreamble {
+		return fmt.Errorf("unexpected raft connection preamble from %s", c.RemoteAddr())
+	}
+	remote := make([]byte, header[len(clusterPreamble)])
+	if _, err := io.ReadFull(c.reader, remote); err != nil {
+		return err
+	}
+
+	local := c.layer.clusterID()
+	if local != "" && len(remote) > 0 && string(remote) != local {
+		c.layer.logger("rejecting raft connection from %s: cluster %s, expected %s", c.RemoteAddr(), remote, local)
+		return errForeignCluster
+	}
+	return nil
+}
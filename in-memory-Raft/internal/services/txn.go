@@ -0,0 +1,381 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"common/keyrange"
+)
+
+var ErrInvalidTxn = errors.New("invalid transaction")
+
+// Targets of a comparison.
+const (
+	CompareValue   = "value"
+	CompareVersion = "version"
+	CompareCreate  = "create"
+	CompareMod     = "mod"
+	CompareLease   = "lease"
+)
+
+// Types of a transaction operation.
+const (
+	OpRange  = "range"
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Compare is a condition of a transaction on the key, or on every key of the
+// range [Key, End) (see Range). Result is one of "=", "!=", "<" and ">".
+// Value is compared for CompareValue and Number for the other targets. Ends
+// are bytes, as the end of a prefix need not be valid UTF-8.
+type Compare struct {
+	Key    string `json:"key"`
+	End    []byte `json:"end,omitempty"`
+	Target string `json:"target"`
+	Result string `json:"result"`
+	Value  []byte `json:"value,omitempty"`
+	Number int64  `json:"number,omitempty"`
+}
+
+// TxnOp reads, writes or deletes the key, or the range [Key, End) for reads
+// and deletes. Values are bytes, as in etcd; those that are not valid UTF-8
+// are stored as binary.
+type TxnOp struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	End   []byte `json:"end,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Lease int64  `json:"lease,omitempty"`
+
+	PrevKV      bool `json:"prev_kv,omitempty"`      // return what a put or delete replaced
+	IgnoreValue bool `json:"ignore_value,omitempty"` // put keeping the current value
+	IgnoreLease bool `json:"ignore_lease,omitempty"` // put keeping the current lease
+}
+
+// Txn runs Success if every comparison holds and Failure otherwise, as one
+// Raft command. A key may be written at most once.
+type Txn struct {
+	Compare []Compare `json:"compare,omitempty"`
+	Success []TxnOp   `json:"success,omitempty"`
+	Failure []TxnOp   `json:"failure,omitempty"`
+}
+
+type TxnResult struct {
+	Succeeded bool
+	Results   []OpResult // one per operation of the branch taken
+	Revision  uint64
+}
+
+// OpResult holds the keys read by a range, or the previous values of the
+// keys a put or delete replaced when PrevKV is set.
+type OpResult struct {
+	KVs     []KeyValue
+	Deleted int64
+}
+
+// KeyValue is a key of the default keyspace with its metadata and lease.
+type KeyValue struct {
+	Key   string
+	Value string
+	Type  string
+	Lease int64
+	KeyMeta
+}
+
+// Range returns the keys in the range [key, end) sorted, as they were at
+// revision, or are now if revision is zero, together with the current
+// revision. Past metadata are derived from the history, so versions it
+// dropped are not counted, and past keys carry no lease.
+func (ims *InMemoryStore) Range(key, end string, revision uint64) ([]KeyValue, uint64, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	if revision == 0 {
+		return (*fsm)(ims).rangeKeys(key, end, time.Now()), ims.revision, nil
+	}
+	if err := ims.checkRevision(revision); err != nil {
+		return nil, 0, err
+	}
+
+	var kvs []KeyValue
+	for k, h := range ims.history {
+		if !keyrange.Contains(k, key, end) {
+			continue
+		}
+		i := sort.Search(len(h.Versions), func(i int) bool { return h.Versions[i].Revision > revision })
+		if i == 0 {
+			if h.Trimmed {
+				return nil, 0, fmt.Errorf("key '%s': %w", k, ErrCompacted)
+			}
+			continue
+		}
+		if v := h.Versions[i-1]; !v.Deleted {
+			kvs = append(kvs, KeyValue{Key: k, Value: v.Value, Type: typeOrString(v.Type), KeyMeta: metaAt(h.Versions, i-1)})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, ims.revision, nil
+}
+
+// rangeKeys returns the visible keys in the range, sorted. Called with the
+// FSM lock held.
+func (f *fsm) rangeKeys(key, end string, now time.Time) []KeyValue {
+	var keys []string
+	if end == "" {
+		if _, ok := f.data[key]; ok {
+			keys = append(keys, key)
+		}
+	} else {
+		for k := range f.data {
+			if keyrange.Contains(k, key, end) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+	}
+
+	kvs := make([]KeyValue, 0, len(keys))
+	for _, k := range keys {
+		if f.hiddenByLease(k, now) {
+			continue
+		}
+		kvs = append(kvs, KeyValue{
+			Key:     k,
+			Value:   f.data[k],
+			Type:    typeOrString(f.types[k]),
+			Lease:   f.keyLeases[k],
+			KeyMeta: f.meta[k],
+		})
+	}
+	return kvs
+}
+
+// Txn checks the transaction and applies it through Raft.
+func (ims *InMemoryStore) Txn(ctx context.Context, txn *Txn) (TxnResult, error) {
+	for _, c := range txn.Compare {
+		if err := checkCompare(c); err != nil {
+			return TxnResult{}, err
+		}
+	}
+	for _, ops := range [][]TxnOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if err := ims.checkTxnOp(op); err != nil {
+				return TxnResult{}, err
+			}
+		}
+		if err := checkWrittenOnce(ops); err != nil {
+			return TxnResult{}, err
+		}
+	}
+	resp, err := ims.apply(ctx, &command{Op: "txn", Txn: txn})
+	if err != nil {
+		return TxnResult{}, err
+	}
+	return resp.(TxnResult), nil
+}
+
+// checkWrittenOnce refuses a key put twice, or put and deleted, in one
+// branch. Deletes may overlap, as in etcd.
+func checkWrittenOnce(ops []TxnOp) error {
+	var puts []string
+	var deletes []TxnOp
+	for _, op := range ops {
+		switch op.Type {
+		case OpPut:
+			for _, k := range puts {
+				if k == op.Key {
+					return fmt.Errorf("%w: key '%s' is written twice", ErrInvalidTxn, k)
+				}
+			}
+			for _, d := range deletes {
+				if keyrange.Contains(op.Key, d.Key, string(d.End)) {
+					return fmt.Errorf("%w: key '%s' is written twice", ErrInvalidTxn, op.Key)
+				}
+			}
+			puts = append(puts, op.Key)
+		case OpDelete:
+			for _, k := range puts {
+				if keyrange.Contains(k, op.Key, string(op.End)) {
+					return fmt.Errorf("%w: key '%s' is written twice", ErrInvalidTxn, k)
+				}
+			}
+			deletes = append(deletes, op)
+		}
+	}
+	return nil
+}
+
+func checkCompare(c Compare) error {
+	switch c.Target {
+	case CompareValue, CompareVersion, CompareCreate, CompareMod, CompareLease:
+	default:
+		return fmt.Errorf("%w: unknown compare target '%s'", ErrInvalidTxn, c.Target)
+	}
+	switch c.Result {
+	case "=", "!=", "<", ">":
+	default:
+		return fmt.Errorf("%w: unknown compare result '%s'", ErrInvalidTxn, c.Result)
+	}
+	return nil
+}
+
+func (ims *InMemoryStore) checkTxnOp(op TxnOp) error {
+	if op.Key == "" {
+		return fmt.Errorf("%w: key is empty", ErrInvalidTxn)
+	}
+	switch op.Type {
+	case OpRange, OpDelete:
+		return nil
+	case OpPut:
+		if len(op.End) > 0 {
+			return fmt.Errorf("%w: a put takes a single key", ErrInvalidTxn)
+		}
+		if err := ims.checkSize(op.Key, len(op.Value)); err != nil {
+			return err
+		}
+		if op.IgnoreValue {
+			return nil
+		}
+		return ims.checkSchemas(op.Key, string(op.Value), valueType(op.Value))
+	default:
+		return fmt.Errorf("%w: unknown operation '%s'", ErrInvalidTxn, op.Type)
+	}
+}
+
+func valueType(value []byte) string {
+	if utf8.Valid(value) {
+		return TypeString
+	}
+	return TypeBinary
+}
+
+// applyTxn checks the leases and the keys the operations of the branch rely
+// on before changing anything, so that such a transaction fails as a whole.
+// A put refused by a quota still stops the operations after it, keeping the
+// ones before, as for applyPutMany.
+func (f *fsm) applyTxn(index uint64, txn *Txn) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	succeeded := true
+	for _, c := range txn.Compare {
+		if !f.compare(c) {
+			succeeded = false
+			break
+		}
+	}
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+
+	for _, op := range ops {
+		if op.Type != OpPut {
+			continue
+		}
+		if err := f.checkLease(op.Lease); err != nil && !op.IgnoreLease {
+			return err
+		}
+		if op.IgnoreValue || op.IgnoreLease {
+			if _, ok := f.data[op.Key]; !ok || f.hiddenByLease(op.Key, f.applyTime) {
+				return fmt.Errorf("%w: '%s'", ErrKeyNotFound, op.Key)
+			}
+		}
+	}
+
+	result := TxnResult{Succeeded: succeeded, Revision: index, Results: make([]OpResult, len(ops))}
+	for i, op := range ops {
+		r := &result.Results[i]
+		switch op.Type {
+		case OpRange:
+			r.KVs = f.rangeKeys(op.Key, string(op.End), f.applyTime)
+		case OpPut:
+			prev := f.rangeKeys(op.Key, "", f.applyTime)
+			if op.PrevKV {
+				r.KVs = prev
+			}
+			value, typ := string(op.Value), valueType(op.Value)
+			if op.IgnoreValue {
+				value, typ = prev[0].Value, prev[0].Type
+			}
+			lease := op.Lease
+			if op.IgnoreLease {
+				lease = prev[0].Lease
+			}
+			if err := f.putWithLease(index, op.Key, value, typ, lease); err != nil {
+				return err
+			}
+		case OpDelete:
+			deleted := f.rangeKeys(op.Key, string(op.End), f.applyTime)
+			if op.PrevKV {
+				r.KVs = deleted
+			}
+			r.Deleted = int64(len(deleted))
+			for _, kv := range deleted {
+				f.attachLease(kv.Key, 0)
+				f.deleteKey(index, kv.Key)
+			}
+		}
+	}
+	return result
+}
+
+// compare follows etcd: a value comparison on a missing key fails, the other
+// ones compare against zero. Called with the FSM lock held.
+func (f *fsm) compare(c Compare) bool {
+	kvs := f.rangeKeys(c.Key, string(c.End), f.applyTime)
+	if len(kvs) == 0 {
+		if c.Target == CompareValue {
+			return false
+		}
+		return compareResult(c.Result, compareNumber(0, c.Number))
+	}
+	for _, kv := range kvs {
+		var cmp int
+		switch c.Target {
+		case CompareValue:
+			cmp = bytes.Compare([]byte(kv.Value), c.Value)
+		case CompareVersion:
+			cmp = compareNumber(kv.Version, c.Number)
+		case CompareCreate:
+			cmp = compareNumber(int64(kv.CreateRevision), c.Number)
+		case CompareMod:
+			cmp = compareNumber(int64(kv.ModRevision), c.Number)
+		case CompareLease:
+			cmp = compareNumber(kv.Lease, c.Number)
+		}
+		if !compareResult(c.Result, cmp) {
+			return false
+		}
+	}
+	return true
+}
+
+func compareNumber(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareResult(result string, cmp int) bool {
+	switch result {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp > 0
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Value types kept with each key of the default keyspace. Keys without an
+// explicit type hold plain strings.
+const (
+	TypeString = "string"
+	TypeJSON   = "json"
+	TypeBinary = "binary"
+)
+
+const (
+	defaultMaxKeySize   = 4096
+	defaultMaxValueSize = 1 << 20
+)
+
+var (
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrNotInteger    = errors.New("value is not an integer or out of range")
+	ErrInvalidType   = errors.New("invalid value type")
+)
+
+// ValueType returns the type of the value stored under key.
+func (ims *InMemoryStore) ValueType(key string) string {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	if t, ok := ims.types[key]; ok {
+		return t
+	}
+	return TypeString
+}
+
+// Lookup returns the value stored under key together with its type.
+func (ims *InMemoryStore) Lookup(key string) (value, typ string, ok bool) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+	value, ok = ims.data[key]
+	if ok && (*fsm)(ims).hiddenByLease(key, time.Now()) {
+		return "", "", false
+	}
+	if typ = ims.types[key]; typ == "" {
+		typ = TypeString
+	}
+	return value, typ, ok
+}
+
+// PutBinary stores raw bytes under key. Commands and snapshots are JSON, so
+// the bytes travel base64-encoded and come back from Get unchanged.
+func (ims *InMemoryStore) PutBinary(ctx context.Context, key string, value []byte) error {
+	if err := ims.checkSize(key, len(value)); err != nil {
+		return err
+	}
+	if err := ims.checkSchemas(key, string(value), TypeBinary); err != nil {
+		return err
+	}
+	_, err := ims.apply(ctx, &command{Op: "set", Key: key, Bytes: value, Type: TypeBinary})
+	return err
+}
+
+// checkSize enforces MaxKeySize and MaxValueSize before a write reaches Raft.
+func (ims *InMemoryStore) checkSize(key string, valueSize int) error {
+	if ims.MaxKeySize > 0 && len(key) > ims.MaxKeySize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLarge, len(key), ims.MaxKeySize)
+	}
+	if ims.MaxValueSize > 0 && valueSize > ims.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrValueTooLarge, valueSize, ims.MaxValueSize)
+	}
+	return nil
+}
+
+func (f *fsm) setType(key, typ string) {
+	if typ == "" || typ == TypeString {
+		delete(f.types, key)
+	} else {
+		f.types[key] = typ
+	}
+}
+
+// eventValue returns value as carried by watch events, which are JSON too.
+func eventValue(value, typ string) string {
+	if typ == TypeBinary {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return value
+}
+
+// IncrementKey adds delta to the integer stored as a string under key and
+// returns the result. A missing key counts as zero. Unlike counters, the
+// integer lives in the keyspace, where Get and watches see it.
+func (ims *InMemoryStore) IncrementKey(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := ims.checkSize(key, 0); err != nil {
+		return 0, err
+	}
+	resp, err := ims.apply(ctx, &command{Op: "incr-key", Key: key, Counter: &CounterRequest{Name: key, Delta: delta}})
+	if err != nil {
+		return 0, err
+	}
+	return resp.(int64), nil
+}
+
+// applyIncrementKey keeps the lease and the type of the key, which has to be
+// a plain string. The result is checked against the schemas here, as the
+// value it replaces is only known when the command applies.
+func (f *fsm) applyIncrementKey(index uint64, key string, delta int64) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.hiddenByLease(key, f.applyTime) {
+		f.attachLease(key, 0)
+		f.deleteKey(index, key)
+	}
+	var n int64
+	if old, ok := f.data[key]; ok {
+		if f.types[key] == TypeBinary {
+			return ErrNotInteger
+		}
+		v, err := strconv.ParseInt(old, 10, 64)
+		if err != nil {
+			return ErrNotInteger
+		}
+		n = v
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return ErrNotInteger
+	}
+	n += delta
+	// Integers are JSON too, so a schema may admit them.
+	value := strconv.FormatInt(n, 10)
+	if err := f.checkSchemas(key, value, TypeString); err != nil {
+		return err
+	}
+	if err := f.put(index, key, value, f.types[key]); err != nil {
+		return err
+	}
+	return n
+}
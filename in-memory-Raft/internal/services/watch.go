@@ -0,0 +1,229 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const watchBufferSize = 64
+
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+
+	// EventSync ends the keys of a snapshot, sent as puts, in a change
+	// stream; EventProgress tells that the stream carried every change up to
+	// its Index. Neither is produced by the FSM.
+	EventSync     = "sync"
+	EventProgress = "progress"
+)
+
+// Event is a single change applied to the FSM.
+type Event struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"` // base64 for binary values
+	ValueType string `json:"value_type,omitempty"`
+	Index     uint64 `json:"index"`
+
+	// CreateRevision, Version and Lease describe the key after a put in the
+	// default keyspace, as etcd watches do.
+	CreateRevision uint64 `json:"create_revision,omitempty"`
+	Version        int64  `json:"version,omitempty"`
+	Lease          int64  `json:"lease,omitempty"`
+}
+
+type watcher struct {
+	namespace string
+	prefix    string
+	ch        chan Event
+}
+
+type watchHub struct {
+	mutex    sync.Mutex
+	nextID   uint64
+	watchers map[uint64]*watcher
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[uint64]*watcher)}
+}
+
+// Watch subscribes to changes of keys starting with prefix. The returned
+// channel is closed when cancel is called, when the watcher falls too far
+// behind the FSM or when the FSM is restored from a snapshot.
+func (ims *InMemoryStore) Watch(prefix string) (<-chan Event, func()) {
+	return ims.watchers.add("", prefix)
+}
+
+// WatchNamespace is Watch for the keys of a namespace.
+func (ims *InMemoryStore) WatchNamespace(namespace, prefix string) (<-chan Event, func()) {
+	return ims.watchers.add(namespace, prefix)
+}
+
+// CompactedError is the error of WatchFrom when the history no longer holds
+// the changes since the revision asked: Revision is the first one a watch can
+// start from.
+type CompactedError struct {
+	Revision uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("%s: history starts at revision %d", ErrCompacted, e.Revision)
+}
+
+func (e *CompactedError) Unwrap() error {
+	return ErrCompacted
+}
+
+// WatchFrom is Watch starting at revision: the changes of keys starting with
+// prefix since revision that are still in the history are returned first, in
+// order, and the channel carries the ones after them, with neither a gap nor
+// a duplicate between the two. Replayed events carry no lease. The error is a
+// *CompactedError when changes since revision were dropped.
+func (ims *InMemoryStore) WatchFrom(prefix string, revision uint64) ([]Event, <-chan Event, func(), error) {
+	// Events are sent with the FSM lock held, so none can slip between the
+	// history read here and the subscription.
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	if revision < ims.compacted {
+		return nil, nil, nil, &CompactedError{Revision: ims.compacted}
+	}
+	var trimmed uint64
+	for k, h := range ims.history {
+		if strings.HasPrefix(k, prefix) && h.Trimmed && len(h.Versions) > 0 && h.Versions[0].Revision > revision {
+			trimmed = max(trimmed, h.Versions[0].Revision)
+		}
+	}
+	if trimmed > 0 {
+		return nil, nil, nil, &CompactedError{Revision: trimmed}
+	}
+
+	var events []Event
+	for k, h := range ims.history {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		for i, v := range h.Versions {
+			if v.Revision < revision {
+				continue
+			}
+			if v.Deleted {
+				events = append(events, Event{Type: EventDelete, Key: k, Index: v.Revision})
+				continue
+			}
+			m := metaAt(h.Versions, i)
+			events = append(events, Event{
+				Type:           EventPut,
+				Key:            k,
+				Value:          eventValue(v.Value, v.Type),
+				ValueType:      typeOrString(v.Type),
+				Index:          v.Revision,
+				CreateRevision: m.CreateRevision,
+				Version:        m.Version,
+			})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Index != events[j].Index {
+			return events[i].Index < events[j].Index
+		}
+		return events[i].Key < events[j].Key
+	})
+
+	ch, cancel := ims.watchers.add("", prefix)
+	return events, ch, cancel, nil
+}
+
+// WatchSnapshot is Watch starting with the keys starting with prefix as put
+// events, all at the current revision, which is returned too. The channel
+// carries the changes after it, with neither a gap nor a duplicate between
+// the two.
+func (ims *InMemoryStore) WatchSnapshot(prefix string) ([]Event, uint64, <-chan Event, func()) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	f, now := (*fsm)(ims), time.Now()
+	var events []Event
+	for k := range ims.data {
+		if strings.HasPrefix(k, prefix) && !f.hiddenByLease(k, now) {
+			events = append(events, f.putEvent(ims.revision, k, eventValue(ims.data[k], ims.types[k]), typeOrString(ims.types[k])))
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Key < events[j].Key })
+
+	ch, cancel := ims.watchers.add("", prefix)
+	return events, ims.revision, ch, cancel
+}
+
+// putEvent describes a put of key in the default keyspace, once written.
+// Called with the FSM lock held.
+func (f *fsm) putEvent(index uint64, key, value, typ string) Event {
+	m := f.meta[key]
+	return Event{
+		Type:           EventPut,
+		Key:            key,
+		Value:          value,
+		ValueType:      typ,
+		Index:          index,
+		CreateRevision: m.CreateRevision,
+		Version:        m.Version,
+		Lease:          f.keyLeases[key],
+	}
+}
+
+func (h *watchHub) add(namespace, prefix string) (<-chan Event, func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	id := h.nextID
+	h.nextID++
+	w := &watcher{namespace: namespace, prefix: prefix, ch: make(chan Event, watchBufferSize)}
+	h.watchers[id] = w
+
+	cancel := func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if _, ok := h.watchers[id]; ok {
+			delete(h.watchers, id)
+			close(w.ch)
+		}
+	}
+	return w.ch, cancel
+}
+
+// notify never blocks the FSM: slow watchers are dropped instead.
+func (h *watchHub) notify(ev Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for id, w := range h.watchers {
+		if ev.Namespace != w.namespace || !strings.HasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			delete(h.watchers, id)
+			close(w.ch)
+		}
+	}
+}
+
+// closeAll drops every watcher. The FSM calls it when a snapshot replaces its
+// state, since the changes the snapshot covers are never sent: watchers have
+// to resume with WatchFrom, which replays them or reports them compacted.
+func (h *watchHub) closeAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for id, w := range h.watchers {
+		delete(h.watchers, id)
+		close(w.ch)
+	}
+}
@@ -0,0 +1,259 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"inmemoryraft/internal/services"
+)
+
+const catchUpPoll = 50 * time.Millisecond
+
+// Split makes the keys of the range holding key from key on a range of its
+// own, served by a new group on the same nodes, and returns the new routing
+// table. It runs on the leader of the meta group, where other nodes forward
+// it.
+//
+// The group giving the keys away bumps its epoch first, which holds the
+// requests for it until the routing table names the new group: no write can
+// land in the old group once the keys are copied.
+func (n *Node) Split(ctx context.Context, key string) (*Table, error) {
+	if err := checkUserKey(key); err != nil {
+		return nil, err
+	}
+	if !n.meta.IsLeader() {
+		return n.forwardAdmin(ctx, "/shard/split", map[string]string{"key": key})
+	}
+	n.adminMutex.Lock()
+	defer n.adminMutex.Unlock()
+
+	// The ID of the new group is taken first, so that a failed split never
+	// reuses the replicas it may have left behind.
+	var id string
+	t, err := n.updateTable(ctx, func(t *Table) error {
+		if r := t.Lookup(key); r.Start == key {
+			return ErrBadSplit
+		}
+		id = t.newGroupID()
+		t.Version++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := t.Lookup(key)
+	old := t.Groups[r.Group]
+	peers := make(map[string]string, len(old.Replicas))
+	for _, node := range old.Replicas {
+		peers[node] = t.Nodes[node].RaftAddr
+	}
+	for _, node := range old.Replicas {
+		if err := n.openOn(ctx, t, node, id, peers); err != nil {
+			return nil, err
+		}
+	}
+	created := &Group{ID: id, Replicas: old.Replicas}
+
+	if _, err := n.onLeaderRetry(ctx, t, old, groupRequest{
+		Epoch: old.Epoch,
+		Ops:   []services.TxnOp{{Type: services.OpPut, Key: fenceKey}},
+	}); err != nil {
+		return nil, fmt.Errorf("fence group %s: %w", old.ID, err)
+	}
+	epoch := old.Epoch + 1
+
+	t, err = n.moveKeys(ctx, t, old, epoch, created, key, r.End)
+	if err != nil {
+		// Let the requests for the old group through again, the keys still
+		// being there.
+		if _, uerr := n.updateTable(ctx, func(t *Table) error {
+			t.Groups[old.ID].Epoch = epoch
+			t.Version++
+			return nil
+		}); uerr != nil {
+			n.logger.Printf("failed to release group %s after a failed split: %s", old.ID, uerr)
+		}
+		return nil, err
+	}
+
+	if _, err := n.onLeaderRetry(ctx, t, t.Groups[old.ID], groupRequest{
+		Epoch: epoch,
+		Ops:   []services.TxnOp{{Type: services.OpDelete, Key: key, End: txnEnd(r.End)}},
+	}); err != nil {
+		n.logger.Printf("failed to delete the keys group %s gave away: %s", old.ID, err)
+	}
+	n.logger.Printf("split range [%q, %q) of group %s at %q into group %s", r.Start, r.End, old.ID, key, id)
+	return t, nil
+}
+
+// moveKeys copies the keys of [start, end) from the old group to the created
+// one and routes the range to it.
+func (n *Node) moveKeys(ctx context.Context, t *Table, old *Group, epoch int64, created *Group, start, end string) (*Table, error) {
+	resp, err := n.onLeaderRetry(ctx, t, old, groupRequest{
+		Epoch: epoch,
+		Ops:   []services.TxnOp{{Type: services.OpRange, Key: start, End: txnEnd(end)}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read group %s: %w", old.ID, err)
+	}
+	if kvs := resp.Results[0].KVs; len(kvs) > 0 {
+		ops := make([]services.TxnOp, len(kvs))
+		for i, kv := range kvs {
+			ops[i] = services.TxnOp{Type: services.OpPut, Key: kv.Key, Value: kv.Value}
+		}
+		if _, err := n.onLeaderRetry(ctx, t, created, groupRequest{Ops: ops}); err != nil {
+			return nil, fmt.Errorf("copy to group %s: %w", created.ID, err)
+		}
+	}
+
+	return n.updateTable(ctx, func(t *Table) error {
+		r := t.Lookup(start)
+		if r.Group != old.ID || t.Groups[old.ID].Epoch != epoch-1 {
+			return fmt.Errorf("group %s changed during the split", old.ID)
+		}
+		return t.split(start, created.ID)
+	})
+}
+
+// Move replaces the replica of the group on node from by one on node to:
+// the new replica is added and caught up before the old one is removed. It
+// runs on the leader of the meta group, where other nodes forward it.
+func (n *Node) Move(ctx context.Context, group, from, to string) (*Table, error) {
+	if !n.meta.IsLeader() {
+		return n.forwardAdmin(ctx, "/shard/move", map[string]string{"group": group, "from": from, "to": to})
+	}
+	n.adminMutex.Lock()
+	defer n.adminMutex.Unlock()
+
+	if err := n.meta.Linearize(ctx); err != nil {
+		return nil, err
+	}
+	t, err := n.Table()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.clone().move(group, from, to); err != nil {
+		return nil, err
+	}
+	g := t.Groups[group]
+	target := t.Nodes[to]
+
+	if err := n.openOn(ctx, t, to, group, nil); err != nil {
+		return nil, err
+	}
+	resp, err := n.onLeaderRetry(ctx, t, g, groupRequest{AddReplica: &target})
+	if err != nil {
+		return nil, fmt.Errorf("add replica on %s: %w", to, err)
+	}
+	if err := n.waitApplied(ctx, target, group, resp.Index); err != nil {
+		return nil, err
+	}
+	withTarget := *g
+	withTarget.Replicas = append(append([]string(nil), g.Replicas...), to)
+	if _, err := n.onLeaderRetry(ctx, t, &withTarget, groupRequest{RemoveReplica: from}); err != nil {
+		return nil, fmt.Errorf("remove replica on %s: %w", from, err)
+	}
+
+	t, err = n.updateTable(ctx, func(t *Table) error {
+		return t.move(group, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := n.closeOn(ctx, t, from, group); err != nil {
+		n.logger.Printf("failed to close the replica of group %s on %s: %s", group, from, err)
+	}
+	n.forgetLeader(g)
+	n.logger.Printf("moved the replica of group %s from %s to %s", group, from, to)
+	return t, nil
+}
+
+// onLeaderRetry is onLeader trying again while the group elects a leader or
+// the replicas point elsewhere.
+func (n *Node) onLeaderRetry(ctx context.Context, t *Table, g *Group, req groupRequest) (groupResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, routeTimeout)
+	defer cancel()
+	backoff := retryBackoffMin
+	for {
+		resp, err := n.onLeader(ctx, t, g, req)
+		if err == nil || errors.Is(err, ErrStaleEpoch) || !retryable(err) {
+			return resp, err
+		}
+		select {
+		case <-ctx.Done():
+			return groupResponse{}, fmt.Errorf("%w (last error: %s)", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, retryBackoffMax)
+	}
+}
+
+// waitApplied waits until the replica of the group on the node has applied
+// the log up to index.
+func (n *Node) waitApplied(ctx context.Context, node NodeInfo, group string, index uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, routeTimeout)
+	defer cancel()
+	for {
+		status, err := n.statusOn(ctx, node, group)
+		if err == nil && status.AppliedIndex >= index {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("replica of group %s on %s did not catch up: %w", group, node.ID, ctx.Err())
+		case <-time.After(catchUpPoll):
+		}
+	}
+}
+
+// openOn opens a replica of the group on the node, bootstrapping the group
+// with peers unless nil.
+func (n *Node) openOn(ctx context.Context, t *Table, node, group string, peers map[string]string) error {
+	if node == n.config.ID {
+		return n.openGroup(group, peers)
+	}
+	info, ok := t.Nodes[node]
+	if !ok || info.HTTPAddr == "" {
+		return fmt.Errorf("%w: '%s' has no known address", ErrNoSuchNode, node)
+	}
+	return n.put(ctx, info.HTTPAddr, "/shard/groups/"+group, openRequest{Peers: peers})
+}
+
+func (n *Node) closeOn(ctx context.Context, t *Table, node, group string) error {
+	if node == n.config.ID {
+		return n.closeGroup(group)
+	}
+	info, ok := t.Nodes[node]
+	if !ok || info.HTTPAddr == "" {
+		return fmt.Errorf("%w: '%s' has no known address", ErrNoSuchNode, node)
+	}
+	return n.delete(ctx, info.HTTPAddr, "/shard/groups/"+group)
+}
+
+func (n *Node) statusOn(ctx context.Context, node NodeInfo, group string) (services.Status, error) {
+	if node.ID == n.config.ID {
+		store, err := n.group(group)
+		if err != nil {
+			return services.Status{}, err
+		}
+		return store.Status(), nil
+	}
+	var status services.Status
+	err := n.get(ctx, node.HTTPAddr, "/shard/groups/"+group, &status)
+	return status, err
+}
+
+// forwardAdmin sends an operation to the leader of the meta group.
+func (n *Node) forwardAdmin(ctx context.Context, path string, in interface{}) (*Table, error) {
+	addr, err := n.metaLeaderAddr()
+	if err != nil {
+		return nil, err
+	}
+	var t Table
+	if err := n.post(ctx, addr, path, in, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
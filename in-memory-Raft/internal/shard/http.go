@@ -0,0 +1,367 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"inmemoryraft/internal/services"
+)
+
+// forwardedHeader carries the ID of the node sending a request to another:
+// requests passed on once are served or fail rather than being passed on
+// again.
+const forwardedHeader = "X-Shard-Forwarded"
+
+// openRequest asks a node to open a replica of a group.
+type openRequest struct {
+	Peers map[string]string `json:"peers,omitempty"`
+}
+
+// errorResponse carries an error between nodes, Code naming the sentinel
+// error it wraps.
+type errorResponse struct {
+	Error  string `json:"error"`
+	Code   string `json:"code"`
+	Group  string `json:"group,omitempty"`
+	Leader string `json:"leader,omitempty"`
+}
+
+var errorCodes = []struct {
+	code   string
+	err    error
+	status int
+}{
+	{"stale_epoch", ErrStaleEpoch, http.StatusConflict},
+	{"not_leader", services.ErrNotLeader, http.StatusMisdirectedRequest},
+	{"no_group", ErrNoSuchGroup, http.StatusNotFound},
+	{"no_node", ErrNoSuchNode, http.StatusNotFound},
+	{"not_found", services.ErrKeyNotFound, http.StatusNotFound},
+	{"no_table", ErrNoTable, http.StatusServiceUnavailable},
+	{"shutting_down", services.ErrShuttingDown, http.StatusServiceUnavailable},
+	{"busy", services.ErrBusy, http.StatusServiceUnavailable},
+	{"reserved_key", ErrReservedKey, http.StatusBadRequest},
+	{"bad_split", ErrBadSplit, http.StatusBadRequest},
+	{"invalid_txn", services.ErrInvalidTxn, http.StatusBadRequest},
+}
+
+// httpServer serves the API of a node: the keys for clients, the routing
+// table, splits and moves for operators, and the groups for other nodes.
+type httpServer struct {
+	node   *Node
+	addr   string
+	ln     net.Listener
+	server *http.Server
+}
+
+func newHTTPServer(n *Node, addr string) *httpServer {
+	return &httpServer{node: n, addr: addr}
+}
+
+func (s *httpServer) start() error {
+	r := mux.NewRouter()
+	r.HandleFunc("/keys/{key}", s.handleGet).Methods("GET")
+	r.HandleFunc("/keys", s.handleList).Methods("GET")
+	r.HandleFunc("/keys", s.handlePut).Methods("POST")
+	r.HandleFunc("/keys/{key}", s.handleDelete).Methods("DELETE")
+	r.HandleFunc("/shard/table", s.handleTable).Methods("GET")
+	r.HandleFunc("/shard/split", s.handleSplit).Methods("POST")
+	r.HandleFunc("/shard/move", s.handleMove).Methods("POST")
+	r.HandleFunc("/shard/nodes", s.handleRegister).Methods("POST")
+	r.HandleFunc("/shard/groups", s.handleGroups).Methods("GET")
+	r.HandleFunc("/shard/groups/{group}", s.handleStatus).Methods("GET")
+	r.HandleFunc("/shard/groups/{group}", s.handleOpen).Methods("PUT")
+	r.HandleFunc("/shard/groups/{group}", s.handleClose).Methods("DELETE")
+	r.HandleFunc("/shard/groups/{group}/execute", s.handleExecute).Methods("POST")
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	s.server = &http.Server{Handler: r}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.node.logger.Printf("HTTP serve: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (s *httpServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+func (s *httpServer) shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
+
+func (s *httpServer) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	val, err := s.node.Get(r.Context(), key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{key: val})
+}
+
+func (s *httpServer) handleList(w http.ResponseWriter, r *http.Request) {
+	kvs, err := s.node.List(r.Context(), r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, kvs)
+}
+
+func (s *httpServer) handlePut(w http.ResponseWriter, r *http.Request) {
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for k, v := range m {
+		if err := s.node.Put(r.Context(), k, v); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+}
+
+func (s *httpServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.node.Delete(r.Context(), mux.Vars(r)["key"]); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (s *httpServer) handleTable(w http.ResponseWriter, r *http.Request) {
+	t, err := s.node.Table()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, t)
+}
+
+func (s *httpServer) handleSplit(w http.ResponseWriter, r *http.Request) {
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m["key"] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.serveOnMetaLeader(w, r) {
+		return
+	}
+	t, err := s.node.Split(r.Context(), m["key"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, t)
+}
+
+func (s *httpServer) handleMove(w http.ResponseWriter, r *http.Request) {
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil ||
+		m["group"] == "" || m["from"] == "" || m["to"] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.serveOnMetaLeader(w, r) {
+		return
+	}
+	t, err := s.node.Move(r.Context(), m["group"], m["from"], m["to"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, t)
+}
+
+func (s *httpServer) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var info NodeInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info.ID == "" || info.RaftAddr == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var err error
+	if s.node.meta.IsLeader() {
+		err = s.node.addNode(r.Context(), info)
+	} else if from := r.Header.Get(forwardedHeader); from != "" && from != info.ID {
+		// Passed on by a node other than the one registering.
+		err = services.ErrNotLeader
+	} else {
+		var addr string
+		if addr, err = s.node.metaLeaderAddr(); err == nil {
+			err = s.node.post(r.Context(), addr, "/shard/nodes", info, nil)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// serveOnMetaLeader refuses a forwarded admin request on a node that does
+// not lead the meta group anymore, so that requests never bounce between
+// nodes disagreeing on the leader.
+func (s *httpServer) serveOnMetaLeader(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(forwardedHeader) != "" && !s.node.meta.IsLeader() {
+		writeError(w, services.ErrNotLeader)
+		return false
+	}
+	return true
+}
+
+func (s *httpServer) handleGroups(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.node.Groups())
+}
+
+func (s *httpServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	store, err := s.node.group(mux.Vars(r)["group"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, store.Status())
+}
+
+func (s *httpServer) handleOpen(w http.ResponseWriter, r *http.Request) {
+	var req openRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.node.openGroup(mux.Vars(r)["group"], req.Peers); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (s *httpServer) handleClose(w http.ResponseWriter, r *http.Request) {
+	if err := s.node.closeGroup(mux.Vars(r)["group"]); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (s *httpServer) handleExecute(w http.ResponseWriter, r *http.Request) {
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resp, err := s.node.execute(r.Context(), mux.Vars(r)["group"], req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	resp := errorResponse{Error: err.Error(), Code: "internal"}
+	status := http.StatusInternalServerError
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			resp.Code, status = c.code, c.status
+			break
+		}
+	}
+	var nle *NotLeaderError
+	if errors.As(err, &nle) {
+		resp.Group, resp.Leader = nle.Group, nle.Leader
+	}
+	if errors.Is(err, services.ErrBusy) {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// errorOf rebuilds the error a node answered with, wrapping the sentinel
+// error its code names.
+func errorOf(resp *http.Response) error {
+	var e errorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Code == "" {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if e.Code == "not_leader" && e.Group != "" {
+		return &NotLeaderError{Group: e.Group, Leader: e.Leader}
+	}
+	for _, c := range errorCodes {
+		if c.code == e.Code {
+			return fmt.Errorf("%w: %s", c.err, e.Error)
+		}
+	}
+	return errors.New(e.Error)
+}
+
+func (n *Node) post(ctx context.Context, addr, path string, in, out interface{}) error {
+	return n.call(ctx, "POST", addr, path, in, out)
+}
+
+func (n *Node) put(ctx context.Context, addr, path string, in interface{}) error {
+	return n.call(ctx, "PUT", addr, path, in, nil)
+}
+
+func (n *Node) get(ctx context.Context, addr, path string, out interface{}) error {
+	return n.call(ctx, "GET", addr, path, nil, out)
+}
+
+func (n *Node) delete(ctx context.Context, addr, path string) error {
+	return n.call(ctx, "DELETE", addr, path, nil, nil)
+}
+
+// call sends in as JSON to the node at addr and decodes its answer into out
+// unless nil.
+func (n *Node) call(ctx context.Context, method, addr, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+addr+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(forwardedHeader, n.config.ID)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errorOf(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,191 @@
+package shard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// groupPreamble starts every Raft connection between nodes, followed by one
+// length byte and the ID of the group the connection belongs to.
+const groupPreamble = "IMRG"
+
+const muxHandshakeTimeout = 5 * time.Second
+
+var errMuxClosed = errors.New("raft multiplexer closed")
+
+// Mux shares one TCP listener between the Raft groups of a node: every
+// group gets a stream layer whose connections are tagged with its ID.
+type Mux struct {
+	ln        net.Listener
+	advertise net.Addr
+	logger    func(format string, v ...interface{})
+
+	mutex  sync.Mutex
+	layers map[string]*groupLayer
+	closed bool
+}
+
+func NewMux(bind string, logger func(string, ...interface{})) (*Mux, error) {
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	// An ephemeral port is only known once listening.
+	var advertise net.Addr = ln.Addr()
+	if addr, err := net.ResolveTCPAddr("tcp", bind); err == nil && addr.Port != 0 {
+		advertise = addr
+	}
+	m := &Mux{ln: ln, advertise: advertise, logger: logger, layers: make(map[string]*groupLayer)}
+	go m.serve()
+	return m, nil
+}
+
+// Addr is the address peers dial to reach the groups of the node.
+func (m *Mux) Addr() net.Addr {
+	return m.advertise
+}
+
+// Layer returns the stream layer of the group, for a raft.NetworkTransport.
+// Closing the layer detaches the group from the multiplexer.
+func (m *Mux) Layer(group string) (raft.StreamLayer, error) {
+	if len(group) > 255 {
+		return nil, fmt.Errorf("group ID '%s' is too long", group)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, errMuxClosed
+	}
+	if _, ok := m.layers[group]; ok {
+		return nil, fmt.Errorf("group '%s' is already attached", group)
+	}
+	l := &groupLayer{mux: m, group: group, conns: make(chan net.Conn), done: make(chan struct{})}
+	m.layers[group] = l
+	return l, nil
+}
+
+func (m *Mux) Close() error {
+	m.mutex.Lock()
+	m.closed = true
+	m.mutex.Unlock()
+	return m.ln.Close()
+}
+
+func (m *Mux) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		// The preamble is read aside, so that one slow peer cannot stall the
+		// listener.
+		go m.dispatch(conn)
+	}
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(muxHandshakeTimeout))
+	group, err := readPreamble(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		m.logger("rejecting raft connection from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	m.mutex.Lock()
+	l, ok := m.layers[group]
+	m.mutex.Unlock()
+	if !ok {
+		// The group is not hosted here (yet): the peer dials again later.
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- &bufferedConn{Conn: conn, reader: reader}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func readPreamble(r io.Reader) (string, error) {
+	header := make([]byte, len(groupPreamble)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if string(header[:len(groupPreamble)]) != groupPreamble {
+		return "", errors.New("unexpected raft connection preamble")
+	}
+	group := make([]byte, header[len(groupPreamble)])
+	if _, err := io.ReadFull(r, group); err != nil {
+		return "", err
+	}
+	return string(group), nil
+}
+
+type groupLayer struct {
+	mux   *Mux
+	group string
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *groupLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(groupPreamble), byte(len(l.group)))
+	header = append(header, l.group...)
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (l *groupLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errMuxClosed
+	}
+}
+
+func (l *groupLayer) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.mux.mutex.Lock()
+		if l.mux.layers[l.group] == l {
+			delete(l.mux.layers, l.group)
+		}
+		l.mux.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *groupLayer) Addr() net.Addr {
+	return l.mux.advertise
+}
+
+// bufferedConn reads what the preamble reader buffered before the
+// connection itself.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,460 @@
+// Package shard spreads the keyspace over several Raft groups, each serving
+// a key range, so that writes are not capped by a single leader. Every node
+// process hosts replicas of some of the groups next to a replica of the meta
+// group, which stores the routing table. Any node routes a request to the
+// leader of the group serving the key, and operators split ranges and move
+// replicas between nodes.
+//
+// Groups are InMemoryStore instances sharing the Raft port of the node
+// through a Mux. A group refuses requests routed with an outdated view of
+// its ranges (see Group.Epoch), so that stale routing tables only cost a
+// retry.
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"inmemoryraft/internal/services"
+)
+
+// metaGroup is the ID of the group holding the routing table.
+const metaGroup = "meta"
+
+const (
+	reconcileInterval = time.Second
+	registerInterval  = 100 * time.Millisecond
+)
+
+var ErrNoTable = errors.New("routing table is not initialized yet")
+
+type Config struct {
+	ID       string
+	RaftAddr string // shared by the Raft groups of the node
+	HTTPAddr string
+	Dir      string // one subdirectory per group
+
+	// Peers maps the IDs of the first nodes to their Raft addresses. Nodes
+	// started with the same Peers form the meta group and the first group,
+	// which serves the whole keyspace. A node started later leaves it empty
+	// and registers through Join instead.
+	Peers map[string]string
+	// Join lists the HTTP addresses of nodes already in the cluster.
+	Join []string
+
+	RaftConfig *raft.Config // raft.DefaultConfig() if nil
+	// Configure is called on the store of every group before it starts.
+	Configure func(group string, store *services.InMemoryStore)
+}
+
+type Node struct {
+	config Config
+	mux    *Mux
+	meta   *services.InMemoryStore
+	http   *httpServer
+	client *http.Client
+	logger *log.Logger
+
+	mutex  sync.RWMutex
+	groups map[string]*services.InMemoryStore
+
+	tableMutex sync.Mutex
+	tableRaw   string
+	table      *Table
+
+	hintMutex sync.Mutex
+	leaders   map[string]string // last known leader of every group
+
+	adminMutex sync.Mutex // serializes splits and moves
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewNode(config Config) *Node {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Node{
+		config:  config,
+		client:  &http.Client{Timeout: routeTimeout},
+		logger:  log.New(os.Stderr, "[shard "+config.ID+"] ", log.LstdFlags),
+		groups:  make(map[string]*services.InMemoryStore),
+		leaders: make(map[string]string),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+// RaftAddr and HTTPAddr are the addresses the node listens on, once started.
+func (n *Node) RaftAddr() string {
+	return n.mux.Addr().String()
+}
+
+func (n *Node) HTTPAddr() string {
+	return n.http.Addr().String()
+}
+
+// Start opens the meta group and, on a fresh node of Peers, the first group,
+// serves the HTTP API and registers the node in the routing table in the
+// background.
+func (n *Node) Start() error {
+	_, err := os.Stat(filepath.Join(n.config.Dir, metaGroup))
+	fresh := os.IsNotExist(err)
+
+	mux, err := NewMux(n.config.RaftAddr, n.logger.Printf)
+	if err != nil {
+		return err
+	}
+	n.mux = mux
+
+	// A restarted node gets its state from the other replicas: bootstrapping
+	// again could revive a group moved away from it.
+	var peers map[string]string
+	if fresh && len(n.config.Peers) > 0 {
+		peers = n.config.Peers
+	}
+	if n.meta, err = n.openStore(metaGroup, peers); err != nil {
+		mux.Close()
+		return err
+	}
+	if peers != nil {
+		if err := n.openGroup(firstGroup(), peers); err != nil {
+			n.meta.Shutdown(false)
+			mux.Close()
+			return err
+		}
+	}
+
+	n.http = newHTTPServer(n, n.config.HTTPAddr)
+	if err := n.http.start(); err != nil {
+		n.Close()
+		return err
+	}
+
+	n.wg.Add(2)
+	go n.register()
+	go n.reconcile()
+	return nil
+}
+
+// firstGroup is the ID newTable gives the group serving the whole keyspace.
+func firstGroup() string {
+	return (&Table{NextGroup: 1}).newGroupID()
+}
+
+// Close stops the node abruptly, as a crash would, apart from closing its
+// listeners.
+func (n *Node) Close() error {
+	n.cancel()
+	if n.http != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		n.http.shutdown(ctx)
+		cancel()
+	}
+	n.wg.Wait()
+
+	n.mutex.Lock()
+	groups := n.groups
+	n.groups = make(map[string]*services.InMemoryStore)
+	n.mutex.Unlock()
+	for id, store := range groups {
+		if err := store.Shutdown(false); err != nil {
+			n.logger.Printf("failed to stop group %s: %s", id, err)
+		}
+	}
+	if n.meta != nil {
+		if err := n.meta.Shutdown(false); err != nil {
+			n.logger.Printf("failed to stop the meta group: %s", err)
+		}
+	}
+	return n.mux.Close()
+}
+
+// openStore starts the local replica of a group, bootstrapping the group
+// with peers unless nil.
+func (n *Node) openStore(group string, peers map[string]string) (*services.InMemoryStore, error) {
+	layer, err := n.mux.Layer(group)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(n.config.Dir, group)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		layer.Close()
+		return nil, err
+	}
+
+	store := services.NewStore()
+	store.RaftDir = dir
+	store.RaftConfig = n.config.RaftConfig
+	store.TransactionLogPath = filepath.Join(dir, "transaction_log.json")
+	store.Transport = raft.NewNetworkTransport(layer, 3, 10*time.Second, os.Stderr)
+	if n.config.Configure != nil {
+		n.config.Configure(group, store)
+	}
+	if err := store.InitNode(false, n.config.ID); err != nil {
+		store.Transport.(*raft.NetworkTransport).Close()
+		return nil, fmt.Errorf("group %s: %w", group, err)
+	}
+	if peers != nil {
+		if err := store.BootstrapPeers(peers); err != nil {
+			store.Shutdown(false)
+			return nil, fmt.Errorf("group %s: %w", group, err)
+		}
+	}
+	return store, nil
+}
+
+// openGroup starts the local replica of a group unless it runs already. A
+// replica started without peers waits for the leader of the group to add
+// it.
+func (n *Node) openGroup(group string, peers map[string]string) error {
+	if group == metaGroup {
+		return fmt.Errorf("%w: '%s'", ErrNoSuchGroup, group)
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if store, ok := n.groups[group]; ok {
+		if peers != nil {
+			return store.BootstrapPeers(peers)
+		}
+		return nil
+	}
+	store, err := n.openStore(group, peers)
+	if err != nil {
+		return err
+	}
+	n.groups[group] = store
+	n.logger.Printf("opened a replica of group %s", group)
+	return nil
+}
+
+// closeGroup stops the local replica of a group and deletes its state.
+func (n *Node) closeGroup(group string) error {
+	n.mutex.Lock()
+	store, ok := n.groups[group]
+	delete(n.groups, group)
+	n.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := store.Shutdown(false); err != nil {
+		return err
+	}
+	n.logger.Printf("closed the replica of group %s", group)
+	return os.RemoveAll(filepath.Join(n.config.Dir, group))
+}
+
+func (n *Node) group(group string) (*services.InMemoryStore, error) {
+	if group == metaGroup {
+		return n.meta, nil
+	}
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	store, ok := n.groups[group]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s' on node '%s'", ErrNoSuchGroup, group, n.config.ID)
+	}
+	return store, nil
+}
+
+// Groups returns the IDs of the groups with a replica on the node, sorted.
+func (n *Node) Groups() []string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	ids := make([]string, 0, len(n.groups))
+	for id := range n.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// GroupStore returns the local replica of a group, for inspection.
+func (n *Node) GroupStore(group string) (*services.InMemoryStore, error) {
+	return n.group(group)
+}
+
+// Table returns the routing table as the local replica of the meta group
+// knows it, which may lag behind the leader.
+func (n *Node) Table() (*Table, error) {
+	raw, _, ok := n.meta.Lookup(tableKey)
+	if !ok {
+		return nil, ErrNoTable
+	}
+
+	n.tableMutex.Lock()
+	defer n.tableMutex.Unlock()
+	if raw != n.tableRaw {
+		t, err := decodeTable(raw)
+		if err != nil {
+			return nil, err
+		}
+		n.table, n.tableRaw = t, raw
+	}
+	return n.table.clone(), nil
+}
+
+// updateTable applies fn to the current routing table and stores the result
+// if the table did not change in between, trying again otherwise. It runs on
+// the leader of the meta group.
+func (n *Node) updateTable(ctx context.Context, fn func(*Table) error) (*Table, error) {
+	for {
+		if err := n.meta.Linearize(ctx); err != nil {
+			return nil, err
+		}
+		kvs, _, err := n.meta.Range(tableKey, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		var t *Table
+		var mod int64
+		if len(kvs) == 0 {
+			if len(n.config.Peers) == 0 {
+				return nil, ErrNoTable
+			}
+			t = newTable(n.config.Peers)
+		} else {
+			if t, err = decodeTable(kvs[0].Value); err != nil {
+				return nil, err
+			}
+			mod = int64(kvs[0].ModRevision)
+		}
+		if err := fn(t); err != nil {
+			return nil, err
+		}
+		result, err := n.meta.Txn(ctx, &services.Txn{
+			Compare: []services.Compare{{Key: tableKey, Target: services.CompareMod, Result: "=", Number: mod}},
+			Success: []services.TxnOp{{Type: services.OpPut, Key: tableKey, Value: []byte(t.encode())}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.Succeeded {
+			return t, nil
+		}
+	}
+}
+
+// register records the addresses of the node in the routing table, through
+// the leader of the meta group, and makes the node a nonvoter of the meta
+// group unless it already belongs to it.
+func (n *Node) register() {
+	defer n.wg.Done()
+	info := NodeInfo{ID: n.config.ID, RaftAddr: n.RaftAddr(), HTTPAddr: n.HTTPAddr()}
+	for {
+		if t, err := n.Table(); err == nil && t.Nodes[info.ID] == info {
+			return
+		}
+		if err := n.registerNode(n.ctx, info); err == nil {
+			n.logger.Printf("registered in the routing table")
+		}
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-time.After(registerInterval):
+		}
+	}
+}
+
+// registerNode adds the node to the routing table on the leader of the meta
+// group, or asks a node that can reach the leader to.
+func (n *Node) registerNode(ctx context.Context, info NodeInfo) error {
+	if n.meta.IsLeader() {
+		return n.addNode(ctx, info)
+	}
+	addrs := n.config.Join
+	if addr, err := n.metaLeaderAddr(); err == nil {
+		addrs = append([]string{addr}, addrs...)
+	}
+	err := ErrNoTable
+	for _, addr := range addrs {
+		if err = n.post(ctx, addr, "/shard/nodes", info, nil); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// addNode runs on the leader of the meta group.
+func (n *Node) addNode(ctx context.Context, info NodeInfo) error {
+	members, err := n.meta.Members()
+	if err != nil {
+		return err
+	}
+	member := false
+	for _, m := range members {
+		member = member || m.ID == info.ID
+	}
+	if !member {
+		if err := n.meta.JoinNonvoter(info.ID, info.RaftAddr); err != nil {
+			return err
+		}
+	}
+	_, err = n.updateTable(ctx, func(t *Table) error {
+		if t.Nodes[info.ID] != info {
+			t.Nodes[info.ID] = info
+			t.Version++
+		}
+		return nil
+	})
+	return err
+}
+
+// metaLeaderAddr returns the HTTP address of the leader of the meta group.
+func (n *Node) metaLeaderAddr() (string, error) {
+	leader := n.meta.Status().LeaderID
+	t, err := n.Table()
+	if err != nil {
+		return "", err
+	}
+	info, ok := t.Nodes[leader]
+	if !ok || info.HTTPAddr == "" {
+		return "", fmt.Errorf("%w: the leader of the meta group is unknown", services.ErrNotLeader)
+	}
+	return info.HTTPAddr, nil
+}
+
+// reconcile opens the replicas the routing table assigns to the node, as
+// after a restart. Replicas the node holds beyond the table are left alone:
+// they belong to splits and moves in progress.
+func (n *Node) reconcile() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t, err := n.Table()
+		if err != nil {
+			continue
+		}
+		for id, g := range t.Groups {
+			if !g.hosts(n.config.ID) {
+				continue
+			}
+			if _, err := n.group(id); err == nil {
+				continue
+			}
+			if err := n.openGroup(id, nil); err != nil {
+				n.logger.Printf("failed to open group %s: %s", id, err)
+			}
+		}
+	}
+}
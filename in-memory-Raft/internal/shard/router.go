@@ -0,0 +1,362 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"inmemoryraft/internal/services"
+)
+
+// fenceKey holds the epoch of a group as its version: a split writes it once
+// before handing keys to a new group. Keys starting with "\x00" are reserved
+// for it.
+const fenceKey = "\x00shard/fence"
+
+const (
+	routeTimeout    = 10 * time.Second
+	retryBackoffMin = 10 * time.Millisecond
+	retryBackoffMax = 500 * time.Millisecond
+)
+
+var (
+	ErrStaleEpoch  = errors.New("routing table is stale")
+	ErrReservedKey = errors.New("key is empty or reserved")
+)
+
+// NotLeaderError tells which node leads the group instead, when known.
+type NotLeaderError struct {
+	Group  string
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	return fmt.Sprintf("not leader of group '%s' (leader '%s')", e.Group, e.Leader)
+}
+
+func (e *NotLeaderError) Unwrap() error {
+	return services.ErrNotLeader
+}
+
+// groupRequest runs on the leader of a group: the operations as one Raft
+// command if the epoch of the group is Epoch, or a membership change.
+type groupRequest struct {
+	Epoch         int64            `json:"epoch"`
+	Ops           []services.TxnOp `json:"ops,omitempty"`
+	AddReplica    *NodeInfo        `json:"add_replica,omitempty"`
+	RemoveReplica string           `json:"remove_replica,omitempty"`
+}
+
+type groupResponse struct {
+	Results []opResult `json:"results,omitempty"`
+	Index   uint64     `json:"index,omitempty"` // last index of the leader after a membership change
+}
+
+// opResult is services.OpResult with values as bytes, which JSON carries
+// whatever they hold.
+type opResult struct {
+	KVs     []kv  `json:"kvs,omitempty"`
+	Deleted int64 `json:"deleted,omitempty"`
+}
+
+type kv struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func checkUserKey(key string) error {
+	if key == "" || key[0] == 0 {
+		return fmt.Errorf("%w: '%s'", ErrReservedKey, key)
+	}
+	return nil
+}
+
+// txnEnd turns the end of a range, empty when unbounded, into the end of a
+// transaction range.
+func txnEnd(end string) []byte {
+	if end == "" {
+		return []byte{0}
+	}
+	return []byte(end)
+}
+
+// minEnd returns the lower of two range ends, empty ones being unbounded.
+func minEnd(a, b string) string {
+	if a == "" || (b != "" && b < a) {
+		return b
+	}
+	return a
+}
+
+// prefixEnd returns the end of the range of keys starting with prefix.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// execute runs the request on the local replica of the group, which has to
+// lead it. Reads are served locally after a barrier; the epoch is checked
+// after them, so that they happened while the group still served the range.
+func (n *Node) execute(ctx context.Context, group string, req groupRequest) (groupResponse, error) {
+	store, err := n.group(group)
+	if err != nil {
+		return groupResponse{}, err
+	}
+	if !store.IsLeader() {
+		return groupResponse{}, &NotLeaderError{Group: group, Leader: store.Status().LeaderID}
+	}
+
+	switch {
+	case req.AddReplica != nil:
+		if err := store.Join(req.AddReplica.ID, req.AddReplica.RaftAddr); err != nil {
+			return groupResponse{}, err
+		}
+		return groupResponse{Index: store.Status().LastIndex}, nil
+	case req.RemoveReplica != "":
+		if err := store.RemoveMember(req.RemoveReplica); err != nil {
+			return groupResponse{}, err
+		}
+		return groupResponse{}, nil
+	}
+
+	readOnly := true
+	for _, op := range req.Ops {
+		readOnly = readOnly && op.Type == services.OpRange
+	}
+	if readOnly {
+		return n.read(ctx, group, store, req)
+	}
+
+	result, err := store.Txn(ctx, &services.Txn{
+		Compare: []services.Compare{{Key: fenceKey, Target: services.CompareVersion, Result: "=", Number: req.Epoch}},
+		Success: req.Ops,
+	})
+	if err != nil {
+		return groupResponse{}, err
+	}
+	if !result.Succeeded {
+		return groupResponse{}, fmt.Errorf("%w: group '%s' moved past epoch %d", ErrStaleEpoch, group, req.Epoch)
+	}
+	return responseOf(result.Results), nil
+}
+
+func (n *Node) read(ctx context.Context, group string, store *services.InMemoryStore, req groupRequest) (groupResponse, error) {
+	if err := store.Linearize(ctx); err != nil {
+		return groupResponse{}, err
+	}
+	results := make([]services.OpResult, len(req.Ops))
+	for i, op := range req.Ops {
+		kvs, _, err := store.Range(op.Key, string(op.End), 0)
+		if err != nil {
+			return groupResponse{}, err
+		}
+		results[i].KVs = kvs
+	}
+	fence, _, err := store.Range(fenceKey, "", 0)
+	if err != nil {
+		return groupResponse{}, err
+	}
+	var epoch int64
+	if len(fence) > 0 {
+		epoch = fence[0].Version
+	}
+	if epoch != req.Epoch {
+		return groupResponse{}, fmt.Errorf("%w: group '%s' is at epoch %d, not %d", ErrStaleEpoch, group, epoch, req.Epoch)
+	}
+	return responseOf(results), nil
+}
+
+func responseOf(results []services.OpResult) groupResponse {
+	resp := groupResponse{Results: make([]opResult, len(results))}
+	for i, r := range results {
+		resp.Results[i].Deleted = r.Deleted
+		for _, v := range r.KVs {
+			if v.Key != fenceKey {
+				resp.Results[i].KVs = append(resp.Results[i].KVs, kv{Key: v.Key, Value: []byte(v.Value)})
+			}
+		}
+	}
+	return resp
+}
+
+// onLeader runs the request on the leader of the group, locally or through
+// the HTTP API of its node, following the hints of the replicas asked.
+func (n *Node) onLeader(ctx context.Context, t *Table, g *Group, req groupRequest) (groupResponse, error) {
+	target := n.leaderHint(g)
+	var resp groupResponse
+	var err error
+	if target == n.config.ID {
+		resp, err = n.execute(ctx, g.ID, req)
+	} else if info, ok := t.Nodes[target]; !ok || info.HTTPAddr == "" {
+		err = fmt.Errorf("%w: '%s' has no known address", ErrNoSuchNode, target)
+	} else {
+		err = n.post(ctx, info.HTTPAddr, "/shard/groups/"+g.ID+"/execute", req, &resp)
+	}
+	n.noteLeader(g, target, err)
+	return resp, err
+}
+
+// leaderHint returns the node believed to lead the group: the last one
+// seen, or else the leader known to the local replica, or else the first
+// replica.
+func (n *Node) leaderHint(g *Group) string {
+	n.hintMutex.Lock()
+	id, ok := n.leaders[g.ID]
+	n.hintMutex.Unlock()
+	if ok && g.hosts(id) {
+		return id
+	}
+	if store, err := n.group(g.ID); err == nil {
+		if leader := store.Status().LeaderID; g.hosts(leader) {
+			return leader
+		}
+	}
+	return g.Replicas[0]
+}
+
+// noteLeader follows the hint of a replica that does not lead the group, or
+// moves on to the replica after target when there is none.
+func (n *Node) noteLeader(g *Group, target string, err error) {
+	n.hintMutex.Lock()
+	defer n.hintMutex.Unlock()
+	var nle *NotLeaderError
+	switch {
+	case err == nil, errors.Is(err, ErrStaleEpoch):
+		n.leaders[g.ID] = target
+	case errors.As(err, &nle) && g.hosts(nle.Leader) && nle.Leader != target:
+		n.leaders[g.ID] = nle.Leader
+	case retryable(err):
+		next := g.Replicas[0]
+		for i, id := range g.Replicas {
+			if id == target {
+				next = g.Replicas[(i+1)%len(g.Replicas)]
+			}
+		}
+		n.leaders[g.ID] = next
+	}
+}
+
+func (n *Node) forgetLeader(g *Group) {
+	n.hintMutex.Lock()
+	delete(n.leaders, g.ID)
+	n.hintMutex.Unlock()
+}
+
+// retryable tells whether another attempt may succeed once the routing
+// table, the leaders or the network settled.
+func retryable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrStaleEpoch) || errors.Is(err, services.ErrNotLeader) ||
+		errors.Is(err, ErrNoSuchGroup) || errors.Is(err, ErrNoSuchNode) || errors.Is(err, ErrNoTable) ||
+		errors.Is(err, services.ErrShuttingDown) || errors.Is(err, services.ErrBusy) ||
+		errors.As(err, &netErr)
+}
+
+// route runs the operations built for the range holding key on its group,
+// trying again with a fresh routing table while errors are retryable.
+func (n *Node) route(ctx context.Context, key string, build func(Range) []services.TxnOp) (groupResponse, Range, error) {
+	ctx, cancel := context.WithTimeout(ctx, routeTimeout)
+	defer cancel()
+	backoff := retryBackoffMin
+	for {
+		t, err := n.Table()
+		var r Range
+		var resp groupResponse
+		if err == nil {
+			r = t.Lookup(key)
+			g := t.Groups[r.Group]
+			resp, err = n.onLeader(ctx, t, g, groupRequest{Epoch: g.Epoch, Ops: build(r)})
+			if err == nil {
+				return resp, r, nil
+			}
+		}
+		if !retryable(err) {
+			return groupResponse{}, r, err
+		}
+		select {
+		case <-ctx.Done():
+			return groupResponse{}, r, fmt.Errorf("%w (last error: %s)", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, retryBackoffMax)
+	}
+}
+
+// Get returns the value of key, or services.ErrKeyNotFound.
+func (n *Node) Get(ctx context.Context, key string) (string, error) {
+	if err := checkUserKey(key); err != nil {
+		return "", err
+	}
+	resp, _, err := n.route(ctx, key, func(Range) []services.TxnOp {
+		return []services.TxnOp{{Type: services.OpRange, Key: key}}
+	})
+	if err != nil {
+		return "", err
+	}
+	if kvs := resp.Results[0].KVs; len(kvs) > 0 {
+		return string(kvs[0].Value), nil
+	}
+	return "", fmt.Errorf("%w: '%s'", services.ErrKeyNotFound, key)
+}
+
+func (n *Node) Put(ctx context.Context, key, value string) error {
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	_, _, err := n.route(ctx, key, func(Range) []services.TxnOp {
+		return []services.TxnOp{{Type: services.OpPut, Key: key, Value: []byte(value)}}
+	})
+	return err
+}
+
+// Delete deletes key and tells whether it existed.
+func (n *Node) Delete(ctx context.Context, key string) (bool, error) {
+	if err := checkUserKey(key); err != nil {
+		return false, err
+	}
+	resp, _, err := n.route(ctx, key, func(Range) []services.TxnOp {
+		return []services.TxnOp{{Type: services.OpDelete, Key: key}}
+	})
+	if err != nil {
+		return false, err
+	}
+	return resp.Results[0].Deleted > 0, nil
+}
+
+// List returns the keys starting with prefix, reading the ranges holding
+// them one after the other: each range is read at a single point, but not
+// the ranges together.
+func (n *Node) List(ctx context.Context, prefix string) (map[string]string, error) {
+	if strings.HasPrefix(prefix, "\x00") {
+		return nil, fmt.Errorf("%w: '%s'", ErrReservedKey, prefix)
+	}
+	start, end := prefix, prefixEnd(prefix)
+	if start == "" {
+		start = "\x01"
+	}
+	result := make(map[string]string)
+	for {
+		resp, r, err := n.route(ctx, start, func(r Range) []services.TxnOp {
+			return []services.TxnOp{{Type: services.OpRange, Key: start, End: txnEnd(minEnd(end, r.End))}}
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Results[0].KVs {
+			result[kv.Key] = string(kv.Value)
+		}
+		if r.End == "" || (end != "" && r.End >= end) {
+			return result, nil
+		}
+		start = r.End
+	}
+}
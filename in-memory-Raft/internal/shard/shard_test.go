@@ -0,0 +1,368 @@
+package shard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"inmemoryraft/internal/services"
+)
+
+func TestTableSplitAndMove(t *testing.T) {
+	table := newTable(map[string]string{"n1": "a1", "n2": "a2"})
+	if r := table.Lookup("x"); r.Group != "g1" {
+		t.Fatalf("x is in %s, want g1", r.Group)
+	}
+
+	for _, key := range []string{"m", "f"} {
+		if err := table.split(key, table.newGroupID()); err != nil {
+			t.Fatalf("split at %s: %s", key, err)
+		}
+	}
+	want := []Range{{End: "f", Group: "g1"}, {Start: "f", End: "m", Group: "g3"}, {Start: "m", Group: "g2"}}
+	if !reflect.DeepEqual(table.Ranges, want) {
+		t.Fatalf("ranges are %+v, want %+v", table.Ranges, want)
+	}
+	for key, group := range map[string]string{"\x01": "g1", "e": "g1", "f": "g3", "lz": "g3", "m": "g2", "zzz": "g2"} {
+		if r := table.Lookup(key); r.Group != group {
+			t.Errorf("%q is in %s, want %s", key, r.Group, group)
+		}
+	}
+	if got := table.Overlapping("g", "n"); len(got) != 2 || got[0].Group != "g3" || got[1].Group != "g2" {
+		t.Errorf("ranges overlapping [g, n) are %+v", got)
+	}
+	if table.Groups["g1"].Epoch != 2 || table.Groups["g2"].Epoch != 0 {
+		t.Errorf("epochs are g1=%d g2=%d, want 2 and 0", table.Groups["g1"].Epoch, table.Groups["g2"].Epoch)
+	}
+	if err := table.split("m", "g9"); !errors.Is(err, ErrBadSplit) {
+		t.Errorf("split at a boundary: %v, want ErrBadSplit", err)
+	}
+
+	table.Nodes["n3"] = NodeInfo{ID: "n3"}
+	if err := table.move("g2", "n1", "n3"); err != nil {
+		t.Fatal(err)
+	}
+	if got := table.Groups["g2"].Replicas; !reflect.DeepEqual(got, []string{"n2", "n3"}) {
+		t.Errorf("g2 is on %v", got)
+	}
+	if err := table.move("g2", "n1", "n3"); err == nil {
+		t.Errorf("moved a replica twice")
+	}
+	if err := table.move("g2", "n2", "n4"); !errors.Is(err, ErrNoSuchNode) {
+		t.Errorf("move to an unknown node: %v", err)
+	}
+}
+
+func testRaftConfig() *raft.Config {
+	rc := raft.DefaultConfig()
+	rc.HeartbeatTimeout = 50 * time.Millisecond
+	rc.ElectionTimeout = 50 * time.Millisecond
+	rc.LeaderLeaseTimeout = 50 * time.Millisecond
+	rc.CommitTimeout = 5 * time.Millisecond
+	rc.LogLevel = "WARN"
+	return rc
+}
+
+// freeAddr returns a local address nothing listens on, for the Raft
+// addresses Peers needs before the nodes start.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func startNode(t *testing.T, id, raftAddr string, peers map[string]string, join []string) *Node {
+	t.Helper()
+	n := NewNode(Config{
+		ID:         id,
+		RaftAddr:   raftAddr,
+		HTTPAddr:   "127.0.0.1:0",
+		Dir:        t.TempDir(),
+		Peers:      peers,
+		Join:       join,
+		RaftConfig: testRaftConfig(),
+	})
+	if err := n.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func startCluster(t *testing.T, size int) []*Node {
+	t.Helper()
+	peers := make(map[string]string)
+	for i := 1; i <= size; i++ {
+		peers[fmt.Sprintf("n%d", i)] = freeAddr(t)
+	}
+	nodes := make([]*Node, size)
+	for i := range nodes {
+		id := fmt.Sprintf("n%d", i+1)
+		nodes[i] = startNode(t, id, peers[id], peers, nil)
+	}
+	for _, n := range nodes {
+		waitForRegistration(t, nodes[0], n)
+	}
+	return nodes
+}
+
+// waitForRegistration waits until the routing table as seen by n tells how
+// to reach node, which splits and moves need.
+func waitForRegistration(t *testing.T, n, node *Node) {
+	t.Helper()
+	waitFor(t, node.ID()+" to register", func() bool {
+		table, err := n.Table()
+		return err == nil && table.Nodes[node.ID()].HTTPAddr == node.HTTPAddr()
+	})
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func checkGet(t *testing.T, n *Node, key, want string) {
+	t.Helper()
+	got, err := n.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("%s: get %s: %s", n.ID(), key, err)
+	}
+	if got != want {
+		t.Fatalf("%s: %s=%q, want %q", n.ID(), key, got, want)
+	}
+}
+
+func metaLeader(t *testing.T, nodes []*Node) *Node {
+	t.Helper()
+	var leader *Node
+	waitFor(t, "a meta leader", func() bool {
+		for _, n := range nodes {
+			if n.meta.IsLeader() {
+				leader = n
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func TestRouting(t *testing.T) {
+	nodes := startCluster(t, 3)
+	ctx := context.Background()
+
+	keys := map[string]string{"apple": "1", "banana": "2", "cherry": "3", "melon": "4", "peach": "5"}
+	for k, v := range keys {
+		if err := nodes[0].Put(ctx, k, v); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	// Split through a node that does not lead the meta group: it forwards.
+	var follower *Node
+	leader := metaLeader(t, nodes)
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+	if _, err := follower.Split(ctx, "c"); err != nil {
+		t.Fatalf("split at c: %s", err)
+	}
+	table, err := leader.Split(ctx, "m")
+	if err != nil {
+		t.Fatalf("split at m: %s", err)
+	}
+	if len(table.Ranges) != 3 {
+		t.Fatalf("table has ranges %+v", table.Ranges)
+	}
+	if _, err := leader.Split(ctx, "m"); !errors.Is(err, ErrBadSplit) {
+		t.Errorf("second split at m: %v, want ErrBadSplit", err)
+	}
+
+	for _, n := range nodes {
+		for k, v := range keys {
+			checkGet(t, n, k, v)
+		}
+	}
+	// Every group holds its own range only.
+	for _, r := range table.Ranges {
+		store, err := nodes[0].GroupStore(r.Group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "group "+r.Group+" to apply the split", func() bool {
+			for k := range store.List("") {
+				if k != fenceKey && (k < r.Start || (r.End != "" && k >= r.End)) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	if err := nodes[2].Put(ctx, "date", "6"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := nodes[1].Delete(ctx, "melon"); err != nil || !ok {
+		t.Fatalf("delete melon: %v, %v", ok, err)
+	}
+	got, err := nodes[1].List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"apple": "1", "banana": "2", "cherry": "3", "date": "6", "peach": "5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("list is %v, want %v", got, want)
+	}
+	if got, err := nodes[1].List(ctx, "b"); err != nil || !reflect.DeepEqual(got, map[string]string{"banana": "2"}) {
+		t.Errorf("list b is %v, %v", got, err)
+	}
+	if _, err := nodes[0].Get(ctx, "melon"); !errors.Is(err, services.ErrKeyNotFound) {
+		t.Errorf("get melon: %v, want ErrKeyNotFound", err)
+	}
+	if err := nodes[0].Put(ctx, fenceKey, "x"); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("put of the fence key: %v, want ErrReservedKey", err)
+	}
+}
+
+// TestStaleRouting checks that a group refuses requests routed with the
+// epoch it had before a split.
+func TestStaleRouting(t *testing.T) {
+	nodes := startCluster(t, 3)
+	ctx := context.Background()
+	if err := nodes[0].Put(ctx, "x", "1"); err != nil {
+		t.Fatal(err)
+	}
+	old, err := nodes[0].Table()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[0].Split(ctx, "m"); err != nil {
+		t.Fatal(err)
+	}
+
+	g := old.Groups[firstGroup()]
+	_, err = nodes[0].onLeaderRetry(ctx, old, g, groupRequest{
+		Epoch: g.Epoch,
+		Ops:   []services.TxnOp{{Type: services.OpPut, Key: "x", Value: []byte("2")}},
+	})
+	if !errors.Is(err, ErrStaleEpoch) {
+		t.Fatalf("write with a stale epoch: %v, want ErrStaleEpoch", err)
+	}
+	checkGet(t, nodes[1], "x", "1")
+}
+
+func TestMove(t *testing.T) {
+	nodes := startCluster(t, 3)
+	ctx := context.Background()
+	if err := nodes[0].Put(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	n4 := startNode(t, "n4", "127.0.0.1:0", nil, []string{nodes[1].HTTPAddr()})
+	waitForRegistration(t, n4, n4)
+
+	table, err := nodes[2].Move(ctx, firstGroup(), "n1", "n4")
+	if err != nil {
+		t.Fatalf("move: %s", err)
+	}
+	if got := table.Groups[firstGroup()].Replicas; !reflect.DeepEqual(got, []string{"n2", "n3", "n4"}) {
+		t.Fatalf("%s is on %v", firstGroup(), got)
+	}
+	if got := n4.Groups(); !reflect.DeepEqual(got, []string{firstGroup()}) {
+		t.Errorf("n4 hosts %v", got)
+	}
+	if got := nodes[0].Groups(); len(got) != 0 {
+		t.Errorf("n1 still hosts %v", got)
+	}
+
+	if err := nodes[0].Put(ctx, "b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := n4.GroupStore(firstGroup())
+	waitFor(t, "n4 to catch up", func() bool {
+		a, _ := store.Get("a")
+		b, _ := store.Get("b")
+		return a == "1" && b == "2"
+	})
+	checkGet(t, n4, "a", "1")
+	checkGet(t, nodes[0], "b", "2")
+}
+
+func TestHTTP(t *testing.T) {
+	nodes := startCluster(t, 3)
+	base := "http://" + nodes[1].HTTPAddr()
+
+	resp, err := http.Post(base+"/keys", "application/json", strings.NewReader(`{"k1":"v1","x1":"v2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put: %s", resp.Status)
+	}
+
+	resp, err = http.Post(base+"/shard/split", "application/json", strings.NewReader(`{"key":"p"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table Table
+	json.NewDecoder(resp.Body).Decode(&table)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(table.Ranges) != 2 {
+		t.Fatalf("split: %s, %+v", resp.Status, table.Ranges)
+	}
+
+	resp, err = http.Get(base + "/keys/x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if got["x1"] != "v2" {
+		t.Errorf("get x1: %s, %v", resp.Status, got)
+	}
+
+	resp, err = http.Get(base + "/keys/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e errorResponse
+	json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || e.Code != "not_found" {
+		t.Errorf("get missing: %s, %+v", resp.Status, e)
+	}
+
+	resp, err = http.Get(base + "/keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if !reflect.DeepEqual(got, map[string]string{"k1": "v1", "x1": "v2"}) {
+		t.Errorf("list: %v", got)
+	}
+}
@@ -0,0 +1,169 @@
+package shard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// tableKey holds the routing table in the keyspace of the meta group.
+const tableKey = "routing"
+
+var (
+	ErrNoSuchGroup = errors.New("no such group")
+	ErrNoSuchNode  = errors.New("no such node")
+	ErrBadSplit    = errors.New("split key is already a range boundary")
+)
+
+// Table routes keys to Raft groups. Ranges cover the whole keyspace without
+// overlapping, sorted by Start; the End of the last one is empty, meaning
+// unbounded. Every change of the table bumps Version.
+type Table struct {
+	Version   uint64              `json:"version"`
+	Ranges    []Range             `json:"ranges"`
+	Groups    map[string]*Group   `json:"groups"`
+	Nodes     map[string]NodeInfo `json:"nodes"`
+	NextGroup int                 `json:"next_group"`
+}
+
+// Range is the key range [Start, End) served by Group.
+type Range struct {
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+	Group string `json:"group"`
+}
+
+// Group is a Raft group and the nodes holding its replicas. Epoch counts the
+// splits of its ranges: requests routed with an older epoch are refused by
+// the group (see fenceKey), so that no write lands in a range it gave away.
+type Group struct {
+	ID       string   `json:"id"`
+	Replicas []string `json:"replicas"`
+	Epoch    int64    `json:"epoch"`
+}
+
+// NodeInfo tells how to reach a node: its Raft groups on RaftAddr, its HTTP
+// API on HTTPAddr.
+type NodeInfo struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	HTTPAddr string `json:"http_addr,omitempty"`
+}
+
+// newTable routes the whole keyspace to a first group replicated on every
+// node of peers.
+func newTable(peers map[string]string) *Table {
+	t := &Table{Groups: make(map[string]*Group), Nodes: make(map[string]NodeInfo), NextGroup: 1}
+	g := &Group{ID: t.newGroupID()}
+	for id, addr := range peers {
+		g.Replicas = append(g.Replicas, id)
+		t.Nodes[id] = NodeInfo{ID: id, RaftAddr: addr}
+	}
+	sort.Strings(g.Replicas)
+	t.Groups[g.ID] = g
+	t.Ranges = []Range{{Group: g.ID}}
+	return t
+}
+
+func decodeTable(s string) (*Table, error) {
+	var t Table
+	if err := json.Unmarshal([]byte(s), &t); err != nil {
+		return nil, fmt.Errorf("routing table: %w", err)
+	}
+	return &t, nil
+}
+
+func (t *Table) encode() string {
+	b, _ := json.Marshal(t)
+	return string(b)
+}
+
+func (t *Table) clone() *Table {
+	c, _ := decodeTable(t.encode())
+	return c
+}
+
+func (t *Table) newGroupID() string {
+	id := fmt.Sprintf("g%d", t.NextGroup)
+	t.NextGroup++
+	return id
+}
+
+// Lookup returns the range holding key.
+func (t *Table) Lookup(key string) Range {
+	i := sort.Search(len(t.Ranges), func(i int) bool { return t.Ranges[i].Start > key })
+	return t.Ranges[i-1]
+}
+
+// Overlapping returns the ranges holding keys of [start, end), an empty end
+// meaning unbounded, in order.
+func (t *Table) Overlapping(start, end string) []Range {
+	var result []Range
+	for _, r := range t.Ranges {
+		if (r.End == "" || r.End > start) && (end == "" || r.Start < end) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// split gives the keys of the range holding key from key on to a new group
+// id, with the same replicas.
+func (t *Table) split(key, id string) error {
+	i := sort.Search(len(t.Ranges), func(i int) bool { return t.Ranges[i].Start > key }) - 1
+	r := t.Ranges[i]
+	if r.Start == key {
+		return ErrBadSplit
+	}
+	if _, ok := t.Groups[id]; ok {
+		return fmt.Errorf("group '%s' already exists", id)
+	}
+	old := t.Groups[r.Group]
+	t.Groups[id] = &Group{ID: id, Replicas: append([]string(nil), old.Replicas...)}
+	old.Epoch++
+
+	t.Ranges = append(t.Ranges, Range{})
+	copy(t.Ranges[i+2:], t.Ranges[i+1:])
+	t.Ranges[i] = Range{Start: r.Start, End: key, Group: r.Group}
+	t.Ranges[i+1] = Range{Start: key, End: r.End, Group: id}
+	t.Version++
+	return nil
+}
+
+// move replaces the replica of the group on node from by one on node to.
+func (t *Table) move(group, from, to string) error {
+	g, ok := t.Groups[group]
+	if !ok {
+		return fmt.Errorf("%w: '%s'", ErrNoSuchGroup, group)
+	}
+	if _, ok := t.Nodes[to]; !ok {
+		return fmt.Errorf("%w: '%s'", ErrNoSuchNode, to)
+	}
+	i := -1
+	for j, id := range g.Replicas {
+		if id == to {
+			return fmt.Errorf("group '%s' already has a replica on node '%s'", group, to)
+		}
+		if id == from {
+			i = j
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("group '%s' has no replica on node '%s'", group, from)
+	}
+	g.Replicas[i] = to
+	sort.Strings(g.Replicas)
+	t.Version++
+	return nil
+}
+
+// hosts tells whether node holds a replica of the group.
+func (g *Group) hosts(node string) bool {
+	for _, id := range g.Replicas {
+		if id == node {
+			return true
+		}
+	}
+	return false
+}
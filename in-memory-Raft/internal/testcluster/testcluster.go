@@ -0,0 +1,410 @@
+// Package testcluster runs several store nodes in one process, so that
+// cluster tests need neither fixed ports nor sleeps. Nodes talk over
+// raft.InmemTransport by default, or over TCP on ephemeral ports, and can be
+// killed, restarted and partitioned from the test. Over TCP the links between
+// nodes can also be slowed down or made lossy through Node.Faults.
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"inmemoryraft/internal/api"
+	"inmemoryraft/internal/chaos"
+	"inmemoryraft/internal/services"
+)
+
+const (
+	defaultNodes   = 3
+	defaultTimeout = 10 * time.Second
+	pollInterval   = 10 * time.Millisecond
+)
+
+type Config struct {
+	Nodes   int           // 3 if zero
+	Network bool          // TCP on ephemeral ports instead of raft.InmemTransport
+	HTTP    bool          // serve the HTTP API of every node on an ephemeral port
+	Timeout time.Duration // of the Wait helpers, 10s if zero
+
+	// Configure is called on every store before it starts, restarts
+	// included.
+	Configure func(*services.InMemoryStore)
+}
+
+// Node is one member of the cluster. Store is replaced when the node is
+// restarted, while its Raft log, stable store, snapshots and addresses are
+// kept, as they would be on disk.
+type Node struct {
+	ID       string
+	RaftAddr string
+	HTTPAddr string // empty unless Config.HTTP
+	Store    *services.InMemoryStore
+
+	// Faults misbehaves the connections the node opens to its peers, keyed
+	// by their RaftAddr. Nil unless Config.Network; Partition sets the
+	// Partition flag of its rules.
+	Faults *chaos.Faults
+
+	dir         string
+	alive       bool
+	transport   *raft.InmemTransport
+	logStore    *raft.InmemStore
+	stableStore *raft.InmemStore
+	api         *api.StorageController
+}
+
+type Cluster struct {
+	t      testing.TB
+	config Config
+
+	mutex sync.Mutex
+	nodes []*Node
+	cut   map[[2]int]bool // links from one node to another cut by Partition
+}
+
+// Start bootstraps a cluster of config.Nodes voters and stops it when the
+// test ends. It does not wait for a leader.
+func Start(t testing.TB, config Config) *Cluster {
+	t.Helper()
+	if config.Nodes == 0 {
+		config.Nodes = defaultNodes
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	c := &Cluster{t: t, config: config, cut: make(map[[2]int]bool)}
+	t.Cleanup(c.Close)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	dir := t.TempDir()
+	for i := 0; i < config.Nodes; i++ {
+		c.nodes = append(c.nodes, c.newNode(dir, i))
+	}
+	for _, n := range c.nodes {
+		c.startNode(n)
+	}
+	c.rewire()
+
+	peers := make(map[string]string, len(c.nodes))
+	for _, n := range c.nodes {
+		peers[n.ID] = n.RaftAddr
+	}
+	for _, n := range c.nodes {
+		if err := n.Store.BootstrapPeers(peers); err != nil {
+			t.Fatalf("testcluster: failed to bootstrap %s: %s", n.ID, err)
+		}
+	}
+	return c
+}
+
+func (c *Cluster) newNode(dir string, i int) *Node {
+	id := fmt.Sprintf("node%d", i)
+	n := &Node{
+		ID:          id,
+		RaftAddr:    "127.0.0.1:0",
+		dir:         filepath.Join(dir, id),
+		logStore:    raft.NewInmemStore(),
+		stableStore: raft.NewInmemStore(),
+	}
+	if c.config.Network {
+		n.Faults = chaos.New()
+	} else {
+		n.RaftAddr = id
+	}
+	return n
+}
+
+// startNode opens the store of n on its existing state. Called with the
+// cluster lock held.
+func (c *Cluster) startNode(n *Node) {
+	c.t.Helper()
+
+	rc := raft.DefaultConfig()
+	rc.HeartbeatTimeout = 50 * time.Millisecond
+	rc.ElectionTimeout = 50 * time.Millisecond
+	rc.LeaderLeaseTimeout = 50 * time.Millisecond
+	rc.CommitTimeout = 5 * time.Millisecond
+	rc.LogLevel = "WARN"
+
+	store := services.NewStore()
+	store.RaftDir = n.dir
+	store.RaftBind = n.RaftAddr
+	store.RaftConfig = rc
+	store.TransactionLogPath = filepath.Join(n.dir, "transaction_log.json")
+	store.LogStore = n.logStore
+	store.StableStore = n.stableStore
+	store.Faults = n.Faults
+	if !c.config.Network {
+		_, n.transport = raft.NewInmemTransport(raft.ServerAddress(n.RaftAddr))
+		store.Transport = n.transport
+	}
+	if c.config.Configure != nil {
+		c.config.Configure(store)
+	}
+	if err := store.InitNode(false, n.ID); err != nil {
+		c.t.Fatalf("testcluster: failed to start %s: %s", n.ID, err)
+	}
+	n.RaftAddr = store.RaftBind
+	n.Store = store
+	n.alive = true
+
+	if c.config.HTTP {
+		addr := n.HTTPAddr
+		if addr == "" {
+			addr = "127.0.0.1:0"
+		}
+		n.api = api.NewInMemoryStore(addr, store)
+		if err := n.api.Starter(); err != nil {
+			c.t.Fatalf("testcluster: failed to start HTTP API of %s: %s", n.ID, err)
+		}
+		n.HTTPAddr = n.api.Addr().String()
+	}
+}
+
+// rewire connects the in-memory transports of the live nodes, leaving out
+// the links cut by Partition, or over TCP sets the Partition flag of the
+// faults of every link that is cut. Called with the cluster lock held.
+func (c *Cluster) rewire() {
+	if c.config.Network {
+		for i, from := range c.nodes {
+			for j, to := range c.nodes {
+				if i == j {
+					continue
+				}
+				r := from.Faults.Rule(to.RaftAddr)
+				if r.Partition != c.cut[[2]int{i, j}] {
+					r.Partition = !r.Partition
+					from.Faults.Set(to.RaftAddr, r)
+				}
+			}
+		}
+		return
+	}
+	for i, from := range c.nodes {
+		if !from.alive {
+			continue
+		}
+		for j, to := range c.nodes {
+			if i == j {
+				continue
+			}
+			if to.alive && !c.cut[[2]int{i, j}] {
+				from.transport.Connect(raft.ServerAddress(to.RaftAddr), to.transport)
+			} else {
+				from.transport.Disconnect(raft.ServerAddress(to.RaftAddr))
+			}
+		}
+	}
+}
+
+// Nodes returns every node, killed ones included, in the order they were
+// created.
+func (c *Cluster) Nodes() []*Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*Node(nil), c.nodes...)
+}
+
+func (c *Cluster) Node(i int) *Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nodes[i]
+}
+
+// Alive reports whether the node is running, that is not killed.
+func (c *Cluster) Alive(i int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nodes[i].alive
+}
+
+// Leader returns the live node that is leader right now, or nil if there is
+// none or more than one, as during the lease of a deposed leader.
+func (c *Cluster) Leader() *Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var leader *Node
+	for _, n := range c.nodes {
+		if n.alive && n.Store.IsLeader() {
+			if leader != nil {
+				return nil
+			}
+			leader = n
+		}
+	}
+	return leader
+}
+
+// Stores returns the stores of the live nodes. Unlike reading Node.Store,
+// it is safe while another goroutine restarts nodes.
+func (c *Cluster) Stores() []*services.InMemoryStore {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var stores []*services.InMemoryStore
+	for _, n := range c.nodes {
+		if n.alive {
+			stores = append(stores, n.Store)
+		}
+	}
+	return stores
+}
+
+// WaitForLeader waits until exactly one live node is leader and returns it.
+func (c *Cluster) WaitForLeader() *Node {
+	c.t.Helper()
+	var leader *Node
+	c.waitFor("a leader", func() bool {
+		leader = c.Leader()
+		return leader != nil
+	})
+	return leader
+}
+
+// WaitForApplied waits until every live node has applied the Raft log up to
+// index.
+func (c *Cluster) WaitForApplied(index uint64) {
+	c.t.Helper()
+	c.waitFor(fmt.Sprintf("index %d to be applied", index), func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for _, n := range c.nodes {
+			if n.alive && n.Store.Status().AppliedIndex < index {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Sync waits until every live node has applied everything the leader has
+// in its log, and returns that index.
+func (c *Cluster) Sync() uint64 {
+	c.t.Helper()
+	index := c.WaitForLeader().Store.Status().LastIndex
+	c.WaitForApplied(index)
+	return index
+}
+
+func (c *Cluster) waitFor(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(c.config.Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("testcluster: timed out after %s waiting for %s", c.config.Timeout, what)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// KillNode stops node i abruptly: no final snapshot, and its HTTP API stops
+// answering.
+func (c *Cluster) KillNode(i int) {
+	c.t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	n := c.nodes[i]
+	if !n.alive {
+		return
+	}
+	c.stopNode(n)
+	c.rewire()
+}
+
+// stopNode is called with the cluster lock held.
+func (c *Cluster) stopNode(n *Node) {
+	n.alive = false
+	if n.api != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		n.api.Shutdown(ctx)
+		cancel()
+		n.api = nil
+	}
+	if err := n.Store.Shutdown(false); err != nil {
+		c.t.Logf("testcluster: failed to stop %s: %s", n.ID, err)
+	}
+}
+
+// RestartNode starts a killed node again from its Raft state, keeping its
+// addresses, and returns it.
+func (c *Cluster) RestartNode(i int) *Node {
+	c.t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	n := c.nodes[i]
+	if n.alive {
+		c.t.Fatalf("testcluster: %s is still running", n.ID)
+	}
+	c.startNode(n)
+	c.rewire()
+	return n
+}
+
+// AddNode starts a node that is not part of the Raft configuration, for
+// tests of joins. It reaches every other node unless partitioned later.
+func (c *Cluster) AddNode() *Node {
+	c.t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	n := c.newNode(filepath.Dir(c.nodes[0].dir), len(c.nodes))
+	c.nodes = append(c.nodes, n)
+	c.startNode(n)
+	c.rewire()
+	return n
+}
+
+// Partition splits the cluster into groups of node indexes that can only
+// reach the nodes of their own group. Nodes left out of every group are
+// isolated.
+func (c *Cluster) Partition(groups ...[]int) {
+	c.t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	group := make(map[int]int)
+	for g, members := range groups {
+		for _, i := range members {
+			group[i] = g + 1
+		}
+	}
+	c.cut = make(map[[2]int]bool)
+	for i := range c.nodes {
+		for j := range c.nodes {
+			if i != j && (group[i] == 0 || group[i] != group[j]) {
+				c.cut[[2]int{i, j}] = true
+			}
+		}
+	}
+	c.rewire()
+}
+
+// Heal undoes Partition.
+func (c *Cluster) Heal() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cut = make(map[[2]int]bool)
+	c.rewire()
+}
+
+// Close stops every live node. Start registers it as a test cleanup.
+func (c *Cluster) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, n := range c.nodes {
+		if n.alive {
+			c.stopNode(n)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package testcluster
+
+import (
+	"context"
+	"testing"
+
+	"inmemoryraft/internal/chaos"
+)
+
+func put(t *testing.T, c *Cluster, key, value string) {
+	t.Helper()
+	if err := c.WaitForLeader().Store.Put(context.Background(), key, value); err != nil {
+		t.Fatalf("failed to put %s: %s", key, err)
+	}
+}
+
+func checkValue(t *testing.T, c *Cluster, i int, key, want string) {
+	t.Helper()
+	if got, _ := c.Node(i).Store.Get(key); got != want {
+		t.Fatalf("%s has %s=%q, want %q", c.Node(i).ID, key, got, want)
+	}
+}
+
+func TestKillAndRestart(t *testing.T) {
+	c := Start(t, Config{Nodes: 3})
+	put(t, c, "a", "1")
+	c.Sync()
+	for i := range c.Nodes() {
+		checkValue(t, c, i, "a", "1")
+	}
+
+	old := c.WaitForLeader()
+	var killed int
+	for i, n := range c.Nodes() {
+		if n == old {
+			killed = i
+		}
+	}
+	c.KillNode(killed)
+	if leader := c.WaitForLeader(); leader == old {
+		t.Fatalf("killed node is still leader")
+	}
+	put(t, c, "b", "2")
+
+	c.RestartNode(killed)
+	c.Sync()
+	checkValue(t, c, killed, "a", "1")
+	checkValue(t, c, killed, "b", "2")
+}
+
+func TestPartition(t *testing.T) {
+	t.Run("inmem", func(t *testing.T) { testPartition(t, false) })
+	t.Run("network", func(t *testing.T) { testPartition(t, true) })
+}
+
+func testPartition(t *testing.T, network bool) {
+	c := Start(t, Config{Nodes: 3, Network: network})
+	put(t, c, "a", "1")
+
+	leader := c.WaitForLeader()
+	var minority int
+	var majority []int
+	for i, n := range c.Nodes() {
+		if n == leader {
+			minority = i
+		} else {
+			majority = append(majority, i)
+		}
+	}
+
+	c.Partition([]int{minority}, majority)
+	c.waitFor("the majority to elect a leader", func() bool {
+		l := c.Leader()
+		return l != nil && l != leader
+	})
+	if err := leader.Store.Put(context.Background(), "a", "lost"); err == nil {
+		t.Fatalf("expected a write on the isolated leader to fail")
+	}
+	put(t, c, "a", "2")
+
+	c.Heal()
+	c.Sync()
+	for i := range c.Nodes() {
+		checkValue(t, c, i, "a", "2")
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	c := Start(t, Config{Nodes: 3, Network: true})
+	put(t, c, "a", "1")
+
+	c.KillNode(2)
+	put(t, c, "b", "2")
+	c.RestartNode(2)
+	c.Sync()
+	checkValue(t, c, 2, "b", "2")
+}
+
+// A leader that can no longer send to its followers, while they still reach
+// it, is deposed by their election and then follows the new leader.
+func TestOneWayPartition(t *testing.T) {
+	c := Start(t, Config{Nodes: 3, Network: true})
+	put(t, c, "a", "1")
+
+	old := c.WaitForLeader()
+	old.Faults.Set(chaos.AllPeers, chaos.Rule{Partition: true})
+	c.waitFor("a new leader", func() bool {
+		l := c.Leader()
+		return l != nil && l != old
+	})
+	put(t, c, "a", "2")
+	c.Sync()
+	for i := range c.Nodes() {
+		checkValue(t, c, i, "a", "2")
+	}
+}
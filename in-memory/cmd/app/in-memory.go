@@ -3,22 +3,19 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
-	"time"
 
+	"common/encryption"
 	"inmemory/internal/api"
+	"inmemory/internal/config"
 	"inmemory/internal/services"
 )
 
-type PathsConfig struct {
-	DataFile  string `json:"data_file"`
-	IndexFile string `json:"index_file"`
-}
-
 func loadDataFromFile(s *services.InMemoryStore, filename string) error {
-	data, err := os.ReadFile(filename)
+	data, err := s.Keyring.ReadFile(filename)
 	if err != nil {
 		return err
 	}
@@ -33,45 +30,53 @@ func loadDataFromFile(s *services.InMemoryStore, filename string) error {
 }
 
 func main() {
-	store := services.NewInMemoryStore()
-
-	file, err := os.Open("in-memory/configs/config.json")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Invalid configuration: %v", err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	config := PathsConfig{}
-	err = decoder.Decode(&config)
-	if err != nil {
-		log.Fatal(err)
+	store := services.NewInMemoryStore()
+	store.DataFile = cfg.DataFile
+	store.LogPath = cfg.LogFile
+	store.SnapshotDir = cfg.SnapshotDir
+	store.MaxSnapshots = cfg.MaxSnapshots
+
+	if cfg.EncryptionKeyFile != "" {
+		keyring, err := encryption.LoadKeyring(cfg.EncryptionKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load encryption keys: %v", err)
+		}
+		store.Keyring = keyring
+		log.Printf("Encryption at rest enabled, active key %s", keyring.ActiveKeyID())
+	}
+	if err := store.CheckEncryption(); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
 	}
 
-	if _, err := os.Stat(config.DataFile); errors.Is(err, os.ErrNotExist) {
-		_, err := os.Create(config.DataFile)
+	if _, err := os.Stat(cfg.DataFile); errors.Is(err, os.ErrNotExist) {
+		_, err := os.Create(cfg.DataFile)
 		if err != nil {
 			log.Fatalf("Failed to create json file: %v", err)
 		}
 	}
 
-	err = loadDataFromFile(store, config.DataFile)
+	err = loadDataFromFile(store, cfg.DataFile)
 	if err != nil {
 		log.Fatalf("Failed to load data from file: %v", err)
 	}
 
-	interval := 30 * time.Minute
-	go services.PeriodicSave(store, interval)
-	go services.Snapshot(store, interval)
+	go services.PeriodicSave(store, cfg.SaveInterval)
+	go services.Snapshot(store, cfg.SnapshotInterval)
 
 	http.HandleFunc("/get", api.HandleGet(store))
 	http.HandleFunc("/put", api.HandlePut(store))
 	http.HandleFunc("/delete", api.HandleDelete(store))
+	http.HandleFunc("/list", api.HandleList(store))
 
 	http.HandleFunc("/rollback", services.HandlerRollback(store))
 
-	http.Handle("/", http.FileServer(http.Dir(config.IndexFile)))
+	http.Handle("/", http.FileServer(http.Dir(cfg.IndexDir)))
 
-	log.Printf("Server is running on http://localhost:8000")
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	log.Printf("Server is running on http://%s", cfg.HTTPAddr)
+	log.Fatal(http.ListenAndServe(cfg.HTTPAddr, nil))
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"inmemory/internal/api"
+	"inmemory/internal/services"
+
+	"kv"
+	"kv/kvtest"
+)
+
+// newKV serves the routes of the server on a store writing to a temporary
+// directory.
+func newKV(tb testing.TB) kv.KV {
+	dir := tb.TempDir()
+	store := services.NewInMemoryStore()
+	store.DataFile = filepath.Join(dir, "data.json")
+	store.LogPath = filepath.Join(dir, "log.log")
+	store.SnapshotDir = filepath.Join(dir, "snapshots")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", api.HandleGet(store))
+	mux.HandleFunc("/put", api.HandlePut(store))
+	mux.HandleFunc("/delete", api.HandleDelete(store))
+	mux.HandleFunc("/list", api.HandleList(store))
+	server := httptest.NewServer(mux)
+	tb.Cleanup(server.Close)
+
+	s := kv.NewStandalone(server.URL)
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestKVConformance(t *testing.T) {
+	kvtest.Run(t, newKV(t))
+}
+
+func BenchmarkKV(b *testing.B) {
+	kvtest.Benchmark(b, newKV(b))
+}
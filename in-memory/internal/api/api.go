@@ -110,3 +110,25 @@ func HandleDelete(s *services.InMemoryStore) http.HandlerFunc {
 		r.Body.Close()
 	}
 }
+
+// HandleList answers with a JSON object of the keys starting with the
+// 'prefix' parameter, or of every key without it.
+func HandleList(s *services.InMemoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+
+		b, err := json.Marshal(s.List(prefix))
+		if err != nil {
+			http.Error(w, "Failed to encode keys", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("List prefix '%s'", prefix)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		if err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
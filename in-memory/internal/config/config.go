@@ -0,0 +1,112 @@
+// Package config loads the settings of the in-memory server from a YAML or
+// JSON file, environment variables and command-line flags, in increasing
+// order of precedence.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"common/configload"
+)
+
+const (
+	EnvConfig = "INMEMORY_CONFIG"
+
+	// DefaultConfigFile is optional: it is only read if it exists.
+	DefaultConfigFile = "in-memory/configs/config.json"
+)
+
+type Config struct {
+	HTTPAddr          string        `yaml:"http_addr" env:"INMEMORY_HTTP_ADDR" flag:"addr"`
+	DataFile          string        `yaml:"data_file" env:"INMEMORY_DATA_FILE" flag:"data-file"`
+	IndexDir          string        `yaml:"index_file" env:"INMEMORY_INDEX_DIR" flag:"index-dir"`
+	LogFile           string        `yaml:"log_file" env:"INMEMORY_LOG_FILE" flag:"log-file"`
+	SnapshotDir       string        `yaml:"snapshot_dir" env:"INMEMORY_SNAPSHOT_DIR" flag:"snapshot-dir"`
+	MaxSnapshots      int           `yaml:"max_snapshots" env:"INMEMORY_MAX_SNAPSHOTS" flag:"max-snapshots"`
+	SaveInterval      time.Duration `yaml:"save_interval" env:"INMEMORY_SAVE_INTERVAL" flag:"save-interval"`
+	SnapshotInterval  time.Duration `yaml:"snapshot_interval" env:"INMEMORY_SNAPSHOT_INTERVAL" flag:"snapshot-interval"`
+	EncryptionKeyFile string        `yaml:"encryption_key_file" env:"INMEMORY_ENCRYPTION_KEY_FILE" flag:"encryption-key-file"`
+}
+
+func Default() *Config {
+	return &Config{
+		HTTPAddr:         ":8000",
+		DataFile:         "in-memory/internal/data/data.json",
+		IndexDir:         "in-memory/configs",
+		LogFile:          "in-memory/internal/data/log.log",
+		SnapshotDir:      "in-memory/internal/data/snapshots",
+		MaxSnapshots:     10,
+		SaveInterval:     30 * time.Minute,
+		SnapshotInterval: 30 * time.Minute,
+	}
+}
+
+// RegisterFlags binds the command-line flags to the fields of c.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.HTTPAddr, "addr", c.HTTPAddr, "HTTP listen address")
+	fs.StringVar(&c.DataFile, "data-file", c.DataFile, "File the data is persisted to")
+	fs.StringVar(&c.IndexDir, "index-dir", c.IndexDir, "Directory with the web interface")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "File the operation log is persisted to")
+	fs.StringVar(&c.SnapshotDir, "snapshot-dir", c.SnapshotDir, "Directory for snapshots")
+	fs.IntVar(&c.MaxSnapshots, "max-snapshots", c.MaxSnapshots, "Number of snapshots kept on disk")
+	fs.DurationVar(&c.SaveInterval, "save-interval", c.SaveInterval, "How often the data is saved to disk")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", c.SnapshotInterval, "How often a snapshot is taken")
+	fs.StringVar(&c.EncryptionKeyFile, "encryption-key-file", c.EncryptionKeyFile, "File with the keys encrypting the data, log and snapshot files, if any")
+}
+
+// Load builds the configuration from defaults, the file named by -config (or
+// INMEMORY_CONFIG), the environment and the flags explicitly set in args.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	fromFlags := Default()
+	fromFlags.RegisterFlags(fs)
+	path := fs.String("config", os.Getenv(EnvConfig), "YAML or JSON configuration file (env "+EnvConfig+")")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *path == "" {
+		if _, err := os.Stat(DefaultConfigFile); err == nil {
+			*path = DefaultConfigFile
+		}
+	}
+	if err := configload.Apply(cfg, fromFlags, *path, fs); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("http_addr: %w", err))
+	}
+	for name, path := range map[string]string{
+		"data_file":    c.DataFile,
+		"index_file":   c.IndexDir,
+		"log_file":     c.LogFile,
+		"snapshot_dir": c.SnapshotDir,
+	} {
+		if path == "" {
+			errs = append(errs, fmt.Errorf("%s must not be empty", name))
+		}
+	}
+	if c.MaxSnapshots < 1 {
+		errs = append(errs, errors.New("max_snapshots must be at least 1"))
+	}
+	if c.SaveInterval <= 0 {
+		errs = append(errs, errors.New("save_interval must be positive"))
+	}
+	if c.SnapshotInterval <= 0 {
+		errs = append(errs, errors.New("snapshot_interval must be positive"))
+	}
+	return errors.Join(errs...)
+}
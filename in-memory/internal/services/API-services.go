@@ -2,10 +2,15 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+
+	"common/encryption"
 )
 
 type InMemoryStore struct {
@@ -15,16 +20,21 @@ type InMemoryStore struct {
 	LogFile        *os.File
 	OperationLog   *OperationLog
 	TransactionLog *TransactionLog
+
+	DataFile     string
+	LogPath      string
+	SnapshotDir  string
+	MaxSnapshots int
+
+	// Keyring seals the data file, the log and the snapshots at rest. Nil
+	// leaves them in plain JSON.
+	Keyring *encryption.Keyring
 }
 
 type OperationLog struct {
 	Operations []string
 }
 
-type PathsConfig struct {
-	DataFile string `json:"data_file"`
-}
-
 type TransactionLog struct {
 	Transactions []LogEntry
 }
@@ -35,6 +45,10 @@ func NewInMemoryStore() *InMemoryStore {
 		SnapCh:         make(chan map[string]string),
 		OperationLog:   &OperationLog{Operations: []string{}},
 		TransactionLog: &TransactionLog{Transactions: []LogEntry{}},
+		DataFile:       "in-memory/internal/data/data.json",
+		LogPath:        "in-memory/internal/data/log.log",
+		SnapshotDir:    "in-memory/internal/data/snapshots",
+		MaxSnapshots:   10,
 	}
 }
 
@@ -45,43 +59,41 @@ func (s *InMemoryStore) Get(key string) (string, bool) {
 	return value, ok
 }
 
+// Put and Delete apply the change before they return, so that a read that
+// follows them sees it.
 func (s *InMemoryStore) Put(key, value string) {
-	go func() {
-		s.Mutex.Lock()
-		defer s.Mutex.Unlock()
-		s.Data[key] = value
-		s.LogOperation("PUT", key, value)
-		if err := s.PersistLogToFile(); err != nil {
-			log.Printf("Error persisting log: %v", err)
-		}
-	}()
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	s.Data[key] = value
+	s.LogOperation("PUT", key, value)
+	if err := s.PersistLogToFile(); err != nil {
+		log.Printf("Error persisting log: %v", err)
+	}
 }
 
 func (s *InMemoryStore) Delete(key string) {
-	go func() {
-		s.Mutex.Lock()
-		defer s.Mutex.Unlock()
-		delete(s.Data, key)
-		s.LogOperation("DELETE", key, "")
-	}()
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	delete(s.Data, key)
+	s.LogOperation("DELETE", key, "")
 }
 
-func (s *InMemoryStore) PersistDataToFile() error {
+// List returns a copy of the keys starting with prefix and their values.
+func (s *InMemoryStore) List(prefix string) map[string]string {
 	s.Mutex.RLock()
 	defer s.Mutex.RUnlock()
-
-	file, err := os.Open("in-memory/configs/config.json")
-	if err != nil {
-		log.Fatal(err)
+	result := make(map[string]string)
+	for k, v := range s.Data {
+		if strings.HasPrefix(k, prefix) {
+			result[k] = v
+		}
 	}
-	defer file.Close()
+	return result
+}
 
-	decoder := json.NewDecoder(file)
-	config := PathsConfig{}
-	err = decoder.Decode(&config)
-	if err != nil {
-		log.Fatal(err)
-	}
+func (s *InMemoryStore) PersistDataToFile() error {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
 
 	data, err := json.MarshalIndent(s.Data, "", "    ")
 	if err != nil {
@@ -89,7 +101,7 @@ func (s *InMemoryStore) PersistDataToFile() error {
 		return err
 	}
 
-	err = os.WriteFile(config.DataFile, data, 0644)
+	err = s.Keyring.WriteFile(s.DataFile, data, 0644)
 	if err != nil {
 		log.Fatal(err)
 		return err
@@ -103,6 +115,31 @@ func (s *InMemoryStore) PersistDataToFile() error {
 	return nil
 }
 
+// CheckEncryption refuses files the keyring cannot open, so that the server
+// does not start on data it would fail to read or overwrite with a new key.
+// Files left plain or sealed with a retired key are sealed with the active
+// key the next time they are written.
+func (s *InMemoryStore) CheckEncryption() error {
+	files := []string{s.DataFile, s.LogPath}
+	snapshots, _ := filepath.Glob(filepath.Join(s.SnapshotDir, "*.json"))
+	files = append(files, snapshots...)
+
+	for _, name := range files {
+		header, err := encryption.ReadFileHeader(name)
+		if err != nil {
+			return err
+		}
+		if err := s.Keyring.Check(header); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if len(header) > 0 && s.Keyring.NeedsRotation(header) {
+			log.Printf("%s is not sealed with the active key %s, it is re-encrypted when next written",
+				name, s.Keyring.ActiveKeyID())
+		}
+	}
+	return nil
+}
+
 func PeriodicSave(s *InMemoryStore, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
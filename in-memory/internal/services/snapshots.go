@@ -10,6 +10,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"common/encryption"
 )
 
 func Snapshot(s *InMemoryStore, interval time.Duration) {
@@ -36,7 +38,7 @@ func CreatSnapshot(s *InMemoryStore, snapshotsMutex *sync.Mutex, snapshots *[]ma
 
 	snapshotsMutex.Lock()
 	*snapshots = append(*snapshots, snapshot)
-	if len(*snapshots) > 10 {
+	if len(*snapshots) > s.MaxSnapshots {
 		*snapshots = (*snapshots)[1:]
 	}
 
@@ -46,28 +48,24 @@ func CreatSnapshot(s *InMemoryStore, snapshotsMutex *sync.Mutex, snapshots *[]ma
 
 	timestamp := time.Now().Format("2006-01-02_15-04-05")
 	filename := fmt.Sprintf("snapshot-%s.json", timestamp)
-	SaveSnapshotToFile(s, filepath.Join("in-memory/internal/data/snapshots", filename), snapshot)
-	DeleteOldSnapshots(filepath.Join("in-memory/internal/data/snapshots"), 10)
+	SaveSnapshotToFile(s, filepath.Join(s.SnapshotDir, filename), snapshot)
+	DeleteOldSnapshots(s.SnapshotDir, s.MaxSnapshots)
 }
 
 func SaveSnapshotToFile(s *InMemoryStore, filename string, snapshot map[string]string) {
-	file, err := os.Create(filename)
+	data, err := json.MarshalIndent(snapshot, "", "  ")
 	if err != nil {
-		log.Println("Error to create file:", err)
+		log.Println("Error to encode snapshot:", err)
 		return
 	}
-	defer file.Close()
-
-	enc := json.NewEncoder(file)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(snapshot); err != nil {
+	if err := s.Keyring.WriteFile(filename, append(data, '\n'), 0644); err != nil {
 		log.Println("Error to write in file:", err)
 		return
 	}
 	log.Println("Snapshot successfully saved in file:", filename)
 }
 
-func GetSnapshots(dir string) ([]map[string]string, error) {
+func GetSnapshots(dir string, kr *encryption.Keyring) ([]map[string]string, error) {
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
@@ -76,7 +74,7 @@ func GetSnapshots(dir string) ([]map[string]string, error) {
 	snapshots := make([]map[string]string, 0)
 	for _, file := range files {
 		if !file.IsDir() && filepath.Ext(file.Name()) == ".json" {
-			snapshot, err := LoadSnapshotFromFile(filepath.Join(dir, file.Name()))
+			snapshot, err := LoadSnapshotFromFile(filepath.Join(dir, file.Name()), kr)
 			if err != nil {
 				return nil, err
 			}
@@ -94,16 +92,14 @@ func GetSnapshots(dir string) ([]map[string]string, error) {
 	return snapshots, nil
 }
 
-func LoadSnapshotFromFile(filename string) (map[string]string, error) {
-	file, err := os.Open(filename)
+func LoadSnapshotFromFile(filename string, kr *encryption.Keyring) (map[string]string, error) {
+	data, err := kr.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	dec := json.NewDecoder(file)
 	snapshot := make(map[string]string)
-	if err := dec.Decode(&snapshot); err != nil {
+	if err := json.Unmarshal(data, &snapshot); err != nil {
 		return nil, err
 	}
 	return snapshot, nil
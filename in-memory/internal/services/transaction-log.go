@@ -5,8 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"time"
+
+	"common/encryption"
 )
 
 type LogEntry struct {
@@ -39,7 +40,7 @@ func (s *InMemoryStore) LogOperation(op, key, value string) {
 }
 
 func (s *InMemoryStore) RestoreState() error {
-	snapshots, err := GetSnapshots("in-memory/internal/data/snapshots")
+	snapshots, err := GetSnapshots(s.SnapshotDir, s.Keyring)
 	if err != nil {
 		return err
 	}
@@ -48,7 +49,7 @@ func (s *InMemoryStore) RestoreState() error {
 		s.Data = snapshots[len(snapshots)-1]
 	}
 
-	operations, err := LoadOperations("in-memory/internal/data/log.log")
+	operations, err := LoadOperations(s.LogPath, s.Keyring)
 	if err != nil {
 		return err
 	}
@@ -65,16 +66,14 @@ func (s *InMemoryStore) RestoreState() error {
 	return nil
 }
 
-func LoadOperations(filename string) ([]LogEntry, error) {
-	file, err := os.Open(filename)
+func LoadOperations(filename string, kr *encryption.Keyring) ([]LogEntry, error) {
+	data, err := kr.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("error opening log file: %w", err)
 	}
-	defer file.Close()
 
 	var entries []LogEntry
-	dec := json.NewDecoder(file)
-	if err := dec.Decode(&entries); err != nil {
+	if err := json.Unmarshal(data, &entries); err != nil {
 		return nil, fmt.Errorf("error decoding log entries: %w", err)
 	}
 
@@ -102,7 +101,7 @@ func Rollback(currentState map[string]string, operations []LogEntry) map[string]
 
 func HandlerRollback(s *InMemoryStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		operations, err := LoadOperations("in-memory/internal/data/log.log")
+		operations, err := LoadOperations(s.LogPath, s.Keyring)
 		if err != nil {
 			http.Error(w, "Failed to load operations from log file", http.StatusInternalServerError)
 			return
@@ -0,0 +1,65 @@
+package kv
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+const etcdDialTimeout = 5 * time.Second
+
+type etcdKV struct {
+	client *clientv3.Client
+}
+
+// NewEtcd returns an adapter for the etcd v3 API at endpoints.
+func NewEtcd(endpoints ...string) (KV, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdKV{client: client}, nil
+}
+
+func (e *etcdKV) Get(ctx context.Context, key string) (string, error) {
+	resp, err := e.client.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrNotFound
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+func (e *etcdKV) Put(ctx context.Context, key, value string) error {
+	_, err := e.client.Put(ctx, key, value)
+	return err
+}
+
+func (e *etcdKV) Delete(ctx context.Context, key string) error {
+	_, err := e.client.Delete(ctx, key)
+	return err
+}
+
+// List reads the range in one request, which etcd serves from a single
+// revision. An empty prefix ranges over the whole keyspace.
+func (e *etcdKV) List(ctx context.Context, prefix string) (map[string]string, error) {
+	resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		result[string(kv.Key)] = string(kv.Value)
+	}
+	return result, nil
+}
+
+func (e *etcdKV) Close() error {
+	return e.client.Close()
+}
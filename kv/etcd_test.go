@@ -0,0 +1,110 @@
+package kv_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"common/keyrange"
+	"kv"
+	"kv/kvtest"
+)
+
+// fakeEtcd serves the part of the etcd v3 KV service the adapter uses:
+// ranges, puts and range deletes over a map, with a revision per write.
+type fakeEtcd struct {
+	mutex    sync.Mutex
+	data     map[string]*mvccpb.KeyValue
+	revision int64
+}
+
+func (f *fakeEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: f.revision}
+}
+
+func (f *fakeEtcd) Range(ctx context.Context, r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	resp := &pb.RangeResponse{Header: f.header()}
+	for k, v := range f.data {
+		if keyrange.Contains(k, string(r.Key), string(r.RangeEnd)) {
+			resp.Kvs = append(resp.Kvs, v)
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return bytes.Compare(resp.Kvs[i].Key, resp.Kvs[j].Key) < 0 })
+	resp.Count = int64(len(resp.Kvs))
+	return resp, nil
+}
+
+func (f *fakeEtcd) Put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.revision++
+	kv := &mvccpb.KeyValue{Key: r.Key, Value: r.Value, CreateRevision: f.revision, ModRevision: f.revision, Version: 1}
+	if old, ok := f.data[string(r.Key)]; ok {
+		kv.CreateRevision = old.CreateRevision
+		kv.Version = old.Version + 1
+	}
+	f.data[string(r.Key)] = kv
+	return &pb.PutResponse{Header: f.header()}, nil
+}
+
+func (f *fakeEtcd) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	resp := &pb.DeleteRangeResponse{}
+	for k := range f.data {
+		if keyrange.Contains(k, string(r.Key), string(r.RangeEnd)) {
+			delete(f.data, k)
+			resp.Deleted++
+		}
+	}
+	if resp.Deleted > 0 {
+		f.revision++
+	}
+	resp.Header = f.header()
+	return resp, nil
+}
+
+func (f *fakeEtcd) Txn(context.Context, *pb.TxnRequest) (*pb.TxnResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "txn is not supported by the fake")
+}
+
+func (f *fakeEtcd) Compact(context.Context, *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "compaction is not supported by the fake")
+}
+
+func newEtcd(tb testing.TB) kv.KV {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterKVServer(srv, &fakeEtcd{data: make(map[string]*mvccpb.KeyValue)})
+	go srv.Serve(ln)
+	tb.Cleanup(srv.Stop)
+
+	store, err := kv.NewEtcd(ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestEtcd(t *testing.T) {
+	kvtest.Run(t, newEtcd(t))
+}
+
+func BenchmarkEtcd(b *testing.B) {
+	kvtest.Benchmark(b, newEtcd(b))
+}
@@ -0,0 +1,184 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// endpoints sends requests to the HTTP endpoints of a server in order, until
+// one of them answers. A follower of the Raft cluster refuses writes, so the
+// leader ends up taking them.
+type endpoints struct {
+	urls   []string
+	client *http.Client
+}
+
+func newEndpoints(addrs []string) endpoints {
+	e := endpoints{client: &http.Client{Timeout: defaultTimeout}}
+	for _, addr := range addrs {
+		if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+			addr = "http://" + addr
+		}
+		e.urls = append(e.urls, strings.TrimSuffix(addr, "/"))
+	}
+	return e
+}
+
+// do returns the first response that is a success or a 404, which the caller
+// has to close.
+func (e endpoints) do(ctx context.Context, method, path string, body []byte, header http.Header) (*http.Response, error) {
+	lastErr := errors.New("no endpoints configured")
+	for _, u := range e.urls {
+		req, err := http.NewRequestWithContext(ctx, method, u+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := e.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotFound {
+			return resp, nil
+		}
+		lastErr = statusError(resp)
+		resp.Body.Close()
+	}
+	return nil, lastErr
+}
+
+// read returns the body of a successful response, or ErrNotFound for a 404.
+func (e endpoints) read(ctx context.Context, path string, header http.Header) ([]byte, error) {
+	resp, err := e.do(ctx, http.MethodGet, path, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// write treats a 404 as success, since deleting a missing key is not an
+// error.
+func (e endpoints) write(ctx context.Context, method, path string, body []byte) error {
+	var header http.Header
+	if body != nil {
+		header = http.Header{"Content-Type": {"application/json"}}
+	}
+	resp, err := e.do(ctx, method, path, body, header)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (e endpoints) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+func statusError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(b))
+	if msg == "" {
+		return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	}
+	return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, msg)
+}
+
+// raft talks to the HTTP API of the Raft cluster.
+type raft struct {
+	endpoints
+}
+
+// NewRaft returns an adapter for the HTTP API of the Raft cluster. Reads are
+// served by the first endpoint that answers, so list the leader first for
+// reads that see the latest writes.
+func NewRaft(addrs ...string) KV {
+	return &raft{newEndpoints(addrs)}
+}
+
+func (r *raft) Get(ctx context.Context, key string) (string, error) {
+	b, err := r.read(ctx, "/keys/"+url.PathEscape(key), http.Header{"Accept": {"application/octet-stream"}})
+	return string(b), err
+}
+
+func (r *raft) Put(ctx context.Context, key, value string) error {
+	b, err := json.Marshal(map[string]string{key: value})
+	if err != nil {
+		return err
+	}
+	return r.write(ctx, http.MethodPost, "/keys", b)
+}
+
+func (r *raft) Delete(ctx context.Context, key string) error {
+	return r.write(ctx, http.MethodDelete, "/keys/"+url.PathEscape(key), nil)
+}
+
+func (r *raft) List(ctx context.Context, prefix string) (map[string]string, error) {
+	b, err := r.read(ctx, "/keys?prefix="+url.QueryEscape(prefix), nil)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	return m, json.Unmarshal(b, &m)
+}
+
+// standalone talks to the in-memory server without Raft.
+type standalone struct {
+	endpoints
+}
+
+// NewStandalone returns an adapter for the in-memory server without Raft.
+func NewStandalone(addrs ...string) KV {
+	return &standalone{newEndpoints(addrs)}
+}
+
+func (s *standalone) Get(ctx context.Context, key string) (string, error) {
+	b, err := s.read(ctx, "/get?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return "", err
+	}
+	// The server answers with "Value for key 'k': 'v'".
+	prefix := "Value for key '" + key + "': '"
+	return strings.TrimSuffix(strings.TrimPrefix(string(b), prefix), "'"), nil
+}
+
+func (s *standalone) Put(ctx context.Context, key, value string) error {
+	b, err := json.Marshal(map[string]string{"key": key, "value": value})
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, http.MethodPost, "/put", b)
+}
+
+func (s *standalone) Delete(ctx context.Context, key string) error {
+	return s.write(ctx, http.MethodDelete, "/delete?key="+url.QueryEscape(key), nil)
+}
+
+func (s *standalone) List(ctx context.Context, prefix string) (map[string]string, error) {
+	b, err := s.read(ctx, "/list?prefix="+url.QueryEscape(prefix), nil)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	return m, json.Unmarshal(b, &m)
+}
@@ -0,0 +1,27 @@
+// Package kv puts the key-value servers of this repository behind one
+// interface: the in-memory server, the Raft cluster, Redis and etcd. The
+// conformance suite in kvtest checks that every adapter behaves the same.
+package kv
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned by Get for a key that does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// KV is a flat string keyspace.
+//
+// Keys and values are non-empty. Put overwrites the value of an existing key,
+// Delete of a missing key is not an error, and List returns every key
+// starting with prefix, or the whole keyspace for an empty prefix.
+type KV interface {
+	Get(ctx context.Context, key string) (string, error)
+	Put(ctx context.Context, key, value string) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) (map[string]string, error)
+
+	// Close releases the connections of the adapter.
+	Close() error
+}
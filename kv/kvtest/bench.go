@@ -0,0 +1,84 @@
+package kvtest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"kv"
+)
+
+// benchKeys is the number of keys Get, List and GetParallel read from.
+const benchKeys = 100
+
+// Benchmark runs the benchmark set against store. The value size is fixed so
+// that the results of different adapters compare.
+func Benchmark(b *testing.B, store kv.KV) {
+	ctx := context.Background()
+	value := strings.Repeat("v", 100)
+
+	load := func(b *testing.B, prefix string) {
+		b.Helper()
+		for i := 0; i < benchKeys; i++ {
+			if err := store.Put(ctx, fmt.Sprintf("%s%03d", prefix, i), value); err != nil {
+				b.Fatalf("load: %s", err)
+			}
+		}
+	}
+
+	b.Run("Put", func(b *testing.B) {
+		prefix := uniquePrefix("BenchmarkPut")
+		for i := 0; i < b.N; i++ {
+			if err := store.Put(ctx, fmt.Sprintf("%s%d", prefix, i%benchKeys), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Get", func(b *testing.B) {
+		prefix := uniquePrefix("BenchmarkGet")
+		load(b, prefix)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.Get(ctx, fmt.Sprintf("%s%03d", prefix, i%benchKeys)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Delete", func(b *testing.B) {
+		prefix := uniquePrefix("BenchmarkDelete")
+		for i := 0; i < b.N; i++ {
+			if err := store.Delete(ctx, fmt.Sprintf("%s%d", prefix, i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// List reads ten of the loaded keys per call.
+	b.Run("List", func(b *testing.B) {
+		prefix := uniquePrefix("BenchmarkList")
+		load(b, prefix)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.List(ctx, fmt.Sprintf("%s%02d", prefix, i%(benchKeys/10))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("GetParallel", func(b *testing.B) {
+		prefix := uniquePrefix("BenchmarkGetParallel")
+		load(b, prefix)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, err := store.Get(ctx, fmt.Sprintf("%s%03d", prefix, i%benchKeys)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
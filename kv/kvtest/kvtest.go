@@ -0,0 +1,238 @@
+// Package kvtest checks that a kv.KV adapter behaves as the interface
+// documents, and measures it with the same set of benchmarks.
+//
+// Every run works under a prefix of its own, so a store may be shared with
+// other runs and may hold other keys. Keys contain no slash, as the Raft HTTP
+// API takes the key as a single path segment.
+package kvtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kv"
+)
+
+// timeout bounds every test of the suite; the in-memory server writes its
+// files on every request.
+const timeout = 30 * time.Second
+
+var runs int64
+
+// uniquePrefix separates runs in the same process and across processes
+// sharing a store.
+func uniquePrefix(name string) string {
+	return fmt.Sprintf("kvtest.%s.%d.%d.", name, time.Now().UnixNano(), atomic.AddInt64(&runs, 1))
+}
+
+// Run runs the conformance suite against store.
+func Run(t *testing.T, store kv.KV) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, ctx context.Context, store kv.KV, prefix string)
+	}{
+		{"PutGet", testPutGet},
+		{"Overwrite", testOverwrite},
+		{"GetMissing", testGetMissing},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"List", testList},
+		{"ListEmpty", testListEmpty},
+		{"SpecialCharacters", testSpecialCharacters},
+		{"Concurrent", testConcurrent},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			tc.fn(t, ctx, store, uniquePrefix(tc.name))
+		})
+	}
+}
+
+func put(t *testing.T, ctx context.Context, store kv.KV, key, value string) {
+	t.Helper()
+	if err := store.Put(ctx, key, value); err != nil {
+		t.Fatalf("put %q: %s", key, err)
+	}
+}
+
+func expectValue(t *testing.T, ctx context.Context, store kv.KV, key, want string) {
+	t.Helper()
+	got, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("get %q: %s", key, err)
+	}
+	if got != want {
+		t.Fatalf("get %q: expected %q, got %q", key, want, got)
+	}
+}
+
+func expectMissing(t *testing.T, ctx context.Context, store kv.KV, key string) {
+	t.Helper()
+	if v, err := store.Get(ctx, key); !errors.Is(err, kv.ErrNotFound) {
+		t.Fatalf("get %q: expected kv.ErrNotFound, got %q, %v", key, v, err)
+	}
+}
+
+func testPutGet(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	put(t, ctx, store, prefix+"key", "value")
+	expectValue(t, ctx, store, prefix+"key", "value")
+}
+
+func testOverwrite(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	put(t, ctx, store, prefix+"key", "first")
+	put(t, ctx, store, prefix+"key", "second")
+	expectValue(t, ctx, store, prefix+"key", "second")
+}
+
+func testGetMissing(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	expectMissing(t, ctx, store, prefix+"missing")
+}
+
+func testDelete(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	put(t, ctx, store, prefix+"key", "value")
+	put(t, ctx, store, prefix+"other", "value")
+	if err := store.Delete(ctx, prefix+"key"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	expectMissing(t, ctx, store, prefix+"key")
+	expectValue(t, ctx, store, prefix+"other", "value")
+
+	// A deleted key can be written again.
+	put(t, ctx, store, prefix+"key", "again")
+	expectValue(t, ctx, store, prefix+"key", "again")
+}
+
+func testDeleteMissing(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	if err := store.Delete(ctx, prefix+"missing"); err != nil {
+		t.Fatalf("expected deleting a missing key to succeed, got %s", err)
+	}
+}
+
+func testList(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	data := map[string]string{
+		prefix + "ab":  "1",
+		prefix + "abc": "2",
+		prefix + "abd": "3",
+		prefix + "b":   "4",
+	}
+	for k, v := range data {
+		put(t, ctx, store, k, v)
+	}
+
+	got, err := store.List(ctx, prefix+"ab")
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	want := map[string]string{prefix + "ab": "1", prefix + "abc": "2", prefix + "abd": "3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("list %q: expected %v, got %v", prefix+"ab", want, got)
+	}
+
+	got, err = store.List(ctx, prefix)
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Fatalf("list %q: expected %v, got %v", prefix, data, got)
+	}
+
+	// The whole keyspace may hold keys of other runs.
+	got, err = store.List(ctx, "")
+	if err != nil {
+		t.Fatalf("list everything: %s", err)
+	}
+	for k, v := range data {
+		if got[k] != v {
+			t.Fatalf("list everything: expected %q for %q, got %q", v, k, got[k])
+		}
+	}
+
+	if err := store.Delete(ctx, prefix+"abc"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	got, err = store.List(ctx, prefix+"ab")
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if _, ok := got[prefix+"abc"]; ok || len(got) != 2 {
+		t.Fatalf("expected the deleted key not to be listed, got %v", got)
+	}
+}
+
+func testListEmpty(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	got, err := store.List(ctx, prefix)
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no keys under a fresh prefix, got %v", got)
+	}
+}
+
+// testSpecialCharacters uses characters that need escaping in URLs, JSON and
+// Redis match patterns.
+func testSpecialCharacters(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	data := map[string]string{
+		prefix + "with space":      "value with space",
+		prefix + "ключ":            "значение",
+		prefix + "q?a=1&b=2#frag":  `"quoted" 'single'`,
+		prefix + "glob*[ab]\\":     "100%",
+		prefix + "plus+percent%20": "tab\there",
+	}
+	for k, v := range data {
+		put(t, ctx, store, k, v)
+		expectValue(t, ctx, store, k, v)
+	}
+	got, err := store.List(ctx, prefix+"glob*")
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(got) != 1 || got[prefix+"glob*[ab]\\"] != "100%" {
+		t.Fatalf("expected the prefix to match literally, got %v", got)
+	}
+}
+
+func testConcurrent(t *testing.T, ctx context.Context, store kv.KV, prefix string) {
+	const writers, keys = 4, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				if err := store.Put(ctx, fmt.Sprintf("%s%d.%d", prefix, w, i), fmt.Sprint(w*keys+i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent put: %s", err)
+	}
+
+	got, err := store.List(ctx, prefix)
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(got) != writers*keys {
+		t.Fatalf("expected %d keys, got %d", writers*keys, len(got))
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keys; i++ {
+			if k := fmt.Sprintf("%s%d.%d", prefix, w, i); got[k] != fmt.Sprint(w*keys+i) {
+				t.Fatalf("expected %d for %q, got %q", w*keys+i, k, got[k])
+			}
+		}
+	}
+}
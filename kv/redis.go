@@ -0,0 +1,98 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// scanCount is the number of keys Redis is asked for per SCAN call.
+const scanCount = 1000
+
+type redisKV struct {
+	rdb *redis.Client
+}
+
+// NewRedis returns an adapter that stores keys in Redis as plain strings
+// without expiry.
+func NewRedis(opts *redis.Options) KV {
+	return &redisKV{rdb: redis.NewClient(opts)}
+}
+
+func (r *redisKV) Get(ctx context.Context, key string) (string, error) {
+	val, err := r.rdb.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotFound
+	}
+	return val, err
+}
+
+func (r *redisKV) Put(ctx context.Context, key, value string) error {
+	return r.rdb.Set(ctx, key, value, 0).Err()
+}
+
+func (r *redisKV) Delete(ctx context.Context, key string) error {
+	return r.rdb.Del(ctx, key).Err()
+}
+
+// List scans the keyspace rather than calling KEYS, which blocks the server.
+// Keys deleted between the scan and the read of their values are left out.
+func (r *redisKV) List(ctx context.Context, prefix string) (map[string]string, error) {
+	result := make(map[string]string)
+	iter := r.rdb.Scan(ctx, 0, globEscape(prefix)+"*", scanCount).Iterator()
+	var keys []string
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		values, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				result[keys[i]] = s
+			}
+		}
+		keys = keys[:0]
+		return nil
+	}
+	for iter.Next(ctx) {
+		// SCAN may return a key more than once.
+		if _, ok := result[iter.Val()]; ok {
+			continue
+		}
+		keys = append(keys, iter.Val())
+		if len(keys) == scanCount {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *redisKV) Close() error {
+	return r.rdb.Close()
+}
+
+// globEscape quotes the characters that are special in a Redis MATCH pattern.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,26 @@
+package kv_test
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"kv"
+	"kv/kvtest"
+)
+
+func newRedis(tb testing.TB) kv.KV {
+	s := miniredis.RunT(tb)
+	store := kv.NewRedis(&redis.Options{Addr: s.Addr()})
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRedis(t *testing.T) {
+	kvtest.Run(t, newRedis(t))
+}
+
+func BenchmarkRedis(b *testing.B) {
+	kvtest.Benchmark(b, newRedis(b))
+}